@@ -0,0 +1,10 @@
+module github.com/syntio/aquarium-persistor-gcp/cmd/persistor
+
+go 1.15
+
+replace github.com/syntio/aquarium-persistor-gcp/lib => ../../lib
+
+require (
+	cloud.google.com/go/pubsub v1.8.2
+	github.com/syntio/aquarium-persistor-gcp/lib v1.2.3
+)
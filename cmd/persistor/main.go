@@ -0,0 +1,163 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Persistor is a long-running version of the streaming pull function, intended for Cloud Run and GKE.
+// It reads the same environment variables as the Cloud Functions and pulls messages until it receives
+// SIGTERM or SIGINT, after which the already received messages are stored before the process exits.
+// The run report is logged and reset every REPORT_INTERVAL seconds, so it does not grow for the life of the process.
+// The Pub/Sub and GCS emulators are used if PUBSUB_EMULATOR_HOST and STORAGE_EMULATOR_HOST are set.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+const (
+	// synchronous identifies whether the pull or streaming pull is used
+	synchronous = false
+
+	defaultPort     = "8080"
+	shutdownTimeout = 5 * time.Second
+
+	// partitionCloseInterval is the time between two checks for partitions which can be closed.
+	partitionCloseInterval = time.Minute
+)
+
+func main() {
+	var ready int32
+	server := &http.Server{
+		Addr:    ":" + port(),
+		Handler: healthHandler(&ready),
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error during health server start. %s.\n", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+		sig := <-signals
+		log.Printf("Received %v, draining in-flight messages.\n", sig)
+		atomic.StoreInt32(&ready, 0)
+		cancel()
+	}()
+
+	err := run(ctx, &ready)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	_ = server.Shutdown(shutdownCtx)
+
+	if err != nil {
+		log.Fatalf("%s.\n", err)
+	}
+}
+
+// run loads the configuration and pulls messages until the context is cancelled, after which the already received
+// messages are stored before it returns. The ready flag is set while the messages are being pulled.
+func run(ctx context.Context, ready *int32) error {
+	var err error
+
+	var persistConf lib.PersistConf
+	err = lib.SetPersistConf(&persistConf)
+	if err != nil {
+		return fmt.Errorf("Error during retrieving environment variables. %s", err)
+	}
+
+	var subscriberConf lib.SubConf
+	err = lib.SetSubscriberConf(&subscriberConf, synchronous)
+	if err != nil {
+		return fmt.Errorf("Error during retrieving environment variables. %s", err)
+	}
+
+	// NumberOfSeconds is left at 0, so messages are pulled until the process is stopped.
+	var pullInfo lib.PullInfo
+	err = lib.SetPullInfo(&pullInfo)
+	if err != nil {
+		return fmt.Errorf("Error during retrieving environment variables. %s", err)
+	}
+
+	var partitionInfo lib.PartitionInfo
+	err = lib.SetPartitionInfo(&partitionInfo)
+	if err != nil {
+		return fmt.Errorf("Error during retrieving environment variables. %s", err)
+	}
+
+	if partitionInfo.Enabled {
+		go lib.CloseCompletePartitionsPeriodically(ctx, partitionInfo, partitionCloseInterval)
+	}
+
+	atomic.StoreInt32(ready, 1)
+	log.Printf("Pulling messages from subscription '%s'.\n", pullInfo.SubID)
+
+	report, err := lib.Pull(ctx, &pullInfo, persistConf, &subscriberConf)
+	atomic.StoreInt32(ready, 0)
+
+	// The notifications of the stored messages are published by now, so their clients are closed.
+	if cErr := lib.CloseNotifications(); cErr != nil {
+		log.Printf("Error during closing notification clients. %s.\n", cErr)
+	}
+	if err != nil {
+		return fmt.Errorf("Error during pubsub pulling. %s", err)
+	}
+
+	log.Printf("Finished execution. Run report: %s.\n", report)
+	return nil
+}
+
+// healthHandler creates the handler for health and readiness endpoints.
+// The /healthz endpoint reports that the process is running, while /readyz reports
+// whether the messages are being pulled (it fails during startup and draining).
+func healthHandler(ready *int32) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(ready) == 0 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+
+	return mux
+}
+
+// port returns the port of the health server, given by the PORT environment variable (set by Cloud Run).
+func port() string {
+	if value := os.Getenv("PORT"); value != "" {
+		return value
+	}
+	return defaultPort
+}
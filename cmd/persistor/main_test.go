@@ -0,0 +1,158 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// setEnv sets the environment variables for the duration of a test.
+func setEnv(t *testing.T, variables map[string]string) {
+	t.Helper()
+
+	for name, value := range variables {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+// waitFor polls the condition until it holds, failing the test after the timeout.
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool, what string) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunDrainsOnShutdown(t *testing.T) {
+	pubsubServer := pstest.NewServer()
+	defer pubsubServer.Close()
+	gcs := sinktest.NewGCSServer()
+	defer gcs.Close()
+
+	setEnv(t, map[string]string{
+		"PUBSUB_EMULATOR_HOST":  pubsubServer.Addr,
+		"STORAGE_EMULATOR_HOST": gcs.Host(),
+		"PROJECT_ID":            "project",
+		"SUB_ID":                "sub",
+		"MAX_OUTSTANDING_MSGS":  "10",
+		"MAX_OUTSTANDING_BYTES": "1000000",
+		"NUM_OF_GOROUTINS":      "1",
+		"BUCKET_ID":             "bucket",
+		"MSG_PREFIX":            "msg",
+		"MSG_EXTENSION":         "txt",
+	})
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic, err := client.CreateTopic(ctx, "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer topic.Stop()
+	if _, err := client.CreateSubscription(ctx, "sub", pubsub.SubscriptionConfig{Topic: topic}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ready int32
+	health := httptest.NewServer(healthHandler(&ready))
+	defer health.Close()
+	readyz := func() int {
+		resp, err := http.Get(health.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before the start = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- run(runCtx, &ready) }()
+
+	waitFor(t, 5*time.Second, func() bool { return atomic.LoadInt32(&ready) == 1 }, "the persistor to start")
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("/readyz while pulling = %d, want %d", code, http.StatusOK)
+	}
+
+	for _, data := range []string{"first", "second", "third"} {
+		if _, err := topic.Publish(ctx, &pubsub.Message{Data: []byte(data)}).Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, 10*time.Second, func() bool { return len(gcs.Names("bucket")) == 3 }, "the messages to be stored")
+
+	// The shutdown stops the pulling, and run returns once the received messages are acknowledged.
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("run() did not return after the shutdown")
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after the shutdown = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	for _, msg := range pubsubServer.Messages() {
+		if msg.Acks != 1 {
+			t.Errorf("message %s acknowledged %d times, want once", msg.Data, msg.Acks)
+		}
+	}
+}
+
+func TestRunRejectsInvalidConfiguration(t *testing.T) {
+	setEnv(t, map[string]string{"BUCKET_ID": "bucket", "MSG_PREFIX": "msg", "MSG_EXTENSION": "txt", "MAX_OUTSTANDING_MSGS": "many"})
+
+	var ready int32
+	if err := run(context.Background(), &ready); err == nil {
+		t.Error("run() error = nil, want an error for an invalid configuration")
+	}
+	if atomic.LoadInt32(&ready) != 0 {
+		t.Error("the persistor is ready after a failed start")
+	}
+}
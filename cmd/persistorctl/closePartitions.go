@@ -0,0 +1,74 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// partitionLayout is the layout of a partition folder, used for parsing the partition flags.
+const partitionLayout = "2006/01/02/15"
+
+// runClosePartitions closes the partitions which are complete at the current time.
+// If the partition flag is set, only that partition is closed, regardless of the lateness allowance.
+func runClosePartitions(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("close-partitions", flag.ExitOnError)
+	bucket := flags.String("bucket", envOrDefault("BUCKET_ID", ""), "ID of a bucket in which the partitions are located")
+	lateness := flags.Duration("lateness", 10*time.Minute, "time after the end of an hour before its partition is closed")
+	lookback := flags.Int("lookback", 24, "number of past hours which are checked")
+	partition := flags.String("partition", "", "close only the given partition (YYYY/MM/DD/HH)")
+	_ = flags.Parse(args)
+
+	if *bucket == "" {
+		return fmt.Errorf("Bucket is not set")
+	}
+
+	if *partition != "" {
+		partitionTime, err := time.ParseInLocation(partitionLayout, *partition, time.Local)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := lib.ClosePartition(ctx, *bucket, partitionTime)
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			log.Printf("Partition %s is already closed or it has no objects.\n", *partition)
+			return nil
+		}
+		log.Printf("Closed partition %s with %d objects and %d messages.\n", manifest.Partition, manifest.ObjectCount, manifest.RecordCount)
+		return nil
+	}
+
+	partitionInfo := lib.PartitionInfo{
+		Enabled:  true,
+		BucketID: *bucket,
+		Lateness: int(lateness.Seconds()),
+		Lookback: *lookback,
+	}
+
+	manifests, err := lib.ClosePartitions(ctx, partitionInfo, time.Now())
+	for _, manifest := range manifests {
+		log.Printf("Closed partition %s with %d objects and %d messages.\n", manifest.Partition, manifest.ObjectCount, manifest.RecordCount)
+	}
+	return err
+}
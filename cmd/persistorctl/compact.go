@@ -0,0 +1,64 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// runCompact merges the objects of a partition into batch files.
+// Running it again with the same partition resumes an interrupted compaction.
+func runCompact(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	bucket := flags.String("bucket", envOrDefault("BUCKET_ID", ""), "ID of a bucket in which the objects are located")
+	partition := flags.String("partition", "", "prefix of the objects which are compacted (e.g. YYYY/MM/DD/HH)")
+	format := flags.String("format", lib.BatchFormatNDJSON, "format of the batch files (ndjson or length-prefixed)")
+	maxRecords := flags.Int("max-records", 10000, "maximum number of objects in a batch file")
+	maxBytes := flags.Int64("max-bytes", 256<<20, "maximum size of a batch file in bytes")
+	deleteOriginals := flags.Bool("delete", false, "delete the original objects once their batch file is verified")
+	_ = flags.Parse(args)
+
+	if *bucket == "" {
+		return fmt.Errorf("Bucket is not set")
+	}
+	if *partition == "" {
+		return fmt.Errorf("Partition is not set")
+	}
+
+	manifest, err := lib.Compact(ctx, lib.CompactionOptions{
+		BucketID:        *bucket,
+		Partition:       *partition,
+		Format:          *format,
+		MaxRecords:      *maxRecords,
+		MaxBytes:        *maxBytes,
+		DeleteOriginals: *deleteOriginals,
+	})
+	if manifest != nil {
+		for _, batch := range manifest.Batches {
+			log.Printf("Batch %s with %d records is %s.\n", batch.Name, len(batch.Sources), batch.Status)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Compacted %d objects (%d bytes) of %s into %d batch files.\n", manifest.RecordCount, manifest.ByteSize, manifest.Partition, len(manifest.Batches))
+	return nil
+}
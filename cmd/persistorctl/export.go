@@ -0,0 +1,372 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// Formats of the exported messages.
+const (
+	exportFiles  = "files"  // one file per message payload
+	exportNDJSON = "ndjson" // one JSON envelope per line
+	exportCSV    = "csv"    // one line of message metadata per message, without the payload
+)
+
+// listFlag is a flag which can be set several times.
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// exportFilter selects the exported messages by their IDs and attributes.
+type exportFilter struct {
+	ids        map[string]bool   // IDs of the exported messages (all messages are exported if empty)
+	attributes map[string]string // attributes which an exported message must have
+}
+
+// matches reports whether the message passes the filter.
+func (filter exportFilter) matches(msg lib.Message) bool {
+	if len(filter.ids) > 0 && !filter.ids[msg.ID] {
+		return false
+	}
+	for key, value := range filter.attributes {
+		if msg.Attributes[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// exporter writes the exported messages in the chosen format. It is used concurrently by the download workers.
+type exporter struct {
+	format string
+	output string
+	mtx    sync.Mutex
+	file   *os.File
+	csv    *csv.Writer
+	count  int
+}
+
+// runExport downloads the messages stored in a range of hourly partitions to the local disk.
+func runExport(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	bucket := flags.String("bucket", envOrDefault("BUCKET_ID", ""), "ID of a bucket in which the messages are stored")
+	format := flags.String("format", envOrDefault("MSG_FORMAT", lib.FormatRaw), "format of the stored messages (raw or envelope)")
+	template := flags.String("prefix", "{YYYY}/{MM}/{DD}/{HH}/"+envOrDefault("MSG_PREFIX", ""), "template of the object prefix, with the {YYYY}, {MM}, {DD} and {HH} placeholders")
+	from := flags.String("from", "", "first exported partition (YYYY/MM/DD/HH)")
+	to := flags.String("to", "", "partition at which the export stops, excluded (YYYY/MM/DD/HH, default is one hour after -from)")
+	output := flags.String("output", "export", "output directory (files) or file (ndjson and csv)")
+	outputFormat := flags.String("output-format", exportFiles, "format of the exported messages (files, ndjson or csv)")
+	parallelism := flags.Int("parallelism", 8, "number of objects downloaded at the same time")
+	var ids, attributes listFlag
+	flags.Var(&ids, "id", "export only the message with the given ID (can be repeated)")
+	flags.Var(&attributes, "attribute", "export only the messages with the given attribute, as key=value (can be repeated)")
+	_ = flags.Parse(args)
+
+	if *bucket == "" {
+		return fmt.Errorf("Bucket is not set")
+	}
+	if *parallelism < 1 {
+		return fmt.Errorf("Parallelism must be at least 1")
+	}
+
+	fromTime, err := time.ParseInLocation(partitionLayout, *from, time.Local)
+	if err != nil {
+		return err
+	}
+	toTime := fromTime.Add(time.Hour)
+	if *to != "" {
+		toTime, err = time.ParseInLocation(partitionLayout, *to, time.Local)
+		if err != nil {
+			return err
+		}
+	}
+
+	filter := exportFilter{ids: make(map[string]bool), attributes: make(map[string]string)}
+	for _, id := range ids {
+		filter.ids[id] = true
+	}
+	for _, attribute := range attributes {
+		keyValue := strings.SplitN(attribute, "=", 2)
+		if len(keyValue) != 2 {
+			return fmt.Errorf("Attribute filter '%s' is not in the key=value form", attribute)
+		}
+		filter.attributes[keyValue[0]] = keyValue[1]
+	}
+
+	exp, err := newExporter(*outputFormat, *output)
+	if err != nil {
+		return err
+	}
+
+	reader, err := lib.NewStoredReader(ctx, *bucket, *format)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	objects, err := listExportedObjects(ctx, reader, *template, fromTime, toTime)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exporting %d objects.\n", len(objects))
+
+	err = downloadObjects(ctx, reader, objects, *parallelism, func(attrs *storage.ObjectAttrs, msg lib.Message) error {
+		if !filter.matches(msg) {
+			return nil
+		}
+		return exp.write(attrs, msg)
+	})
+
+	if cErr := exp.close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exported %d messages to %s.\n", exp.count, *output)
+	return nil
+}
+
+// expandPrefix replaces the placeholders of the prefix template with the date and hour of the given time.
+func expandPrefix(template string, t time.Time) string {
+	return strings.NewReplacer(
+		"{YYYY}", fmt.Sprintf("%04d", t.Year()),
+		"{MM}", fmt.Sprintf("%02d", t.Month()),
+		"{DD}", fmt.Sprintf("%02d", t.Day()),
+		"{HH}", fmt.Sprintf("%02d", t.Hour()),
+	).Replace(template)
+}
+
+// listExportedObjects lists the objects of each hour of the time range. The same prefix is listed only once,
+// so the template does not have to contain all of the placeholders (e.g. {YYYY}/{MM}/{DD}/ lists whole days).
+func listExportedObjects(ctx context.Context, reader *lib.StoredReader, template string, from time.Time, to time.Time) ([]*storage.ObjectAttrs, error) {
+	listed := make(map[string]bool)
+
+	var objects []*storage.ObjectAttrs
+	for t := lib.PartitionHour(from); t.Before(to); t = t.Add(time.Hour) {
+		prefix := expandPrefix(template, t)
+		if listed[prefix] {
+			continue
+		}
+		listed[prefix] = true
+
+		attrs, err := reader.ListPrefix(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, attrs...)
+	}
+	return objects, nil
+}
+
+// downloadObjects reads the objects with the given number of workers and calls fn for each stored message.
+// The function stops at the first error.
+func downloadObjects(ctx context.Context, reader *lib.StoredReader, objects []*storage.ObjectAttrs, parallelism int, fn func(attrs *storage.ObjectAttrs, msg lib.Message) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan *storage.ObjectAttrs)
+	errs := make(chan error, parallelism)
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for attrs := range jobs {
+				attrs := attrs
+				err := reader.ReadObject(ctx, attrs, 0, func(_ int, msg lib.Message) error {
+					return fn(attrs, msg)
+				})
+				if err != nil {
+					errs <- fmt.Errorf("Error during reading '%s'. %s", attrs.Name, err)
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+
+	for _, attrs := range objects {
+		select {
+		case jobs <- attrs:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// newExporter creates the output of the chosen format.
+func newExporter(format string, output string) (*exporter, error) {
+	exp := &exporter{format: format, output: output}
+
+	switch format {
+	case exportFiles:
+		return exp, os.MkdirAll(output, 0755)
+
+	case exportNDJSON, exportCSV:
+		if dir := filepath.Dir(output); dir != "" {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, err
+			}
+		}
+		file, err := os.Create(output)
+		if err != nil {
+			return nil, err
+		}
+		exp.file = file
+
+		if format == exportCSV {
+			exp.csv = csv.NewWriter(file)
+			err = exp.csv.Write([]string{"object", "messageId", "publishTime", "orderingKey", "size", "attributes"})
+			if err != nil {
+				return nil, err
+			}
+		}
+		return exp, nil
+	}
+
+	return nil, fmt.Errorf("Unknown output format '%s'", format)
+}
+
+// write exports a single message stored in the given object.
+func (exp *exporter) write(attrs *storage.ObjectAttrs, msg lib.Message) error {
+	var err error
+
+	switch exp.format {
+	case exportFiles:
+		// The files are written outside of the lock, since each message has its own file.
+		var name string
+		name, err = exportPath(exp.output, attrs.Name, msg.ID+exportExtension(attrs))
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(name), 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(name, msg.Data, 0644)
+		}
+
+	case exportNDJSON:
+		var data []byte
+		data, err = json.Marshal(lib.NewEnvelope(msg))
+		if err == nil {
+			exp.mtx.Lock()
+			_, err = exp.file.Write(append(data, '\n'))
+			exp.mtx.Unlock()
+		}
+
+	case exportCSV:
+		var attributes []byte
+		attributes, err = json.Marshal(msg.Attributes)
+		if err == nil {
+			record := []string{attrs.Name, msg.ID, "", msg.OrderingKey, strconv.Itoa(len(msg.Data)), string(attributes)}
+			if !msg.PublishTime.IsZero() {
+				record[2] = msg.PublishTime.Format(time.RFC3339Nano)
+			}
+			exp.mtx.Lock()
+			err = exp.csv.Write(record)
+			exp.mtx.Unlock()
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	exp.mtx.Lock()
+	exp.count++
+	exp.mtx.Unlock()
+	return nil
+}
+
+// close flushes and closes the output file.
+func (exp *exporter) close() error {
+	if exp.file == nil {
+		return nil
+	}
+	if exp.csv != nil {
+		exp.csv.Flush()
+		if err := exp.csv.Error(); err != nil {
+			_ = exp.file.Close()
+			return err
+		}
+	}
+	return exp.file.Close()
+}
+
+// exportPath returns the path of the file of a message, i.e. the file name within the folder of the object under the output
+// directory. The message ID comes from the stored data (e.g. an envelope), so the names which could point outside of the
+// output directory (with path separators or '..') are rejected.
+func exportPath(output string, objectName string, fileName string) (string, error) {
+	if fileName == "" || fileName == "." || fileName == ".." || strings.ContainsAny(fileName, "/\\\x00") {
+		return "", fmt.Errorf("Message file name '%s' of object '%s' is not a valid file name", fileName, objectName)
+	}
+	for _, folder := range strings.Split(path.Dir(objectName), "/") {
+		if folder == ".." || strings.ContainsAny(folder, "\\\x00") {
+			return "", fmt.Errorf("Object name '%s' is not a valid path", objectName)
+		}
+	}
+
+	output = filepath.Clean(output)
+	name := filepath.Join(output, filepath.FromSlash(path.Dir(objectName)), fileName)
+	if relative, err := filepath.Rel(output, name); err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Message of object '%s' would be written outside of the output directory", objectName)
+	}
+	return name, nil
+}
+
+// exportExtension returns the extension of the exported message files. Messages of single message objects keep
+// the extension of their object, while messages of batch files (whose extension describes the batch) get none.
+func exportExtension(attrs *storage.ObjectAttrs) string {
+	if attrs.Metadata["batchFormat"] != "" {
+		return ""
+	}
+	return path.Ext(attrs.Name)
+}
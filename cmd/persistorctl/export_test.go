@@ -0,0 +1,218 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// putMessage stores a message in the partition of the given time, in the raw format or as an envelope.
+func putMessage(t *testing.T, gcs *sinktest.GCSServer, partitionTime time.Time, format string, msg lib.Message) {
+	t.Helper()
+
+	data := msg.Data
+	if format == lib.FormatEnvelope {
+		var err error
+		data, err = json.Marshal(lib.NewEnvelope(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	gcs.Put("bucket", path.Join(lib.PartitionFolder(partitionTime), "msg-"+msg.ID+".txt"), data, msg.Attributes)
+}
+
+// exportedFiles returns the contents of the files under the output directory by their relative paths.
+func exportedFiles(t *testing.T, output string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.Walk(output, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(output, name)
+		files[filepath.ToSlash(relative)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestExportPath(t *testing.T) {
+	output := filepath.Join("out", "export")
+
+	tests := []struct {
+		name     string
+		object   string
+		fileName string
+		want     string
+		wantErr  bool
+	}{
+		{name: "message file", object: "2020/10/01/12/msg-1.txt", fileName: "1.txt", want: filepath.Join(output, "2020", "10", "01", "12", "1.txt")},
+		{name: "object in the root", object: "msg-1.txt", fileName: "1.txt", want: filepath.Join(output, "1.txt")},
+		{name: "ID with a parent folder", object: "2020/10/01/12/msg-1.txt", fileName: "../../../../../x", wantErr: true},
+		{name: "ID with a folder", object: "2020/10/01/12/msg-1.txt", fileName: "a/b.txt", wantErr: true},
+		{name: "ID with a backslash", object: "2020/10/01/12/msg-1.txt", fileName: `..\x.txt`, wantErr: true},
+		{name: "parent ID", object: "2020/10/01/12/msg-1.txt", fileName: "..", wantErr: true},
+		{name: "empty ID", object: "2020/10/01/12/msg-1.txt", fileName: "", wantErr: true},
+		{name: "object with a parent folder", object: "../../etc/msg-1.txt", fileName: "1.txt", wantErr: true},
+		{name: "object with a nested parent folder", object: "2020/../../msg-1.txt", fileName: "1.txt", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := exportPath(output, test.object, test.fileName)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("exportPath() = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Errorf("exportPath() = %s, %v, want %s", got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestRunExport(t *testing.T) {
+	gcs := startGCS(t)
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local)
+	putMessage(t, gcs, from, lib.FormatEnvelope, lib.Message{ID: "1", Data: []byte("one"), Attributes: map[string]string{"origin": "a"}})
+	putMessage(t, gcs, from.Add(time.Hour), lib.FormatEnvelope, lib.Message{ID: "2", Data: []byte("two"), Attributes: map[string]string{"origin": "b"}})
+	// The partition of -to is not exported.
+	putMessage(t, gcs, from.Add(2*time.Hour), lib.FormatEnvelope, lib.Message{ID: "3", Data: []byte("three")})
+
+	output := filepath.Join(dir, "messages.ndjson")
+	err = runExport(context.Background(), []string{"-bucket", "bucket", "-format", lib.FormatEnvelope, "-prefix", "{YYYY}/{MM}/{DD}/{HH}/msg-",
+		"-from", "2020/10/01/12", "-to", "2020/10/01/14", "-output", output, "-output-format", exportNDJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	exported := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var envelope lib.Envelope
+		if err := json.Unmarshal(scanner.Bytes(), &envelope); err != nil {
+			t.Fatal(err)
+		}
+		exported[envelope.MessageID] = string(envelope.Data) + "/" + envelope.Attributes["origin"]
+	}
+	if want := map[string]string{"1": "one/a", "2": "two/b"}; !reflect.DeepEqual(exported, want) {
+		t.Errorf("exported %v, want %v", exported, want)
+	}
+
+	// Only the messages which pass the filter are exported.
+	output = filepath.Join(dir, "filtered")
+	err = runExport(context.Background(), []string{"-bucket", "bucket", "-format", lib.FormatEnvelope, "-prefix", "{YYYY}/{MM}/{DD}/",
+		"-from", "2020/10/01/12", "-to", "2020/10/01/14", "-output", output, "-attribute", "origin=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, want := exportedFiles(t, output), map[string]string{"2020/10/01/13/2.txt": "two"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("exported files %v, want %v", files, want)
+	}
+}
+
+func TestRunExportCompactedPartition(t *testing.T) {
+	gcs := startGCS(t)
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local)
+	for _, id := range []string{"1", "2", "3"} {
+		putMessage(t, gcs, from, lib.FormatRaw, lib.Message{ID: id, Data: []byte("payload " + id)})
+	}
+	folder := lib.PartitionFolder(from)
+
+	export := func(name string) []string {
+		t.Helper()
+
+		output := filepath.Join(dir, name)
+		err := runExport(context.Background(), []string{"-bucket", "bucket", "-prefix", "{YYYY}/{MM}/{DD}/{HH}/", "-from", "2020/10/01/12",
+			"-output", output, "-output-format", exportCSV})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Scan() // header
+		for scanner.Scan() {
+			ids = append(ids, strings.Split(scanner.Text(), ",")[1])
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// The originals are kept, so only they are exported and not the batch file as well.
+	_, err = lib.Compact(context.Background(), lib.CompactionOptions{BucketID: "bucket", Partition: folder, Format: lib.BatchFormatNDJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, want := export("kept.csv"), []string{"1", "2", "3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("exported %v, want %v", ids, want)
+	}
+
+	// Once the originals are deleted, the messages are exported from the batch file.
+	_, err = lib.Compact(context.Background(), lib.CompactionOptions{BucketID: "bucket", Partition: folder, Format: lib.BatchFormatNDJSON, DeleteOriginals: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids, want := export("deleted.csv"), []string{"1", "2", "3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("exported %v, want %v", ids, want)
+	}
+}
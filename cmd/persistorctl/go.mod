@@ -0,0 +1,10 @@
+module github.com/syntio/aquarium-persistor-gcp/cmd/persistorctl
+
+go 1.15
+
+replace github.com/syntio/aquarium-persistor-gcp/lib => ../../lib
+
+require (
+	cloud.google.com/go/storage v1.12.0
+	github.com/syntio/aquarium-persistor-gcp/lib v1.2.3
+)
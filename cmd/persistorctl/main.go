@@ -0,0 +1,84 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Persistorctl is a command line tool for maintaining the data stored by the persistor.
+// Each task is a separate subcommand, run "persistorctl <subcommand> -h" for its flags.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// subcommand represents a task of the command line tool.
+// The run function receives the arguments which follow the subcommand name.
+type subcommand struct {
+	description string
+	run         func(ctx context.Context, args []string) error
+}
+
+// subcommands holds all of the subcommands mapped by their names.
+var subcommands = map[string]subcommand{
+	"close-partitions": {"write _SUCCESS markers and manifests of closed hourly partitions", runClosePartitions},
+	"compact":          {"merge the objects of a partition into batch files", runCompact},
+	"export":           {"download the stored messages of a time range to the local disk", runExport},
+	"quarantine":       {"list the quarantined messages or print the record of one of them", runQuarantine},
+	"replay":           {"republish the stored messages of a time range to a topic", runReplay},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	command, ok := subcommands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown subcommand '%s'.\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	err := command.run(context.Background(), os.Args[2:])
+	if err != nil {
+		log.Fatalf("Error during %s. %s.\n", os.Args[1], err)
+	}
+}
+
+// usage prints the list of subcommands.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: persistorctl <subcommand> [flags]\n\nSubcommands:\n")
+
+	var names []string
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", name, subcommands[name].description)
+	}
+}
+
+// envOrDefault returns the value of an environment variable, or the default value if it is not set.
+// It is used for flag defaults, so the tool can reuse the configuration of the persistor.
+func envOrDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
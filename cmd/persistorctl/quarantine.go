@@ -0,0 +1,79 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// runQuarantine lists the quarantined messages, or prints the record of a single message if the show flag is set.
+func runQuarantine(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	bucket := flags.String("bucket", envOrDefault("QUARANTINE_BUCKET_ID", ""), "ID of the quarantine bucket")
+	prefix := flags.String("prefix", envOrDefault("QUARANTINE_PREFIX", "quarantine"), "folder of the quarantined messages")
+	partition := flags.String("partition", "", "list only the messages quarantined in the given period (YYYY, YYYY/MM, YYYY/MM/DD or YYYY/MM/DD/HH)")
+	reason := flags.String("reason", "", "list only the messages quarantined for the given reason")
+	show := flags.String("show", "", "print the quarantine record stored in the given object instead of the list")
+	_ = flags.Parse(args)
+
+	if *bucket == "" {
+		return fmt.Errorf("Quarantine bucket is not set")
+	}
+	info := lib.QuarantineInfo{BucketID: *bucket, Prefix: *prefix}
+
+	if *show != "" {
+		return showQuarantined(ctx, os.Stdout, info, *show)
+	}
+	return listQuarantined(ctx, os.Stdout, info, *partition, *reason)
+}
+
+// listQuarantined writes a table of the quarantined messages of the given partition, optionally only those quarantined for the given reason.
+func listQuarantined(ctx context.Context, w io.Writer, info lib.QuarantineInfo, partition string, reason string) error {
+	items, err := lib.ListQuarantined(ctx, info, partition)
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "QUARANTINED\tREASON\tSIZE\tOBJECT\tERROR")
+	for _, item := range items {
+		if reason != "" && item.Reason != reason {
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%s\t%s\n", item.Created.Format(time.RFC3339), item.Reason, item.Size, item.Name, item.Error)
+	}
+	return table.Flush()
+}
+
+// showQuarantined writes the quarantine record stored in the given object as indented JSON.
+func showQuarantined(ctx context.Context, w io.Writer, info lib.QuarantineInfo, name string) error {
+	record, err := lib.ReadQuarantined(ctx, info, name)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(record)
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// startGCS starts a fake GCS server and points the storage clients to it for the duration of a test.
+func startGCS(t *testing.T) *sinktest.GCSServer {
+	t.Helper()
+
+	server := sinktest.NewGCSServer()
+	previous, ok := os.LookupEnv("STORAGE_EMULATOR_HOST")
+	os.Setenv("STORAGE_EMULATOR_HOST", server.Host())
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("STORAGE_EMULATOR_HOST", previous)
+		} else {
+			os.Unsetenv("STORAGE_EMULATOR_HOST")
+		}
+		server.Close()
+	})
+	return server
+}
+
+func TestListQuarantined(t *testing.T) {
+	gcs := startGCS(t)
+	ctx := context.Background()
+
+	info := lib.QuarantineInfo{BucketID: "quarantine", Prefix: "quarantine"}
+	if err := lib.QuarantineMessage(ctx, lib.Message{ID: "1", Data: []byte("a")}, lib.ReasonPermanentError, errors.New("access denied"), info); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.QuarantineMessage(ctx, lib.Message{ID: "2", Data: []byte("b")}, lib.ReasonMaxDeliveryAttempts, errors.New("timeout"), info); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := listQuarantined(ctx, &out, info, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "QUARANTINED") {
+		t.Fatalf("output = %q, want a header and 2 messages", out.String())
+	}
+	if !strings.Contains(out.String(), "access denied") || !strings.Contains(out.String(), "timeout") {
+		t.Errorf("output = %q, want the errors of both messages", out.String())
+	}
+
+	// The messages are filtered by the reason.
+	out.Reset()
+	if err := listQuarantined(ctx, &out, info, "", lib.ReasonMaxDeliveryAttempts); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.Contains(lines[1], "-2.json") {
+		t.Errorf("output = %q, want only the message 2", out.String())
+	}
+
+	// A partition without quarantined messages lists none.
+	out.Reset()
+	if err := listQuarantined(ctx, &out, info, "1999", ""); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 1 {
+		t.Errorf("output = %q, want only the header", out.String())
+	}
+
+	var name string
+	for _, objectName := range gcs.Names("quarantine") {
+		if strings.HasSuffix(objectName, "-1.json") {
+			name = objectName
+		}
+	}
+	out.Reset()
+	if err := showQuarantined(ctx, &out, info, name); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"messageId": "1"`) || !strings.Contains(out.String(), `"reason": "permanent-error"`) {
+		t.Errorf("output = %q, want the record of the message 1", out.String())
+	}
+	if err := showQuarantined(ctx, &out, info, "quarantine/missing.json"); err == nil {
+		t.Error("showQuarantined() of a missing object error = nil, want an error")
+	}
+}
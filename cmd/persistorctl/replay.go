@@ -0,0 +1,86 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// runReplay republishes the messages stored in a range of hourly partitions to a topic.
+// Running it again with the same flags resumes an interrupted replay from its checkpoint.
+func runReplay(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	bucket := flags.String("bucket", envOrDefault("BUCKET_ID", ""), "ID of a bucket in which the messages are stored")
+	format := flags.String("format", envOrDefault("MSG_FORMAT", lib.FormatRaw), "format of the stored messages (raw or envelope)")
+	prefix := flags.String("prefix", envOrDefault("MSG_PREFIX", ""), "file prefix of the replayed objects")
+	from := flags.String("from", "", "first replayed partition (YYYY/MM/DD/HH)")
+	to := flags.String("to", "", "partition at which the replay stops, excluded (YYYY/MM/DD/HH, default is one hour after -from)")
+	project := flags.String("project", envOrDefault("PROJECT_ID", ""), "ID of a project in which the target topic is located")
+	topic := flags.String("topic", "", "ID of a topic to which the messages are republished")
+	rate := flags.Float64("rate", 0, "maximum number of published messages per second (0 disables the limit)")
+	dryRun := flags.Bool("dry-run", false, "only count the messages, without publishing")
+	checkpoint := flags.String("checkpoint", "", "name of the checkpoint object in the bucket (default is _replay/<topic>.json)")
+	_ = flags.Parse(args)
+
+	if *bucket == "" {
+		return fmt.Errorf("Bucket is not set")
+	}
+	if *topic == "" && !*dryRun {
+		return fmt.Errorf("Topic is not set")
+	}
+
+	fromTime, err := time.ParseInLocation(partitionLayout, *from, time.Local)
+	if err != nil {
+		return err
+	}
+	toTime := fromTime.Add(time.Hour)
+	if *to != "" {
+		toTime, err = time.ParseInLocation(partitionLayout, *to, time.Local)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *checkpoint == "" && *topic != "" {
+		*checkpoint = fmt.Sprintf("_replay/%s.json", *topic)
+	}
+
+	report, err := lib.Replay(ctx, lib.ReplayOptions{
+		BucketID:   *bucket,
+		Format:     *format,
+		From:       fromTime,
+		To:         toTime,
+		Prefix:     *prefix,
+		ProjectID:  *project,
+		TopicID:    *topic,
+		Rate:       *rate,
+		DryRun:     *dryRun,
+		Checkpoint: *checkpoint,
+	})
+	if report != nil {
+		action := "Replayed"
+		if *dryRun {
+			action = "Dry run found"
+		}
+		log.Printf("%s %d messages (%d bytes) from %d objects.\n", action, report.Messages, report.Bytes, report.Objects)
+	}
+	return err
+}
@@ -1,6 +1,6 @@
 module github.com/syntio/aquarium-persistor-gcp/invoker
 
-go 1.13
+go 1.15
 
 replace github.com/syntio/aquarium-persistor-gcp/lib => ../lib
 
@@ -16,11 +16,14 @@ package invoker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/syntio/aquarium-persistor-gcp/lib"
 )
@@ -32,9 +35,15 @@ const (
 // InvokerHandler represents the main invoke function which is triggered by HTTP request.
 // Function provides information needed for invocation by calling SetInvokerInfo method and
 // starts N parallel instances of InvokeFunction (go routines), where N is given by the NumberOfInstances parameter.
+// The number of instances running at the same time and the rate at which they are started can be limited.
 // Function logs invocation error messages received through channel.
+// If the invoker lock is configured, the function takes the lock before starting the instances and
+// skips the run if the lock is still held by the previous run.
+// The invoker deadline is counted from the start of the function, so it includes the time spent waiting for the lock.
 func InvokerHandler(w http.ResponseWriter, r *http.Request) {
 
+	ctx := context.Background()
+
 	invokerInfo := lib.InvokerInfo{}
 	err := lib.SetInvokerInfo(&invokerInfo)
 	if err != nil {
@@ -42,36 +51,182 @@ func InvokerHandler(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	ch := make(chan string)
+	// The lock client uses the background context, so the lock can be released after the deadline.
+	runCtx := ctx
+	if invokerInfo.Deadline > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, time.Duration(invokerInfo.Deadline)*time.Second)
+		defer cancel()
+	}
+
+	lockInfo := lib.LockInfo{}
+	err = lib.SetLockInfo(&lockInfo)
+	if err != nil {
+		log.Printf("Error during retrieving lock environment variables.\n")
+		panic(err)
+	}
+
+	var waited time.Duration
+	if lockInfo.Enabled() {
+		var release func()
+		locker, err := lib.NewGCSLocker(ctx, lockInfo)
+		if err != nil {
+			log.Printf("Error during lock client creation. %v.\n", err)
+			panic(err)
+		}
+		defer locker.Close()
+
+		release, waited, err = takeLock(runCtx, locker, lockInfo)
+		if err == lib.ErrLockHeld {
+			log.Printf("Skipping run, the previous run is still in progress.\n")
+			fmt.Fprint(w, "Skipped execution: the previous run is still in progress")
+			return
+		}
+		if err != nil {
+			log.Printf("Error during lock acquisition. %v.\n", err)
+			panic(err)
+		}
+		defer release()
+	}
+
+	started := fanOut(runCtx, invokerInfo)
+
+	summary := "Finished execution"
+	if started < invokerInfo.NumberOfInstances {
+		summary += fmt.Sprintf(" (started %d of %d instances before the deadline)", started, invokerInfo.NumberOfInstances)
+	}
+	if waited > 0 {
+		summary += fmt.Sprintf(" (queued for %v behind the previous run)", waited)
+	}
+	fmt.Fprint(w, summary)
+
+}
+
+// fanOut starts the instances of InvokeFunction and waits for all of them to finish.
+// An instance is started only when a concurrency slot is free and the ramp-up schedule allows it.
+// Instances that could not finish their pull window before the deadline of the context (the invoker deadline) are not started.
+// The function returns the number of started instances.
+func fanOut(ctx context.Context, invokerInfo lib.InvokerInfo) int {
+	slots := invokerInfo.MaxConcurrentInstances
+	if slots <= 0 || slots > invokerInfo.NumberOfInstances {
+		slots = invokerInfo.NumberOfInstances
+	}
+	sem := make(chan struct{}, slots)
 
+	var rampUp <-chan time.Time
+	if interval := invokerInfo.RampUpInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		rampUp = ticker.C
+	}
+
+	// The channel is buffered so finished instances can free their slots before the results are read.
+	ch := make(chan string, invokerInfo.NumberOfInstances)
+	window := time.Duration(invokerInfo.NumberOfSeconds) * time.Second
+
+	started := 0
 	for i := 0; i < invokerInfo.NumberOfInstances; i++ {
+		if !waitForSlot(ctx, sem, rampUp, i) {
+			break
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < window {
+			<-sem
+			break
+		}
+
 		invokerInfo.InstanceNumber = i + 1
-		go InvokeFunction(invokerInfo, ch)
+		started++
+		go func(info lib.InvokerInfo) {
+			defer func() { <-sem }()
+			_ = InvokeFunction(ctx, info, ch)
+		}(invokerInfo)
 	}
 
-	for i := 0; i < invokerInfo.NumberOfInstances; i++ {
+	if started < invokerInfo.NumberOfInstances {
+		log.Printf("Deadline reached, %d of %d instances were not started.\n", invokerInfo.NumberOfInstances-started, invokerInfo.NumberOfInstances)
+	}
+
+	for i := 0; i < started; i++ {
 		log.Printf("Call to function finished. %v.\n", <-ch)
 	}
-	fmt.Fprint(w, "Finished execution")
 
+	return started
+}
+
+// waitForSlot blocks until a concurrency slot is taken and the ramp-up schedule allows the next instance.
+// The first instance does not wait for the ramp-up schedule.
+// The function returns false if the context expires while waiting.
+func waitForSlot(ctx context.Context, sem chan struct{}, rampUp <-chan time.Time, index int) bool {
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+
+	if rampUp == nil || index == 0 {
+		return true
+	}
+
+	select {
+	case <-rampUp:
+		return true
+	case <-ctx.Done():
+		<-sem
+		return false
+	}
+}
+
+// takeLock acquires the invoker lock and returns a function which releases it,
+// together with the time spent waiting for the previous run (only in the queue mode).
+// The lock is released with a context of its own, so it is released even if the passed in context has expired.
+// ErrLockHeld is returned if the lock is held by another run.
+func takeLock(ctx context.Context, locker lib.Locker, lockInfo lib.LockInfo) (func(), time.Duration, error) {
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("%s-%d", hostname, time.Now().UnixNano())
+
+	start := time.Now()
+	lease, err := lib.AcquireLock(ctx, locker, lockInfo, holder)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	waited := time.Since(start).Round(time.Second)
+	if waited > 0 {
+		log.Printf("Lock acquired after waiting %v for the previous run.\n", waited)
+	}
+
+	release := func() {
+		if err := locker.Release(context.Background(), lease); err != nil {
+			log.Printf("Error during lock release. %v.\n", err)
+		}
+	}
+	return release, waited, nil
 }
 
 // InvokeFunction sends a HTTP post request and checks the call validity.
 // The invokerInfo argument contains the target URL and informations which will be sent through the request body.
+// The outcome of the call is always sent through the channel.
 // Returned result is an error which defines the validity of the function action.
-func InvokeFunction(invokerInfo lib.InvokerInfo, ch chan<- string) error {
+func InvokeFunction(ctx context.Context, invokerInfo lib.InvokerInfo, ch chan<- string) error {
 	var err error
 
 	//NumberOfInstances and NumberOfSeconds will be passed to the invoked function.
 	jsonRequest, err := json.Marshal(&invokerInfo)
 	if err != nil {
-		log.Printf("Error during #%d request parameter marshaling. %v.\n", invokerInfo.InstanceNumber, err)
+		ch <- fmt.Sprintf("Error during #%d request parameter marshaling: %v", invokerInfo.InstanceNumber, err)
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, invokerInfo.FunctionURL, bytes.NewBuffer(jsonRequest))
+	if err != nil {
+		ch <- fmt.Sprintf("Error during #%d request creation: %v", invokerInfo.InstanceNumber, err)
 		return err
 	}
+	request.Header.Set("Content-Type", contentType)
 
-	response, err := http.Post(invokerInfo.FunctionURL, contentType, bytes.NewBuffer(jsonRequest))
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
 	if err != nil {
-		log.Printf("Error during #%d function invocation: %v.\n", invokerInfo.InstanceNumber, err)
+		ch <- fmt.Sprintf("Error during #%d function invocation: %v", invokerInfo.InstanceNumber, err)
 		return err
 	}
 	defer response.Body.Close()
@@ -0,0 +1,137 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package invoker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// pullServer is a fake pull function which records the start times of the invocations and the highest number
+// of invocations running at the same time. Each invocation takes the given duration.
+type pullServer struct {
+	*httptest.Server
+
+	mtx         sync.Mutex
+	starts      []time.Time
+	running     int
+	maxRunning  int
+	invocations int
+}
+
+func newPullServer(duration time.Duration) *pullServer {
+	server := &pullServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mtx.Lock()
+		server.starts = append(server.starts, time.Now())
+		server.invocations++
+		server.running++
+		if server.running > server.maxRunning {
+			server.maxRunning = server.running
+		}
+		server.mtx.Unlock()
+
+		select {
+		case <-time.After(duration):
+		case <-r.Context().Done():
+		}
+
+		server.mtx.Lock()
+		server.running--
+		server.mtx.Unlock()
+	}))
+	return server
+}
+
+func TestRampUpInterval(t *testing.T) {
+	for _, test := range []struct {
+		perSecond int
+		want      time.Duration
+	}{
+		{0, 0},
+		{-1, 0},
+		{1, time.Second},
+		{3, 333333333 * time.Nanosecond},
+		{int(time.Second), time.Nanosecond},
+		// More than one instance per nanosecond starts the instances without a delay, instead of panicking in the ticker.
+		{2 * int(time.Second), 0},
+	} {
+		got := lib.InvokerInfo{InstancesPerSecond: test.perSecond}.RampUpInterval()
+		if got != test.want {
+			t.Errorf("RampUpInterval() with %d instances per second = %v, want %v", test.perSecond, got, test.want)
+		}
+	}
+}
+
+func TestFanOutConcurrencyLimit(t *testing.T) {
+	server := newPullServer(50 * time.Millisecond)
+	defer server.Close()
+
+	info := lib.InvokerInfo{FunctionURL: server.URL, NumberOfInstances: 5, MaxConcurrentInstances: 2}
+	if started := fanOut(context.Background(), info); started != 5 {
+		t.Errorf("started = %d, want 5", started)
+	}
+	if server.invocations != 5 || server.maxRunning > 2 {
+		t.Errorf("invocations = %d, at most %d running, want 5 and at most 2", server.invocations, server.maxRunning)
+	}
+}
+
+func TestFanOutRampUp(t *testing.T) {
+	server := newPullServer(0)
+	defer server.Close()
+
+	// The first instance starts at once, and the others 50 ms apart.
+	info := lib.InvokerInfo{FunctionURL: server.URL, NumberOfInstances: 4, InstancesPerSecond: 20}
+	if started := fanOut(context.Background(), info); started != 4 {
+		t.Fatalf("started = %d, want 4", started)
+	}
+	if spread := server.starts[3].Sub(server.starts[0]); spread < 140*time.Millisecond {
+		t.Errorf("instances started within %v, want at least 150ms", spread)
+	}
+
+	// A rate too high for a ticker starts the instances without a delay.
+	info.InstancesPerSecond = 2 * int(time.Second)
+	if started := fanOut(context.Background(), info); started != 4 {
+		t.Errorf("started = %d, want 4", started)
+	}
+}
+
+func TestFanOutDeadline(t *testing.T) {
+	server := newPullServer(300 * time.Millisecond)
+	defer server.Close()
+
+	// The pull window of an instance would not end before the deadline, so no instance is started.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	info := lib.InvokerInfo{FunctionURL: server.URL, NumberOfInstances: 3, NumberOfSeconds: 1}
+	started := fanOut(ctx, info)
+	cancel()
+	if started != 0 || server.invocations != 0 {
+		t.Errorf("started = %d, invocations = %d, want 0", started, server.invocations)
+	}
+
+	// With a single slot, the third instance would wait for the slot beyond the deadline.
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	info = lib.InvokerInfo{FunctionURL: server.URL, NumberOfInstances: 3, MaxConcurrentInstances: 1}
+	if started := fanOut(ctx, info); started != 2 {
+		t.Errorf("started = %d, want 2", started)
+	}
+}
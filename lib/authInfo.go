@@ -0,0 +1,65 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import "strings"
+
+const (
+	defaultJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+	defaultIssuers = "accounts.google.com,https://accounts.google.com"
+)
+
+// AuthInfo represents push authentication configuration.
+// It holds information needed for verifying the OIDC tokens sent by authenticated push subscriptions.
+type AuthInfo struct {
+	Audience      string   // expected audience of a token (set in the push subscription)
+	AllowedEmails []string // service account emails which are allowed to push messages
+	Issuers       []string // accepted token issuers
+	JWKSURL       string   // URL of a JSON Web Key Set used for checking token signatures
+}
+
+// SetAuthInfo sets the parameters of a push authentication configuration by extracting values from the corresponding environment variables.
+// An error is returned if any errors occur during the function execution.
+func SetAuthInfo(authInfo *AuthInfo) error {
+	var err error
+
+	authInfo.Audience, err = getEnvVariable("PUSH_AUTH_AUDIENCE")
+	if err != nil {
+		return err
+	}
+
+	allowedEmails, err := getEnvVariable("PUSH_AUTH_EMAILS")
+	if err != nil {
+		return err
+	}
+	authInfo.AllowedEmails = splitList(allowedEmails)
+
+	authInfo.Issuers = splitList(getOptionalEnvVariable("PUSH_AUTH_ISSUERS", defaultIssuers))
+	authInfo.JWKSURL = getOptionalEnvVariable("PUSH_AUTH_JWKS_URL", defaultJWKSURL)
+
+	return nil
+}
+
+// splitList represents helper function which splits a comma separated list and trims its elements.
+// Empty elements are left out.
+func splitList(value string) []string {
+	var list []string
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
@@ -0,0 +1,973 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package avro writes and reads Avro object container files, whose records are encoded with a schema given in the
+// Avro JSON form. It is used to store the batches of messages in the Avro format.
+package avro
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// CodecNull stores the blocks of an Avro container file uncompressed.
+	CodecNull = "null"
+	// CodecDeflate compresses the blocks of an Avro container file with deflate.
+	CodecDeflate = "deflate"
+	// CodecSnappy compresses the blocks of an Avro container file with snappy.
+	CodecSnappy = "snappy"
+
+	// blockSize is the size of the encoded records after which a block is written.
+	blockSize = 64 << 10
+	// syncSize is the size of the sync marker which follows each block.
+	syncSize = 16
+	// maxReadSize is the maximum size of a block, and of a byte sequence, which is read.
+	maxReadSize = 64 << 20
+)
+
+// magic starts each Avro container file.
+var magic = []byte{'O', 'b', 'j', 1}
+
+// Schema is a parsed Avro schema. The logical types are kept as the annotations of their underlying types.
+type Schema struct {
+	Type        string    // primitive type name, record, enum, array, map, union or fixed
+	Name        string    // full name of a named type (record, enum or fixed)
+	LogicalType string    // logical type annotation (e.g. timestamp-micros)
+	Fields      []Field   // fields of a record
+	Symbols     []string  // symbols of an enum
+	Items       *Schema   // schema of the items of an array
+	Values      *Schema   // schema of the values of a map
+	Branches    []*Schema // branches of a union
+	Size        int       // size of a fixed type in bytes
+
+	source []byte // JSON of the schema, stored in the container files
+}
+
+// Field is a field of an Avro record.
+type Field struct {
+	Name    string
+	Type    *Schema
+	Default json.RawMessage // default value of the field (nil if the field has no default)
+}
+
+// ParseSchema parses a schema given in the Avro JSON form.
+// An error is returned if the schema is not valid.
+func ParseSchema(data []byte) (*Schema, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("Invalid Avro schema. %s", err)
+	}
+
+	parser := schemaParser{named: make(map[string]*Schema)}
+	schema, err := parser.parse(value, "")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Avro schema. %s", err)
+	}
+
+	schema.source = append([]byte(nil), data...)
+	return schema, nil
+}
+
+// schemaParser parses a schema, keeping the named types, so they can be referenced by their names.
+type schemaParser struct {
+	named map[string]*Schema
+}
+
+var primitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true,
+}
+
+func (parser schemaParser) parse(value interface{}, namespace string) (*Schema, error) {
+	switch value := value.(type) {
+	case string:
+		if primitives[value] {
+			return &Schema{Type: value}, nil
+		}
+		if schema, ok := parser.named[parser.fullName(value, namespace)]; ok {
+			return schema, nil
+		}
+		if schema, ok := parser.named[value]; ok {
+			return schema, nil
+		}
+		return nil, fmt.Errorf("Unknown type '%s'", value)
+
+	case []interface{}:
+		union := &Schema{Type: "union"}
+		for _, branch := range value {
+			schema, err := parser.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if schema.Type == "union" {
+				return nil, fmt.Errorf("Union must not contain a union")
+			}
+			union.Branches = append(union.Branches, schema)
+		}
+		if len(union.Branches) == 0 {
+			return nil, fmt.Errorf("Union must have at least one branch")
+		}
+		return union, nil
+
+	case map[string]interface{}:
+		return parser.parseComplex(value, namespace)
+	}
+
+	return nil, fmt.Errorf("Invalid type definition %v", value)
+}
+
+func (parser schemaParser) parseComplex(value map[string]interface{}, namespace string) (*Schema, error) {
+	typeName, ok := value["type"].(string)
+	if !ok {
+		// A type given as a nested definition, e.g. {"type": {"type": "array", ...}}.
+		if nested, ok := value["type"]; ok {
+			return parser.parse(nested, namespace)
+		}
+		return nil, fmt.Errorf("Type definition has no type")
+	}
+	logicalType, _ := value["logicalType"].(string)
+
+	switch typeName {
+	case "record", "error", "enum", "fixed":
+		name, _ := value["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("Type %s has no name", typeName)
+		}
+		if ns, ok := value["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		schema := &Schema{Type: typeName, Name: parser.fullName(name, namespace), LogicalType: logicalType}
+		if typeName == "error" {
+			schema.Type = "record"
+		}
+		if _, ok := parser.named[schema.Name]; ok {
+			return nil, fmt.Errorf("Type '%s' is defined more than once", schema.Name)
+		}
+		parser.named[schema.Name] = schema
+		if i := strings.LastIndex(schema.Name, "."); i >= 0 {
+			namespace = schema.Name[:i]
+		} else {
+			namespace = ""
+		}
+
+		switch schema.Type {
+		case "record":
+			fields, ok := value["fields"].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Record '%s' has no fields", schema.Name)
+			}
+			names := make(map[string]bool)
+			for _, field := range fields {
+				definition, ok := field.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("Invalid field of record '%s'", schema.Name)
+				}
+				fieldName, _ := definition["name"].(string)
+				if fieldName == "" || names[fieldName] {
+					return nil, fmt.Errorf("Record '%s' has a field without a name or with a duplicate name", schema.Name)
+				}
+				names[fieldName] = true
+
+				fieldType, err := parser.parse(definition["type"], namespace)
+				if err != nil {
+					return nil, fmt.Errorf("Field '%s' of record '%s'. %s", fieldName, schema.Name, err)
+				}
+				avroField := Field{Name: fieldName, Type: fieldType}
+				if defaultValue, ok := definition["default"]; ok {
+					avroField.Default, _ = json.Marshal(defaultValue)
+				}
+				schema.Fields = append(schema.Fields, avroField)
+			}
+
+		case "enum":
+			symbols, ok := value["symbols"].([]interface{})
+			if !ok || len(symbols) == 0 {
+				return nil, fmt.Errorf("Enum '%s' has no symbols", schema.Name)
+			}
+			for _, symbol := range symbols {
+				name, ok := symbol.(string)
+				if !ok {
+					return nil, fmt.Errorf("Invalid symbol of enum '%s'", schema.Name)
+				}
+				schema.Symbols = append(schema.Symbols, name)
+			}
+
+		case "fixed":
+			size, ok := value["size"].(float64)
+			if !ok || size < 0 || size != math.Trunc(size) {
+				return nil, fmt.Errorf("Fixed '%s' has an invalid size", schema.Name)
+			}
+			schema.Size = int(size)
+		}
+		return schema, nil
+
+	case "array":
+		items, err := parser.parse(value["items"], namespace)
+		if err != nil {
+			return nil, fmt.Errorf("Items of an array. %s", err)
+		}
+		return &Schema{Type: typeName, Items: items, LogicalType: logicalType}, nil
+
+	case "map":
+		values, err := parser.parse(value["values"], namespace)
+		if err != nil {
+			return nil, fmt.Errorf("Values of a map. %s", err)
+		}
+		return &Schema{Type: typeName, Values: values, LogicalType: logicalType}, nil
+	}
+
+	if primitives[typeName] {
+		return &Schema{Type: typeName, LogicalType: logicalType}, nil
+	}
+
+	// A reference to a named type, annotated with other attributes.
+	schema, err := parser.parse(typeName, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// fullName returns the full name of a type defined or referenced in the given namespace.
+func (parser schemaParser) fullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+// TypeError is returned if a value does not match the Avro schema.
+type TypeError struct {
+	Path    string // path of the value within the record (e.g. .customer.id)
+	Message string
+}
+
+func (err *TypeError) Error() string {
+	if err.Path == "" {
+		return err.Message
+	}
+	return fmt.Sprintf("%s: %s", err.Path, err.Message)
+}
+
+// encode appends the binary encoding of a value to the buffer. The values are given as the values decoded from
+// JSON (with numbers as float64 or json.Number), or as Go values of the corresponding types (e.g. int64 for a long,
+// []byte for bytes, map[string]string for a map of strings). A missing record field takes its default value,
+// or null if the field is nullable. The fields which are not in the schema are ignored.
+func encode(buf *bytes.Buffer, schema *Schema, value interface{}, path string) error {
+	mismatch := func() error {
+		return &TypeError{Path: path, Message: fmt.Sprintf("expected %s, got %s", schema.Type, valueKind(value))}
+	}
+
+	switch schema.Type {
+	case "null":
+		if value != nil {
+			return mismatch()
+		}
+		return nil
+
+	case "boolean":
+		b, ok := value.(bool)
+		if !ok {
+			return mismatch()
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		return nil
+
+	case "int", "long":
+		n, ok := integer(value)
+		if !ok || (schema.Type == "int" && (n < math.MinInt32 || n > math.MaxInt32)) {
+			return mismatch()
+		}
+		writeLong(buf, n)
+		return nil
+
+	case "float", "double":
+		f, ok := number(value)
+		if !ok {
+			return mismatch()
+		}
+		var data [8]byte
+		if schema.Type == "float" {
+			binary.LittleEndian.PutUint32(data[:4], math.Float32bits(float32(f)))
+			buf.Write(data[:4])
+		} else {
+			binary.LittleEndian.PutUint64(data[:], math.Float64bits(f))
+			buf.Write(data[:])
+		}
+		return nil
+
+	case "bytes", "string":
+		var data []byte
+		switch value := value.(type) {
+		case string:
+			data = []byte(value)
+		case []byte:
+			data = value
+		default:
+			return mismatch()
+		}
+		writeBytes(buf, data)
+		return nil
+
+	case "fixed":
+		var data []byte
+		switch value := value.(type) {
+		case string:
+			data = []byte(value)
+		case []byte:
+			data = value
+		default:
+			return mismatch()
+		}
+		if len(data) != schema.Size {
+			return &TypeError{Path: path, Message: fmt.Sprintf("expected %d bytes, got %d", schema.Size, len(data))}
+		}
+		buf.Write(data)
+		return nil
+
+	case "enum":
+		symbol, ok := value.(string)
+		if !ok {
+			return mismatch()
+		}
+		for i, s := range schema.Symbols {
+			if s == symbol {
+				writeLong(buf, int64(i))
+				return nil
+			}
+		}
+		return &TypeError{Path: path, Message: fmt.Sprintf("'%s' is not a symbol of enum %s", symbol, schema.Name)}
+
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		if len(items) > 0 {
+			writeLong(buf, int64(len(items)))
+			for i, item := range items {
+				if err := encode(buf, schema.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buf, 0)
+		return nil
+
+	case "map":
+		var entries map[string]interface{}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			entries = value
+		case map[string]string:
+			entries = make(map[string]interface{}, len(value))
+			for key, v := range value {
+				entries[key] = v
+			}
+		default:
+			return mismatch()
+		}
+		if len(entries) > 0 {
+			writeLong(buf, int64(len(entries)))
+			for _, key := range sortedKeys(entries) {
+				writeBytes(buf, []byte(key))
+				if err := encode(buf, schema.Values, entries[key], path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+		writeLong(buf, 0)
+		return nil
+
+	case "record":
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		for _, field := range schema.Fields {
+			fieldValue, ok := fields[field.Name]
+			if !ok {
+				var err error
+				fieldValue, err = defaultValue(field)
+				if err != nil {
+					return &TypeError{Path: path + "." + field.Name, Message: err.Error()}
+				}
+			}
+			if err := encode(buf, field.Type, fieldValue, path+"."+field.Name); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "union":
+		for i, branch := range schema.Branches {
+			if accepts(branch, value) {
+				writeLong(buf, int64(i))
+				return encode(buf, branch, value, path)
+			}
+		}
+		var branches []string
+		for _, branch := range schema.Branches {
+			branches = append(branches, branch.Type)
+		}
+		return &TypeError{Path: path, Message: fmt.Sprintf("expected one of %s, got %s", strings.Join(branches, ", "), valueKind(value))}
+	}
+
+	return &TypeError{Path: path, Message: fmt.Sprintf("unsupported type %s", schema.Type)}
+}
+
+// defaultValue returns the value of a missing field, which is its default value, or null if the field is nullable.
+func defaultValue(field Field) (interface{}, error) {
+	if field.Default != nil {
+		decoder := json.NewDecoder(bytes.NewReader(field.Default))
+		decoder.UseNumber()
+		var value interface{}
+		err := decoder.Decode(&value)
+		return value, err
+	}
+	if field.Type.Type == "null" {
+		return nil, nil
+	}
+	if field.Type.Type == "union" {
+		for _, branch := range field.Type.Branches {
+			if branch.Type == "null" {
+				return nil, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("missing required field")
+}
+
+// accepts reports whether a value can be encoded in the branch of a union, which chooses the branch of the value.
+func accepts(schema *Schema, value interface{}) bool {
+	switch schema.Type {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "int":
+		n, ok := integer(value)
+		return ok && n >= math.MinInt32 && n <= math.MaxInt32
+	case "long":
+		_, ok := integer(value)
+		return ok
+	case "float", "double":
+		_, ok := number(value)
+		return ok
+	case "string", "bytes":
+		switch value.(type) {
+		case string, []byte:
+			return true
+		}
+	case "fixed":
+		switch value := value.(type) {
+		case string:
+			return len(value) == schema.Size
+		case []byte:
+			return len(value) == schema.Size
+		}
+	case "enum":
+		symbol, ok := value.(string)
+		if ok {
+			for _, s := range schema.Symbols {
+				if s == symbol {
+					return true
+				}
+			}
+		}
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "map":
+		switch value.(type) {
+		case map[string]interface{}, map[string]string:
+			return true
+		}
+	case "record":
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+	return false
+}
+
+// integer converts a value to an integer, if it is an integral number.
+func integer(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case float64:
+		if value == math.Trunc(value) && math.Abs(value) < 1<<63 {
+			return int64(value), true
+		}
+	case json.Number:
+		n, err := value.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// number converts a value to a floating point number.
+func number(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float32:
+		return float64(value), true
+	case float64:
+		return value, true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	}
+	n, ok := integer(value)
+	return float64(n), ok
+}
+
+// valueKind describes the kind of a value in the type errors.
+func valueKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case int, int32, int64, float32, float64, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []byte:
+		return "bytes"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}, map[string]string:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// sortedKeys returns the keys of a map in a sorted order, so the encoding of a map is deterministic.
+func sortedKeys(entries map[string]interface{}) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeLong appends a zig-zag encoded variable-length integer.
+func writeLong(buf *bytes.Buffer, n int64) {
+	var data [binary.MaxVarintLen64]byte
+	buf.Write(data[:binary.PutVarint(data[:], n)])
+}
+
+// writeBytes appends a byte sequence after its length.
+func writeBytes(buf *bytes.Buffer, data []byte) {
+	writeLong(buf, int64(len(data)))
+	buf.Write(data)
+}
+
+// Writer writes the records of an Avro object container file.
+type Writer struct {
+	writer io.Writer
+	schema *Schema
+	codec  string
+	sync   [syncSize]byte
+
+	block  bytes.Buffer // encoded records of the current block
+	count  int64        // number of records in the current block
+	record bytes.Buffer // encoding of the appended record
+	size   int64        // size of the encoded records
+}
+
+// NewWriter writes the header of a container file with records of the given schema, whose blocks are compressed with the codec.
+// An error is returned if the codec is not supported or if the header could not be written.
+func NewWriter(w io.Writer, schema *Schema, codec string) (*Writer, error) {
+	if codec == "" {
+		codec = CodecNull
+	}
+	if codec != CodecNull && codec != CodecDeflate && codec != CodecSnappy {
+		return nil, fmt.Errorf("Unknown Avro codec '%s', expected '%s', '%s' or '%s'", codec, CodecNull, CodecDeflate, CodecSnappy)
+	}
+
+	writer := &Writer{writer: w, schema: schema, codec: codec}
+	if _, err := rand.Read(writer.sync[:]); err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.Write(magic)
+	writeLong(&header, 2)
+	writeBytes(&header, []byte("avro.schema"))
+	writeBytes(&header, schema.source)
+	writeBytes(&header, []byte("avro.codec"))
+	writeBytes(&header, []byte(codec))
+	writeLong(&header, 0)
+	header.Write(writer.sync[:])
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Append adds a record to the file. A record which does not match the schema is not added and an *TypeError is returned.
+// The records are written in blocks, so a record may be written only by a later call or by Close.
+func (writer *Writer) Append(value interface{}) error {
+	writer.record.Reset()
+	if err := encode(&writer.record, writer.schema, value, ""); err != nil {
+		return err
+	}
+
+	writer.block.Write(writer.record.Bytes())
+	writer.count++
+	writer.size += int64(writer.record.Len())
+	if writer.block.Len() >= blockSize {
+		return writer.Flush()
+	}
+	return nil
+}
+
+// Size returns the size of the encoded records (before they are compressed).
+func (writer *Writer) Size() int64 {
+	return writer.size
+}
+
+// Flush writes the records of the current block.
+func (writer *Writer) Flush() error {
+	if writer.count == 0 {
+		return nil
+	}
+
+	var data []byte
+	switch writer.codec {
+	case CodecDeflate:
+		var compressed bytes.Buffer
+		deflater, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err = deflater.Write(writer.block.Bytes()); err != nil {
+			return err
+		}
+		if err = deflater.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	case CodecSnappy:
+		data = snappy.Encode(nil, writer.block.Bytes())
+		var checksum [4]byte
+		binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(writer.block.Bytes()))
+		data = append(data, checksum[:]...)
+	default:
+		data = writer.block.Bytes()
+	}
+
+	var block bytes.Buffer
+	writeLong(&block, writer.count)
+	writeBytes(&block, data)
+	block.Write(writer.sync[:])
+	if _, err := writer.writer.Write(block.Bytes()); err != nil {
+		return err
+	}
+
+	writer.block.Reset()
+	writer.count = 0
+	return nil
+}
+
+// Close writes the remaining records. It does not close the underlying writer.
+func (writer *Writer) Close() error {
+	return writer.Flush()
+}
+
+// Reader reads the records of an Avro object container file.
+type Reader struct {
+	reader *bufio.Reader
+	schema *Schema
+	codec  string
+	sync   [syncSize]byte
+
+	block *bytes.Reader // decompressed records of the current block
+	count int64         // number of records left in the current block
+}
+
+// NewReader reads the header of a container file.
+// An error is returned if the header is not valid or if the codec is not supported.
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{reader: bufio.NewReader(r)}
+
+	magic := make([]byte, len(magic))
+	if _, err := io.ReadFull(reader.reader, magic); err != nil || !bytes.Equal(magic, magic) {
+		return nil, fmt.Errorf("Not an Avro container file")
+	}
+
+	metadata, err := decode(reader.reader, &Schema{Type: "map", Values: &Schema{Type: "bytes"}})
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Avro file header. %s", err)
+	}
+	entries := metadata.(map[string]interface{})
+
+	schema, _ := entries["avro.schema"].([]byte)
+	reader.schema, err = ParseSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+	reader.codec = CodecNull
+	if codec, ok := entries["avro.codec"].([]byte); ok && len(codec) > 0 {
+		reader.codec = string(codec)
+	}
+	if reader.codec != CodecNull && reader.codec != CodecDeflate && reader.codec != CodecSnappy {
+		return nil, fmt.Errorf("Unknown Avro codec '%s'", reader.codec)
+	}
+
+	if _, err := io.ReadFull(reader.reader, reader.sync[:]); err != nil {
+		return nil, fmt.Errorf("Invalid Avro file header. %s", err)
+	}
+	return reader, nil
+}
+
+// Schema returns the schema of the records.
+func (reader *Reader) Schema() *Schema {
+	return reader.schema
+}
+
+// Codec returns the codec with which the blocks are compressed.
+func (reader *Reader) Codec() string {
+	return reader.codec
+}
+
+// Next returns the next record, or io.EOF if there are no more records. The records are decoded as null (nil), boolean (bool),
+// int (int32), long (int64), float (float32), double (float64), bytes and fixed ([]byte), string and enum (string),
+// array ([]interface{}), and map and record (map[string]interface{}). A union is decoded as the value of its branch.
+func (reader *Reader) Next() (interface{}, error) {
+	for reader.count == 0 {
+		if err := reader.readBlock(); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := decode(reader.block, reader.schema)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Avro record. %s", err)
+	}
+	reader.count--
+	return value, nil
+}
+
+func (reader *Reader) readBlock() error {
+	count, err := binary.ReadVarint(reader.reader)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil || count < 0 {
+		return fmt.Errorf("Invalid Avro block")
+	}
+	size, err := binary.ReadVarint(reader.reader)
+	if err != nil || size < 0 || size > maxReadSize {
+		return fmt.Errorf("Invalid Avro block size")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(reader.reader, data); err != nil {
+		return fmt.Errorf("Truncated Avro block")
+	}
+	var sync [syncSize]byte
+	if _, err := io.ReadFull(reader.reader, sync[:]); err != nil || sync != reader.sync {
+		return fmt.Errorf("Invalid Avro sync marker")
+	}
+
+	switch reader.codec {
+	case CodecDeflate:
+		data, err = ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), maxReadSize))
+		if err != nil {
+			return err
+		}
+	case CodecSnappy:
+		if len(data) < 4 {
+			return fmt.Errorf("Invalid snappy block")
+		}
+		checksum := binary.BigEndian.Uint32(data[len(data)-4:])
+		data, err = snappy.Decode(nil, data[:len(data)-4])
+		if err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(data) != checksum {
+			return fmt.Errorf("Checksum of a snappy block does not match")
+		}
+	}
+
+	reader.block = bytes.NewReader(data)
+	reader.count = count
+	return nil
+}
+
+// byteReader is a reader of the encoded values.
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// decode decodes a single value of the schema.
+func decode(r byteReader, schema *Schema) (interface{}, error) {
+	switch schema.Type {
+	case "null":
+		return nil, nil
+
+	case "boolean":
+		b, err := r.ReadByte()
+		return b != 0, err
+
+	case "int":
+		n, err := binary.ReadVarint(r)
+		return int32(n), err
+
+	case "long":
+		return binary.ReadVarint(r)
+
+	case "float":
+		var data [4]byte
+		_, err := io.ReadFull(r, data[:])
+		return math.Float32frombits(binary.LittleEndian.Uint32(data[:])), err
+
+	case "double":
+		var data [8]byte
+		_, err := io.ReadFull(r, data[:])
+		return math.Float64frombits(binary.LittleEndian.Uint64(data[:])), err
+
+	case "bytes", "string":
+		data, err := readBytes(r)
+		if err != nil || schema.Type == "bytes" {
+			return data, err
+		}
+		return string(data), nil
+
+	case "fixed":
+		data := make([]byte, schema.Size)
+		_, err := io.ReadFull(r, data)
+		return data, err
+
+	case "enum":
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n >= int64(len(schema.Symbols)) {
+			return nil, fmt.Errorf("Invalid symbol index %d of enum %s", n, schema.Name)
+		}
+		return schema.Symbols[n], nil
+
+	case "array", "map":
+		var items []interface{}
+		entries := make(map[string]interface{})
+		for {
+			count, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				break
+			}
+			if count < 0 {
+				// A negative count is followed by the size of the block in bytes.
+				count = -count
+				if _, err := binary.ReadVarint(r); err != nil {
+					return nil, err
+				}
+			}
+			for i := int64(0); i < count; i++ {
+				if schema.Type == "array" {
+					item, err := decode(r, schema.Items)
+					if err != nil {
+						return nil, err
+					}
+					items = append(items, item)
+					continue
+				}
+
+				key, err := readBytes(r)
+				if err != nil {
+					return nil, err
+				}
+				entries[string(key)], err = decode(r, schema.Values)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if schema.Type == "array" {
+			if items == nil {
+				items = []interface{}{}
+			}
+			return items, nil
+		}
+		return entries, nil
+
+	case "record":
+		record := make(map[string]interface{}, len(schema.Fields))
+		for _, field := range schema.Fields {
+			value, err := decode(r, field.Type)
+			if err != nil {
+				return nil, err
+			}
+			record[field.Name] = value
+		}
+		return record, nil
+
+	case "union":
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 || n >= int64(len(schema.Branches)) {
+			return nil, fmt.Errorf("Invalid union branch %d", n)
+		}
+		return decode(r, schema.Branches[n])
+	}
+
+	return nil, fmt.Errorf("Unsupported type %s", schema.Type)
+}
+
+// readBytes reads a byte sequence preceded by its length.
+func readBytes(r byteReader) ([]byte, error) {
+	size, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > maxReadSize {
+		return nil, fmt.Errorf("Invalid length %d", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
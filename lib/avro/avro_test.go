@@ -0,0 +1,233 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package avro
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// orderSchema is a user-supplied schema of JSON payloads, with a nested record, an enum, a nullable field and a default value.
+const orderSchema = `{
+	"type": "record",
+	"name": "Order",
+	"namespace": "io.syntio.test",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "PAID"]}},
+		{"name": "customer", "type": {"type": "record", "name": "Customer", "fields": [{"name": "name", "type": "string"}]}},
+		{"name": "note", "type": ["null", "string"]},
+		{"name": "quantity", "type": "int", "default": 1},
+		{"name": "tags", "type": {"type": "array", "items": "string"}, "default": []}
+	]
+}`
+
+// messageSchema is a schema of message envelopes, with a logical type and a map.
+const messageSchema = `{
+	"type": "record",
+	"name": "Message",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "publishTime", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "attributes", "type": {"type": "map", "values": "string"}},
+		{"name": "payload", "type": "bytes"}
+	]
+}`
+
+// readAvro reads all of the records of a container file.
+func readAvro(t *testing.T, data []byte) (*Reader, []interface{}) {
+	t.Helper()
+
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []interface{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return reader, records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	publishTime := time.Date(2020, 11, 5, 10, 30, 0, 0, time.UTC)
+	for _, codec := range []string{CodecNull, CodecDeflate, CodecSnappy} {
+		t.Run(codec, func(t *testing.T) {
+			schema, err := ParseSchema([]byte(messageSchema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			writer, err := NewWriter(&buf, schema, codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Enough records for several blocks.
+			payload := bytes.Repeat([]byte("x"), 1000)
+			for i := 0; i < 200; i++ {
+				record := map[string]interface{}{
+					"id":          "42",
+					"publishTime": publishTime.UnixNano() / 1000,
+					"attributes":  map[string]string{"origin": "test"},
+					"payload":     payload,
+				}
+				if err := writer.Append(record); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			reader, records := readAvro(t, buf.Bytes())
+			if reader.Codec() != codec {
+				t.Errorf("codec = %s, want %s", reader.Codec(), codec)
+			}
+			if len(records) != 200 {
+				t.Fatalf("read %d records, want 200", len(records))
+			}
+			want := map[string]interface{}{
+				"id":          "42",
+				"publishTime": publishTime.UnixNano() / 1000,
+				"attributes":  map[string]interface{}{"origin": "test"},
+				"payload":     payload,
+			}
+			if !reflect.DeepEqual(records[199], want) {
+				t.Errorf("record = %v, want %v", records[199], want)
+			}
+		})
+	}
+}
+
+func TestReaderGoavroFiles(t *testing.T) {
+	// The files in testdata were written by github.com/linkedin/goavro/v2 (v2.10.0) with orderSchema,
+	// the first two records in one block and the third in another.
+	want := []interface{}{
+		map[string]interface{}{"id": int64(1), "status": "NEW", "customer": map[string]interface{}{"name": "Ana"}, "note": nil, "quantity": int32(1), "tags": []interface{}{}},
+		map[string]interface{}{"id": int64(2), "status": "PAID", "customer": map[string]interface{}{"name": "Ivo"}, "note": "gift", "quantity": int32(3), "tags": []interface{}{"express", "fragile"}},
+		map[string]interface{}{"id": int64(-3), "status": "NEW", "customer": map[string]interface{}{"name": "Eva"}, "note": nil, "quantity": int32(2), "tags": []interface{}{"x"}},
+	}
+	for _, codec := range []string{CodecNull, CodecDeflate, CodecSnappy} {
+		t.Run(codec, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join("testdata", "orders-"+codec+".avro"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reader, records := readAvro(t, data)
+			if reader.Codec() != codec {
+				t.Errorf("codec = %s, want %s", reader.Codec(), codec)
+			}
+			if reader.Schema().Name != "io.syntio.test.Order" {
+				t.Errorf("schema = %s, want io.syntio.test.Order", reader.Schema().Name)
+			}
+			if !reflect.DeepEqual(records, want) {
+				t.Errorf("records = %#v, want %#v", records, want)
+			}
+		})
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	schema, err := ParseSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Name != "io.syntio.test.Order" || len(schema.Fields) != 6 {
+		t.Errorf("Unexpected schema %+v", schema)
+	}
+	if customer := schema.Fields[2].Type; customer.Name != "io.syntio.test.Customer" {
+		t.Errorf("nested record name = %s, want it in the namespace of the enclosing record", customer.Name)
+	}
+
+	for _, invalid := range []string{
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "R", "fields": [{"name": "a", "type": "Unknown"}]}`,
+		`{"type": "enum", "name": "E", "symbols": []}`,
+		`{"type": "fixed", "name": "F", "size": -1}`,
+		`[["null"], "string"]`,
+		`not json`,
+	} {
+		if _, err := ParseSchema([]byte(invalid)); err == nil {
+			t.Errorf("ParseSchema(%s) error = nil, want an error", invalid)
+		}
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	schema, err := ParseSchema([]byte(orderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, schema, CodecDeflate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The missing fields take their defaults (or null), and the unknown field is left out.
+	err = writer.Append(map[string]interface{}{
+		"id":       float64(7),
+		"status":   "PAID",
+		"customer": map[string]interface{}{"name": "Ana"},
+		"unknown":  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, records := readAvro(t, buf.Bytes())
+	want := map[string]interface{}{
+		"id":       int64(7),
+		"status":   "PAID",
+		"customer": map[string]interface{}{"name": "Ana"},
+		"note":     nil,
+		"quantity": int32(1),
+		"tags":     []interface{}{},
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0], want) {
+		t.Errorf("records = %v, want %v", records, want)
+	}
+
+	for _, test := range []struct {
+		record map[string]interface{}
+		path   string
+	}{
+		{map[string]interface{}{"id": 1.5, "status": "NEW", "customer": map[string]interface{}{"name": "Ana"}}, ".id"},
+		{map[string]interface{}{"id": 1, "status": "SHIPPED", "customer": map[string]interface{}{"name": "Ana"}}, ".status"},
+		{map[string]interface{}{"id": 1, "status": "NEW", "customer": map[string]interface{}{}}, ".customer.name"},
+		{map[string]interface{}{"id": 1, "status": "NEW", "customer": map[string]interface{}{"name": "Ana"}, "note": 5}, ".note"},
+	} {
+		err := writer.Append(test.record)
+		typeErr, ok := err.(*TypeError)
+		if !ok || typeErr.Path != test.path {
+			t.Errorf("Append(%v) error = %v, want an *TypeError at %s", test.record, err, test.path)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package avro
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// fuzzSchema is a schema with each of the types.
+const fuzzSchema = `{
+	"type": "record",
+	"name": "Fuzz",
+	"fields": [
+		{"name": "long", "type": "long"},
+		{"name": "int", "type": "int"},
+		{"name": "float", "type": "float"},
+		{"name": "double", "type": "double"},
+		{"name": "boolean", "type": "boolean"},
+		{"name": "string", "type": "string"},
+		{"name": "bytes", "type": "bytes"},
+		{"name": "fixed", "type": {"type": "fixed", "name": "Four", "size": 4}},
+		{"name": "enum", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "PAID", "SHIPPED"]}},
+		{"name": "nullable", "type": ["null", "string"]},
+		{"name": "array", "type": {"type": "array", "items": "long"}},
+		{"name": "map", "type": {"type": "map", "values": "bytes"}},
+		{"name": "record", "type": {"type": "record", "name": "Nested", "fields": [{"name": "flag", "type": "boolean"}]}}
+	]
+}`
+
+func FuzzWriterRoundTrip(f *testing.F) {
+	f.Add(int64(1), int32(7), float32(0.5), 12.25, true, "Ana", []byte{0, 1, 2, 3, 4}, uint8(0), uint16(1))
+	f.Add(int64(math.MinInt64), int32(math.MaxInt32), float32(math.Inf(1)), math.NaN(), false, "", []byte{}, uint8(5), uint16(200))
+	f.Add(int64(-3), int32(-1), float32(-2), -1e10, true, "ključ", []byte("x"), uint8(10), uint16(3000))
+
+	schema, err := ParseSchema([]byte(fuzzSchema))
+	if err != nil {
+		f.Fatal(err)
+	}
+	codecs := []string{CodecNull, CodecDeflate, CodecSnappy}
+	symbols := []string{"NEW", "PAID", "SHIPPED"}
+	f.Fuzz(func(t *testing.T, l int64, i int32, fl float32, d float64, b bool, s string, data []byte, choice uint8, count uint16) {
+		if data == nil {
+			data = []byte{}
+		}
+		fixed := append(append([]byte(nil), data...), 0, 0, 0, 0)[:4]
+		array := make([]interface{}, len(data))
+		for j, c := range data {
+			array[j] = l * int64(c)
+		}
+		var nullable interface{}
+		if choice&1 == 0 {
+			nullable = s
+		}
+		record := map[string]interface{}{
+			"long":     l,
+			"int":      i,
+			"float":    fl,
+			"double":   d,
+			"boolean":  b,
+			"string":   s,
+			"bytes":    data,
+			"fixed":    fixed,
+			"enum":     symbols[int(choice)%len(symbols)],
+			"nullable": nullable,
+			"array":    array,
+			"map":      map[string]interface{}{s: data, "": []byte(s)},
+			"record":   map[string]interface{}{"flag": !b},
+		}
+
+		// Enough copies of the record may span several blocks.
+		codec := codecs[int(choice)%len(codecs)]
+		var buf bytes.Buffer
+		writer, err := NewWriter(&buf, schema, codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copies := int(count)%2000 + 1
+		for j := 0; j < copies; j++ {
+			if err := writer.Append(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, records := readAvro(t, buf.Bytes())
+		if reader.Codec() != codec || len(records) != copies {
+			t.Fatalf("read %d records with the %s codec, want %d with %s", len(records), reader.Codec(), copies, codec)
+		}
+
+		// The floating point values are compared by their bits, so a NaN matches itself. A float may only
+		// lose the signaling bit of a NaN when it is converted to a double and back.
+		got := records[copies-1].(map[string]interface{})
+		if f, ok := got["float"].(float32); !ok || (math.Float32bits(f) != math.Float32bits(fl) && !(math.IsNaN(float64(f)) && math.IsNaN(float64(fl)))) {
+			t.Errorf("float = %v, want %v", got["float"], fl)
+		}
+		if f, ok := got["double"].(float64); !ok || math.Float64bits(f) != math.Float64bits(d) {
+			t.Errorf("double = %v, want %v", got["double"], d)
+		}
+		delete(got, "float")
+		delete(got, "double")
+		delete(record, "float")
+		delete(record, "double")
+		if !reflect.DeepEqual(got, record) {
+			t.Errorf("record = %#v, want %#v", got, record)
+		}
+	})
+}
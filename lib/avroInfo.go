@@ -0,0 +1,41 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/avro"
+)
+
+// AvroInfo represents Avro format configuration.
+// It holds information needed for storing messages in Avro container files (the avro message format).
+type AvroInfo struct {
+	Codec  string // codec with which the blocks of the files are compressed (null, deflate or snappy)
+	Schema string // local path or gs:// URI of a schema of the JSON payloads (empty value stores the message envelopes)
+}
+
+// SetAvroInfo sets the parameters of an Avro format configuration by extracting values from the corresponding environment variables.
+// An error is returned if any errors occur during the function execution.
+func SetAvroInfo(avroInfo *AvroInfo) error {
+	avroInfo.Codec = getOptionalEnvVariable("AVRO_CODEC", avro.CodecDeflate)
+	if avroInfo.Codec != avro.CodecNull && avroInfo.Codec != avro.CodecDeflate && avroInfo.Codec != avro.CodecSnappy {
+		return fmt.Errorf("Invalid Avro codec '%s', expected '%s', '%s' or '%s'", avroInfo.Codec, avro.CodecNull, avro.CodecDeflate, avro.CodecSnappy)
+	}
+
+	avroInfo.Schema = getOptionalEnvVariable("AVRO_SCHEMA", "")
+
+	return nil
+}
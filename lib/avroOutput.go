@@ -0,0 +1,158 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/avro"
+)
+
+// AvroEnvelopeSchema is the schema of the records of the Avro files if no schema is configured.
+// Each record holds a message with its payload as bytes, so payloads of any format can be stored.
+const AvroEnvelopeSchema = `{
+	"type": "record",
+	"name": "Message",
+	"namespace": "io.syntio.persistor",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "publishTime", "type": {"type": "long", "logicalType": "timestamp-micros"}},
+		{"name": "attributes", "type": {"type": "map", "values": "string"}},
+		{"name": "payload", "type": "bytes"}
+	]
+}`
+
+// avroEnvelopeSchema is the parsed AvroEnvelopeSchema.
+var avroEnvelopeSchema *avro.Schema
+
+func init() {
+	var err error
+	avroEnvelopeSchema, err = avro.ParseSchema([]byte(AvroEnvelopeSchema))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// avroSchemas caches the configured schemas, so a schema is read once per instance instead of once per batch.
+var (
+	avroSchemas    = make(map[string]*avro.Schema)
+	avroSchemasMtx sync.Mutex
+)
+
+// LoadAvroSchema reads and parses the Avro schema at the given source (see ReadConfigSource).
+// The schema is cached, so it is read only once.
+// An error is returned if the schema could not be read or is not valid.
+func LoadAvroSchema(ctx context.Context, source string) (*avro.Schema, error) {
+	avroSchemasMtx.Lock()
+	defer avroSchemasMtx.Unlock()
+
+	if schema, ok := avroSchemas[source]; ok {
+		return schema, nil
+	}
+
+	data, err := ReadConfigSource(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("Error during reading Avro schema '%s'. %s", source, err)
+	}
+
+	schema, err := avro.ParseSchema(data)
+	if err != nil {
+		return nil, err
+	}
+
+	avroSchemas[source] = schema
+	return schema, nil
+}
+
+// avroEncoder encodes a batch of messages into an Avro container file.
+type avroEncoder struct {
+	buf      bytes.Buffer
+	writer   *avro.Writer
+	envelope bool // whether the records are message envelopes, or the JSON payloads
+}
+
+// newAvroEncoder creates an encoder of the Avro format configuration. If a schema is configured, the records are
+// the JSON payloads of the messages, otherwise they are the message envelopes (see AvroEnvelopeSchema).
+func newAvroEncoder(ctx context.Context, conf PersistConf) (BatchEncoder, error) {
+	encoder := &avroEncoder{envelope: conf.Avro.Schema == ""}
+
+	schema := avroEnvelopeSchema
+	if !encoder.envelope {
+		var err error
+		schema, err = LoadAvroSchema(ctx, conf.Avro.Schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writer, err := avro.NewWriter(&encoder.buf, schema, conf.Avro.Codec)
+	if err != nil {
+		return nil, err
+	}
+	encoder.writer = writer
+	return encoder, nil
+}
+
+// Add encodes a message as a record of the batch.
+func (encoder *avroEncoder) Add(msg Message) error {
+	var record interface{}
+	if encoder.envelope {
+		attributes := msg.Attributes
+		if attributes == nil {
+			attributes = map[string]string{}
+		}
+		var publishTime int64
+		if !msg.PublishTime.IsZero() {
+			publishTime = msg.PublishTime.UnixNano() / 1000
+		}
+		record = map[string]interface{}{
+			"id":          msg.ID,
+			"publishTime": publishTime,
+			"attributes":  attributes,
+			"payload":     msg.Data,
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(msg.Data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&record); err != nil {
+			return &SchemaMismatchError{Format: FormatAvro, Err: fmt.Errorf("Payload is not valid JSON. %s", err)}
+		}
+	}
+
+	if err := encoder.writer.Append(record); err != nil {
+		if _, ok := err.(*avro.TypeError); ok {
+			return &SchemaMismatchError{Format: FormatAvro, Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+// Size returns the size of the encoded records.
+func (encoder *avroEncoder) Size() int64 {
+	return encoder.writer.Size()
+}
+
+// Close writes the remaining records and returns the content of the file.
+func (encoder *avroEncoder) Close() ([]byte, error) {
+	if err := encoder.writer.Close(); err != nil {
+		return nil, err
+	}
+	return encoder.buf.Bytes(), nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/avro"
+)
+
+// orderSchema is a user-supplied schema of JSON payloads, with a nested record, an enum, a nullable field and a default value.
+const orderSchema = `{
+	"type": "record",
+	"name": "Order",
+	"namespace": "io.syntio.test",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "PAID"]}},
+		{"name": "customer", "type": {"type": "record", "name": "Customer", "fields": [{"name": "name", "type": "string"}]}},
+		{"name": "note", "type": ["null", "string"]},
+		{"name": "quantity", "type": "int", "default": 1},
+		{"name": "tags", "type": {"type": "array", "items": "string"}, "default": []}
+	]
+}`
+
+// readAvro reads all of the records of a container file.
+func readAvro(t *testing.T, data []byte) (*avro.Reader, []interface{}) {
+	t.Helper()
+
+	reader, err := avro.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []interface{}
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return reader, records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+}
+
+func TestProcessMessageAvroBatch(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+
+	schemaPath := filepath.Join(t.TempDir(), "order.avsc")
+	if err := ioutil.WriteFile(schemaPath, []byte(orderSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := PersistConf{
+		Storage:     StorageInfo{BucketID: "bucket", Prefix: "orders", Extension: "avro", Format: FormatAvro},
+		Quarantine:  QuarantineInfo{BucketID: "quarantine"},
+		BatchOutput: BatchOutputInfo{MaxMessages: 2, MaxBytes: 1 << 20},
+		Avro:        AvroInfo{Codec: avro.CodecSnappy, Schema: schemaPath},
+	}
+	report := NewRunReport()
+	results := make(chan error, 3)
+	for i, data := range []string{
+		`{"id": 1, "status": "NEW", "customer": {"name": "Ana"}}`,
+		`{"id": 2, "status": "UNKNOWN", "customer": {"name": "Ivo"}}`,
+		`{"id": 3, "status": "PAID", "customer": {"name": "Eva"}, "note": "gift"}`,
+	} {
+		msg := Message{ID: string(rune('1' + i)), Data: []byte(data)}
+		ProcessMessageAsync(context.Background(), msg, conf, report, func(err error) { results <- err })
+	}
+
+	// The message which does not match the schema is quarantined, while the other two fill a batch which is written.
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("result error = %v, want nil", err)
+		}
+	}
+	quarantined := gcs.Names("quarantine")
+	if len(quarantined) != 1 || !strings.Contains(quarantined[0], ReasonSchemaMismatch) {
+		t.Errorf("quarantined objects = %v, want 1 with the %s reason", quarantined, ReasonSchemaMismatch)
+	}
+	names := gcs.Names("bucket")
+	if len(names) != 1 || !strings.HasSuffix(names[0], ".avro") {
+		t.Fatalf("stored objects = %v, want 1 batch file", names)
+	}
+	object, _ := gcs.Object("bucket", names[0])
+	_, records := readAvro(t, object.Data)
+	if len(records) != 2 {
+		t.Fatalf("read %d records, want 2", len(records))
+	}
+	if note := records[1].(map[string]interface{})["note"]; note != "gift" {
+		t.Errorf("note = %v, want gift", note)
+	}
+	if report.Persisted != 2 {
+		t.Errorf("persisted = %d, want 2", report.Persisted)
+	}
+}
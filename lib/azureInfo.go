@@ -0,0 +1,64 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AzureInfo represents Azure Blob Storage configuration.
+// It holds information needed for storing objects in the containers given as azblob://container destinations.
+// The requests are authorized with the account key (Shared Key) or, if it is not set, with a SAS token.
+type AzureInfo struct {
+	Endpoint    string // URL of the Blob service (e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite), the public endpoint of the account if empty
+	AccountName string // name of the storage account
+	AccountKey  []byte // decoded account key
+	SASToken    string // shared access signature, used if the account key is not set
+	BlockSize   int    // size of the staged blocks in MB, blobs larger than a block are written in blocks
+}
+
+// SetAzureInfo sets the parameters of an Azure configuration by extracting values from the corresponding environment variables.
+// An error is returned if any errors occur during the function execution.
+func SetAzureInfo(azureInfo *AzureInfo) error {
+	var err error
+
+	azureInfo.AccountName, err = getEnvVariable("AZURE_STORAGE_ACCOUNT")
+	if err != nil {
+		return err
+	}
+	azureInfo.Endpoint = getOptionalEnvVariable("AZURE_STORAGE_ENDPOINT", fmt.Sprintf("https://%s.blob.core.windows.net", azureInfo.AccountName))
+
+	azureInfo.AccountKey, err = base64.StdEncoding.DecodeString(getOptionalEnvVariable("AZURE_STORAGE_KEY", ""))
+	if err != nil {
+		return fmt.Errorf("Invalid Azure account key. %s", err)
+	}
+	azureInfo.SASToken = strings.TrimPrefix(getOptionalEnvVariable("AZURE_STORAGE_SAS_TOKEN", ""), "?")
+	if len(azureInfo.AccountKey) == 0 && azureInfo.SASToken == "" {
+		return fmt.Errorf("Azure credentials are not set (AZURE_STORAGE_KEY or AZURE_STORAGE_SAS_TOKEN)")
+	}
+
+	azureInfo.BlockSize, err = strconv.Atoi(getOptionalEnvVariable("AZURE_BLOCK_SIZE", "16"))
+	if err != nil {
+		return err
+	}
+	if azureInfo.BlockSize < 1 || azureInfo.BlockSize > 4000 {
+		return fmt.Errorf("Azure block size must be between 1 and 4000 MB")
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// azureVersion is the version of the Blob service REST API used by the sink.
+	azureVersion = "2019-12-12"
+	// azureRequestTimeout is the timeout of a single request to the Blob service.
+	azureRequestTimeout = 30 * time.Second
+)
+
+// AzureSink writes objects as block blobs to a container of Azure Blob Storage. Objects larger than the block size
+// are staged in blocks, which are committed with a block list.
+type AzureSink struct {
+	info      AzureInfo
+	container string
+	endpoint  *url.URL
+	client    *http.Client
+}
+
+// NewAzureSink creates a sink of the given container.
+// An error is returned if the endpoint of the configuration is not a valid URL.
+func NewAzureSink(info AzureInfo, container string) (*AzureSink, error) {
+	endpoint, err := url.Parse(info.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid Azure endpoint '%s'", info.Endpoint)
+	}
+
+	return &AzureSink{
+		info:      info,
+		container: container,
+		endpoint:  endpoint,
+		client:    &http.Client{Timeout: azureRequestTimeout},
+	}, nil
+}
+
+// WriteObject writes a blob to the container. The metadata is stored as the blob metadata (x-ms-meta-* headers).
+// Since the metadata names must be C# identifiers, the characters which are not allowed (e.g. - in event-type)
+// are replaced with _xHH_, where HH is their hex code, and the values which are not printable ASCII are encoded
+// as described in RFC 2047.
+func (sink *AzureSink) WriteObject(ctx context.Context, objectName string, data []byte, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	header := make(http.Header)
+	for key, value := range metadata {
+		for _, c := range value {
+			if c < ' ' || c >= 0x7f {
+				value = mime.QEncoding.Encode("utf-8", value)
+				break
+			}
+		}
+		header.Set("x-ms-meta-"+azureMetadataName(key), value)
+	}
+
+	var response http.Header
+	var err error
+	if len(data) <= sink.info.BlockSize<<20 {
+		header.Set("x-ms-blob-type", "BlockBlob")
+		response, err = sink.do(ctx, http.MethodPut, objectName, nil, header, data)
+	} else {
+		response, err = sink.putBlocks(ctx, objectName, header, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.ObjectAttrs{
+		Bucket:   SchemeAzure + "://" + sink.container,
+		Name:     objectName,
+		Size:     int64(len(data)),
+		Etag:     response.Get("ETag"),
+		Metadata: metadata,
+	}, nil
+}
+
+// putBlocks stages the data in blocks and commits them, together with the metadata, as the content of the blob.
+// The blocks which are staged but never committed (e.g. after a failure) are removed by the service.
+func (sink *AzureSink) putBlocks(ctx context.Context, objectName string, header http.Header, data []byte) (http.Header, error) {
+	blockSize := sink.info.BlockSize << 20
+
+	var blockList struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}
+	for offset := 0; offset < len(data); offset += blockSize {
+		end := offset + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		// The IDs of all of the blocks of a blob must have the same length.
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", len(blockList.Latest))))
+		query := url.Values{"comp": {"block"}, "blockid": {blockID}}
+		if _, err := sink.do(ctx, http.MethodPut, objectName, query, nil, data[offset:end]); err != nil {
+			return nil, err
+		}
+		blockList.Latest = append(blockList.Latest, blockID)
+	}
+
+	body, err := xml.Marshal(blockList)
+	if err != nil {
+		return nil, err
+	}
+	return sink.do(ctx, http.MethodPut, objectName, url.Values{"comp": {"blocklist"}}, header, append([]byte(xml.Header), body...))
+}
+
+// do sends an authorized request for a blob and returns the response header.
+// An *ObjectStoreError is returned if the service responds with an error status.
+func (sink *AzureSink) do(ctx context.Context, method string, objectName string, query url.Values, header http.Header, body []byte) (http.Header, error) {
+	blobURL := *sink.endpoint
+	blobURL.Path = strings.TrimSuffix(blobURL.Path, "/") + "/" + sink.container + "/" + objectName
+	blobURL.RawPath = uriEscape(blobURL.Path, false)
+	blobURL.RawQuery = query.Encode()
+	if len(sink.info.AccountKey) == 0 {
+		blobURL.RawQuery = strings.TrimPrefix(blobURL.RawQuery+"&"+sink.info.SASToken, "&")
+	}
+
+	request, err := http.NewRequest(method, blobURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	request.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	request.Header.Set("x-ms-version", azureVersion)
+	if len(sink.info.AccountKey) > 0 {
+		sink.info.sign(request, len(body))
+	}
+
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		storeErr := &ObjectStoreError{StatusCode: response.StatusCode, Code: response.Header.Get("x-ms-error-code"), Message: http.StatusText(response.StatusCode)}
+		var xmlErr struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(data, &xmlErr) == nil && xmlErr.Code != "" {
+			storeErr.Code = xmlErr.Code
+			storeErr.Message = xmlErr.Message
+		}
+		return nil, storeErr
+	}
+	return response.Header, nil
+}
+
+// sign authorizes a request with the account key (Shared Key authorization).
+func (info AzureInfo) sign(request *http.Request, contentLength int) {
+	length := ""
+	if contentLength > 0 {
+		length = strconv.Itoa(contentLength)
+	}
+
+	var msHeaders []string
+	for key, values := range request.Header {
+		if name := strings.ToLower(key); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + info.AccountName + request.URL.EscapedPath()
+	query := request.URL.Query()
+	var names []string
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+
+	header := request.Header
+	stringToSign := strings.Join([]string{
+		request.Method,
+		header.Get("Content-Encoding"),
+		header.Get("Content-Language"),
+		length,
+		header.Get("Content-MD5"),
+		header.Get("Content-Type"),
+		"", // the date is given in x-ms-date
+		header.Get("If-Modified-Since"),
+		header.Get("If-Match"),
+		header.Get("If-None-Match"),
+		header.Get("If-Unmodified-Since"),
+		header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, info.AccountKey)
+	mac.Write([]byte(stringToSign))
+	request.Header.Set("Authorization", "SharedKey "+info.AccountName+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// azureMetadataName converts a metadata key to a valid C# identifier, replacing the other characters with _xHH_.
+func azureMetadataName(key string) string {
+	var name strings.Builder
+	for i, c := range key {
+		if c == '_' || c < unicode.MaxASCII && (unicode.IsLetter(c) || i > 0 && unicode.IsDigit(c)) {
+			name.WriteRune(c)
+			continue
+		}
+		for _, b := range []byte(string(c)) {
+			fmt.Fprintf(&name, "_x%02X_", b)
+		}
+	}
+	return name.String()
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// startAzure starts a fake Azure server and returns a sink of the given container which writes to it.
+// The returned function stops the server.
+func startAzure(t *testing.T, container string) (*sinktest.AzureServer, *AzureSink, func()) {
+	t.Helper()
+
+	key := []byte("test-account-key")
+	server := sinktest.NewAzureServer("account", base64.StdEncoding.EncodeToString(key))
+	sink, err := NewAzureSink(AzureInfo{
+		Endpoint:    server.Endpoint(),
+		AccountName: "account",
+		AccountKey:  key,
+		BlockSize:   1,
+	}, container)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return server, sink, server.Close
+}
+
+func TestAzureSinkPutBlob(t *testing.T) {
+	server, sink, stop := startAzure(t, "container")
+	defer stop()
+
+	attrs, err := sink.WriteObject(context.Background(), "dir/msg 1.txt", []byte("data"), map[string]string{"origin": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Bucket != "azblob://container" || attrs.Name != "dir/msg 1.txt" || attrs.Size != 4 || attrs.Etag == "" {
+		t.Errorf("Unexpected attributes %+v", attrs)
+	}
+
+	blob, ok := server.Blob("container", "dir/msg 1.txt")
+	if !ok {
+		t.Fatal("Blob was not written")
+	}
+	if string(blob.Data) != "data" || blob.Blocks != 0 || blob.ETag != attrs.Etag {
+		t.Errorf("Unexpected blob %+v", blob)
+	}
+	if blob.Metadata["origin"] != "test" {
+		t.Errorf("Unexpected metadata %v", blob.Metadata)
+	}
+}
+
+func TestAzureSinkPutBlocks(t *testing.T) {
+	server, sink, stop := startAzure(t, "container")
+	defer stop()
+
+	var requests []string
+	server.Fail = func(r *http.Request) int {
+		requests = append(requests, r.URL.Query().Get("comp"))
+		return 0
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), (5<<20)/10)
+	if _, err := sink.WriteObject(context.Background(), "large", data, map[string]string{"event-type": "created"}); err != nil {
+		t.Fatal(err)
+	}
+
+	blob, ok := server.Blob("container", "large")
+	if !ok {
+		t.Fatal("Blob was not written")
+	}
+	if blob.Blocks != 5 || !bytes.Equal(blob.Data, data) {
+		t.Errorf("Blob was not written in blocks (%d blocks, %d of %d bytes)", blob.Blocks, len(blob.Data), len(data))
+	}
+	// The metadata is set when the block list is committed.
+	if blob.Metadata["event_x2d_type"] != "created" {
+		t.Errorf("Unexpected metadata %v", blob.Metadata)
+	}
+	want := []string{"block", "block", "block", "block", "block", "blocklist"}
+	if len(requests) != len(want) {
+		t.Fatalf("Got requests %v, want %v", requests, want)
+	}
+	for i := range want {
+		if requests[i] != want[i] {
+			t.Fatalf("Got requests %v, want %v", requests, want)
+		}
+	}
+}
+
+func TestAzureSinkFailedBlock(t *testing.T) {
+	server, sink, stop := startAzure(t, "container")
+	defer stop()
+
+	server.Fail = func(r *http.Request) int {
+		if r.URL.Query().Get("comp") == "block" {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+
+	_, err := sink.WriteObject(context.Background(), "large", make([]byte, 2<<20), nil)
+	if err == nil {
+		t.Fatal("Failed block did not fail the write")
+	}
+	if !IsRetryable(err) {
+		t.Errorf("Error %s is not retryable", err)
+	}
+	if _, ok := server.Blob("container", "large"); ok {
+		t.Error("Blob was committed although a block failed")
+	}
+}
+
+func TestAzureSinkInvalidKey(t *testing.T) {
+	server, _, stop := startAzure(t, "container")
+	defer stop()
+
+	sink, err := NewAzureSink(AzureInfo{Endpoint: server.Endpoint(), AccountName: "account", AccountKey: []byte("wrong"), BlockSize: 1}, "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sink.WriteObject(context.Background(), "msg", []byte("data"), nil); err == nil || IsRetryable(err) {
+		t.Errorf("Rejected signature did not cause a permanent error (%v)", err)
+	}
+}
+
+func TestAzureMetadataName(t *testing.T) {
+	tests := map[string]string{
+		"origin":     "origin",
+		"_private":   "_private",
+		"eventType2": "eventType2",
+		"event-type": "event_x2D_type",
+		"2nd":        "_x32_nd",
+		"a.b c":      "a_x2E_b_x20_c",
+		"čas":        "_xC4__x8D_as",
+	}
+	for key, want := range tests {
+		if got := azureMetadataName(key); got != want {
+			t.Errorf("Key '%s': got '%s', want '%s'", key, got, want)
+		}
+	}
+}
+
+func TestAzureSinkMetadataValues(t *testing.T) {
+	server, sink, stop := startAzure(t, "container")
+	defer stop()
+
+	if _, err := sink.WriteObject(context.Background(), "msg", []byte("data"), map[string]string{"name": "Zürich", "event-type": "created"}); err != nil {
+		t.Fatal(err)
+	}
+	blob, _ := server.Blob("container", "msg")
+	if got, want := blob.Metadata["name"], "=?utf-8?q?Z=C3=BCrich?="; got != want {
+		t.Errorf("Got '%s', want '%s'", got, want)
+	}
+	if got := blob.Metadata["event_x2d_type"]; got != "created" {
+		t.Errorf("Mangled metadata name was not stored, got %v", blob.Metadata)
+	}
+}
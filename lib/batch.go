@@ -0,0 +1,108 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// BatchFormatNDJSON stores one record per line. The records must not contain new lines (e.g. JSON envelopes).
+	BatchFormatNDJSON = "ndjson"
+	// BatchFormatLengthPrefixed stores each record after its length, given as a 4 byte big-endian integer.
+	BatchFormatLengthPrefixed = "length-prefixed"
+
+	// maxRecordSize is the maximum size of a single record (the maximum size of a Pub/Sub message is 10 MB).
+	maxRecordSize = 64 << 20
+)
+
+// WriteRecord writes a single record to a batch in the given format.
+// An error is returned if the format is unknown or if the record can not be stored in the format.
+func WriteRecord(w io.Writer, format string, record []byte) error {
+	switch format {
+	case BatchFormatNDJSON:
+		if bytes.IndexByte(record, '\n') >= 0 {
+			return fmt.Errorf("Record contains a new line and can not be stored in the %s format", format)
+		}
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+		_, err := w.Write([]byte{'\n'})
+		return err
+
+	case BatchFormatLengthPrefixed:
+		var prefix [4]byte
+		binary.BigEndian.PutUint32(prefix[:], uint32(len(record)))
+		if _, err := w.Write(prefix[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(record)
+		return err
+	}
+
+	return fmt.Errorf("Unknown batch format '%s'", format)
+}
+
+// BatchReader reads the records of a batch written by WriteRecord.
+type BatchReader struct {
+	format string
+	reader *bufio.Reader
+}
+
+// NewBatchReader creates a reader of a batch in the given format.
+// An error is returned if the format is unknown.
+func NewBatchReader(r io.Reader, format string) (*BatchReader, error) {
+	if format != BatchFormatNDJSON && format != BatchFormatLengthPrefixed {
+		return nil, fmt.Errorf("Unknown batch format '%s'", format)
+	}
+	return &BatchReader{format: format, reader: bufio.NewReaderSize(r, 64<<10)}, nil
+}
+
+// Next returns the next record of the batch, or io.EOF if there are no more records.
+func (batch *BatchReader) Next() ([]byte, error) {
+	if batch.format == BatchFormatNDJSON {
+		record, err := batch.reader.ReadBytes('\n')
+		if err == io.EOF && len(record) > 0 {
+			return record, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return record[:len(record)-1], nil
+	}
+
+	var prefix [4]byte
+	if _, err := io.ReadFull(batch.reader, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("Record size %d exceeds the maximum record size", size)
+	}
+
+	record := make([]byte, size)
+	if _, err := io.ReadFull(batch.reader, record); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return record, nil
+}
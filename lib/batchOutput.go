@@ -0,0 +1,350 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ReasonSchemaMismatch is the quarantine reason of messages which do not match the schema of their batched format.
+const ReasonSchemaMismatch = "schema-mismatch"
+
+// SchemaMismatchError is returned by a batch encoder if a message does not match the schema of the format.
+type SchemaMismatchError struct {
+	Format string
+	Err    error
+}
+
+func (err *SchemaMismatchError) Error() string {
+	return fmt.Sprintf("Message does not match the %s schema. %s", err.Format, err.Err)
+}
+
+// Unwrap returns the wrapped error.
+func (err *SchemaMismatchError) Unwrap() error {
+	return err.Err
+}
+
+// BatchEncoder encodes the messages of a batch into a single file of a batched format.
+type BatchEncoder interface {
+	// Add encodes a message into the batch. If the message can not be stored in the format (e.g. its payload
+	// does not match the schema), a *SchemaMismatchError is returned and the message is not added.
+	Add(msg Message) error
+	// Size returns the size of the encoded messages in bytes (before compression).
+	Size() int64
+	// Close finishes the batch and returns the content of the file.
+	Close() ([]byte, error)
+}
+
+// batchEncoders maps the batched formats to the functions creating their encoders.
+var batchEncoders = map[string]func(ctx context.Context, conf PersistConf) (BatchEncoder, error){
+	FormatAvro:    newAvroEncoder,
+	FormatParquet: newParquetEncoder,
+}
+
+// IsBatchFormat reports whether the messages are stored in batch files in the given format, instead of a file per message.
+func IsBatchFormat(format string) bool {
+	_, ok := batchEncoders[format]
+	return ok
+}
+
+// batchFormats returns the names of the batched formats.
+func batchFormats() []string {
+	var formats []string
+	for format := range batchEncoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// outputBatch is a batch file which is not written yet.
+type outputBatch struct {
+	conf          PersistConf  // configuration with which the messages were processed
+	encoder       BatchEncoder // encoder holding the encoded messages
+	partitionTime time.Time    // time at which the batch was started, which decides its partition
+	entries       []batchEntry // messages of the batch, in the order of their records
+}
+
+// batchEntry is a message added to a batch.
+type batchEntry struct {
+	msg    Message
+	route  string      // route by which the message is stored
+	report *RunReport  // report of the run in which the message was received
+	done   func(error) // called with the result of the message once the batch is written
+}
+
+// batches holds the pending batches mapped by their storage configuration (without a message ID).
+var (
+	batches    = make(map[StorageInfo]*outputBatch)
+	batchesMtx sync.Mutex
+)
+
+// addToBatch encodes a message into the pending batch of its storage configuration. The message is acknowledged
+// (its part of the ack group is done) only when the batch is written. A batch is written as soon as it reaches the
+// size limits, or when it is flushed. A batch of a previous hour is written before the message is added,
+// so each batch file contains the messages of a single partition.
+// Returned result is nil if the message was added to the batch or quarantined, or an error if it should be redelivered.
+func addToBatch(ctx context.Context, msg Message, info StorageInfo, route string, conf PersistConf, report *RunReport, group *ackGroup) error {
+	info.MessageID = ""
+	now := time.Now()
+
+	batchesMtx.Lock()
+	var full []*outputBatch
+	batch := batches[info]
+	if batch != nil && !PartitionHour(batch.partitionTime).Equal(PartitionHour(now)) {
+		full = append(full, batch)
+		batch = nil
+	}
+	if batch == nil {
+		encoder, err := batchEncoders[info.Format](ctx, conf)
+		if err != nil {
+			delete(batches, info)
+			batchesMtx.Unlock()
+			writeOutputBatches(ctx, info, full)
+
+			// The encoder could not be created (e.g. the schema could not be loaded), so the message is redelivered.
+			log.Printf("Error during creating %s batch. %s.\n", info.Format, err)
+			report.CountFailed()
+			return err
+		}
+		batch = &outputBatch{conf: conf, encoder: encoder, partitionTime: now}
+	}
+
+	err := batch.encoder.Add(msg)
+	if err == nil {
+		batch.entries = append(batch.entries, batchEntry{msg: msg, route: route, report: report, done: group.add()})
+		group.batches = append(group.batches, groupBatch{info: info, batch: batch})
+	}
+	if len(batch.entries) >= conf.BatchOutput.MaxMessages || batch.encoder.Size() >= conf.BatchOutput.MaxBytes {
+		full = append(full, batch)
+		delete(batches, info)
+	} else {
+		batches[info] = batch
+	}
+	batchesMtx.Unlock()
+
+	writeOutputBatches(ctx, info, full)
+
+	if mismatch, ok := err.(*SchemaMismatchError); ok {
+		return quarantine(ctx, msg, ReasonSchemaMismatch, mismatch, conf, report)
+	}
+	if err != nil {
+		log.Printf("Error during encoding message '%s' in the %s format. %s.\n", msg.ID, info.Format, err)
+		return handleFailure(ctx, msg, err, conf, report)
+	}
+	return nil
+}
+
+// FlushBatches writes the pending batches. The messages of a batch which could not be written are
+// handled by HandleFailure, so they are quarantined or redelivered.
+// An error is returned if any of the batches could not be written.
+func FlushBatches(ctx context.Context) error {
+	batchesMtx.Lock()
+	pending := batches
+	batches = make(map[StorageInfo]*outputBatch)
+	batchesMtx.Unlock()
+
+	var firstErr error
+	for info, batch := range pending {
+		err := writeOutputBatch(ctx, info, batch)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// flushGroupBatches writes the pending batches to which the messages of the ack group were added, leaving the
+// other batches pending. A batch which was already written (e.g. because it was full) is skipped.
+// An error is returned if any of the batches could not be written.
+func flushGroupBatches(ctx context.Context, group *ackGroup) error {
+	batchesMtx.Lock()
+	var pending []groupBatch
+	for _, added := range group.batches {
+		if batches[added.info] == added.batch {
+			delete(batches, added.info)
+			pending = append(pending, added)
+		}
+	}
+	batchesMtx.Unlock()
+
+	var firstErr error
+	for _, added := range pending {
+		err := writeOutputBatch(ctx, added.info, added.batch)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// writeOutputBatches writes the given batches, logging their errors.
+func writeOutputBatches(ctx context.Context, info StorageInfo, full []*outputBatch) {
+	for _, batch := range full {
+		if err := writeOutputBatch(ctx, info, batch); err != nil {
+			log.Printf("Error during writing %s batch. %s.\n", info.Format, err)
+		}
+	}
+}
+
+// writeOutputBatch writes a batch file named after its first message, with its format and number of messages as metadata,
+// and takes the steps which follow storing for each of its messages (notification, index entry, BigQuery row, counting). The messages are then acknowledged, or, if the
+// BigQuery sink is configured, they are acknowledged once their rows are inserted or dead-lettered.
+// If the file could not be written or its notification could not be published, the error is returned
+// after the messages are handled by HandleFailure or redelivered.
+func writeOutputBatch(ctx context.Context, info StorageInfo, batch *outputBatch) error {
+	if len(batch.entries) == 0 {
+		return nil
+	}
+
+	conf := batch.conf
+	report := batch.entries[0].report
+	msgs := make([]Message, len(batch.entries))
+	for i, entry := range batch.entries {
+		msgs[i] = entry.msg
+	}
+
+	info.MessageID = msgs[0].ID
+	objectName := fileName(info, batch.partitionTime)
+	// As for the batch files of a compaction, the metadata lets the partition manifests count the messages
+	// and the stored readers decode the file.
+	metadata := map[string]string{
+		"batchFormat":  info.Format,
+		"messageCount": strconv.Itoa(len(msgs)),
+	}
+
+	var attrs *storage.ObjectAttrs
+	data, err := batch.encoder.Close()
+	if err == nil {
+		write := func(ctx context.Context, destination StorageInfo) (*storage.ObjectAttrs, error) {
+			sink, err := GetSink(destination.BucketID)
+			if err != nil {
+				return nil, err
+			}
+			return sink.WriteObject(ctx, objectName, data, metadata)
+		}
+
+		if conf.FanOut.Enabled() {
+			attrs, err = writeFanOut(ctx, fmt.Sprintf("batch '%s'", objectName), info, conf.FanOut, report, write)
+		} else {
+			attrs, err = write(ctx, info)
+		}
+	}
+	if err != nil {
+		log.Printf("Error during storing batch '%s' of %d messages. %s.\n", objectName, len(msgs), err)
+		for _, entry := range batch.entries {
+			entry.done(handleFailure(ctx, entry.msg, err, conf, entry.report))
+		}
+		return err
+	}
+
+	if conf.Notification.Enabled() {
+		err = Notify(ctx, newPersistedEvent(attrs, batch.partitionTime, msgs...), conf.Notification)
+		if err != nil {
+			// The messages are already stored, so they are redelivered instead of being quarantined.
+			log.Printf("Error during publishing notification for batch '%s'. %s.\n", objectName, err)
+			for _, entry := range batch.entries {
+				entry.report.CountFailed()
+				entry.done(err)
+			}
+			return err
+		}
+	}
+
+	indexBucketID := conf.Index.BucketID
+	if conf.Routing.Enabled() || conf.FanOut.Enabled() {
+		indexBucketID = attrs.Bucket
+	}
+	for i, entry := range batch.entries {
+		if conf.Index.Enabled && IsGCSDestination(indexBucketID) {
+			addIndexEntry(indexBucketID, IndexEntry{
+				MessageID:  entry.msg.ID,
+				Object:     attrs.Name,
+				Generation: attrs.Generation,
+				Partition:  path.Dir(attrs.Name),
+				Record:     i,
+				Length:     attrs.Size,
+				Batch:      info.Format,
+			})
+		}
+		if entry.route != "" {
+			entry.report.CountRouted(entry.route)
+		}
+		entry.report.CountPersisted()
+		if conf.BigQuery.Enabled() {
+			// The message is acknowledged once its row is inserted or dead-lettered.
+			addBigQueryRow(ctx, entry.msg, objectURI(attrs), conf.BigQuery, conf.Quarantine, entry.done)
+		} else {
+			entry.done(nil)
+		}
+	}
+	return nil
+}
+
+// ackGroup collects the results of the messages into which a received message was split (a single message
+// if it was not split), some of which may be stored in batches. The received message is acknowledged or
+// redelivered once all of the results are known, and the first error decides its result.
+type ackGroup struct {
+	mtx     sync.Mutex
+	pending int
+	err     error
+	done    func(error)
+	batches []groupBatch // batches to which the messages were added, guarded by batchesMtx
+}
+
+// groupBatch is a batch to which a message of an ack group was added, with its storage configuration.
+type groupBatch struct {
+	info  StorageInfo
+	batch *outputBatch
+}
+
+// newAckGroup creates an ack group which calls the done function with the result of the received message.
+// The group starts with a single pending result, which is the result of processing the message.
+func newAckGroup(done func(error)) *ackGroup {
+	return &ackGroup{pending: 1, done: done}
+}
+
+// add adds a pending result and returns the function which sets it.
+func (group *ackGroup) add() func(error) {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+
+	group.pending++
+	return group.finish
+}
+
+// finish sets one of the pending results.
+func (group *ackGroup) finish(err error) {
+	group.mtx.Lock()
+	if err != nil && group.err == nil {
+		group.err = err
+	}
+	group.pending--
+	last := group.pending == 0
+	group.mtx.Unlock()
+
+	if last {
+		group.done(group.err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	defaultBatchMaxMessages   = 1000
+	defaultBatchMaxSize       = 64
+	defaultBatchFlushInterval = 60
+)
+
+// BatchOutputInfo represents batched output configuration.
+// It holds the limits of the batch files in which the messages are stored if a batched format (e.g. Avro) is chosen.
+type BatchOutputInfo struct {
+	MaxMessages   int   // maximum number of messages in a single batch file
+	MaxBytes      int64 // maximum size of a single batch file in bytes (the size of the encoded messages before compression)
+	FlushInterval int   // interval in seconds at which a continuous pull writes the pending batches
+}
+
+// SetBatchOutputInfo sets the parameters of a batched output configuration by extracting values from the corresponding environment variables.
+// An error is returned if any errors occur during the function execution.
+func SetBatchOutputInfo(batchOutputInfo *BatchOutputInfo) error {
+	var err error
+
+	batchOutputInfo.MaxMessages, err = strconv.Atoi(getOptionalEnvVariable("BATCH_MAX_MESSAGES", strconv.Itoa(defaultBatchMaxMessages)))
+	if err != nil {
+		return err
+	}
+	if batchOutputInfo.MaxMessages < 1 {
+		return fmt.Errorf("Maximum number of messages in a batch must be positive")
+	}
+
+	maxSize, err := strconv.Atoi(getOptionalEnvVariable("BATCH_MAX_SIZE", strconv.Itoa(defaultBatchMaxSize)))
+	if err != nil {
+		return err
+	}
+	if maxSize < 1 {
+		return fmt.Errorf("Maximum size of a batch must be at least 1 MB")
+	}
+	batchOutputInfo.MaxBytes = int64(maxSize) << 20
+
+	batchOutputInfo.FlushInterval, err = strconv.Atoi(getOptionalEnvVariable("BATCH_FLUSH_INTERVAL", strconv.Itoa(defaultBatchFlushInterval)))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/avro"
+	"github.com/syntio/aquarium-persistor-gcp/lib/parquet"
+)
+
+// processBatch processes the payloads as messages with the IDs 1, 2 and so on, which fill a single batch file.
+func processBatch(t *testing.T, conf PersistConf, payloads ...string) {
+	t.Helper()
+
+	conf.BatchOutput = BatchOutputInfo{MaxMessages: len(payloads), MaxBytes: 1 << 20}
+	results := make(chan error, len(payloads))
+	for i, data := range payloads {
+		msg := Message{ID: string(rune('1' + i)), Data: []byte(data), Attributes: map[string]string{"position": string(rune('1' + i))}}
+		ProcessMessageAsync(context.Background(), msg, conf, NewRunReport(), func(err error) { results <- err })
+	}
+	for range payloads {
+		if err := <-results; err != nil {
+			t.Fatalf("result error = %v, want nil", err)
+		}
+	}
+}
+
+func TestBatchedOutputReadBack(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopPubsub := startPubsub(t, "project", "replayed")
+	defer stopPubsub()
+
+	conf := PersistConf{
+		Storage:    StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "avro", Format: FormatAvro},
+		Quarantine: QuarantineInfo{BucketID: "quarantine"},
+		Avro:       AvroInfo{Codec: avro.CodecDeflate},
+		Index:      IndexInfo{Enabled: true, BucketID: "bucket"},
+	}
+	now := time.Now()
+	processBatch(t, conf, `{"n": 1}`, `{"n": 2}`, `{"n": 3}`)
+	if err := FlushIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	names := gcs.Names("bucket")
+	object, ok := gcs.Object("bucket", path.Join(PartitionFolder(now), "msg-1.avro"))
+	if !ok {
+		t.Fatalf("stored objects = %v, want the batch file of the first message", names)
+	}
+	if object.Metadata["batchFormat"] != FormatAvro || object.Metadata["messageCount"] != "3" {
+		t.Errorf("metadata = %v, want the avro batch format and 3 messages", object.Metadata)
+	}
+
+	// The manifest counts the messages of the batch file.
+	manifest, err := ClosePartition(context.Background(), "bucket", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ObjectCount != 1 || manifest.RecordCount != 3 {
+		t.Errorf("manifest counts %d objects and %d records, want 1 and 3", manifest.ObjectCount, manifest.RecordCount)
+	}
+
+	// The messages are replayed one by one, with their attributes.
+	report, err := Replay(context.Background(), ReplayOptions{
+		BucketID:  "bucket",
+		Format:    FormatEnvelope,
+		From:      PartitionHour(now),
+		To:        PartitionHour(now).Add(time.Hour),
+		ProjectID: "project",
+		TopicID:   "replayed",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 1 || report.Messages != 3 {
+		t.Errorf("report = %+v, want 1 object with 3 messages", report)
+	}
+	if got := publishedData(server); !reflect.DeepEqual(got, []string{`{"n": 1}`, `{"n": 2}`, `{"n": 3}`}) {
+		t.Fatalf("published %v, want the 3 payloads", got)
+	}
+	for _, msg := range server.Messages() {
+		if msg.Attributes["position"] != string(msg.Data[6]) {
+			t.Errorf("attributes of %s = %v, want its position", msg.Data, msg.Attributes)
+		}
+	}
+
+	// The index locates a message by its record in the batch file.
+	result, err := LookupMessage(context.Background(), "bucket", FormatEnvelope, "2", now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Entry.Batch != FormatAvro || result.Entry.Record != 1 {
+		t.Errorf("entry = %+v, want record 1 of an avro batch", result.Entry)
+	}
+	if result.Message.ID != "2" || string(result.Message.Data) != `{"n": 2}` || result.Message.Attributes["position"] != "2" {
+		t.Errorf("message = %+v, want message 2", result.Message)
+	}
+
+	// Compaction leaves the batch file as it is.
+	compaction, err := Compact(context.Background(), CompactionOptions{BucketID: "bucket", Partition: PartitionFolder(now), Format: BatchFormatNDJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compaction.RecordCount != 0 || len(compaction.Batches) != 0 {
+		t.Errorf("compaction manifest = %+v, want no batches", compaction)
+	}
+}
+
+func TestBatchedOutputReadBackUnsupported(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+
+	dir := t.TempDir()
+	avroSchema := filepath.Join(dir, "order.avsc")
+	if err := ioutil.WriteFile(avroSchema, []byte(orderSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	parquetSchema := filepath.Join(dir, "orders.json")
+	if err := ioutil.WriteFile(parquetSchema, []byte(`{"columns": [{"name": "id", "type": "int64", "required": true}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The records of Avro files with a configured schema and of Parquet files do not hold the message IDs.
+	for _, conf := range []PersistConf{
+		{
+			Storage: StorageInfo{BucketID: "avro", Prefix: "msg", Extension: "avro", Format: FormatAvro},
+			Avro:    AvroInfo{Codec: avro.CodecNull, Schema: avroSchema},
+			Index:   IndexInfo{Enabled: true, BucketID: "avro"},
+		},
+		{
+			Storage: StorageInfo{BucketID: "parquet", Prefix: "msg", Extension: "parquet", Format: FormatParquet},
+			Parquet: ParquetInfo{Compression: parquet.Uncompressed, RowGroupSize: 1 << 20, Schema: parquetSchema},
+			Index:   IndexInfo{Enabled: true, BucketID: "parquet"},
+		},
+	} {
+		conf.Quarantine = QuarantineInfo{BucketID: "quarantine"}
+		now := time.Now()
+		processBatch(t, conf, `{"id": 1, "status": "NEW", "customer": {"name": "Ana"}}`, `{"id": 2, "status": "PAID", "customer": {"name": "Ivo"}}`)
+		if err := FlushIndex(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		bucketID := conf.Storage.BucketID
+		if names := gcs.Names("quarantine"); len(names) != 0 {
+			t.Fatalf("quarantined objects = %v, want none", names)
+		}
+
+		_, err := Replay(context.Background(), ReplayOptions{
+			BucketID:  bucketID,
+			Format:    FormatEnvelope,
+			From:      PartitionHour(now),
+			To:        PartitionHour(now).Add(time.Hour),
+			ProjectID: "project",
+			TopicID:   "replayed",
+			DryRun:    true,
+		})
+		if !errors.Is(err, ErrUnsupportedBatch) {
+			t.Errorf("Replay of the %s bucket error = %v, want ErrUnsupportedBatch", bucketID, err)
+		}
+		_, err = LookupMessage(context.Background(), bucketID, FormatEnvelope, "2", now.Add(-time.Hour), now.Add(time.Hour))
+		if !errors.Is(err, ErrUnsupportedBatch) {
+			t.Errorf("LookupMessage in the %s bucket error = %v, want ErrUnsupportedBatch", bucketID, err)
+		}
+	}
+}
+
+func TestProcessMessageWritesOwnBatch(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+
+	conf := PersistConf{
+		Storage:     StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "avro", Format: FormatAvro},
+		Quarantine:  QuarantineInfo{BucketID: "quarantine"},
+		BatchOutput: BatchOutputInfo{MaxMessages: 10, MaxBytes: 1 << 20},
+		Avro:        AvroInfo{Codec: avro.CodecNull},
+	}
+	other := conf
+	other.Storage.Prefix = "other"
+
+	// A message of another batch, e.g. of a concurrent request, is pending.
+	result := make(chan error, 1)
+	ProcessMessageAsync(context.Background(), Message{ID: "1", Data: []byte(`{"n": 1}`)}, other, NewRunReport(), func(err error) { result <- err })
+
+	if err := ProcessMessage(context.Background(), Message{ID: "2", Data: []byte(`{"n": 2}`)}, conf, NewRunReport()); err != nil {
+		t.Fatal(err)
+	}
+	names := gcs.Names("bucket")
+	if len(names) != 1 || path.Base(names[0]) != "msg-2.avro" {
+		t.Fatalf("stored objects = %v, want only the batch file of message 2", names)
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("message 1 was done with %v before its batch was written", err)
+	default:
+	}
+
+	if err := FlushBatches(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("result error = %v, want nil", err)
+	}
+	if names := gcs.Names("bucket"); len(names) != 2 {
+		t.Errorf("stored objects = %v, want 2 batch files", names)
+	}
+}
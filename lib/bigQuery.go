@@ -0,0 +1,325 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	bigquery "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+)
+
+const (
+	// ReasonBigQueryRejected is the quarantine (dead-letter) reason of messages whose rows were rejected by BigQuery.
+	ReasonBigQueryRejected = "bigquery-rejected"
+
+	// bigQueryInsertAttempts is the number of attempts of an insert request which fails with a retryable error.
+	bigQueryInsertAttempts = 3
+)
+
+// BigQuerySchema returns the schema of the table into which the rows are inserted, with the payload column of the given type.
+// The table can be created with this schema, e.g. partitioned by the publish time.
+func BigQuerySchema(payload string) *bigquery.TableSchema {
+	payloadType := "JSON"
+	if payload == BigQueryPayloadBytes {
+		payloadType = "BYTES"
+	}
+
+	return &bigquery.TableSchema{Fields: []*bigquery.TableFieldSchema{
+		{Name: "message_id", Type: "STRING", Mode: "REQUIRED"},
+		{Name: "publish_time", Type: "TIMESTAMP"},
+		{Name: "ordering_key", Type: "STRING"},
+		{Name: "attributes", Type: "RECORD", Mode: "REPEATED", Fields: []*bigquery.TableFieldSchema{
+			{Name: "key", Type: "STRING"},
+			{Name: "value", Type: "STRING"},
+		}},
+		{Name: "payload", Type: payloadType},
+		{Name: "object", Type: "STRING"},
+		{Name: "persisted_at", Type: "TIMESTAMP"},
+	}}
+}
+
+// bigQueryRow is a pending row, together with the message from which it was created.
+type bigQueryRow struct {
+	msg  Message
+	row  map[string]bigquery.JsonValue
+	done func(error) // called with the result of the message once the row is inserted or dead-lettered
+}
+
+// bigQueryKey groups the pending rows by their table and dead-letter configuration.
+type bigQueryKey struct {
+	table      BigQueryInfo
+	deadLetter QuarantineInfo
+}
+
+// pendingRows holds the rows which are not inserted yet. Their messages are not acknowledged until the rows are
+// inserted or dead-lettered, so the number of pending rows is limited by the flow control of the subscription.
+var (
+	pendingRows    = make(map[bigQueryKey][]bigQueryRow)
+	pendingRowsMtx sync.Mutex
+)
+
+// newBigQueryRow maps a stored message to a row of the table (see BigQuerySchema).
+// An error is returned if the payload is not valid JSON and the payload column is a JSON column.
+func newBigQueryRow(msg Message, object string, payload string) (map[string]bigquery.JsonValue, error) {
+	var keys []string
+	for key := range msg.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attributes := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, map[string]string{"key": key, "value": msg.Attributes[key]})
+	}
+
+	row := map[string]bigquery.JsonValue{
+		"message_id":   msg.ID,
+		"ordering_key": msg.OrderingKey,
+		"attributes":   attributes,
+		"object":       object,
+		"persisted_at": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if !msg.PublishTime.IsZero() {
+		row["publish_time"] = msg.PublishTime.UTC().Format(time.RFC3339Nano)
+	}
+
+	if payload == BigQueryPayloadBytes {
+		row["payload"] = base64.StdEncoding.EncodeToString(msg.Data)
+	} else {
+		if !json.Valid(msg.Data) {
+			return nil, fmt.Errorf("Payload is not valid JSON")
+		}
+		row["payload"] = string(msg.Data)
+	}
+
+	return row, nil
+}
+
+// objectURI returns the URI of a stored object, e.g. gs://bucket/name.
+func objectURI(attrs *storage.ObjectAttrs) string {
+	if IsGCSDestination(attrs.Bucket) {
+		return SchemeGCS + "://" + attrs.Bucket + "/" + attrs.Name
+	}
+	return attrs.Bucket + "/" + attrs.Name
+}
+
+// addBigQueryRow adds the row of a stored message to the pending rows, and inserts them once there are enough rows for a batch.
+// The done function is called with the result of the message once its row is inserted or written to the dead-letter path,
+// or with an error if the row could not be inserted or dead-lettered, so the message is redelivered (see DrainBigQuery).
+// A message whose row cannot be created is written to the dead-letter path immediately.
+func addBigQueryRow(ctx context.Context, msg Message, object string, info BigQueryInfo, deadLetter QuarantineInfo, done func(error)) {
+	row, err := newBigQueryRow(msg, object, info.Payload)
+	if err != nil {
+		done(deadLetterRow(ctx, msg, err, deadLetter))
+		return
+	}
+
+	key := bigQueryKey{table: info, deadLetter: deadLetter}
+
+	pendingRowsMtx.Lock()
+	pendingRows[key] = append(pendingRows[key], bigQueryRow{msg: msg, row: row, done: done})
+	var batch []bigQueryRow
+	if len(pendingRows[key]) >= info.BatchSize {
+		batch = pendingRows[key]
+		delete(pendingRows, key)
+	}
+	pendingRowsMtx.Unlock()
+
+	if batch != nil {
+		failed, err := insertBigQueryRows(ctx, key, batch)
+		if err != nil {
+			log.Printf("Error during inserting rows into BigQuery. %s.\n", err)
+			restoreBigQueryRows(key, failed)
+		}
+	}
+}
+
+// FlushBigQuery inserts the pending rows into their tables. The rows rejected by BigQuery are written to the dead-letter
+// path (the quarantine), while the messages of the requests which failed with a permanent error (e.g. a missing table or
+// permission) are redelivered. The rows which could not be inserted because of retryable errors are kept, so they are
+// inserted by the next call.
+// An error is returned if any errors occur during the function execution.
+func FlushBigQuery(ctx context.Context) error {
+	return flushBigQuery(ctx, false)
+}
+
+// DrainBigQuery inserts the pending rows in the same way as FlushBigQuery, but the messages of the rows which could not
+// be inserted because of retryable errors are redelivered instead of being kept. It is called when the rows are not
+// flushed again (e.g. at the end of a run), so no message is acknowledged without its row.
+// An error is returned if any errors occur during the function execution.
+func DrainBigQuery(ctx context.Context) error {
+	return flushBigQuery(ctx, true)
+}
+
+// flushBigQuery inserts the pending rows, and keeps or, if drain is set, redelivers the rows which failed.
+func flushBigQuery(ctx context.Context, drain bool) error {
+	pendingRowsMtx.Lock()
+	pending := pendingRows
+	pendingRows = make(map[bigQueryKey][]bigQueryRow)
+	pendingRowsMtx.Unlock()
+
+	var firstErr error
+	for key, rows := range pending {
+		failed, err := insertBigQueryRows(ctx, key, rows)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if drain {
+			for _, row := range failed {
+				row.done(err)
+			}
+		} else {
+			restoreBigQueryRows(key, failed)
+		}
+	}
+	return firstErr
+}
+
+// insertBigQueryRows inserts the rows in batches. The rows of the batch which failed with a retryable error,
+// and of the batches which follow it, are returned together with the error. The batches which failed with a permanent error
+// are done (see insertBigQueryBatch), so only the error is returned for them.
+func insertBigQueryRows(ctx context.Context, key bigQueryKey, rows []bigQueryRow) ([]bigQueryRow, error) {
+	service, err := newBigQueryService(ctx)
+	if err != nil {
+		return rows, err
+	}
+
+	var permanentErr error
+	for start := 0; start < len(rows); start += key.table.BatchSize {
+		end := start + key.table.BatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		err = insertBigQueryBatch(ctx, service, key, rows[start:end])
+		if IsRetryable(err) {
+			return rows[start:], err
+		}
+		if err != nil && permanentErr == nil {
+			permanentErr = err
+		}
+	}
+	return nil, permanentErr
+}
+
+// insertBigQueryBatch inserts a batch of rows with a single streaming insert request, retrying the request while
+// its error is retryable. The message IDs are used as the insert IDs, so BigQuery drops the duplicates of a retried insert.
+// The messages of the inserted rows and of the rows rejected by BigQuery (which are dead-lettered) are done. If the request
+// fails with a permanent error, the messages of all of the rows are done with the error, so they are redelivered, and the error
+// is returned. If it fails with a retryable error, the rows are left pending and the error is returned.
+func insertBigQueryBatch(ctx context.Context, service *bigquery.Service, key bigQueryKey, rows []bigQueryRow) error {
+	request := &bigquery.TableDataInsertAllRequest{SkipInvalidRows: true}
+	for _, row := range rows {
+		request.Rows = append(request.Rows, &bigquery.TableDataInsertAllRequestRows{InsertId: row.msg.ID, Json: row.row})
+	}
+
+	var response *bigquery.TableDataInsertAllResponse
+	var err error
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		response, err = service.Tabledata.InsertAll(key.table.ProjectID, key.table.DatasetID, key.table.TableID, request).Context(ctx).Do()
+		if err == nil || !IsRetryable(err) || attempt >= bigQueryInsertAttempts {
+			break
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+	if err != nil && !IsRetryable(err) {
+		// The request itself was rejected (e.g. the table or the dataset does not exist, or the permission is missing),
+		// which is an error of the deployment rather than of the rows, so the messages are redelivered instead of being dead-lettered.
+		for _, row := range rows {
+			row.done(err)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	rejected := make(map[int]error)
+	for _, insertErr := range response.InsertErrors {
+		if insertErr.Index < 0 || int(insertErr.Index) >= len(rows) {
+			continue
+		}
+
+		var errs []string
+		for _, rowErr := range insertErr.Errors {
+			if rowErr.Location != "" {
+				errs = append(errs, fmt.Sprintf("%s: %s (%s)", rowErr.Reason, rowErr.Message, rowErr.Location))
+			} else {
+				errs = append(errs, fmt.Sprintf("%s: %s", rowErr.Reason, rowErr.Message))
+			}
+		}
+		rejected[int(insertErr.Index)] = fmt.Errorf("Row was rejected by BigQuery. %s", strings.Join(errs, "; "))
+	}
+
+	for i, row := range rows {
+		if cause, ok := rejected[i]; ok {
+			row.done(deadLetterRow(ctx, row.msg, cause, key.deadLetter))
+		} else {
+			row.done(nil)
+		}
+	}
+	return nil
+}
+
+// restoreBigQueryRows returns the rows which could not be inserted to the pending rows.
+func restoreBigQueryRows(key bigQueryKey, rows []bigQueryRow) {
+	pendingRowsMtx.Lock()
+	defer pendingRowsMtx.Unlock()
+
+	pendingRows[key] = append(append([]bigQueryRow(nil), rows...), pendingRows[key]...)
+}
+
+// deadLetterRow writes a message whose row was rejected to the quarantine.
+// An error is returned if the message could not be quarantined, so it should be redelivered.
+func deadLetterRow(ctx context.Context, msg Message, cause error, deadLetter QuarantineInfo) error {
+	log.Printf("Row of message '%s' was not inserted into BigQuery. %s.\n", msg.ID, cause)
+
+	err := QuarantineMessage(ctx, msg, ReasonBigQueryRejected, cause, deadLetter)
+	if err != nil {
+		log.Printf("Error during writing rejected row of message '%s' to the dead-letter path. %s.\n", msg.ID, err)
+	}
+	return err
+}
+
+// newBigQueryService creates a client of the BigQuery API.
+// If BIGQUERY_EMULATOR_HOST is set (in the host:port form), the requests are sent to the emulator without authentication.
+func newBigQueryService(ctx context.Context) (*bigquery.Service, error) {
+	host := os.Getenv("BIGQUERY_EMULATOR_HOST")
+	if host == "" {
+		return bigquery.NewService(ctx)
+	}
+
+	return bigquery.NewService(ctx, option.WithEndpoint("http://"+host+"/bigquery/v2/"), option.WithoutAuthentication())
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// BigQueryPayloadJSON stores the payload in a JSON column, so the payloads must be valid JSON.
+	BigQueryPayloadJSON = "json"
+	// BigQueryPayloadBytes stores the payload in a BYTES column.
+	BigQueryPayloadBytes = "bytes"
+
+	defaultBigQueryBatchSize     = 500
+	defaultBigQueryFlushInterval = 10
+)
+
+// BigQueryInfo represents BigQuery sink configuration.
+// It holds information needed for inserting a row for each stored message into a BigQuery table, alongside the stored object.
+// The BigQuery sink is optional and it is disabled if the table is not set.
+type BigQueryInfo struct {
+	ProjectID     string // ID of a project in which the table is located
+	DatasetID     string // ID of a dataset in which the table is located
+	TableID       string // ID of the table (empty value disables the BigQuery sink)
+	Payload       string // type of the payload column (json or bytes)
+	BatchSize     int    // number of rows inserted by a single request
+	FlushInterval int    // interval in seconds at which a continuous pull inserts the pending rows
+}
+
+// SetBigQueryInfo sets the parameters of a BigQuery configuration by extracting values from the corresponding environment variables.
+// The table is given in BIGQUERY_TABLE as project.dataset.table, or as dataset.table in the project given by PROJECT_ID.
+// If BIGQUERY_TABLE is not set, the BigQuery sink is disabled.
+// An error is returned if any errors occur during the function execution.
+func SetBigQueryInfo(bigQueryInfo *BigQueryInfo) error {
+	var err error
+
+	table := getOptionalEnvVariable("BIGQUERY_TABLE", "")
+	if table == "" {
+		return nil
+	}
+
+	parts := strings.Split(table, ".")
+	switch len(parts) {
+	case 2:
+		bigQueryInfo.ProjectID, err = getEnvVariable("PROJECT_ID")
+		if err != nil {
+			return err
+		}
+		bigQueryInfo.DatasetID, bigQueryInfo.TableID = parts[0], parts[1]
+	case 3:
+		bigQueryInfo.ProjectID, bigQueryInfo.DatasetID, bigQueryInfo.TableID = parts[0], parts[1], parts[2]
+	default:
+		return fmt.Errorf("Invalid BigQuery table '%s', expected project.dataset.table or dataset.table", table)
+	}
+
+	bigQueryInfo.Payload = getOptionalEnvVariable("BIGQUERY_PAYLOAD", BigQueryPayloadJSON)
+	if bigQueryInfo.Payload != BigQueryPayloadJSON && bigQueryInfo.Payload != BigQueryPayloadBytes {
+		return fmt.Errorf("Invalid BigQuery payload type '%s', expected '%s' or '%s'", bigQueryInfo.Payload, BigQueryPayloadJSON, BigQueryPayloadBytes)
+	}
+
+	bigQueryInfo.BatchSize, err = strconv.Atoi(getOptionalEnvVariable("BIGQUERY_BATCH_SIZE", strconv.Itoa(defaultBigQueryBatchSize)))
+	if err != nil {
+		return err
+	}
+	if bigQueryInfo.BatchSize < 1 {
+		return fmt.Errorf("BigQuery batch size must be positive")
+	}
+
+	bigQueryInfo.FlushInterval, err = strconv.Atoi(getOptionalEnvVariable("BIGQUERY_FLUSH_INTERVAL", strconv.Itoa(defaultBigQueryFlushInterval)))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Enabled reports whether the BigQuery sink is configured.
+func (bigQueryInfo BigQueryInfo) Enabled() bool {
+	return bigQueryInfo.TableID != ""
+}
@@ -0,0 +1,330 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// startBigQuery starts a fake BigQuery server with the schema of the given payload type, and points the BigQuery clients to it.
+// The returned function stops the server and discards the rows left pending by the test.
+func startBigQuery(t *testing.T, payload string) (*sinktest.BigQueryServer, func()) {
+	t.Helper()
+
+	server := sinktest.NewBigQueryServer()
+	server.Schema = BigQuerySchema(payload)
+	restore := setEnv("BIGQUERY_EMULATOR_HOST", server.Host())
+	return server, func() {
+		restore()
+		server.Close()
+
+		pendingRowsMtx.Lock()
+		pendingRows = make(map[bigQueryKey][]bigQueryRow)
+		pendingRowsMtx.Unlock()
+	}
+}
+
+// bigQueryConf returns a persist configuration which stores raw messages and inserts their rows into project.dataset.table.
+func bigQueryConf(batchSize int) PersistConf {
+	return PersistConf{
+		Storage:    StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "txt", Format: FormatRaw},
+		Quarantine: QuarantineInfo{BucketID: "quarantine"},
+		BigQuery: BigQueryInfo{
+			ProjectID: "project",
+			DatasetID: "dataset",
+			TableID:   "table",
+			Payload:   BigQueryPayloadJSON,
+			BatchSize: batchSize,
+		},
+	}
+}
+
+func TestNewBigQueryRow(t *testing.T) {
+	publishTime := time.Date(2020, 11, 5, 10, 30, 0, 0, time.UTC)
+	msg := Message{
+		ID:          "42",
+		Data:        []byte(`{"a":1}`),
+		Attributes:  map[string]string{"b": "2", "a": "1"},
+		PublishTime: publishTime,
+	}
+
+	row, err := newBigQueryRow(msg, "gs://bucket/msg", BigQueryPayloadJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row["message_id"] != "42" || row["object"] != "gs://bucket/msg" || row["payload"] != `{"a":1}` {
+		t.Errorf("Unexpected row %v", row)
+	}
+	if row["publish_time"] != "2020-11-05T10:30:00Z" {
+		t.Errorf("publish_time = %v, want 2020-11-05T10:30:00Z", row["publish_time"])
+	}
+	attributes := row["attributes"].([]map[string]string)
+	if len(attributes) != 2 || attributes[0]["key"] != "a" || attributes[1]["key"] != "b" || attributes[1]["value"] != "2" {
+		t.Errorf("attributes = %v, want the attributes sorted by key", attributes)
+	}
+
+	row, err = newBigQueryRow(Message{ID: "42", Data: []byte("abc")}, "gs://bucket/msg", BigQueryPayloadBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row["payload"] != "YWJj" {
+		t.Errorf("payload = %v, want YWJj", row["payload"])
+	}
+	if _, ok := row["publish_time"]; ok {
+		t.Error("publish_time is set for a message without the publish time")
+	}
+
+	if _, err = newBigQueryRow(Message{ID: "42", Data: []byte("abc")}, "gs://bucket/msg", BigQueryPayloadJSON); err == nil {
+		t.Error("newBigQueryRow() error = nil, want an error for a payload which is not valid JSON")
+	}
+}
+
+func TestProcessMessageInsertsBigQueryRow(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopBigQuery := startBigQuery(t, BigQueryPayloadJSON)
+	defer stopBigQuery()
+
+	// The batch is not full, so the row is inserted before ProcessMessage returns.
+	msg := Message{ID: "42", Data: []byte(`{"a":1}`), Attributes: map[string]string{"origin": "test"}}
+	if err := ProcessMessage(context.Background(), msg, bigQueryConf(10), NewRunReport()); err != nil {
+		t.Fatalf("ProcessMessage() error = %v", err)
+	}
+
+	names := gcs.Names("bucket")
+	if len(names) != 1 {
+		t.Fatalf("stored objects = %v, want 1", names)
+	}
+	rows := server.Rows("project.dataset.table")
+	if len(rows) != 1 {
+		t.Fatalf("inserted %d rows, want 1", len(rows))
+	}
+	if rows[0]["message_id"] != "42" || rows[0]["payload"] != `{"a":1}` || rows[0]["object"] != "gs://bucket/"+names[0] {
+		t.Errorf("Unexpected row %v", rows[0])
+	}
+}
+
+func TestProcessMessageDeadLettersRejectedRows(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data string
+	}{
+		{name: "invalid JSON", data: "abc"},
+		{name: "rejected row", data: `{"reject":true}`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			gcs, stopGCS := startGCS(t)
+			defer stopGCS()
+			server, stopBigQuery := startBigQuery(t, BigQueryPayloadJSON)
+			defer stopBigQuery()
+			server.Reject = func(row map[string]interface{}) string {
+				if strings.Contains(row["payload"].(string), "reject") {
+					return "Rejected"
+				}
+				return ""
+			}
+
+			err := ProcessMessage(context.Background(), Message{ID: "42", Data: []byte(test.data)}, bigQueryConf(10), NewRunReport())
+			if err != nil {
+				t.Fatalf("ProcessMessage() error = %v, want nil after the message is dead-lettered", err)
+			}
+
+			if len(server.Rows("project.dataset.table")) != 0 {
+				t.Errorf("inserted rows = %v, want none", server.Rows("project.dataset.table"))
+			}
+			// The message is stored in the bucket, and its row is written to the dead-letter path.
+			if len(gcs.Names("bucket")) != 1 {
+				t.Errorf("stored objects = %v, want 1", gcs.Names("bucket"))
+			}
+			quarantined := gcs.Names("quarantine")
+			if len(quarantined) != 1 || !strings.Contains(quarantined[0], ReasonBigQueryRejected) {
+				t.Errorf("quarantined objects = %v, want 1 with the %s reason", quarantined, ReasonBigQueryRejected)
+			}
+		})
+	}
+}
+
+func TestProcessMessageRedeliversOnBigQueryFailure(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopBigQuery := startBigQuery(t, BigQueryPayloadJSON)
+	defer stopBigQuery()
+	server.Fail = func(r *http.Request) int { return http.StatusServiceUnavailable }
+
+	err := ProcessMessage(context.Background(), Message{ID: "42", Data: []byte(`{"a":1}`)}, bigQueryConf(10), NewRunReport())
+	if err == nil {
+		t.Fatal("ProcessMessage() error = nil, want the insert error so the message is redelivered")
+	}
+
+	if server.Requests() != bigQueryInsertAttempts {
+		t.Errorf("requests = %d, want %d", server.Requests(), bigQueryInsertAttempts)
+	}
+	if len(gcs.Names("quarantine")) != 0 {
+		t.Errorf("quarantined objects = %v, want none", gcs.Names("quarantine"))
+	}
+	// The row is not kept, since the message is redelivered.
+	pendingRowsMtx.Lock()
+	pending := len(pendingRows)
+	pendingRowsMtx.Unlock()
+	if pending != 0 {
+		t.Errorf("pending tables = %d, want 0", pending)
+	}
+}
+
+func TestProcessMessageRedeliversOnRejectedRequest(t *testing.T) {
+	// A missing table or dataset, or a missing permission, is an error of the deployment, so the messages are not dead-lettered.
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			gcs, stopGCS := startGCS(t)
+			defer stopGCS()
+			server, stopBigQuery := startBigQuery(t, BigQueryPayloadJSON)
+			defer stopBigQuery()
+			server.Fail = func(r *http.Request) int { return status }
+
+			err := ProcessMessage(context.Background(), Message{ID: "42", Data: []byte(`{"a":1}`)}, bigQueryConf(10), NewRunReport())
+			if err == nil || IsRetryable(err) {
+				t.Fatalf("ProcessMessage() error = %v, want the permanent insert error so the message is redelivered", err)
+			}
+
+			// The request is not retried, and the row is neither dead-lettered nor kept.
+			if server.Requests() != 1 {
+				t.Errorf("requests = %d, want 1", server.Requests())
+			}
+			if len(gcs.Names("quarantine")) != 0 {
+				t.Errorf("quarantined objects = %v, want none", gcs.Names("quarantine"))
+			}
+			pendingRowsMtx.Lock()
+			pending := len(pendingRows)
+			pendingRowsMtx.Unlock()
+			if pending != 0 {
+				t.Errorf("pending tables = %d, want 0", pending)
+			}
+		})
+	}
+}
+
+func TestFlushBigQueryRedeliversRejectedRequests(t *testing.T) {
+	server, stopBigQuery := startBigQuery(t, BigQueryPayloadJSON)
+	defer stopBigQuery()
+	server.Fail = func(r *http.Request) int { return http.StatusNotFound }
+
+	// Each batch fails on its own, so the messages of all of the batches are redelivered.
+	conf := bigQueryConf(2)
+	results := make(chan error, 3)
+	for _, id := range []string{"1", "2", "3"} {
+		addBigQueryRow(context.Background(), Message{ID: id, Data: []byte(`{"a":1}`)}, "gs://bucket/"+id, conf.BigQuery, conf.Quarantine,
+			func(err error) { results <- err })
+	}
+	if err := FlushBigQuery(context.Background()); err == nil {
+		t.Error("FlushBigQuery() error = nil, want the insert error")
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-results; err == nil {
+			t.Error("done error = nil, want the insert error")
+		}
+	}
+	if server.Requests() != 2 {
+		t.Errorf("requests = %d, want 2", server.Requests())
+	}
+}
+
+func TestFlushBigQueryKeepsFailedRows(t *testing.T) {
+	_, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopBigQuery := startBigQuery(t, BigQueryPayloadJSON)
+	defer stopBigQuery()
+
+	var mtx sync.Mutex
+	failing := true
+	server.Fail = func(r *http.Request) int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if failing {
+			return http.StatusServiceUnavailable
+		}
+		return 0
+	}
+
+	conf := bigQueryConf(10)
+	results := make(chan error, 2)
+	for _, id := range []string{"1", "2"} {
+		addBigQueryRow(context.Background(), Message{ID: id, Data: []byte(`{"a":1}`)}, "gs://bucket/"+id, conf.BigQuery, conf.Quarantine,
+			func(err error) { results <- err })
+	}
+
+	if err := FlushBigQuery(context.Background()); err == nil {
+		t.Fatal("FlushBigQuery() error = nil, want the insert error")
+	}
+	// The rows are kept for the next flush, so their messages are neither acknowledged nor redelivered.
+	if len(results) != 0 {
+		t.Fatalf("done was called for %d messages, want 0", len(results))
+	}
+
+	mtx.Lock()
+	failing = false
+	mtx.Unlock()
+	if err := FlushBigQuery(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("done error = %v, want nil", err)
+		}
+	}
+	if rows := server.Rows("project.dataset.table"); len(rows) != 2 {
+		t.Errorf("inserted %d rows, want 2", len(rows))
+	}
+}
+
+func TestAddBigQueryRowInsertsFullBatch(t *testing.T) {
+	server, stopBigQuery := startBigQuery(t, BigQueryPayloadBytes)
+	defer stopBigQuery()
+
+	conf := bigQueryConf(2)
+	conf.BigQuery.Payload = BigQueryPayloadBytes
+	var done []string
+	for _, id := range []string{"1", "2", "3"} {
+		id := id
+		addBigQueryRow(context.Background(), Message{ID: id, Data: []byte("abc")}, "gs://bucket/"+id, conf.BigQuery, conf.Quarantine,
+			func(err error) {
+				if err != nil {
+					t.Errorf("done error of message %s = %v, want nil", id, err)
+				}
+				done = append(done, id)
+			})
+	}
+
+	// The first two rows are inserted as a full batch, while the third one is pending.
+	if server.Requests() != 1 || len(server.Rows("project.dataset.table")) != 2 {
+		t.Errorf("requests = %d, rows = %d, want 1 and 2", server.Requests(), len(server.Rows("project.dataset.table")))
+	}
+	if strings.Join(done, ",") != "1,2" {
+		t.Errorf("done messages = %v, want 1,2", done)
+	}
+
+	if err := DrainBigQuery(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(done, ",") != "1,2,3" {
+		t.Errorf("done messages = %v, want 1,2,3", done)
+	}
+}
@@ -0,0 +1,558 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// CompactionManifestName is the name of the manifest which tracks the compaction of a partition.
+	CompactionManifestName = "_COMPACTION.json"
+
+	// Statuses of a compacted batch, in the order in which they are reached.
+	BatchPending  = "pending"  // the batch is planned, but it is not written and verified yet
+	BatchVerified = "verified" // the batch is written and its content matches the original objects
+	BatchDeleted  = "deleted"  // the original objects of the batch are deleted
+
+	defaultCompactionRecords = 10000
+	defaultCompactionBytes   = 256 << 20
+
+	// maxComposeSources is the maximum number of source objects of a single GCS compose request.
+	maxComposeSources = 32
+	// compactionTmpFolder is the folder (within the partition) of the intermediate objects of a compaction.
+	compactionTmpFolder = "_compaction"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CompactionOptions represents the configuration of a compaction run.
+type CompactionOptions struct {
+	BucketID        string // ID of a bucket in which the objects are located
+	Partition       string // prefix of the objects which are compacted (e.g. a YYYY/MM/DD/HH partition folder)
+	Format          string // format of the batch files (BatchFormatNDJSON or BatchFormatLengthPrefixed)
+	MaxRecords      int    // maximum number of objects merged into a single batch file
+	MaxBytes        int64  // maximum size of a single batch file in bytes
+	DeleteOriginals bool   // whether the original objects are deleted after their batch is verified
+}
+
+// CompactionSource describes an original object merged into a batch file.
+type CompactionSource struct {
+	Name       string            `json:"name"`               // name of the object
+	Generation int64             `json:"generation"`         // generation of the object at the time of planning
+	ByteSize   int64             `json:"byteSize"`           // size of the object in bytes
+	CRC32C     uint32            `json:"crc32c"`             // CRC32C checksum of the object
+	Metadata   map[string]string `json:"metadata,omitempty"` // metadata of the object (the message attributes in the raw format)
+}
+
+// CompactionBatch describes a single batch file of a compaction.
+type CompactionBatch struct {
+	Name       string             `json:"name"`       // name of the batch file
+	Status     string             `json:"status"`     // status of the batch (BatchPending, BatchVerified or BatchDeleted)
+	Generation int64              `json:"generation"` // generation of the written batch file
+	Records    int                `json:"records"`    // number of records in the batch file
+	ByteSize   int64              `json:"byteSize"`   // size of the batch file in bytes
+	CRC32C     string             `json:"crc32c"`     // base64 encoded CRC32C checksum of the batch file
+	Sources    []CompactionSource `json:"sources"`    // original objects, in the order of their records
+}
+
+// CompactionManifest is the content of the compaction manifest of a partition.
+// The manifest is written after every step, so an interrupted compaction continues where it stopped.
+type CompactionManifest struct {
+	Partition   string            `json:"partition"`             // compacted prefix
+	Format      string            `json:"format"`                // format of the batch files
+	StartedAt   time.Time         `json:"startedAt"`             // time at which the compaction was planned
+	CompletedAt *time.Time        `json:"completedAt,omitempty"` // time at which all of the batches were first verified
+	RecordCount int               `json:"recordCount"`           // total number of records
+	ByteSize    int64             `json:"byteSize"`              // total size of the original objects in bytes
+	Batches     []CompactionBatch `json:"batches"`               // batch files
+}
+
+// Compact merges the objects under the partition prefix into batch files of the chosen format.
+// Newline delimited batches are built with GCS compose (the objects are not downloaded), while length prefixed
+// batches are written from the downloaded objects. Each batch file is read back and verified against the
+// checksums of the original objects, and only verified batches have their original objects deleted.
+// The messages of each verified batch are added to the message index, so they can be looked up after the deletion.
+// The progress is stored in the compaction manifest of the partition, so the function can be run again
+// to resume an interrupted compaction. If the partition is closed, its manifest is rewritten once original objects
+// are deleted, so it lists the batch files instead of the deleted objects.
+// An error is returned if any errors occur during the function execution.
+func Compact(ctx context.Context, options CompactionOptions) (*CompactionManifest, error) {
+	options.Partition = strings.Trim(options.Partition, "/")
+	if options.Partition == "" {
+		return nil, fmt.Errorf("Partition is not set")
+	}
+	if options.Format != BatchFormatNDJSON && options.Format != BatchFormatLengthPrefixed {
+		return nil, fmt.Errorf("Unknown batch format '%s'", options.Format)
+	}
+	if options.MaxRecords <= 0 {
+		options.MaxRecords = defaultCompactionRecords
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = defaultCompactionBytes
+	}
+
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(options.BucketID)
+
+	manifest, err := readCompactionManifest(ctx, bucket, options.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		manifest, err = planCompaction(ctx, bucket, options)
+		if err != nil {
+			return nil, err
+		}
+		err = saveCompactionManifest(ctx, bucket, manifest)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Format != options.Format {
+		return manifest, fmt.Errorf("Partition %s is already compacted in the %s format", manifest.Partition, manifest.Format)
+	}
+
+	// The intermediate objects are named after the run, so compactions running at the same time do not overwrite them.
+	runID, err := newRunID()
+	if err != nil {
+		return manifest, err
+	}
+	defer func() {
+		newline := bucket.Object(path.Join(manifest.Partition, compactionTmpFolder, runID, "newline"))
+		if err := newline.Delete(context.Background()); err != nil && err != storage.ErrObjectNotExist {
+			log.Printf("Error during deleting intermediate objects. %s.\n", err)
+		}
+	}()
+
+	deleted, err := compactBatches(ctx, bucket, manifest, options, runID)
+	if deleted {
+		if err := updatePartitionManifest(ctx, bucket, manifest.Partition); err != nil {
+			log.Printf("Error during updating the manifest of partition %s. %s.\n", manifest.Partition, err)
+		}
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	if manifest.CompletedAt == nil {
+		completedAt := time.Now()
+		manifest.CompletedAt = &completedAt
+		err = saveCompactionManifest(ctx, bucket, manifest)
+	}
+
+	return manifest, err
+}
+
+// compactBatches writes, verifies and indexes the pending batches, and deletes the original objects of the verified ones
+// if the options require it. The function reports whether any of the original objects were deleted.
+func compactBatches(ctx context.Context, bucket *storage.BucketHandle, manifest *CompactionManifest, options CompactionOptions, runID string) (bool, error) {
+	deleted := false
+	for i := range manifest.Batches {
+		batch := &manifest.Batches[i]
+
+		if batch.Status == BatchPending {
+			err := writeBatch(ctx, bucket, manifest, batch, runID)
+			if err != nil {
+				return deleted, err
+			}
+			err = verifyBatch(ctx, bucket, manifest.Format, batch)
+			if err != nil {
+				return deleted, err
+			}
+			err = writeIndexFile(ctx, bucket, manifest.Partition, batchIndexEntries(manifest.Format, batch))
+			if err != nil {
+				return deleted, err
+			}
+
+			batch.Status = BatchVerified
+			err = saveCompactionManifest(ctx, bucket, manifest)
+			if err != nil {
+				return deleted, err
+			}
+		}
+
+		if batch.Status == BatchVerified && options.DeleteOriginals {
+			err := deleteSources(ctx, bucket, batch.Sources)
+			if err != nil {
+				return deleted, err
+			}
+			deleted = true
+
+			batch.Status = BatchDeleted
+			err = saveCompactionManifest(ctx, bucket, manifest)
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// planCompaction lists the objects under the partition prefix and assigns them to batches.
+// Internal objects (e.g. markers and manifests), batch files of earlier compactions and files of the batched formats are skipped.
+func planCompaction(ctx context.Context, bucket *storage.BucketHandle, options CompactionOptions) (*CompactionManifest, error) {
+	manifest := &CompactionManifest{
+		Partition: options.Partition,
+		Format:    options.Format,
+		StartedAt: time.Now(),
+		Batches:   []CompactionBatch{},
+	}
+
+	var batch *CompactionBatch
+	it := bucket.Objects(ctx, &storage.Query{Prefix: options.Partition + "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if isInternalObject(options.Partition, attrs.Name) || attrs.Metadata["batchFormat"] != "" {
+			continue
+		}
+
+		if batch == nil || len(batch.Sources) >= options.MaxRecords || (len(batch.Sources) > 0 && batch.ByteSize+attrs.Size > options.MaxBytes) {
+			manifest.Batches = append(manifest.Batches, CompactionBatch{
+				Name:   batchName(options.Partition, options.Format, len(manifest.Batches)+1),
+				Status: BatchPending,
+			})
+			batch = &manifest.Batches[len(manifest.Batches)-1]
+		}
+
+		batch.Sources = append(batch.Sources, CompactionSource{
+			Name:       attrs.Name,
+			Generation: attrs.Generation,
+			ByteSize:   attrs.Size,
+			CRC32C:     attrs.CRC32C,
+			Metadata:   attrs.Metadata,
+		})
+		batch.Records++
+		batch.ByteSize += attrs.Size
+
+		manifest.RecordCount++
+		manifest.ByteSize += attrs.Size
+	}
+
+	return manifest, nil
+}
+
+// writeBatch writes the batch file from its original objects. The intermediate objects are written to the folder of the run.
+func writeBatch(ctx context.Context, bucket *storage.BucketHandle, manifest *CompactionManifest, batch *CompactionBatch, runID string) error {
+	metadata := map[string]string{
+		"messageCount":       strconv.Itoa(len(batch.Sources)),
+		"compactedPartition": manifest.Partition,
+		"batchFormat":        manifest.Format,
+	}
+
+	var attrs *storage.ObjectAttrs
+	var err error
+	if manifest.Format == BatchFormatNDJSON {
+		attrs, err = composeBatch(ctx, bucket, path.Join(manifest.Partition, compactionTmpFolder, runID), batch, metadata)
+	} else {
+		attrs, err = rewriteBatch(ctx, bucket, manifest.Format, batch, metadata)
+	}
+	if err != nil {
+		return err
+	}
+
+	batch.Generation = attrs.Generation
+	batch.ByteSize = attrs.Size
+	batch.CRC32C = encodeCRC32C(attrs.CRC32C)
+	return nil
+}
+
+// composeBatch builds a newline delimited batch file by composing the original objects with a new line object
+// between them. Since a compose request accepts a limited number of sources, larger batches are composed
+// from intermediate objects, which are written to the given folder and deleted at the end.
+func composeBatch(ctx context.Context, bucket *storage.BucketHandle, tmpFolder string, batch *CompactionBatch, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	newline := bucket.Object(path.Join(tmpFolder, "newline"))
+	err := writeToHandle(ctx, newline, []byte{'\n'}, "text/plain")
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []*storage.ObjectHandle
+	for _, source := range batch.Sources {
+		parts = append(parts, bucket.Object(source.Name).Generation(source.Generation), newline)
+	}
+
+	var intermediate []*storage.ObjectHandle
+	defer func() {
+		for _, object := range intermediate {
+			if err := object.Delete(context.Background()); err != nil && err != storage.ErrObjectNotExist {
+				log.Printf("Error during deleting intermediate object '%s'. %s.\n", object.ObjectName(), err)
+			}
+		}
+	}()
+
+	for level := 0; len(parts) > maxComposeSources; level++ {
+		var next []*storage.ObjectHandle
+		for i := 0; i < len(parts); i += maxComposeSources {
+			end := i + maxComposeSources
+			if end > len(parts) {
+				end = len(parts)
+			}
+
+			name := fmt.Sprintf("%s-%d-%d", path.Base(batch.Name), level, i/maxComposeSources)
+			object := bucket.Object(path.Join(tmpFolder, name))
+			if _, err := object.ComposerFrom(parts[i:end]...).Run(ctx); err != nil {
+				return nil, err
+			}
+
+			intermediate = append(intermediate, object)
+			next = append(next, object)
+		}
+		parts = next
+	}
+
+	composer := bucket.Object(batch.Name).ComposerFrom(parts...)
+	composer.ContentType = "application/x-ndjson"
+	composer.Metadata = metadata
+	return composer.Run(ctx)
+}
+
+// rewriteBatch writes a batch file by downloading the original objects and writing them as records.
+func rewriteBatch(ctx context.Context, bucket *storage.BucketHandle, format string, batch *CompactionBatch, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	ctxx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := bucket.Object(batch.Name).NewWriter(ctxx)
+	writer.ContentType = "application/octet-stream"
+	writer.Metadata = metadata
+
+	for _, source := range batch.Sources {
+		data, err := readObject(ctxx, bucket.Object(source.Name).Generation(source.Generation))
+		if err != nil {
+			return nil, fmt.Errorf("Error during reading '%s'. %s", source.Name, err)
+		}
+		err = WriteRecord(writer, format, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return writer.Attrs(), nil
+}
+
+// verifyBatch reads the written batch file back and checks that it consists of the records of the original
+// objects, in order, and that its content matches the checksum reported by GCS.
+func verifyBatch(ctx context.Context, bucket *storage.BucketHandle, format string, batch *CompactionBatch) error {
+	reader, err := bucket.Object(batch.Name).Generation(batch.Generation).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	hash := crc32.New(crc32cTable)
+	records, err := NewBatchReader(io.TeeReader(reader, hash), format)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for {
+		record, err := records.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if count >= len(batch.Sources) {
+			return fmt.Errorf("Batch '%s' has more records than original objects", batch.Name)
+		}
+		if source := batch.Sources[count]; crc32.Checksum(record, crc32cTable) != source.CRC32C {
+			return fmt.Errorf("Record %d of batch '%s' does not match the object '%s' (objects containing new lines can not be compacted in the %s format)", count, batch.Name, source.Name, BatchFormatNDJSON)
+		}
+		count++
+	}
+
+	if count != len(batch.Sources) {
+		return fmt.Errorf("Batch '%s' has %d records instead of %d", batch.Name, count, len(batch.Sources))
+	}
+	if crc := encodeCRC32C(hash.Sum32()); crc != batch.CRC32C {
+		return fmt.Errorf("Checksum of batch '%s' is %s instead of %s", batch.Name, crc, batch.CRC32C)
+	}
+
+	batch.Records = count
+	return nil
+}
+
+// deleteSources deletes the original objects of a verified batch. An object is deleted only if it was not
+// overwritten since the compaction was planned, and objects which are already deleted are skipped.
+func deleteSources(ctx context.Context, bucket *storage.BucketHandle, sources []CompactionSource) error {
+	for _, source := range sources {
+		err := bucket.Object(source.Name).If(storage.Conditions{GenerationMatch: source.Generation}).Delete(ctx)
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if isPreconditionFailed(err) {
+			log.Printf("Object '%s' was overwritten after it was compacted, so it is not deleted.\n", source.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchIndexEntries returns the index entries of the messages stored in a batch file.
+// The message IDs are taken from the names of the original objects.
+func batchIndexEntries(format string, batch *CompactionBatch) []IndexEntry {
+	entries := make([]IndexEntry, 0, len(batch.Sources))
+
+	var offset int64
+	for i, source := range batch.Sources {
+		if format == BatchFormatLengthPrefixed {
+			offset += 4
+		}
+		entries = append(entries, IndexEntry{
+			MessageID:  messageIDFromName(source.Name),
+			Object:     batch.Name,
+			Generation: batch.Generation,
+			Partition:  path.Dir(batch.Name),
+			Record:     i,
+			Offset:     offset,
+			Length:     source.ByteSize,
+			Batch:      format,
+		})
+
+		offset += source.ByteSize
+		if format == BatchFormatNDJSON {
+			offset++
+		}
+	}
+	return entries
+}
+
+// readCompactionManifest reads the compaction manifest of a partition, or returns nil if it does not exist.
+func readCompactionManifest(ctx context.Context, bucket *storage.BucketHandle, partition string) (*CompactionManifest, error) {
+	data, err := readObject(ctx, bucket.Object(path.Join(partition, CompactionManifestName)))
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &CompactionManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// saveCompactionManifest writes the compaction manifest of a partition.
+func saveCompactionManifest(ctx context.Context, bucket *storage.BucketHandle, manifest *CompactionManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeToHandle(ctx, bucket.Object(path.Join(manifest.Partition, CompactionManifestName)), data, "application/json")
+}
+
+// updatePartitionManifest rewrites the manifest of a closed partition after its objects were compacted, keeping the time
+// at which the partition was closed. Nothing is written if the partition is not closed yet.
+func updatePartitionManifest(ctx context.Context, bucket *storage.BucketHandle, partition string) error {
+	closed, err := readManifest(ctx, bucket, partition)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	manifest, err := buildManifest(ctx, bucket, partition)
+	if err != nil {
+		return err
+	}
+	compactedAt := time.Now()
+	manifest.PartitionTime = closed.PartitionTime
+	manifest.Watermark = closed.Watermark
+	manifest.ClosedAt = closed.ClosedAt
+	manifest.CompactedAt = &compactedAt
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeToHandle(ctx, bucket.Object(path.Join(partition, ManifestName)), data, "application/json")
+}
+
+// newRunID returns a random ID of a compaction run.
+func newRunID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// batchName returns the name of the n-th batch file of a partition.
+func batchName(partition string, format string, n int) string {
+	extension := "ndjson"
+	if format == BatchFormatLengthPrefixed {
+		extension = "bin"
+	}
+	return fmt.Sprintf("%s/compacted-%05d.%s", partition, n, extension)
+}
+
+// isInternalObject reports whether an object under the given folder is written by the persistor itself
+// (markers, manifests and intermediate objects), i.e. whether its name or any of its folders starts with '_'.
+func isInternalObject(folder string, name string) bool {
+	relative := strings.TrimPrefix(name, strings.TrimSuffix(folder, "/")+"/")
+	return strings.HasPrefix(relative, "_") || strings.Contains(relative, "/_")
+}
+
+// readObject reads the whole content of an object.
+func readObject(ctx context.Context, object *storage.ObjectHandle) ([]byte, error) {
+	reader, err := object.NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// putPartition stores a raw message object for each payload in the partition of the given time.
+func putPartition(gcs *sinktest.GCSServer, partitionTime time.Time, payloads ...string) string {
+	folder := PartitionFolder(partitionTime)
+	for i, payload := range payloads {
+		gcs.Put("bucket", path.Join(folder, "msg-"+string(rune('a'+i))+".txt"), []byte(payload), nil)
+	}
+	return folder
+}
+
+func writtenManifest(t *testing.T, gcs *sinktest.GCSServer, folder string) Manifest {
+	t.Helper()
+
+	object, ok := gcs.Object("bucket", path.Join(folder, ManifestName))
+	if !ok {
+		t.Fatal("manifest was not written")
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(object.Data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestCompactRewritesPartitionManifest(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	partitionTime := time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local)
+	folder := putPartition(gcs, partitionTime, "one", "two", "three")
+	if _, err := ClosePartition(context.Background(), "bucket", partitionTime); err != nil {
+		t.Fatal(err)
+	}
+	closed := writtenManifest(t, gcs, folder)
+
+	compaction, err := Compact(context.Background(), CompactionOptions{BucketID: "bucket", Partition: folder, Format: BatchFormatNDJSON, DeleteOriginals: true})
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if len(compaction.Batches) != 1 || compaction.Batches[0].Status != BatchDeleted {
+		t.Fatalf("batches = %+v, want a single deleted batch", compaction.Batches)
+	}
+
+	manifest := writtenManifest(t, gcs, folder)
+	if manifest.ObjectCount != 1 || manifest.RecordCount != 3 || manifest.Objects[0].Name != compaction.Batches[0].Name {
+		t.Errorf("manifest = %+v, want the batch file with 3 records", manifest)
+	}
+	if manifest.CompactedAt == nil || !manifest.ClosedAt.Equal(closed.ClosedAt) || !manifest.PartitionTime.Equal(closed.PartitionTime) {
+		t.Errorf("manifest times = %v, %v, %v, want the closing times and the compaction time", manifest.ClosedAt, manifest.PartitionTime, manifest.CompactedAt)
+	}
+
+	for _, name := range gcs.Names("bucket") {
+		if strings.Contains(name, compactionTmpFolder) {
+			t.Errorf("intermediate object %s was not deleted", name)
+		}
+	}
+}
+
+func TestBuildManifestCountsCompactedMessagesOnce(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	partitionTime := time.Date(2020, 10, 1, 13, 0, 0, 0, time.Local)
+	folder := putPartition(gcs, partitionTime, "one", "two")
+
+	// The originals are kept, so the partition holds both the originals and the batch file.
+	if _, err := Compact(context.Background(), CompactionOptions{BucketID: "bucket", Partition: folder, Format: BatchFormatLengthPrefixed}); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	manifest, err := ClosePartition(context.Background(), "bucket", partitionTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.RecordCount != 2 || manifest.ObjectCount != 2 {
+		t.Errorf("manifest = %+v, want the 2 original objects", manifest)
+	}
+}
+
+func TestCompactRunsUseSeparateIntermediateObjects(t *testing.T) {
+	first, err := newRunID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newRunID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("run IDs %s and %s are equal", first, second)
+	}
+}
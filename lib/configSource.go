@@ -0,0 +1,61 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ConfigSourceError is returned if a configuration file which is loaded together with the configuration
+// (e.g. the routes) cannot be read from its source. The wrapped error decides whether the failure is retryable.
+type ConfigSourceError struct {
+	Source string // source of the configuration file
+	Err    error  // error which occurred while reading the file
+}
+
+// Error returns the message of the wrapped error, together with the source.
+func (e *ConfigSourceError) Error() string {
+	return fmt.Sprintf("Error during reading '%s'. %s", e.Source, e.Err)
+}
+
+// Unwrap returns the wrapped error.
+func (e *ConfigSourceError) Unwrap() error {
+	return e.Err
+}
+
+// ReadConfigSource reads a configuration file (e.g. a schema or a rule set) from the given source.
+// The source is either a GCS object, given as gs://bucket/object, or a path on the local file system.
+// An error is returned if any errors occur during the function execution.
+func ReadConfigSource(ctx context.Context, source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "gs://") {
+		return ioutil.ReadFile(source)
+	}
+
+	bucketAndObject := strings.SplitN(strings.TrimPrefix(source, "gs://"), "/", 2)
+	if len(bucketAndObject) != 2 || bucketAndObject[0] == "" || bucketAndObject[1] == "" {
+		return nil, fmt.Errorf("Invalid GCS source '%s', expected gs://bucket/object", source)
+	}
+
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return readObject(ctx, client.Bucket(bucketAndObject[0]).Object(bucketAndObject[1]))
+}
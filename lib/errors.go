@@ -0,0 +1,95 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PermanentError wraps an error which will not be resolved by retrying (e.g. an invalid configuration or a malformed message).
+type PermanentError struct {
+	Err error
+}
+
+// Error returns the message of the wrapped error.
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks the error as permanent. A nil error is returned unchanged.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsRetryable classifies an error as retryable (transient) or permanent.
+// Errors marked with Permanent and client errors of the GCP APIs (e.g. permission denied, not found, invalid argument)
+// are permanent. Timeouts, throttling, server errors and network errors are retryable.
+// Unknown errors are considered retryable, so a message is never dropped because of an unrecognized error.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var permanentErr *PermanentError
+	if errors.As(err, &permanentErr) {
+		return false
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return true
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return isRetryableStatus(apiErr.Code)
+	}
+
+	var storeErr *ObjectStoreError
+	if errors.As(err, &storeErr) {
+		return isRetryableStatus(storeErr.StatusCode)
+	}
+
+	if grpcStatus, ok := status.FromError(err); ok && grpcStatus.Code() != codes.Unknown {
+		switch grpcStatus.Code() {
+		case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+			codes.FailedPrecondition, codes.OutOfRange, codes.Unimplemented, codes.Unauthenticated:
+			return false
+		default:
+			return true
+		}
+	}
+
+	// Network errors (e.g. a refused connection) fall through, so they are retried like the unknown errors.
+	return true
+}
+
+// isRetryableStatus classifies an HTTP status code of an error response as retryable (timeouts, throttling and server errors).
+func isRetryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
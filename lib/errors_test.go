@@ -0,0 +1,58 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "permanent", err: Permanent(errors.New("malformed")), want: false},
+		{name: "wrapped permanent", err: fmt.Errorf("storing: %w", Permanent(errors.New("malformed"))), want: false},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: true},
+		{name: "forbidden", err: &googleapi.Error{Code: 403}, want: false},
+		{name: "not found", err: &googleapi.Error{Code: 404}, want: false},
+		{name: "throttled", err: &googleapi.Error{Code: 429}, want: true},
+		{name: "server error", err: &googleapi.Error{Code: 503}, want: true},
+		{name: "object store client error", err: &ObjectStoreError{StatusCode: 400}, want: false},
+		{name: "object store server error", err: &ObjectStoreError{StatusCode: 500}, want: true},
+		{name: "grpc permission denied", err: status.Error(codes.PermissionDenied, "denied"), want: false},
+		{name: "grpc unavailable", err: status.Error(codes.Unavailable, "unavailable"), want: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: true},
+		{name: "unknown", err: errors.New("unknown"), want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsRetryable(test.err); got != test.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// setEnv sets an environment variable and returns a function which restores its previous value.
+func setEnv(name string, value string) func() {
+	previous, ok := os.LookupEnv(name)
+	os.Setenv(name, value)
+	return func() {
+		if ok {
+			os.Setenv(name, previous)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// startGCS starts a fake GCS server and points the storage clients to it.
+// The returned function stops the server.
+func startGCS(t *testing.T) (*sinktest.GCSServer, func()) {
+	t.Helper()
+
+	server := sinktest.NewGCSServer()
+	restore := setEnv("STORAGE_EMULATOR_HOST", server.Host())
+	return server, func() {
+		restore()
+		server.Close()
+	}
+}
+
+// startPubsub starts a fake Pub/Sub server, points the Pub/Sub clients to it and creates the given topics in the project.
+// The returned function releases the cached notification topics and stops the server.
+func startPubsub(t *testing.T, projectID string, topics ...string) (*pstest.Server, func()) {
+	t.Helper()
+
+	server := pstest.NewServer()
+	restore := setEnv("PUBSUB_EMULATOR_HOST", server.Addr)
+
+	client, err := pubsub.NewClient(context.Background(), projectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, topic := range topics {
+		if _, err := client.CreateTopic(context.Background(), topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return server, func() {
+		CloseNotifications()
+		restore()
+		server.Close()
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// DestinationError is the error of a write to a single fan-out destination, after all of its retries.
+type DestinationError struct {
+	BucketID string
+	Err      error
+}
+
+// FanOutError is returned if a message was not stored in enough destinations to satisfy the fan-out policy.
+type FanOutError struct {
+	Stored   int                // number of destinations in which the message was stored
+	Required int                // number of destinations required by the policy
+	Errors   []DestinationError // errors of the failed destinations
+}
+
+func (err *FanOutError) Error() string {
+	var errs []string
+	for _, destinationErr := range err.Errors {
+		errs = append(errs, fmt.Sprintf("%s: %s", destinationErr.BucketID, destinationErr.Err))
+	}
+	return fmt.Sprintf("Message was stored in %d destinations, %d required (%s)", err.Stored, err.Required, strings.Join(errs, "; "))
+}
+
+// persistFanOut stores a message in the bucket of the storage configuration and in the additional buckets of the
+// fan-out configuration, under the same object name. The destinations are written concurrently, and a failed write
+// is retried while its error is retryable. The failed destinations are logged and counted in the run report.
+// The function returns the attributes of the object in the first destination in which the message was stored,
+// or a *FanOutError if the policy is not satisfied. The error is permanent only if all of the failures are permanent.
+// Under the quorum policy a message stored in a majority of the destinations is acknowledged, so the copies which
+// failed are not written later; they are only logged and counted.
+func persistFanOut(ctx context.Context, msg Message, info StorageInfo, fanOut FanOutInfo, partitionTime time.Time, report *RunReport) (*storage.ObjectAttrs, error) {
+	return writeFanOut(ctx, fmt.Sprintf("message '%s'", msg.ID), info, fanOut, report, func(ctx context.Context, destination StorageInfo) (*storage.ObjectAttrs, error) {
+		return persistMessage(ctx, msg, destination, partitionTime)
+	})
+}
+
+// writeFanOut writes an object to the destinations of the fan-out configuration with the given write function,
+// as described for persistFanOut. The description of the object is used in the logged errors.
+func writeFanOut(ctx context.Context, description string, info StorageInfo, fanOut FanOutInfo, report *RunReport, write func(context.Context, StorageInfo) (*storage.ObjectAttrs, error)) (*storage.ObjectAttrs, error) {
+	destinations := []string{info.BucketID}
+	for _, bucketID := range fanOut.BucketIDs {
+		if destinationKey(bucketID) != destinationKey(info.BucketID) {
+			destinations = append(destinations, bucketID)
+		}
+	}
+
+	results := make([]*storage.ObjectAttrs, len(destinations))
+	errs := make([]error, len(destinations))
+
+	var wg sync.WaitGroup
+	for i, bucketID := range destinations {
+		wg.Add(1)
+		go func(i int, bucketID string) {
+			defer wg.Done()
+
+			destination := info
+			destination.BucketID = bucketID
+			results[i], errs[i] = writeWithRetry(ctx, destination, fanOut, write)
+		}(i, bucketID)
+	}
+	wg.Wait()
+
+	fanOutErr := &FanOutError{Required: len(destinations)}
+	if fanOut.Policy == FanOutQuorum {
+		fanOutErr.Required = len(destinations)/2 + 1
+	}
+
+	var attrs *storage.ObjectAttrs
+	permanent := true
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("Error during storing %s in bucket '%s'. %s.\n", description, destinations[i], err)
+			report.CountWriteError(destinations[i])
+			fanOutErr.Errors = append(fanOutErr.Errors, DestinationError{BucketID: destinations[i], Err: err})
+			permanent = permanent && !IsRetryable(err)
+			continue
+		}
+
+		fanOutErr.Stored++
+		if attrs == nil {
+			attrs = results[i]
+		}
+	}
+
+	if fanOutErr.Stored < fanOutErr.Required {
+		if permanent {
+			return nil, Permanent(fanOutErr)
+		}
+		return nil, fanOutErr
+	}
+	return attrs, nil
+}
+
+// writeWithRetry writes an object, retrying the write while its error is retryable, at most the configured number of times.
+func writeWithRetry(ctx context.Context, info StorageInfo, fanOut FanOutInfo, write func(context.Context, StorageInfo) (*storage.ObjectAttrs, error)) (*storage.ObjectAttrs, error) {
+	delay := time.Duration(fanOut.RetryDelay) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		attrs, err := write(ctx, info)
+		if err == nil || !IsRetryable(err) || attempt >= fanOut.Retries {
+			return attrs, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// FanOutAll requires each message to be stored in all of the destinations before it is acknowledged.
+	FanOutAll = "all"
+	// FanOutQuorum requires each message to be stored in a majority of the destinations before it is acknowledged.
+	FanOutQuorum = "quorum"
+)
+
+// FanOutInfo represents fan-out configuration.
+// It holds information needed for storing a copy of each message in additional buckets (e.g. in other regions).
+// The fan-out is optional and it is disabled if no additional buckets are set.
+type FanOutInfo struct {
+	BucketIDs  []string // IDs of the additional buckets, in which the messages are stored under the same names
+	Policy     string   // consistency policy (all or quorum) deciding when a message is acknowledged
+	Retries    int      // number of retries of a failed write to a single destination
+	RetryDelay int      // delay before the first retry in milliseconds, doubled on each further retry
+}
+
+// SetFanOutInfo sets the parameters of a fan-out configuration by extracting values from the corresponding environment variables.
+// If FANOUT_BUCKET_IDS is not set, the fan-out is disabled. The duplicates in the list of buckets are left out.
+// An error is returned if any errors occur during the function execution.
+func SetFanOutInfo(fanOutInfo *FanOutInfo) error {
+	var err error
+
+	fanOutInfo.BucketIDs = nil
+	seen := make(map[string]bool)
+	for _, bucketID := range splitList(getOptionalEnvVariable("FANOUT_BUCKET_IDS", "")) {
+		if key := destinationKey(bucketID); !seen[key] {
+			seen[key] = true
+			fanOutInfo.BucketIDs = append(fanOutInfo.BucketIDs, bucketID)
+		}
+	}
+
+	fanOutInfo.Policy = getOptionalEnvVariable("FANOUT_POLICY", FanOutAll)
+	if fanOutInfo.Policy != FanOutAll && fanOutInfo.Policy != FanOutQuorum {
+		return fmt.Errorf("Invalid fan-out policy '%s', expected '%s' or '%s'", fanOutInfo.Policy, FanOutAll, FanOutQuorum)
+	}
+
+	fanOutInfo.Retries, err = strconv.Atoi(getOptionalEnvVariable("FANOUT_RETRIES", "2"))
+	if err != nil {
+		return err
+	}
+	if fanOutInfo.Retries < 0 {
+		return fmt.Errorf("Fan-out retries must not be negative")
+	}
+
+	fanOutInfo.RetryDelay, err = strconv.Atoi(getOptionalEnvVariable("FANOUT_RETRY_DELAY", "200"))
+	if err != nil {
+		return err
+	}
+	if fanOutInfo.RetryDelay < 0 {
+		return fmt.Errorf("Fan-out retry delay must not be negative")
+	}
+
+	return nil
+}
+
+// Enabled reports whether the fan-out is configured.
+func (fanOutInfo FanOutInfo) Enabled() bool {
+	return len(fanOutInfo.BucketIDs) > 0
+}
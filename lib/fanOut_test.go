@@ -0,0 +1,222 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// failBucket makes the fake GCS server respond to the requests of the given bucket with the status.
+func failBucket(bucketID string, status int) func(r *http.Request) int {
+	return func(r *http.Request) int {
+		if strings.Contains(r.URL.Path, "/b/"+bucketID+"/") {
+			return status
+		}
+		return 0
+	}
+}
+
+func TestPersistFanOut(t *testing.T) {
+	msg := Message{ID: "42", Data: []byte("payload")}
+	partitionTime := time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local)
+	info := StorageInfo{BucketID: "main", Prefix: "msg", Extension: "txt", Format: FormatRaw}
+	name := path.Join(PartitionFolder(partitionTime), "msg-42.txt")
+
+	tests := []struct {
+		name      string
+		policy    string
+		fail      string // bucket whose writes are rejected
+		stored    []string
+		wantErr   bool
+		permanent bool
+	}{
+		{name: "all", policy: FanOutAll, stored: []string{"main", "backup", "archive"}},
+		{name: "all with a failed destination", policy: FanOutAll, fail: "backup", stored: []string{"main", "archive"}, wantErr: true, permanent: true},
+		{name: "quorum", policy: FanOutQuorum, stored: []string{"main", "backup", "archive"}},
+		{name: "quorum with a failed destination", policy: FanOutQuorum, fail: "backup", stored: []string{"main", "archive"}},
+		{name: "quorum with a failed main bucket", policy: FanOutQuorum, fail: "main", stored: []string{"backup", "archive"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gcs, stop := startGCS(t)
+			defer stop()
+			if test.fail != "" {
+				gcs.Fail = failBucket(test.fail, http.StatusForbidden)
+			}
+
+			// The main bucket and the duplicates in the list are written once.
+			fanOut := FanOutInfo{BucketIDs: []string{"backup", "main", "gs://archive"}, Policy: test.policy, Retries: 2, RetryDelay: 1}
+			report := NewRunReport()
+			attrs, err := persistFanOut(context.Background(), msg, info, fanOut, partitionTime, report)
+
+			for _, bucketID := range []string{"main", "backup", "archive"} {
+				_, ok := gcs.Object(bucketID, name)
+				want := false
+				for _, stored := range test.stored {
+					want = want || stored == bucketID
+				}
+				if ok != want {
+					t.Errorf("object in bucket %s = %v, want %v", bucketID, ok, want)
+				}
+			}
+
+			if test.wantErr {
+				var fanOutErr *FanOutError
+				if !errors.As(err, &fanOutErr) || fanOutErr.Stored != 2 || fanOutErr.Required != 3 || len(fanOutErr.Errors) != 1 {
+					t.Fatalf("persistFanOut() error = %v, want 2 of 3 destinations stored", err)
+				}
+				if IsRetryable(err) == test.permanent {
+					t.Errorf("persistFanOut() error retryable = %v, want %v", IsRetryable(err), !test.permanent)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("persistFanOut() error = %v", err)
+				}
+				if attrs == nil || attrs.Name != name || attrs.Bucket != test.stored[0] {
+					t.Errorf("persistFanOut() = %+v, want the object of bucket %s", attrs, test.stored[0])
+				}
+			}
+
+			wantErrors := map[string]int{}
+			if test.fail != "" {
+				wantErrors[test.fail] = 1
+			}
+			if !reflect.DeepEqual(report.WriteErrors, wantErrors) {
+				t.Errorf("write errors = %v, want %v", report.WriteErrors, wantErrors)
+			}
+		})
+	}
+}
+
+func TestWriteFanOutRetries(t *testing.T) {
+	info := StorageInfo{BucketID: "main"}
+	retryable := errors.New("connection reset")
+
+	tests := []struct {
+		name     string
+		policy   string
+		failures int // number of failed writes to the backup bucket before it succeeds
+		attempts int
+		wantErr  bool
+	}{
+		{name: "recovered", policy: FanOutAll, failures: 2, attempts: 3},
+		{name: "exhausted", policy: FanOutAll, failures: 5, attempts: 3, wantErr: true},
+		{name: "exhausted under quorum", policy: FanOutQuorum, failures: 5, attempts: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mtx sync.Mutex
+			attempts := 0
+			write := func(ctx context.Context, destination StorageInfo) (*storage.ObjectAttrs, error) {
+				if destination.BucketID != "backup" {
+					return &storage.ObjectAttrs{Bucket: destination.BucketID}, nil
+				}
+				mtx.Lock()
+				defer mtx.Unlock()
+				attempts++
+				if attempts <= test.failures {
+					return nil, retryable
+				}
+				return &storage.ObjectAttrs{Bucket: destination.BucketID}, nil
+			}
+
+			fanOut := FanOutInfo{BucketIDs: []string{"backup", "archive"}, Policy: test.policy, Retries: 2, RetryDelay: 10}
+			report := NewRunReport()
+			start := time.Now()
+			_, err := writeFanOut(context.Background(), "message '42'", info, fanOut, report, write)
+
+			if attempts != test.attempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.attempts)
+			}
+			// The delay is doubled on each retry.
+			if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+				t.Errorf("retries took %v, want at least 30ms", elapsed)
+			}
+			if test.wantErr {
+				if err == nil || !IsRetryable(err) {
+					t.Errorf("writeFanOut() error = %v, want a retryable error", err)
+				}
+			} else if err != nil {
+				t.Errorf("writeFanOut() error = %v", err)
+			}
+			if exhausted := test.failures >= test.attempts; (report.WriteErrors["backup"] == 1) != exhausted {
+				t.Errorf("write errors = %v, want a write error only if the retries are exhausted", report.WriteErrors)
+			}
+		})
+	}
+
+	// A canceled context stops the retries.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts := 0
+	_, err := writeWithRetry(ctx, info, FanOutInfo{Retries: 5, RetryDelay: 1000}, func(ctx context.Context, destination StorageInfo) (*storage.ObjectAttrs, error) {
+		attempts++
+		return nil, retryable
+	})
+	if err != retryable || attempts != 1 {
+		t.Errorf("writeWithRetry() with a canceled context = %v after %d attempts, want the write error after 1 attempt", err, attempts)
+	}
+}
+
+func TestSetFanOutInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "disabled", env: map[string]string{}},
+		{name: "duplicates", env: map[string]string{"FANOUT_BUCKET_IDS": "backup, s3://copy,gs://backup,archive,s3://copy,backup"}, want: []string{"backup", "s3://copy", "archive"}},
+		{name: "invalid policy", env: map[string]string{"FANOUT_BUCKET_IDS": "backup", "FANOUT_POLICY": "some"}, wantErr: true},
+		{name: "negative retries", env: map[string]string{"FANOUT_BUCKET_IDS": "backup", "FANOUT_RETRIES": "-1"}, wantErr: true},
+		{name: "negative retry delay", env: map[string]string{"FANOUT_BUCKET_IDS": "backup", "FANOUT_RETRY_DELAY": "-200"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"FANOUT_BUCKET_IDS", "FANOUT_POLICY", "FANOUT_RETRIES", "FANOUT_RETRY_DELAY"} {
+				restore := setEnv(name, test.env[name])
+				defer restore()
+			}
+
+			var info FanOutInfo
+			err := SetFanOutInfo(&info)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("SetFanOutInfo() error = nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(info.BucketIDs, test.want) {
+				t.Errorf("BucketIDs = %v, want %v", info.BucketIDs, test.want)
+			}
+		})
+	}
+}
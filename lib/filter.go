@@ -0,0 +1,202 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// ReasonInvalidPayload is the quarantine reason of messages whose payload is used by the filter or a route condition,
+// but is not valid JSON.
+const ReasonInvalidPayload = "invalid-payload"
+
+// ErrInvalidPayload is the cause of the errors returned by Filter.Match for messages whose payload is used by the
+// expression, but is not valid JSON.
+var ErrInvalidPayload = errors.New("payload is not valid JSON")
+
+// Filter is a compiled filter expression, which decides whether a message is stored.
+//
+// The expressions are written in the Common Expression Language (CEL, https://github.com/google/cel-spec).
+// The variables are:
+//
+//	attributes   map of the message attributes (e.g. attributes.type or attributes["event-type"])
+//	orderingKey  ordering key of the message
+//	publishTime  publish time of the message (a timestamp)
+//	messageId    ID of the message
+//	payload      payload parsed as JSON (numbers are doubles, so payload.n > 1.0 rather than payload.n > 1)
+//
+// Selecting a payload field or an attribute which does not exist is an evaluation error, so the optional ones are tested
+// with has() first (e.g. has(payload.n) && payload.n > 1.0).
+type Filter struct {
+	expression string
+	program    cel.Program
+}
+
+// filterEnv is the CEL environment with the declarations of the message variables. It is created once per instance.
+var (
+	filterEnv     *cel.Env
+	filterEnvErr  error
+	filterEnvOnce sync.Once
+)
+
+// newFilterEnv returns the CEL environment of the filter expressions.
+func newFilterEnv() (*cel.Env, error) {
+	filterEnvOnce.Do(func() {
+		filterEnv, filterEnvErr = cel.NewEnv(cel.Declarations(
+			decls.NewVar("attributes", decls.NewMapType(decls.String, decls.String)),
+			decls.NewVar("orderingKey", decls.String),
+			decls.NewVar("publishTime", decls.Timestamp),
+			decls.NewVar("messageId", decls.String),
+			decls.NewVar("payload", decls.Dyn),
+		))
+	})
+	return filterEnv, filterEnvErr
+}
+
+// CompileFilter parses and type-checks a filter expression. Besides the syntax and type errors (e.g. unknown variables
+// or functions, or an expression which does not result in a bool), invalid timestamp literals and regular expressions
+// are reported, so an invalid filter is detected before any message is evaluated.
+// An error is returned if the expression is not valid.
+func CompileFilter(expression string) (*Filter, error) {
+	env, err := newFilterEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("Invalid filter expression. %s", issues.Err())
+	}
+	if resultType := ast.ResultType(); resultType.GetPrimitive() != exprpb.Type_BOOL && resultType.GetDyn() == nil {
+		return nil, fmt.Errorf("Invalid filter expression. Expression results in %s instead of bool", cel.FormatType(resultType))
+	}
+	if err := checkFilterPatterns(ast.Expr()); err != nil {
+		return nil, fmt.Errorf("Invalid filter expression. %s", err)
+	}
+
+	// The optimization evaluates the conversions of literals (e.g. timestamp("2020-01-01T00:00:00Z")) in advance.
+	program, err := env.Program(ast, cel.EvalOptions(cel.OptOptimize))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter expression. %s", err)
+	}
+
+	return &Filter{expression: expression, program: program}, nil
+}
+
+// checkFilterPatterns checks the regular expressions given to matches() as literals.
+func checkFilterPatterns(expr *exprpb.Expr) error {
+	call := expr.GetCallExpr()
+	if call == nil {
+		for _, child := range filterChildren(expr) {
+			if err := checkFilterPatterns(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	args := call.GetArgs()
+	if call.GetFunction() == "matches" && len(args) > 0 {
+		if pattern := args[len(args)-1].GetConstExpr(); pattern != nil {
+			if _, err := regexp.Compile(pattern.GetStringValue()); err != nil {
+				return err
+			}
+		}
+	}
+	if call.GetTarget() != nil {
+		args = append([]*exprpb.Expr{call.GetTarget()}, args...)
+	}
+	for _, arg := range args {
+		if err := checkFilterPatterns(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterChildren returns the subexpressions of an expression which is not a call.
+func filterChildren(expr *exprpb.Expr) []*exprpb.Expr {
+	switch kind := expr.ExprKind.(type) {
+	case *exprpb.Expr_SelectExpr:
+		return []*exprpb.Expr{kind.SelectExpr.GetOperand()}
+	case *exprpb.Expr_ListExpr:
+		return kind.ListExpr.GetElements()
+	case *exprpb.Expr_StructExpr:
+		var children []*exprpb.Expr
+		for _, entry := range kind.StructExpr.GetEntries() {
+			children = append(children, entry.GetMapKey(), entry.GetValue())
+		}
+		return children
+	case *exprpb.Expr_ComprehensionExpr:
+		comprehension := kind.ComprehensionExpr
+		return []*exprpb.Expr{comprehension.GetIterRange(), comprehension.GetAccuInit(), comprehension.GetLoopCondition(),
+			comprehension.GetLoopStep(), comprehension.GetResult()}
+	}
+	return nil
+}
+
+// Match evaluates the filter for a message. The payload is parsed only if the evaluation uses it.
+// An error wrapping ErrInvalidPayload is returned if the payload is used but it is not valid JSON, and an error
+// if the evaluation fails otherwise (e.g. a missing field, or comparing a payload field with a value of a different type).
+// Both are marked as permanent since they depend only on the message.
+func (filter *Filter) Match(msg Message) (bool, error) {
+	attributes := msg.Attributes
+	if attributes == nil {
+		attributes = map[string]string{}
+	}
+
+	var payload interface{}
+	var payloadErr error
+	parsed := false
+	vars := map[string]interface{}{
+		"attributes":  attributes,
+		"orderingKey": msg.OrderingKey,
+		"publishTime": msg.PublishTime,
+		"messageId":   msg.ID,
+		"payload": func() interface{} {
+			if !parsed {
+				parsed = true
+				payloadErr = json.Unmarshal(msg.Data, &payload)
+			}
+			return payload
+		},
+	}
+
+	result, _, err := filter.program.Eval(vars)
+	if payloadErr != nil {
+		return false, Permanent(fmt.Errorf("Filter '%s' uses the payload of message '%s'. %w", filter.expression, msg.ID, ErrInvalidPayload))
+	}
+	if err != nil {
+		return false, Permanent(fmt.Errorf("Error during evaluating filter '%s'. %s", filter.expression, err))
+	}
+	match, ok := result.Value().(bool)
+	if !ok {
+		return false, Permanent(fmt.Errorf("Filter '%s' results in %s instead of bool", filter.expression, result.Type().TypeName()))
+	}
+	return match, nil
+}
+
+// String returns the source of the expression.
+func (filter *Filter) String() string {
+	return filter.expression
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+// FilterInfo represents message filter configuration.
+// It holds the filter expression which decides whether a received message is stored (see Filter for its syntax).
+// The filter is optional and it is disabled if the expression is not set.
+type FilterInfo struct {
+	Expression string  // filter expression (empty value disables the filter)
+	filter     *Filter // compiled expression
+}
+
+// SetFilterInfo sets the parameters of a filter configuration by extracting values from the corresponding environment variables.
+// If FILTER_EXPRESSION is not set, the filter is disabled.
+// An error is returned if the expression is not valid, so an invalid filter is reported when the persistor starts.
+func SetFilterInfo(filterInfo *FilterInfo) error {
+	filterInfo.Expression = getOptionalEnvVariable("FILTER_EXPRESSION", "")
+	if filterInfo.Expression == "" {
+		return nil
+	}
+
+	filter, err := CompileFilter(filterInfo.Expression)
+	if err != nil {
+		return err
+	}
+	filterInfo.filter = filter
+
+	return nil
+}
+
+// Enabled reports whether the filter is configured.
+func (filterInfo FilterInfo) Enabled() bool {
+	return filterInfo.Expression != ""
+}
+
+// Match reports whether a message matches the filter expression, compiling it first if the configuration was not set
+// by SetFilterInfo. An error is returned if the expression is not valid or if its evaluation fails.
+func (filterInfo FilterInfo) Match(msg Message) (bool, error) {
+	filter := filterInfo.filter
+	if filter == nil {
+		var err error
+		filter, err = CompileFilter(filterInfo.Expression)
+		if err != nil {
+			return false, err
+		}
+	}
+	return filter.Match(msg)
+}
@@ -0,0 +1,234 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// filterMessage is the message against which the filter tests are evaluated.
+var filterMessage = Message{
+	ID:          "42",
+	Data:        []byte(`{"n": 3, "price": 9.5, "name": "Åse", "type": "order", "tags": ["a", "b"], "user": {"email": "a@b.no", "age": null}, "items": [{"id": 1}, {"id": 2}]}`),
+	Attributes:  map[string]string{"source": "web", "event-type": "click"},
+	PublishTime: time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC),
+	OrderingKey: "key",
+}
+
+func TestFilterMatch(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		// Variables.
+		{`attributes.source == "web"`, true},
+		{`attributes["event-type"] == "click"`, true},
+		{`attributes.source != "web"`, false},
+		{`messageId == "42"`, true},
+		{`orderingKey == "key"`, true},
+		{`publishTime == timestamp("2020-10-01T12:00:00Z")`, true},
+		{`publishTime >= timestamp("2020-10-01T14:00:00+02:00")`, true},
+		{`publishTime < timestamp("2020-10-01T12:00:00Z")`, false},
+		{`payload.type == "order"`, true},
+
+		// Payload fields.
+		{`payload.n == 3.0`, true},
+		{`payload.n > 2.5`, true},
+		{`payload.n + 1.0 > 3.0`, true},
+		{`payload.price * 2.0 - payload.n == 16.0`, true},
+		{`payload.name > "Anne"`, true},
+		{`payload.tags == ["a", "b"]`, true},
+		{`payload.user.age == null`, true},
+		{`payload.items[1].id == 2.0`, true},
+
+		// Logical operators and membership.
+		{`attributes.source == "web" && payload.n > 1.0`, true},
+		{`attributes.source == "web" && payload.n > 5.0`, false},
+		{`attributes.source == "app" || payload.n > 1.0`, true},
+		{`!(payload.n > 1.0)`, false},
+		{`payload.type in ["order", "refund"]`, true},
+		{`payload.type in ["refund"]`, false},
+		{`"source" in attributes`, true},
+		{`"missing" in attributes`, false},
+
+		// Functions, methods and macros.
+		{`has(payload.user.email)`, true},
+		{`has(payload.user.phone)`, false},
+		{`has(attributes.source)`, true},
+		{`has(payload.missing) && payload.missing > 1.0`, false},
+		{`size(payload.name) == 3`, true},
+		{`size(payload.tags) == 2`, true},
+		{`payload.user.email.endsWith("@b.no")`, true},
+		{`payload.user.email.startsWith("b")`, false},
+		{`payload.name.contains("s")`, true},
+		{`attributes.source.matches("^w[a-z]+$")`, true},
+		{`payload.items.exists(item, item.id == 2.0)`, true},
+		{`payload.items.all(item, item.id > 1.0)`, false},
+		{`int(payload.n) == 3`, true},
+		{`string(payload.n) == "3"`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			filter, err := CompileFilter(test.expression)
+			if err != nil {
+				t.Fatalf("CompileFilter() error = %v", err)
+			}
+			match, err := filter.Match(filterMessage)
+			if err != nil {
+				t.Fatalf("Match() error = %v", err)
+			}
+			if match != test.want {
+				t.Errorf("Match() = %v, want %v", match, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterMatchInvalidPayload(t *testing.T) {
+	nonJSON := Message{ID: "42", Data: []byte("not json"), Attributes: map[string]string{"type": "ping"}}
+
+	tests := []struct {
+		expression string
+		want       bool
+		wantErr    bool
+	}{
+		// The payload is not used, so the message is not quarantined.
+		{expression: `attributes.type == "ping"`, want: true},
+		{expression: `attributes.type == "ping" || payload.n > 1.0`, want: true},
+		{expression: `attributes.type == "pong" && payload.n > 1.0`, want: false},
+
+		{expression: `payload.n > 1.0`, wantErr: true},
+		{expression: `has(payload.n)`, wantErr: true},
+		{expression: `attributes.type == "ping" && payload.n > 1.0`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			filter, err := CompileFilter(test.expression)
+			if err != nil {
+				t.Fatalf("CompileFilter() error = %v", err)
+			}
+			match, err := filter.Match(nonJSON)
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidPayload) || IsRetryable(err) {
+					t.Errorf("Match() = %v, %v, want a permanent %v", match, err, ErrInvalidPayload)
+				}
+				return
+			}
+			if err != nil || match != test.want {
+				t.Errorf("Match() = %v, %v, want %v", match, err, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterMatchErrors(t *testing.T) {
+	for _, expression := range []string{
+		`payload.missing > 1.0`,
+		`payload.n > 1`,
+		`payload.type > 1.0`,
+		`payload.n == 3.0 && payload.type > 1.0`,
+		`payload.n.startsWith("a")`,
+		`payload.tags[5] == "c"`,
+		`payload.n`,
+		`attributes.missing == "a"`,
+	} {
+		t.Run(expression, func(t *testing.T) {
+			filter, err := CompileFilter(expression)
+			if err != nil {
+				t.Fatalf("CompileFilter() error = %v", err)
+			}
+			_, err = filter.Match(filterMessage)
+			if err == nil {
+				t.Fatal("Match() error = nil, want an error")
+			}
+			if IsRetryable(err) || errors.Is(err, ErrInvalidPayload) {
+				t.Errorf("Match() error = %v, want a permanent evaluation error", err)
+			}
+		})
+	}
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+	for _, expression := range []string{
+		``,
+		`payload.n >`,
+		`payload.n > 1.0)`,
+		`(payload.n > 1.0`,
+		`payload.n = 1.0`,
+		`"unterminated`,
+		`unknown == 1`,
+		`unknown(1)`,
+		`size(1, 2)`,
+		`timestamp("yesterday") < publishTime`,
+		`attributes.source.matches("(")`,
+		`matches(attributes.source, "[")`,
+		`"a" < 1`,
+		`1 + "a" == 2`,
+		`"a"`,
+		`1 + 2`,
+		`messageId.field == 1`,
+		`publishTime > 1`,
+	} {
+		t.Run(expression, func(t *testing.T) {
+			if _, err := CompileFilter(expression); err == nil {
+				t.Errorf("CompileFilter(%q) error = nil, want an error", expression)
+			}
+		})
+	}
+}
+
+func TestProcessMessageFilter(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	conf := PersistConf{
+		Storage:    StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "txt", Format: FormatRaw},
+		Quarantine: QuarantineInfo{BucketID: "quarantine"},
+		Filter:     FilterInfo{Expression: `has(payload.n) && payload.n > 1.0`},
+	}
+	report := NewRunReport()
+	for i, data := range []string{`{"n": 2}`, `{"n": 1}`, `{"m": 2}`, `not json`, `{"n": "x"}`} {
+		msg := Message{ID: string(rune('a' + i)), Data: []byte(data)}
+		if err := ProcessMessage(context.Background(), msg, conf, report); err != nil {
+			t.Fatalf("ProcessMessage(%s) error = %v", data, err)
+		}
+	}
+
+	// The message which is not valid JSON and the one whose n cannot be compared with a number are quarantined.
+	if names := gcs.Names("bucket"); len(names) != 1 {
+		t.Errorf("stored objects = %v, want 1", names)
+	}
+	reasons := make(map[string]string)
+	for _, name := range gcs.Names("quarantine") {
+		object, _ := gcs.Object("quarantine", name)
+		var record QuarantineRecord
+		if err := json.Unmarshal(object.Data, &record); err != nil {
+			t.Fatal(err)
+		}
+		reasons[record.MessageID] = record.Reason
+	}
+	if reasons["d"] != ReasonInvalidPayload || reasons["e"] != ReasonPermanentError || len(reasons) != 2 {
+		t.Errorf("quarantine reasons = %v, want %s for d and %s for e", reasons, ReasonInvalidPayload, ReasonPermanentError)
+	}
+	if report.Filtered != 2 {
+		t.Errorf("filtered = %d, want 2", report.Filtered)
+	}
+}
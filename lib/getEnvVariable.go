@@ -34,3 +34,14 @@ func getEnvVariable(name string) (string, error) {
 
 	return value, nil
 }
+
+// getOptionalEnvVariable represents helper function which extracts the value of an optional environment variable.
+// If the variable is not set or is empty, the given default value is returned instead.
+func getOptionalEnvVariable(name string, defaultValue string) string {
+	value, err := getEnvVariable(name)
+	if err != nil {
+		return defaultValue
+	}
+
+	return value
+}
@@ -1,10 +1,15 @@
 module github.com/syntio/aquarium-persistor-gcp/lib
 
-go 1.13
+go 1.15
 
 require (
 	cloud.google.com/go/pubsub v1.8.2
 	cloud.google.com/go/storage v1.12.0
-	github.com/stretchr/testify v1.4.0
-	google.golang.org/grpc v1.33.1
+	github.com/golang/snappy v0.0.1
+	github.com/google/cel-go v0.7.3
+	github.com/santhosh-tekuri/jsonschema/v5 v5.0.0
+	github.com/stretchr/testify v1.5.1
+	google.golang.org/api v0.33.0
+	google.golang.org/genproto v0.0.0-20201102152239-715cce707fb0
+	google.golang.org/grpc v1.33.2
 )
@@ -0,0 +1,340 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// indexFolder is the folder (within a partition) of the index files.
+const indexFolder = "_index"
+
+// ErrMessageNotFound is returned by LookupMessage if the message is not found in the given time window.
+var ErrMessageNotFound = errors.New("Message not found")
+
+// IndexEntry describes where a single message is stored.
+type IndexEntry struct {
+	MessageID  string `json:"id"`              // ID of the message
+	Object     string `json:"object"`          // name of the object in which the message is stored
+	Generation int64  `json:"generation"`      // generation of the object
+	Partition  string `json:"partition"`       // folder of the partition in which the object is located
+	Record     int    `json:"record"`          // position of the message in a batch file (0 for single message objects)
+	Offset     int64  `json:"offset"`          // byte offset of the message in the object
+	Length     int64  `json:"length"`          // size of the stored message in bytes
+	Batch      string `json:"batch,omitempty"` // batch format of the object (empty for single message objects)
+}
+
+// indexKey identifies the index files to which an entry belongs.
+type indexKey struct {
+	bucketID  string
+	partition string
+}
+
+// pendingIndex holds the index entries which are not written yet. The entries are collected by ProcessMessage
+// and written by FlushIndex, so the index files are written once per pull run instead of once per message.
+// pendingIndexSince is the time at which the oldest of the pending entries was added.
+var (
+	pendingIndex      = make(map[indexKey][]IndexEntry)
+	pendingIndexSince time.Time
+	pendingIndexMtx   sync.Mutex
+)
+
+// addIndexEntry adds an entry of a stored message to the pending index.
+func addIndexEntry(bucketID string, entry IndexEntry) {
+	pendingIndexMtx.Lock()
+	defer pendingIndexMtx.Unlock()
+
+	if len(pendingIndex) == 0 {
+		pendingIndexSince = time.Now()
+	}
+	key := indexKey{bucketID: bucketID, partition: entry.Partition}
+	pendingIndex[key] = append(pendingIndex[key], entry)
+}
+
+// newIndexEntry creates the index entry of a message stored in a single message object.
+func newIndexEntry(msgID string, attrs *storage.ObjectAttrs) IndexEntry {
+	return IndexEntry{
+		MessageID:  msgID,
+		Object:     attrs.Name,
+		Generation: attrs.Generation,
+		Partition:  path.Dir(attrs.Name),
+		Length:     attrs.Size,
+	}
+}
+
+// FlushIndex writes the pending index entries to a new index file in each of their partitions.
+// The entries which could not be written are kept, so they are written by the next call.
+// An error is returned if any errors occur during the function execution.
+func FlushIndex(ctx context.Context) error {
+	pendingIndexMtx.Lock()
+	pending := pendingIndex
+	pendingIndex = make(map[indexKey][]IndexEntry)
+	pendingIndexMtx.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		restoreIndexEntries(pending)
+		return err
+	}
+	defer client.Close()
+
+	var firstErr error
+	for key, entries := range pending {
+		err := writeIndexFile(ctx, client.Bucket(key.bucketID), key.partition, entries)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delete(pending, key)
+	}
+
+	restoreIndexEntries(pending)
+	return firstErr
+}
+
+// FlushIndexIfDue writes the pending index entries only if there are at least FlushSize of them, or the oldest of them
+// was added at least FlushInterval seconds ago. It is used by the push function, which handles a single message per
+// call, so the index files are not written once per message.
+// An error is returned if any errors occur during the function execution.
+func FlushIndexIfDue(ctx context.Context, info IndexInfo) error {
+	pendingIndexMtx.Lock()
+	count := 0
+	for _, entries := range pendingIndex {
+		count += len(entries)
+	}
+	due := count > 0 && (count >= info.FlushSize || time.Since(pendingIndexSince) >= time.Duration(info.FlushInterval)*time.Second)
+	pendingIndexMtx.Unlock()
+
+	if !due {
+		return nil
+	}
+	return FlushIndex(ctx)
+}
+
+// restoreIndexEntries returns the entries which could not be written to the pending index.
+func restoreIndexEntries(entries map[indexKey][]IndexEntry) {
+	pendingIndexMtx.Lock()
+	defer pendingIndexMtx.Unlock()
+
+	if len(entries) > 0 && len(pendingIndex) == 0 {
+		pendingIndexSince = time.Now()
+	}
+	for key, keyEntries := range entries {
+		pendingIndex[key] = append(keyEntries, pendingIndex[key]...)
+	}
+}
+
+// writeIndexFile writes the entries as a new NDJSON index file of the partition. Index files are never modified,
+// so they are named by the time at which they are written, followed by the host name and process ID of the writer.
+func writeIndexFile(ctx context.Context, bucket *storage.BucketHandle, partition string, entries []IndexEntry) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	name := fmt.Sprintf("%020d-%s-%d.ndjson", time.Now().UnixNano(), hostname, os.Getpid())
+	return writeToHandle(ctx, bucket.Object(path.Join(partition, indexFolder, name)), data.Bytes(), "application/x-ndjson")
+}
+
+// LookupResult holds a message found by LookupMessage together with its location.
+type LookupResult struct {
+	Entry   IndexEntry // location of the message
+	Message Message    // stored message
+}
+
+// LookupMessage finds the message with the given ID in the partitions of the time window and reads it.
+// The index files of each partition are searched first, starting with the newest one, so batch files written
+// by a compaction take precedence over the deleted original objects. If the message is not in the index
+// (e.g. it was stored before the index was enabled), the names of the single message objects are searched.
+// ErrMessageNotFound is returned if the message is not found, and an error if any errors occur during the function execution.
+func LookupMessage(ctx context.Context, bucketID string, format string, messageID string, from time.Time, to time.Time) (*LookupResult, error) {
+	reader, err := NewStoredReader(ctx, bucketID, format)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	for partitionTime := PartitionHour(from); partitionTime.Before(to); partitionTime = partitionTime.Add(time.Hour) {
+		folder := PartitionFolder(partitionTime)
+
+		entries, err := readIndexEntries(ctx, reader.bucket, folder, messageID)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			msg, err := reader.ReadEntry(ctx, entry)
+			if err == storage.ErrObjectNotExist {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &LookupResult{Entry: entry, Message: msg}, nil
+		}
+
+		objects, err := reader.ListObjects(ctx, partitionTime, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, attrs := range objects {
+			if attrs.Metadata["batchFormat"] != "" || messageIDFromName(attrs.Name) != messageID {
+				continue
+			}
+			entry := newIndexEntry(messageID, attrs)
+			msg, err := reader.ReadEntry(ctx, entry)
+			if err != nil {
+				return nil, err
+			}
+			return &LookupResult{Entry: entry, Message: msg}, nil
+		}
+	}
+
+	return nil, ErrMessageNotFound
+}
+
+// readIndexEntries reads the index files of a partition and returns the entries of the given message, newest first.
+func readIndexEntries(ctx context.Context, bucket *storage.BucketHandle, partition string, messageID string) ([]IndexEntry, error) {
+	var names []string
+	it := bucket.Objects(ctx, &storage.Query{Prefix: path.Join(partition, indexFolder) + "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, attrs.Name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	var entries []IndexEntry
+	for _, name := range names {
+		data, err := readObject(ctx, bucket.Object(name))
+		if err != nil {
+			return nil, err
+		}
+
+		// The lines are checked for the ID before they are decoded, since most of them belong to other messages.
+		needle := []byte(fmt.Sprintf(`"id":%q`, messageID))
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			if !bytes.Contains(line, needle) {
+				continue
+			}
+			var entry IndexEntry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				log.Printf("Error during reading index file '%s'. %s.\n", name, err)
+				continue
+			}
+			if entry.MessageID == messageID {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// ReadEntry reads the message stored at the location given by an index entry. For the batch files of a compaction only
+// the bytes of the message are read, and the attributes of messages stored in the raw format are restored as in ReadObject.
+// The files of the batched formats are compressed, so they are read up to the record of the message.
+// An error is returned if any errors occur during the function execution.
+func (reader *StoredReader) ReadEntry(ctx context.Context, entry IndexEntry) (Message, error) {
+	object := reader.bucket.Object(entry.Object).Generation(entry.Generation)
+
+	if entry.Batch == "" {
+		attrs, err := object.Attrs(ctx)
+		if err != nil {
+			return Message{}, err
+		}
+		data, err := readObject(ctx, object)
+		if err != nil {
+			return Message{}, err
+		}
+		return reader.message(data, entry.Object, attrs.Metadata)
+	}
+
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	if IsBatchFormat(entry.Batch) {
+		return reader.readRecord(ctx, attrs, entry.Record)
+	}
+	sources, err := reader.batchSources(ctx, attrs)
+	if err != nil {
+		return Message{}, err
+	}
+
+	rangeReader, err := object.NewRangeReader(ctx, entry.Offset, entry.Length)
+	if err != nil {
+		return Message{}, err
+	}
+	defer rangeReader.Close()
+
+	data, err := ioutil.ReadAll(rangeReader)
+	if err != nil {
+		return Message{}, err
+	}
+
+	source := CompactionSource{Name: entry.MessageID}
+	if entry.Record < len(sources) {
+		source = sources[entry.Record]
+	}
+	return reader.message(data, source.Name, source.Metadata)
+}
+
+// errRecordFound stops reading a batch file once the record of a message is read.
+var errRecordFound = errors.New("record found")
+
+// readRecord reads the message stored in the given record of a file of a batched format.
+func (reader *StoredReader) readRecord(ctx context.Context, attrs *storage.ObjectAttrs, record int) (Message, error) {
+	var found Message
+	err := reader.ReadObject(ctx, attrs, record, func(index int, msg Message) error {
+		found = msg
+		return errRecordFound
+	})
+	if err == nil {
+		return Message{}, fmt.Errorf("Object '%s' has no record %d", attrs.Name, record)
+	}
+	if err != errRecordFound {
+		return Message{}, err
+	}
+	return found, nil
+}
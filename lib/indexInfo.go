@@ -0,0 +1,65 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"strconv"
+)
+
+const (
+	defaultIndexFlushInterval = 60
+	defaultIndexFlushSize     = 500
+)
+
+// IndexInfo represents message index configuration.
+// It holds information needed for writing the index which maps message IDs to the objects in which they are stored.
+type IndexInfo struct {
+	Enabled       bool   // whether the stored messages are indexed
+	BucketID      string // ID of a bucket in which the messages and their index are stored
+	FlushInterval int    // number of seconds between two index writes of a long-running pull or a push function
+	FlushSize     int    // number of pending entries at which the index is written by a push function
+}
+
+// SetIndexInfo sets the parameters of a message index configuration by extracting values from the corresponding environment variables.
+// The index is written only if MESSAGE_INDEX is set to true, and it is located in the bucket given by BUCKET_ID.
+// An error is returned if any errors occur during the function execution.
+func SetIndexInfo(indexInfo *IndexInfo) error {
+	var err error
+
+	indexInfo.Enabled, err = strconv.ParseBool(getOptionalEnvVariable("MESSAGE_INDEX", "false"))
+	if err != nil {
+		return err
+	}
+	if !indexInfo.Enabled {
+		return nil
+	}
+
+	indexInfo.BucketID, err = getEnvVariable("BUCKET_ID")
+	if err != nil {
+		return err
+	}
+
+	indexInfo.FlushInterval, err = strconv.Atoi(getOptionalEnvVariable("INDEX_FLUSH_INTERVAL", strconv.Itoa(defaultIndexFlushInterval)))
+	if err != nil {
+		return err
+	}
+
+	indexInfo.FlushSize, err = strconv.Atoi(getOptionalEnvVariable("INDEX_FLUSH_SIZE", strconv.Itoa(defaultIndexFlushSize)))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// indexFiles returns the names of the index files in the bucket.
+func indexFiles(names []string) []string {
+	var files []string
+	for _, name := range names {
+		if strings.Contains(name, "/"+indexFolder+"/") {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+func TestFlushIndexIfDue(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	ctx := context.Background()
+	info := IndexInfo{Enabled: true, BucketID: "bucket", FlushInterval: 3600, FlushSize: 3}
+	partition := PartitionFolder(time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local))
+	entry := func(id string) IndexEntry {
+		return IndexEntry{MessageID: id, Object: partition + "/" + id + ".txt", Partition: partition}
+	}
+
+	if err := FlushIndexIfDue(ctx, info); err != nil {
+		t.Fatalf("FlushIndexIfDue() without entries error = %v", err)
+	}
+
+	for i, id := range []string{"1", "2"} {
+		addIndexEntry("bucket", entry(id))
+		if err := FlushIndexIfDue(ctx, info); err != nil {
+			t.Fatalf("FlushIndexIfDue() error = %v", err)
+		}
+		if files := indexFiles(gcs.Names("bucket")); len(files) != 0 {
+			t.Fatalf("index written after %d entries: %v", i+1, files)
+		}
+	}
+
+	addIndexEntry("bucket", entry("3"))
+	if err := FlushIndexIfDue(ctx, info); err != nil {
+		t.Fatalf("FlushIndexIfDue() error = %v", err)
+	}
+	files := indexFiles(gcs.Names("bucket"))
+	if len(files) != 1 {
+		t.Fatalf("index files after reaching the flush size = %v, want 1 file", files)
+	}
+	object, _ := gcs.Object("bucket", files[0])
+	if lines := strings.Count(string(object.Data), "\n"); lines != 3 {
+		t.Errorf("index file has %d entries, want 3", lines)
+	}
+
+	// An entry older than the flush interval is written with the next message.
+	info.FlushInterval = 0
+	addIndexEntry("bucket", entry("4"))
+	if err := FlushIndexIfDue(ctx, info); err != nil {
+		t.Fatalf("FlushIndexIfDue() error = %v", err)
+	}
+	if files := indexFiles(gcs.Names("bucket")); len(files) != 2 {
+		t.Errorf("index files after the flush interval = %v, want 2 files", files)
+	}
+}
+
+func TestFlushIndexKeepsFailedEntries(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	ctx := context.Background()
+	partition := PartitionFolder(time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local))
+	addIndexEntry("bucket", IndexEntry{MessageID: "1", Object: partition + "/msg-1.txt", Partition: partition})
+
+	gcs.Fail = func(r *http.Request) int {
+		return http.StatusForbidden
+	}
+	if err := FlushIndex(ctx); err == nil {
+		t.Fatal("FlushIndex() with a failing bucket error = nil, want an error")
+	}
+
+	gcs.Fail = nil
+	addIndexEntry("bucket", IndexEntry{MessageID: "2", Object: partition + "/msg-2.txt", Partition: partition})
+	if err := FlushIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+	files := indexFiles(gcs.Names("bucket"))
+	if len(files) != 1 {
+		t.Fatalf("index files = %v, want 1 file", files)
+	}
+	object, _ := gcs.Object("bucket", files[0])
+	if !strings.Contains(string(object.Data), `"id":"1"`) || !strings.Contains(string(object.Data), `"id":"2"`) {
+		t.Errorf("index file = %s, want the failed and the new entry", object.Data)
+	}
+}
+
+func TestLookupMessage(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	ctx := context.Background()
+	from := time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local)
+	to := from.Add(2 * time.Hour)
+
+	// An indexed message in the second hour of the window.
+	indexed := path.Join(PartitionFolder(from.Add(time.Hour)), "msg-indexed.txt")
+	gcs.Put("bucket", indexed, []byte("indexed"), map[string]string{"origin": "test"})
+	attrs, ok := gcs.Object("bucket", indexed)
+	if !ok {
+		t.Fatal("object was not stored")
+	}
+	addIndexEntry("bucket", IndexEntry{MessageID: "indexed", Object: indexed, Generation: attrs.Generation, Partition: path.Dir(indexed), Length: int64(len("indexed"))})
+	if err := FlushIndex(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A message stored before the index was enabled.
+	unindexed := path.Join(PartitionFolder(from), "msg-unindexed.txt")
+	gcs.Put("bucket", unindexed, []byte("unindexed"), nil)
+
+	tests := []struct {
+		name   string
+		id     string
+		object string
+		data   string
+	}{
+		{name: "indexed", id: "indexed", object: indexed, data: "indexed"},
+		{name: "not indexed", id: "unindexed", object: unindexed, data: "unindexed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := LookupMessage(ctx, "bucket", FormatRaw, test.id, from, to)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Entry.Object != test.object || string(result.Message.Data) != test.data || result.Message.ID != test.id {
+				t.Errorf("LookupMessage() = %+v, want message %s of %s", result, test.id, test.object)
+			}
+		})
+	}
+
+	if result, err := LookupMessage(ctx, "bucket", FormatRaw, "indexed", from, from.Add(time.Hour)); err != ErrMessageNotFound {
+		t.Errorf("LookupMessage() outside of the window = %+v, %v, want %v", result, err, ErrMessageNotFound)
+	}
+	if result, err := LookupMessage(ctx, "bucket", FormatRaw, "missing", from, to); err != ErrMessageNotFound {
+		t.Errorf("LookupMessage() of a missing message = %+v, %v, want %v", result, err, ErrMessageNotFound)
+	}
+}
+
+func TestLookupCompactedMessage(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	ctx := context.Background()
+	from := time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local)
+	folder := putPartition(gcs, from, "one", "two", "three")
+	_, err := Compact(ctx, CompactionOptions{BucketID: "bucket", Partition: folder, Format: BatchFormatLengthPrefixed, DeleteOriginals: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The originals are deleted, so the message is read from the batch file through the index.
+	result, err := LookupMessage(ctx, "bucket", FormatRaw, "b", from, from.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Message.Data) != "two" || result.Entry.Record != 1 || result.Entry.Batch != BatchFormatLengthPrefixed {
+		t.Errorf("LookupMessage() = %+v, want the second record of the batch file", result)
+	}
+	if result.Message.ID != "b" {
+		t.Errorf("message ID = %s, want b", result.Message.ID)
+	}
+}
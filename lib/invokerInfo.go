@@ -19,6 +19,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"time"
 )
 
 // InvokerInfo represents a invoker configuration.
@@ -29,6 +30,10 @@ type InvokerInfo struct {
 	NumberOfInstances int    //number of pull function instances that will run in parallel
 	InstanceNumber    int    //help parameter used for logging error messages (indicates on which instance the error occurred)
 	FunctionURL       string //URL of a Cloud function which will be triggered by invoker
+
+	MaxConcurrentInstances int `json:"-"` //maximum number of pull function instances running at the same time (0 means no limit)
+	InstancesPerSecond     int `json:"-"` //number of pull function instances started per second during ramp-up (0 means no ramp-up)
+	Deadline               int `json:"-"` //number of seconds after which no more instances are started (0 means no deadline)
 }
 
 // SetInvokerInfo sets the parameters of a invoker configuration by extracting values ​​from the corresponding environment variables.
@@ -67,10 +72,43 @@ func SetInvokerInfo(invokerInfo *InvokerInfo) error {
 		return err
 	}
 
+	invokerInfo.MaxConcurrentInstances, err = strconv.Atoi(getOptionalEnvVariable("MAX_CONCURRENT_INSTANCES", "0"))
+	if err != nil {
+		return err
+	}
+	if invokerInfo.MaxConcurrentInstances < 0 {
+		return fmt.Errorf("MAX_CONCURRENT_INSTANCES must not be negative")
+	}
+
+	invokerInfo.InstancesPerSecond, err = strconv.Atoi(getOptionalEnvVariable("INSTANCES_PER_SECOND", "0"))
+	if err != nil {
+		return err
+	}
+	if invokerInfo.InstancesPerSecond < 0 {
+		return fmt.Errorf("INSTANCES_PER_SECOND must not be negative")
+	}
+
+	invokerInfo.Deadline, err = strconv.Atoi(getOptionalEnvVariable("INVOKER_DEADLINE", "0"))
+	if err != nil {
+		return err
+	}
+	if invokerInfo.Deadline < 0 {
+		return fmt.Errorf("INVOKER_DEADLINE must not be negative")
+	}
+
 	return nil
 
 }
 
+// RampUpInterval returns the time between the starts of two consecutive instances during the ramp-up.
+// Zero is returned if there is no ramp-up, and also if the rate is so high that the interval is shorter than a nanosecond.
+func (invokerInfo InvokerInfo) RampUpInterval() time.Duration {
+	if invokerInfo.InstancesPerSecond <= 0 {
+		return 0
+	}
+	return time.Second / time.Duration(invokerInfo.InstancesPerSecond)
+}
+
 // checkURL represents helper function which checks if given URL is in the form of a Cloud function URL.
 // The function returns error message if URL was not a match.
 func checkURL(url string) error {
@@ -0,0 +1,47 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import "testing"
+
+func TestSetInvokerInfo(t *testing.T) {
+	defer setEnv("NUM_OF_SECONDS", "60")()
+	defer setEnv("NUM_OF_INSTANCES", "4")()
+	defer setEnv("FUNC_URL", "https://europe-west1-project.cloudfunctions.net/pull")()
+
+	for _, test := range []struct {
+		name  string
+		value string
+	}{
+		{"MAX_CONCURRENT_INSTANCES", "-1"},
+		{"INSTANCES_PER_SECOND", "-1"},
+		{"INVOKER_DEADLINE", "-1"},
+	} {
+		restore := setEnv(test.name, test.value)
+		err := SetInvokerInfo(&InvokerInfo{})
+		restore()
+		if err == nil {
+			t.Errorf("SetInvokerInfo() with %s=%s error = nil, want an error", test.name, test.value)
+		}
+	}
+
+	var invokerInfo InvokerInfo
+	if err := SetInvokerInfo(&invokerInfo); err != nil {
+		t.Fatal(err)
+	}
+	if invokerInfo.NumberOfInstances != 4 || invokerInfo.MaxConcurrentInstances != 0 || invokerInfo.Deadline != 0 {
+		t.Errorf("SetInvokerInfo() = %+v, want 4 instances without a limit or a deadline", invokerInfo)
+	}
+}
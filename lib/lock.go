@@ -0,0 +1,208 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// lockPollInterval is the time between two acquire attempts in the queue mode.
+var lockPollInterval = 5 * time.Second
+
+// ErrLockHeld is returned when the lock is held by another holder.
+var ErrLockHeld = errors.New("lock is held by another run")
+
+// Lease represents an acquired lock.
+type Lease struct {
+	Holder     string    // identifier of the run that holds the lock
+	Expires    time.Time // time after which the lease can be taken over by another holder
+	generation int64     // generation of the lock object (used only by GCSLocker)
+}
+
+// Locker is an interface which wraps the methods for acquiring and releasing the invoker lock.
+// Acquire returns ErrLockHeld if a valid lease is held by another holder.
+type Locker interface {
+	Acquire(ctx context.Context, holder string, ttl time.Duration) (*Lease, error)
+	Release(ctx context.Context, lease *Lease) error
+}
+
+// MemoryLocker is an in-memory implementation of the Locker interface.
+// It is useful for testing and for deployments where all runs share a single process.
+type MemoryLocker struct {
+	mtx   sync.Mutex
+	lease *Lease
+}
+
+// Acquire takes the lock if it is free or if the current lease has expired.
+func (locker *MemoryLocker) Acquire(ctx context.Context, holder string, ttl time.Duration) (*Lease, error) {
+	locker.mtx.Lock()
+	defer locker.mtx.Unlock()
+
+	now := time.Now()
+	if locker.lease != nil && now.Before(locker.lease.Expires) {
+		return nil, ErrLockHeld
+	}
+
+	locker.lease = &Lease{Holder: holder, Expires: now.Add(ttl)}
+	lease := *locker.lease
+	return &lease, nil
+}
+
+// Release frees the lock if it is still held by the given lease.
+func (locker *MemoryLocker) Release(ctx context.Context, lease *Lease) error {
+	locker.mtx.Lock()
+	defer locker.mtx.Unlock()
+
+	if locker.lease != nil && locker.lease.Holder == lease.Holder {
+		locker.lease = nil
+	}
+	return nil
+}
+
+// GCSLocker is an implementation of the Locker interface which keeps the lock as an object in a GCS bucket.
+// Object generation preconditions are used so only one holder can create or take over the lock object.
+type GCSLocker struct {
+	client *storage.Client
+	object *storage.ObjectHandle
+}
+
+// NewGCSLocker creates a GCSLocker which uses the bucket and object given by the lock configuration.
+// An error is returned if the storage client could not be created.
+func NewGCSLocker(ctx context.Context, lockInfo LockInfo) (*GCSLocker, error) {
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GCSLocker{
+		client: client,
+		object: client.Bucket(lockInfo.BucketID).Object(lockInfo.ObjectName),
+	}, nil
+}
+
+// Acquire creates the lock object if it does not exist.
+// If the object exists and its lease has expired, the object is overwritten on the condition
+// that its generation has not changed in the meantime.
+func (locker *GCSLocker) Acquire(ctx context.Context, holder string, ttl time.Duration) (*Lease, error) {
+	lease, err := locker.write(ctx, storage.Conditions{DoesNotExist: true}, holder, ttl)
+	if !isPreconditionFailed(err) {
+		return lease, err
+	}
+
+	attrs, err := locker.object.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		// The lock was released in the meantime, try again on the next attempt.
+		return nil, ErrLockHeld
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expires, err := time.Parse(time.RFC3339, attrs.Metadata["expires"])
+	if err == nil && time.Now().Before(expires) {
+		return nil, ErrLockHeld
+	}
+
+	lease, err = locker.write(ctx, storage.Conditions{GenerationMatch: attrs.Generation}, holder, ttl)
+	if isPreconditionFailed(err) {
+		return nil, ErrLockHeld
+	}
+	return lease, err
+}
+
+// Release deletes the lock object if it still has the generation of the given lease.
+// A lease which was already taken over by another holder is ignored.
+func (locker *GCSLocker) Release(ctx context.Context, lease *Lease) error {
+	err := locker.object.If(storage.Conditions{GenerationMatch: lease.generation}).Delete(ctx)
+	if err == storage.ErrObjectNotExist || isPreconditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the storage client used by the locker.
+func (locker *GCSLocker) Close() error {
+	return locker.client.Close()
+}
+
+// write writes the lock object using given preconditions and returns the resulting lease.
+func (locker *GCSLocker) write(ctx context.Context, conds storage.Conditions, holder string, ttl time.Duration) (*Lease, error) {
+	expires := time.Now().Add(ttl)
+
+	writer := locker.object.If(conds).NewWriter(ctx)
+	writer.ContentType = "text/plain"
+	writer.Metadata = map[string]string{
+		"holder":  holder,
+		"expires": expires.Format(time.RFC3339),
+	}
+
+	if _, err := writer.Write([]byte(holder)); err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return &Lease{Holder: holder, Expires: expires, generation: writer.Attrs().Generation}, nil
+}
+
+// AcquireLock acquires the lock depending on the mode given by the lock configuration.
+// In the skip mode only one attempt is made. In the queue mode the function retries until
+// the lock is acquired or the queue timeout expires.
+// ErrLockHeld is returned if the lock could not be acquired.
+func AcquireLock(ctx context.Context, locker Locker, lockInfo LockInfo, holder string) (*Lease, error) {
+	ttl := time.Duration(lockInfo.TTL) * time.Second
+
+	lease, err := locker.Acquire(ctx, holder, ttl)
+	if err != ErrLockHeld || lockInfo.Mode != LockModeQueue {
+		return lease, err
+	}
+
+	ctxx, cancel := context.WithTimeout(ctx, time.Duration(lockInfo.QueueTimeout)*time.Second)
+	defer cancel()
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctxx.Done():
+			return nil, ErrLockHeld
+		case <-ticker.C:
+			lease, err = locker.Acquire(ctxx, holder, ttl)
+			if err != nil && ctxx.Err() != nil {
+				// The queue timeout expired during the attempt.
+				return nil, ErrLockHeld
+			}
+			if err != ErrLockHeld {
+				return lease, err
+			}
+		}
+	}
+}
+
+// isPreconditionFailed checks whether the error was caused by an unsatisfied GCS precondition.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
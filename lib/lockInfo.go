@@ -0,0 +1,80 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// LockModeSkip makes the invoker skip a run if the lock is held by a previous run.
+	LockModeSkip = "skip"
+	// LockModeQueue makes the invoker wait for the lock to be released before starting a run.
+	LockModeQueue = "queue"
+
+	defaultLockObject       = "invoker.lock"
+	defaultLockTTL          = 540
+	defaultLockQueueTimeout = 60
+)
+
+// LockInfo represents invoker lock configuration.
+// It holds information needed for preventing overlapping invoker runs.
+// The lock is optional and it is disabled if the bucket ID is not set.
+type LockInfo struct {
+	BucketID     string // ID of a bucket in which the lock object will be kept (empty value disables the lock)
+	ObjectName   string // name of the lock object
+	TTL          int    // number of seconds after which an unreleased lock is considered expired
+	Mode         string // behaviour when the lock is held: skip or queue
+	QueueTimeout int    // number of seconds the invoker waits for the lock in the queue mode
+}
+
+// SetLockInfo sets the parameters of a lock configuration by extracting values from the corresponding environment variables.
+// All of the variables are optional, if LOCK_BUCKET_ID is not set the lock is disabled.
+// An error is returned if any errors occur during the function execution.
+func SetLockInfo(lockInfo *LockInfo) error {
+	var err error
+
+	lockInfo.BucketID = getOptionalEnvVariable("LOCK_BUCKET_ID", "")
+	lockInfo.ObjectName = getOptionalEnvVariable("LOCK_OBJECT", defaultLockObject)
+	lockInfo.Mode = getOptionalEnvVariable("LOCK_MODE", LockModeSkip)
+
+	if lockInfo.Mode != LockModeSkip && lockInfo.Mode != LockModeQueue {
+		return fmt.Errorf("Invalid lock mode '%s', expected '%s' or '%s'", lockInfo.Mode, LockModeSkip, LockModeQueue)
+	}
+
+	lockInfo.TTL, err = strconv.Atoi(getOptionalEnvVariable("LOCK_TTL", strconv.Itoa(defaultLockTTL)))
+	if err != nil {
+		return err
+	}
+	if lockInfo.TTL < 1 {
+		return fmt.Errorf("Lock TTL must be positive")
+	}
+
+	lockInfo.QueueTimeout, err = strconv.Atoi(getOptionalEnvVariable("LOCK_QUEUE_TIMEOUT", strconv.Itoa(defaultLockQueueTimeout)))
+	if err != nil {
+		return err
+	}
+	if lockInfo.QueueTimeout < 0 {
+		return fmt.Errorf("Lock queue timeout must not be negative")
+	}
+
+	return nil
+}
+
+// Enabled reports whether the lock is configured.
+func (lockInfo LockInfo) Enabled() bool {
+	return lockInfo.BucketID != ""
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// startLocker starts a fake GCS server and returns a locker which keeps the lock in it.
+// The returned function closes the locker and stops the server.
+func startLocker(t *testing.T) (*sinktest.GCSServer, *GCSLocker, func()) {
+	t.Helper()
+
+	gcs, stopGCS := startGCS(t)
+	locker, err := NewGCSLocker(context.Background(), LockInfo{BucketID: "locks", ObjectName: "invoker.lock"})
+	if err != nil {
+		stopGCS()
+		t.Fatal(err)
+	}
+	return gcs, locker, func() {
+		locker.Close()
+		stopGCS()
+	}
+}
+
+func TestMemoryLocker(t *testing.T) {
+	var locker MemoryLocker
+	ctx := context.Background()
+
+	lease, err := locker.Acquire(ctx, "run-1", time.Minute)
+	if err != nil || lease.Holder != "run-1" {
+		t.Fatalf("Acquire() = %+v, %v, want the lease of run-1", lease, err)
+	}
+	if _, err := locker.Acquire(ctx, "run-2", time.Minute); err != ErrLockHeld {
+		t.Errorf("Acquire() of a held lock error = %v, want ErrLockHeld", err)
+	}
+
+	if err := locker.Release(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := locker.Acquire(ctx, "run-2", -time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire() of a released lock error = %v", err)
+	}
+
+	// An expired lease is taken over, and its release leaves the new lease in place.
+	lease, err = locker.Acquire(ctx, "run-3", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire() of an expired lock error = %v", err)
+	}
+	if err := locker.Release(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := locker.Acquire(ctx, "run-4", time.Minute); err != ErrLockHeld {
+		t.Errorf("Acquire() after the release of an expired lease error = %v, want ErrLockHeld", err)
+	}
+
+	// The lease returned by Acquire is a copy, so changing it does not change the held lease.
+	lease.Expires = time.Now().Add(-time.Minute)
+	if _, err := locker.Acquire(ctx, "run-4", time.Minute); err != ErrLockHeld {
+		t.Errorf("Acquire() after changing the returned lease error = %v, want ErrLockHeld", err)
+	}
+}
+
+func TestAcquireLockMemoryLocker(t *testing.T) {
+	var locker MemoryLocker
+	ctx := context.Background()
+
+	previous := lockPollInterval
+	lockPollInterval = 10 * time.Millisecond
+	defer func() { lockPollInterval = previous }()
+
+	held, err := AcquireLock(ctx, &locker, LockInfo{TTL: 60, Mode: LockModeSkip}, "run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireLock(ctx, &locker, LockInfo{TTL: 60, Mode: LockModeSkip}, "run-2"); err != ErrLockHeld {
+		t.Errorf("AcquireLock() in the skip mode error = %v, want ErrLockHeld", err)
+	}
+
+	// The queue mode takes the lock once the previous run releases it.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		locker.Release(ctx, held)
+	}()
+	lease, err := AcquireLock(ctx, &locker, LockInfo{TTL: 60, Mode: LockModeQueue, QueueTimeout: 10}, "run-2")
+	if err != nil || lease.Holder != "run-2" {
+		t.Errorf("AcquireLock() in the queue mode = %+v, %v, want the lease of run-2", lease, err)
+	}
+}
+
+func TestGCSLockerAcquireAndRelease(t *testing.T) {
+	gcs, locker, stop := startLocker(t)
+	defer stop()
+	ctx := context.Background()
+
+	lease, err := locker.Acquire(ctx, "run-1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, ok := gcs.Object("locks", "invoker.lock")
+	if !ok || object.Metadata["holder"] != "run-1" || object.Generation != lease.generation {
+		t.Fatalf("lock object = %+v, want the lease of run-1", object)
+	}
+
+	if _, err := locker.Acquire(ctx, "run-2", time.Minute); err != ErrLockHeld {
+		t.Errorf("Acquire() of a held lock error = %v, want ErrLockHeld", err)
+	}
+
+	if err := locker.Release(ctx, lease); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gcs.Object("locks", "invoker.lock"); ok {
+		t.Error("lock object was not deleted on release")
+	}
+	if _, err := locker.Acquire(ctx, "run-2", time.Minute); err != nil {
+		t.Errorf("Acquire() of a released lock error = %v", err)
+	}
+}
+
+func TestGCSLockerTakesOverExpiredLease(t *testing.T) {
+	gcs, locker, stop := startLocker(t)
+	defer stop()
+	ctx := context.Background()
+
+	expired, err := locker.Acquire(ctx, "run-1", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err := locker.Acquire(ctx, "run-2", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire() of an expired lock error = %v", err)
+	}
+	if lease.generation == expired.generation {
+		t.Error("lock object was not rewritten")
+	}
+
+	// The generation of the expired lease no longer matches, so its release leaves the new lease in place.
+	if err := locker.Release(ctx, expired); err != nil {
+		t.Fatal(err)
+	}
+	object, ok := gcs.Object("locks", "invoker.lock")
+	if !ok || object.Metadata["holder"] != "run-2" {
+		t.Errorf("lock object = %+v, want the lease of run-2", object)
+	}
+}
+
+func TestGCSLockerLosesTakeOverRace(t *testing.T) {
+	gcs, locker, stop := startLocker(t)
+	defer stop()
+	ctx := context.Background()
+
+	if _, err := locker.Acquire(ctx, "run-1", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// Another holder rewrites the lock object between the read of its attributes and the take-over.
+	attrs, _ := gcs.Object("locks", "invoker.lock")
+	_, err := locker.write(ctx, storage.Conditions{GenerationMatch: attrs.Generation + 1}, "run-2", time.Minute)
+	if !isPreconditionFailed(err) {
+		t.Errorf("write() with a stale generation error = %v, want a failed precondition", err)
+	}
+}
+
+func TestAcquireLockModes(t *testing.T) {
+	_, locker, stop := startLocker(t)
+	defer stop()
+	ctx := context.Background()
+
+	previous := lockPollInterval
+	lockPollInterval = 10 * time.Millisecond
+	defer func() { lockPollInterval = previous }()
+
+	held, err := locker.Acquire(ctx, "run-1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The skip mode makes a single attempt.
+	start := time.Now()
+	_, err = AcquireLock(ctx, locker, LockInfo{TTL: 60, Mode: LockModeSkip, QueueTimeout: 60}, "run-2")
+	if err != ErrLockHeld || time.Since(start) > time.Second {
+		t.Errorf("AcquireLock() in the skip mode error = %v after %v, want ErrLockHeld at once", err, time.Since(start))
+	}
+
+	// The queue mode gives up once the queue timeout expires.
+	_, err = AcquireLock(ctx, locker, LockInfo{TTL: 60, Mode: LockModeQueue, QueueTimeout: 1}, "run-2")
+	if err != ErrLockHeld {
+		t.Errorf("AcquireLock() in the queue mode error = %v, want ErrLockHeld after the timeout", err)
+	}
+
+	// The queue mode takes the lock once the previous run releases it.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		locker.Release(ctx, held)
+	}()
+	lease, err := AcquireLock(ctx, locker, LockInfo{TTL: 60, Mode: LockModeQueue, QueueTimeout: 10}, "run-2")
+	if err != nil || lease.Holder != "run-2" {
+		t.Errorf("AcquireLock() in the queue mode = %+v, %v, want the lease of run-2", lease, err)
+	}
+}
+
+func TestSetLockInfo(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		value string
+	}{
+		{"LOCK_TTL", "0"},
+		{"LOCK_TTL", "-5"},
+		{"LOCK_QUEUE_TIMEOUT", "-1"},
+		{"LOCK_MODE", "wait"},
+	} {
+		restore := setEnv(test.name, test.value)
+		err := SetLockInfo(&LockInfo{})
+		restore()
+		if err == nil {
+			t.Errorf("SetLockInfo() with %s=%s error = nil, want an error", test.name, test.value)
+		}
+	}
+
+	var lockInfo LockInfo
+	if err := SetLockInfo(&lockInfo); err != nil {
+		t.Fatal(err)
+	}
+	if lockInfo.TTL != defaultLockTTL || lockInfo.Mode != LockModeSkip || lockInfo.Enabled() {
+		t.Errorf("SetLockInfo() = %+v, want the defaults", lockInfo)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const defaultLookupWindow = 24
+
+// LookupInfo represents message lookup configuration.
+// It holds information needed for finding the stored messages by their IDs.
+type LookupInfo struct {
+	BucketID string // ID of a bucket in which the messages are stored
+	Format   string // format of the stored messages (raw or envelope)
+	Window   int    // number of past hours which are searched if the time window is not given
+}
+
+// SetLookupInfo sets the parameters of a message lookup configuration by extracting values from the corresponding environment variables.
+// An error is returned if any errors occur during the function execution.
+func SetLookupInfo(lookupInfo *LookupInfo) error {
+	var err error
+
+	lookupInfo.BucketID, err = getEnvVariable("BUCKET_ID")
+	if err != nil {
+		return err
+	}
+
+	lookupInfo.Format = getOptionalEnvVariable("MSG_FORMAT", FormatRaw)
+	if lookupInfo.Format != FormatRaw && lookupInfo.Format != FormatEnvelope {
+		return fmt.Errorf("Invalid message format '%s', expected '%s' or '%s'", lookupInfo.Format, FormatRaw, FormatEnvelope)
+	}
+
+	lookupInfo.Window, err = strconv.Atoi(getOptionalEnvVariable("LOOKUP_WINDOW", strconv.Itoa(defaultLookupWindow)))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Message represents a Pub/Sub message independently of the way it was delivered (push or pull).
+type Message struct {
+	ID              string            // ID of a message assigned by Pub/Sub
+	Data            []byte            // message payload
+	Attributes      map[string]string // message attributes
+	PublishTime     time.Time         // time at which the message was published
+	OrderingKey     string            // ordering key of a message (empty if message ordering is not used)
+	DeliveryAttempt *int              // number of delivery attempts (set only if a dead letter policy is configured)
+}
+
+// Envelope is the JSON representation of a message which is stored when the envelope format is chosen.
+// Unlike the raw format, the envelope keeps the message metadata together with the payload.
+type Envelope struct {
+	MessageID   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	Data        []byte            `json:"data"`
+}
+
+// MessageFromPubsub converts a message received by the Pub/Sub client to a Message.
+func MessageFromPubsub(msg *pubsub.Message) Message {
+	return Message{
+		ID:              msg.ID,
+		Data:            msg.Data,
+		Attributes:      msg.Attributes,
+		PublishTime:     msg.PublishTime,
+		OrderingKey:     msg.OrderingKey,
+		DeliveryAttempt: msg.DeliveryAttempt,
+	}
+}
+
+// NewEnvelope creates the envelope of a given message.
+func NewEnvelope(msg Message) Envelope {
+	return Envelope{
+		MessageID:   msg.ID,
+		PublishTime: msg.PublishTime,
+		Attributes:  msg.Attributes,
+		OrderingKey: msg.OrderingKey,
+		Data:        msg.Data,
+	}
+}
+
+// Message converts the envelope back to a Message.
+func (envelope Envelope) Message() Message {
+	return Message{
+		ID:          envelope.MessageID,
+		Data:        envelope.Data,
+		Attributes:  envelope.Attributes,
+		PublishTime: envelope.PublishTime,
+		OrderingKey: envelope.OrderingKey,
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+)
+
+// PersistedEvent is the notification published after an object is stored.
+type PersistedEvent struct {
+	Bucket         string    `json:"bucket"`         // bucket in which the object is stored
+	Object         string    `json:"object"`         // name of the stored object
+	Generation     int64     `json:"generation"`     // generation of the stored object
+	MessageCount   int       `json:"messageCount"`   // number of messages stored in the object
+	ByteSize       int64     `json:"byteSize"`       // size of the object in bytes
+	PartitionTime  time.Time `json:"partitionTime"`  // start of the hourly partition in which the object is stored
+	FirstMessageID string    `json:"firstMessageId"` // ID of the first message stored in the object
+	LastMessageID  string    `json:"lastMessageId"`  // ID of the last message stored in the object
+}
+
+// newPersistedEvent creates the notification of an object which holds the given messages.
+func newPersistedEvent(attrs *storage.ObjectAttrs, partitionTime time.Time, msgs ...Message) PersistedEvent {
+	event := PersistedEvent{
+		Bucket:        attrs.Bucket,
+		Object:        attrs.Name,
+		Generation:    attrs.Generation,
+		MessageCount:  len(msgs),
+		ByteSize:      attrs.Size,
+		PartitionTime: PartitionHour(partitionTime),
+	}
+	if len(msgs) > 0 {
+		event.FirstMessageID = msgs[0].ID
+		event.LastMessageID = msgs[len(msgs)-1].ID
+	}
+	return event
+}
+
+// notificationKey identifies a notification topic by its project and ID.
+type notificationKey struct {
+	projectID string
+	topicID   string
+}
+
+// notificationClients and topics cache the Pub/Sub clients of the notification projects and their topics, so a client
+// is created once per instance instead of once per stored object. They are released by CloseNotifications.
+var (
+	notificationClients = make(map[string]*pubsub.Client)
+	topics              = make(map[notificationKey]*pubsub.Topic)
+	topicsMtx           sync.Mutex
+)
+
+// notificationTopic returns the cached topic of the notification configuration, creating it (and the client of its project) if needed.
+func notificationTopic(ctx context.Context, info NotificationInfo) (*pubsub.Topic, error) {
+	topicsMtx.Lock()
+	defer topicsMtx.Unlock()
+
+	key := notificationKey{projectID: info.ProjectID, topicID: info.TopicID}
+	if topic, ok := topics[key]; ok {
+		return topic, nil
+	}
+
+	client, ok := notificationClients[info.ProjectID]
+	if !ok {
+		// The client is not bound to the passed in context, since it outlives the call.
+		var err error
+		client, err = pubsub.NewClient(context.Background(), info.ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		notificationClients[info.ProjectID] = client
+	}
+
+	topic := client.Topic(info.TopicID)
+	topics[key] = topic
+	return topic, nil
+}
+
+// CloseNotifications stops the cached notification topics and closes their clients. It is called when a long-running
+// process shuts down, after the last message is stored. The topics are created again if a notification is published later.
+// An error is returned if any of the clients could not be closed.
+func CloseNotifications() error {
+	topicsMtx.Lock()
+	defer topicsMtx.Unlock()
+
+	for key, topic := range topics {
+		topic.Stop()
+		delete(topics, key)
+	}
+
+	var err error
+	for projectID, client := range notificationClients {
+		if cErr := client.Close(); cErr != nil && err == nil {
+			err = cErr
+		}
+		delete(notificationClients, projectID)
+	}
+	return err
+}
+
+// Notify publishes the notification of a stored object to the configured topic and waits until it is published.
+// The event is published as JSON, with the bucket, object and generation also set as message attributes.
+// An error is returned if the notification could not be published, in which case the messages stored in the object
+// should be redelivered, so the notifications are published at least once.
+func Notify(ctx context.Context, event PersistedEvent, info NotificationInfo) error {
+	topic, err := notificationTopic(ctx, info)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	result := topic.Publish(ctx, &pubsub.Message{
+		Data: data,
+		Attributes: map[string]string{
+			"eventType":  "persisted",
+			"bucket":     event.Bucket,
+			"object":     event.Object,
+			"generation": strconv.FormatInt(event.Generation, 10),
+		},
+	})
+
+	_, err = result.Get(ctx)
+	return err
+}
@@ -0,0 +1,47 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import "fmt"
+
+// NotificationInfo represents notification configuration.
+// It holds information needed for publishing a notification after each stored object.
+// The notifications are optional and they are disabled if the topic ID is not set.
+type NotificationInfo struct {
+	ProjectID string // ID of a project in which the notification topic is located
+	TopicID   string // ID of a topic to which the notifications will be published (empty value disables the notifications)
+}
+
+// SetNotificationInfo sets the parameters of a notification configuration by extracting values from the corresponding environment variables.
+// If NOTIFY_PROJECT_ID is not set, the project given by PROJECT_ID is used.
+// An error is returned if any errors occur during the function execution.
+func SetNotificationInfo(notificationInfo *NotificationInfo) error {
+	notificationInfo.TopicID = getOptionalEnvVariable("NOTIFY_TOPIC_ID", "")
+	if notificationInfo.TopicID == "" {
+		return nil
+	}
+
+	notificationInfo.ProjectID = getOptionalEnvVariable("NOTIFY_PROJECT_ID", getOptionalEnvVariable("PROJECT_ID", ""))
+	if notificationInfo.ProjectID == "" {
+		return fmt.Errorf("Project of the notification topic is not set (NOTIFY_PROJECT_ID or PROJECT_ID)")
+	}
+
+	return nil
+}
+
+// Enabled reports whether the notifications are configured.
+func (notificationInfo NotificationInfo) Enabled() bool {
+	return notificationInfo.TopicID != ""
+}
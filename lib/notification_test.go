@@ -0,0 +1,180 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+func TestNewPersistedEvent(t *testing.T) {
+	kolkata := time.FixedZone("IST", 5*3600+1800)
+	attrs := &storage.ObjectAttrs{Bucket: "bucket", Name: "2020/10/01/12/msg-2.txt", Generation: 7, Size: 42}
+	partitionTime := time.Date(2020, 10, 1, 12, 10, 0, 0, kolkata)
+
+	event := newPersistedEvent(attrs, partitionTime, Message{ID: "1"}, Message{ID: "2"}, Message{ID: "3"})
+
+	want := PersistedEvent{
+		Bucket:         "bucket",
+		Object:         "2020/10/01/12/msg-2.txt",
+		Generation:     7,
+		MessageCount:   3,
+		ByteSize:       42,
+		PartitionTime:  time.Date(2020, 10, 1, 12, 0, 0, 0, kolkata),
+		FirstMessageID: "1",
+		LastMessageID:  "3",
+	}
+	if !event.PartitionTime.Equal(want.PartitionTime) {
+		t.Errorf("PartitionTime = %v, want %v", event.PartitionTime, want.PartitionTime)
+	}
+	event.PartitionTime = want.PartitionTime
+	if event != want {
+		t.Errorf("newPersistedEvent() = %+v, want %+v", event, want)
+	}
+	if folder := PartitionFolder(event.PartitionTime); folder != "2020/10/01/12" {
+		t.Errorf("partition folder = %s, want 2020/10/01/12", folder)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	info := NotificationInfo{ProjectID: "project", TopicID: "notify-payload"}
+	server, stop := startPubsub(t, info.ProjectID, info.TopicID)
+	defer stop()
+
+	event := PersistedEvent{Bucket: "bucket", Object: "2020/10/01/12/msg-1.txt", Generation: 5, MessageCount: 1, ByteSize: 3, FirstMessageID: "1", LastMessageID: "1"}
+	if err := Notify(context.Background(), event, info); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	msgs := server.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("published %d messages, want 1", len(msgs))
+	}
+	wantAttributes := map[string]string{"eventType": "persisted", "bucket": "bucket", "object": "2020/10/01/12/msg-1.txt", "generation": "5"}
+	for key, value := range wantAttributes {
+		if msgs[0].Attributes[key] != value {
+			t.Errorf("attribute %s = %q, want %q", key, msgs[0].Attributes[key], value)
+		}
+	}
+
+	var published map[string]interface{}
+	if err := json.Unmarshal(msgs[0].Data, &published); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"bucket", "object", "generation", "messageCount", "byteSize", "partitionTime", "firstMessageId", "lastMessageId"} {
+		if _, ok := published[field]; !ok {
+			t.Errorf("notification has no %s field", field)
+		}
+	}
+}
+
+func TestProcessMessageNotifies(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopPubsub := startPubsub(t, "project", "notify-stored")
+	defer stopPubsub()
+
+	conf := PersistConf{
+		Storage:      StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "txt", Format: FormatRaw},
+		Notification: NotificationInfo{ProjectID: "project", TopicID: "notify-stored"},
+	}
+	report := NewRunReport()
+	if err := ProcessMessage(context.Background(), Message{ID: "42", Data: []byte("abc")}, conf, report); err != nil {
+		t.Fatalf("ProcessMessage() error = %v", err)
+	}
+
+	names := gcs.Names("bucket")
+	if len(names) != 1 {
+		t.Fatalf("stored objects = %v, want 1", names)
+	}
+	msgs := server.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("published %d notifications, want 1", len(msgs))
+	}
+	var event PersistedEvent
+	if err := json.Unmarshal(msgs[0].Data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Object != names[0] || event.MessageCount != 1 || event.FirstMessageID != "42" || event.ByteSize != 3 {
+		t.Errorf("notification = %+v, want the stored object %s", event, names[0])
+	}
+	if report.Persisted != 1 {
+		t.Errorf("persisted = %d, want 1", report.Persisted)
+	}
+}
+
+func TestProcessMessageRedeliversOnNotificationFailure(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	// The topic is not created, so publishing fails.
+	_, stopPubsub := startPubsub(t, "project")
+	defer stopPubsub()
+
+	conf := PersistConf{
+		Storage:      StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "txt", Format: FormatRaw},
+		Notification: NotificationInfo{ProjectID: "project", TopicID: "notify-missing"},
+		Quarantine:   QuarantineInfo{BucketID: "quarantine"},
+	}
+	report := NewRunReport()
+	err := ProcessMessage(context.Background(), Message{ID: "42", Data: []byte("abc")}, conf, report)
+	if err == nil {
+		t.Fatal("ProcessMessage() error = nil, want the publish error so the message is redelivered")
+	}
+
+	// The message is stored, but it is neither acknowledged nor quarantined.
+	if len(gcs.Names("bucket")) != 1 {
+		t.Errorf("stored objects = %v, want 1", gcs.Names("bucket"))
+	}
+	if len(gcs.Names("quarantine")) != 0 {
+		t.Errorf("quarantined objects = %v, want none", gcs.Names("quarantine"))
+	}
+	if report.Failed != 1 || report.Persisted != 0 {
+		t.Errorf("failed = %d, persisted = %d, want 1 and 0", report.Failed, report.Persisted)
+	}
+}
+
+func TestNotificationTopicCache(t *testing.T) {
+	_, stop := startPubsub(t, "project")
+	defer stop()
+	ctx := context.Background()
+
+	first, err := notificationTopic(ctx, NotificationInfo{ProjectID: "project", TopicID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := notificationTopic(ctx, NotificationInfo{ProjectID: "project", TopicID: "a"})
+	other, _ := notificationTopic(ctx, NotificationInfo{ProjectID: "project", TopicID: "b"})
+	otherProject, _ := notificationTopic(ctx, NotificationInfo{ProjectID: "other", TopicID: "a"})
+	if again != first || other == first || otherProject == first {
+		t.Error("topics are not cached by the project and topic ID")
+	}
+	if len(notificationClients) != 2 {
+		t.Errorf("created %d clients, want one per project", len(notificationClients))
+	}
+
+	if err := CloseNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 0 || len(notificationClients) != 0 {
+		t.Errorf("%d topics and %d clients are cached after closing, want none", len(topics), len(notificationClients))
+	}
+	if topic, _ := notificationTopic(ctx, NotificationInfo{ProjectID: "project", TopicID: "a"}); topic == first {
+		t.Error("a closed topic is reused")
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.18
+// +build go1.18
+
+package parquet
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fuzzColumns are columns of each type, all of them optional except the first one.
+var fuzzColumns = []Column{
+	{Name: "id", Type: Int64, Required: true},
+	{Name: "name", Type: String},
+	{Name: "raw", Type: Bytes},
+	{Name: "doc", Type: JSON},
+	{Name: "count", Type: Int32},
+	{Name: "ratio", Type: Float},
+	{Name: "amount", Type: Double},
+	{Name: "paid", Type: Boolean},
+	{Name: "created", Type: Timestamp},
+	{Name: "labels", Type: StringMap},
+}
+
+// sameRows compares rows as reflect.DeepEqual does, except that the floating point values are compared by their bits,
+// so a NaN matches itself.
+func sameRows(a, b [][]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			switch x := a[i][j].(type) {
+			case float32:
+				y, ok := b[i][j].(float32)
+				if !ok || math.Float32bits(x) != math.Float32bits(y) {
+					return false
+				}
+			case float64:
+				y, ok := b[i][j].(float64)
+				if !ok || math.Float64bits(x) != math.Float64bits(y) {
+					return false
+				}
+			default:
+				if !reflect.DeepEqual(a[i][j], b[i][j]) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func FuzzWriterRoundTrip(f *testing.F) {
+	f.Add(int64(1), "Ana", []byte{0, 1, 2}, int32(7), float32(0.5), 12.25, true, int64(1604572200123456000), uint16(0), uint8(0), uint16(1<<10))
+	f.Add(int64(-3), "", []byte{}, int32(-1), float32(math.NaN()), math.Inf(-1), false, int64(-1), uint16(0xffff), uint8(1), uint16(1))
+	f.Add(int64(math.MaxInt64), "ključ", []byte("x"), int32(math.MinInt32), float32(-2), -1e10, true, int64(0), uint16(0x0155), uint8(2), uint16(40))
+
+	compressions := []string{Uncompressed, Snappy, Gzip}
+	f.Fuzz(func(t *testing.T, id int64, s string, b []byte, n int32, ratio float32, amount float64, paid bool,
+		nanos int64, nulls uint16, compression uint8, rowGroupSize uint16) {
+		if b == nil {
+			b = []byte{}
+		}
+		created := time.Unix(0, nanos/1000*1000).UTC()
+		full := []interface{}{id, s, b, s, n, ratio, amount, paid, created, map[string]string{s: string(b), "": s}}
+
+		// The first row has all of the values, the second one is null where a bit of nulls is set,
+		// and the third one is null in all of the optional columns, with an empty map.
+		rows := [][]interface{}{full, make([]interface{}, len(full)), make([]interface{}, len(full))}
+		for i := range full {
+			if i == 0 || nulls&(1<<uint(i)) == 0 {
+				rows[1][i] = full[i]
+			}
+		}
+		rows[2][0] = -id
+		rows[2][9] = map[string]string{}
+
+		compressionName := compressions[int(compression)%len(compressions)]
+		var buf bytes.Buffer
+		writer, err := NewWriter(&buf, fuzzColumns, compressionName, int64(rowGroupSize)+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, row := range rows {
+			if err := writer.Write(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := readRows(t, buf.Bytes(), fuzzColumns, compressionName); !sameRows(got, rows) {
+			t.Errorf("rows read back = %v, want %v", got, rows)
+		}
+	})
+}
@@ -0,0 +1,635 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package parquet writes Parquet files of flat rows, whose columns are primitive values or maps of strings.
+// It is used to store the batches of messages in the Parquet format.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	// Uncompressed stores the pages of a Parquet file uncompressed.
+	Uncompressed = "uncompressed"
+	// Snappy compresses the pages of a Parquet file with snappy.
+	Snappy = "snappy"
+	// Gzip compresses the pages of a Parquet file with gzip.
+	Gzip = "gzip"
+)
+
+// The types of the Parquet columns.
+const (
+	String    = "string"    // UTF-8 string
+	Bytes     = "bytes"     // byte sequence
+	JSON      = "json"      // JSON document
+	Int32     = "int32"     // 32-bit integer
+	Int64     = "int64"     // 64-bit integer
+	Float     = "float"     // 32-bit floating point number
+	Double    = "double"    // 64-bit floating point number
+	Boolean   = "boolean"   // boolean
+	Timestamp = "timestamp" // timestamp with microsecond precision (UTC)
+	StringMap = "map"       // map of strings to strings
+)
+
+// magic starts and ends each Parquet file.
+var magic = []byte("PAR1")
+
+// The values of the enumerations of the Parquet file metadata.
+const (
+	typeBoolean   = 0
+	typeInt32     = 1
+	typeInt64     = 2
+	typeFloat     = 4
+	typeDouble    = 5
+	typeByteArray = 6
+
+	convertedUTF8            = 0
+	convertedMap             = 1
+	convertedMapKeyValue     = 2
+	convertedTimestampMicros = 10
+	convertedJSON            = 19
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+	repetitionRepeated = 2
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	pageTypeData = 0
+)
+
+// codecs maps the compression options to the codecs of the Parquet file metadata.
+var codecs = map[string]int32{Uncompressed: 0, Snappy: 1, Gzip: 2}
+
+// physicalTypes maps the column types to their physical and converted (logical) types (-1 if there is none).
+var physicalTypes = map[string][2]int32{
+	String:    {typeByteArray, convertedUTF8},
+	Bytes:     {typeByteArray, -1},
+	JSON:      {typeByteArray, convertedJSON},
+	Int32:     {typeInt32, -1},
+	Int64:     {typeInt64, -1},
+	Float:     {typeFloat, -1},
+	Double:    {typeDouble, -1},
+	Boolean:   {typeBoolean, -1},
+	Timestamp: {typeInt64, convertedTimestampMicros},
+}
+
+// Column is a top-level column of a Parquet file.
+type Column struct {
+	Name     string
+	Type     string // type of the column (e.g. String)
+	Required bool   // whether the column must have a value in each row
+}
+
+// leafColumn holds the buffered values of a leaf column (a primitive column, or a key or value of a map) of the current row group.
+type leafColumn struct {
+	path      []string
+	physical  int32
+	maxDef    int
+	maxRep    int
+	defs      []int
+	reps      []int
+	values    bytes.Buffer // plain encoded values (except booleans)
+	booleans  []bool
+	numValues int // number of values, including nulls
+}
+
+// Writer writes the rows of a Parquet file. The rows are buffered and written in row groups, each with
+// a single data page per column. The file metadata is written by Close.
+type Writer struct {
+	writer       io.Writer
+	columns      []Column
+	leaves       [][]*leafColumn // leaves of each column
+	codec        int32
+	rowGroupSize int64
+
+	offset    int64      // number of written bytes
+	rows      int64      // number of rows in the current row group
+	buffered  int64      // size of the buffered values and levels
+	rowGroups []rowGroup // written row groups
+	totalRows int64
+}
+
+// rowGroup is the metadata of a written row group.
+type rowGroup struct {
+	chunks    []columnChunk
+	byteSize  int64
+	numRows   int64
+	fileStart int64
+}
+
+// columnChunk is the metadata of a written column chunk.
+type columnChunk struct {
+	leaf             *leafColumn
+	offset           int64
+	numValues        int64
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// NewWriter writes the header of a Parquet file with the given columns, whose pages are compressed with the given codec.
+// A row group is written once its buffered values reach the row group size in bytes.
+// An error is returned if the columns or the codec are not valid, or if the header could not be written.
+func NewWriter(w io.Writer, columns []Column, compression string, rowGroupSize int64) (*Writer, error) {
+	codec, ok := codecs[compression]
+	if !ok {
+		return nil, fmt.Errorf("Unknown Parquet compression '%s', expected '%s', '%s' or '%s'", compression, Uncompressed, Snappy, Gzip)
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("Parquet schema has no columns")
+	}
+
+	writer := &Writer{writer: w, columns: columns, codec: codec, rowGroupSize: rowGroupSize}
+	names := make(map[string]bool)
+	for _, column := range columns {
+		if column.Name == "" || names[column.Name] {
+			return nil, fmt.Errorf("Parquet column without a name or with a duplicate name '%s'", column.Name)
+		}
+		names[column.Name] = true
+
+		def := 0
+		if !column.Required {
+			def = 1
+		}
+		if column.Type == StringMap {
+			writer.leaves = append(writer.leaves, []*leafColumn{
+				{path: []string{column.Name, "key_value", "key"}, physical: typeByteArray, maxDef: def + 1, maxRep: 1},
+				{path: []string{column.Name, "key_value", "value"}, physical: typeByteArray, maxDef: def + 2, maxRep: 1},
+			})
+			continue
+		}
+
+		types, ok := physicalTypes[column.Type]
+		if !ok {
+			return nil, fmt.Errorf("Unknown type '%s' of Parquet column '%s'", column.Type, column.Name)
+		}
+		writer.leaves = append(writer.leaves, []*leafColumn{{path: []string{column.Name}, physical: types[0], maxDef: def}})
+	}
+
+	if err := writer.write(magic); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// TypeError is returned if a value does not match the type of its column.
+type TypeError struct {
+	Column  string
+	Message string
+}
+
+func (err *TypeError) Error() string {
+	return fmt.Sprintf("Column '%s': %s", err.Column, err.Message)
+}
+
+// Write adds a row, given as the values of the columns in their order. A nil value is a null. The values are given as
+// string or []byte (string, bytes and json columns), int32 or int64 (integer columns), float32 or float64 (floating point
+// columns), bool, time.Time (timestamp columns) and map[string]string (map columns). A row which does not match
+// the columns is not added and a *TypeError is returned.
+func (writer *Writer) Write(row []interface{}) error {
+	if len(row) != len(writer.columns) {
+		return &TypeError{Message: fmt.Sprintf("expected %d values, got %d", len(writer.columns), len(row))}
+	}
+
+	// The values are checked before any of them is buffered, so a row is either added as a whole or not at all.
+	for i, column := range writer.columns {
+		if err := checkValue(column, row[i]); err != nil {
+			return err
+		}
+	}
+
+	for i, column := range writer.columns {
+		leaves := writer.leaves[i]
+		before := writer.leafSize(leaves)
+		if column.Type == StringMap {
+			writer.addMap(column, leaves[0], leaves[1], row[i])
+		} else {
+			writer.addValue(leaves[0], row[i])
+		}
+		writer.buffered += writer.leafSize(leaves) - before
+	}
+	writer.rows++
+
+	if writer.buffered >= writer.rowGroupSize {
+		return writer.flushRowGroup()
+	}
+	return nil
+}
+
+// Size returns the size of the written row groups and of the buffered values (before compression).
+func (writer *Writer) Size() int64 {
+	var size int64
+	for _, group := range writer.rowGroups {
+		size += group.byteSize
+	}
+	return size + writer.buffered
+}
+
+func (writer *Writer) leafSize(leaves []*leafColumn) int64 {
+	var size int64
+	for _, leaf := range leaves {
+		size += int64(leaf.values.Len()) + int64(len(leaf.booleans)/8) + int64(len(leaf.defs)+len(leaf.reps))/4
+	}
+	return size
+}
+
+// checkValue checks whether a value matches the type of its column.
+func checkValue(column Column, value interface{}) error {
+	if value == nil {
+		if column.Required {
+			return &TypeError{Column: column.Name, Message: "missing required value"}
+		}
+		return nil
+	}
+
+	ok := false
+	switch column.Type {
+	case String, Bytes, JSON:
+		switch value.(type) {
+		case string, []byte:
+			ok = true
+		}
+	case Int32:
+		_, ok = value.(int32)
+	case Int64:
+		_, ok = value.(int64)
+	case Float:
+		_, ok = value.(float32)
+	case Double:
+		_, ok = value.(float64)
+	case Boolean:
+		_, ok = value.(bool)
+	case Timestamp:
+		_, ok = value.(time.Time)
+	case StringMap:
+		_, ok = value.(map[string]string)
+	}
+	if !ok {
+		return &TypeError{Column: column.Name, Message: fmt.Sprintf("value of type %T does not match the column type %s", value, column.Type)}
+	}
+	return nil
+}
+
+// addValue buffers a value of a primitive column.
+func (writer *Writer) addValue(leaf *leafColumn, value interface{}) {
+	leaf.numValues++
+	if value == nil {
+		leaf.defs = append(leaf.defs, 0)
+		return
+	}
+	leaf.defs = append(leaf.defs, leaf.maxDef)
+
+	var data [8]byte
+	switch value := value.(type) {
+	case string:
+		binary.LittleEndian.PutUint32(data[:4], uint32(len(value)))
+		leaf.values.Write(data[:4])
+		leaf.values.WriteString(value)
+	case []byte:
+		binary.LittleEndian.PutUint32(data[:4], uint32(len(value)))
+		leaf.values.Write(data[:4])
+		leaf.values.Write(value)
+	case int32:
+		binary.LittleEndian.PutUint32(data[:4], uint32(value))
+		leaf.values.Write(data[:4])
+	case int64:
+		binary.LittleEndian.PutUint64(data[:], uint64(value))
+		leaf.values.Write(data[:])
+	case float32:
+		binary.LittleEndian.PutUint32(data[:4], math.Float32bits(value))
+		leaf.values.Write(data[:4])
+	case float64:
+		binary.LittleEndian.PutUint64(data[:], math.Float64bits(value))
+		leaf.values.Write(data[:])
+	case bool:
+		leaf.booleans = append(leaf.booleans, value)
+	case time.Time:
+		binary.LittleEndian.PutUint64(data[:], uint64(value.UnixNano()/1000))
+		leaf.values.Write(data[:])
+	}
+}
+
+// addMap buffers the keys and values of a map column. The entries are sorted by their keys.
+func (writer *Writer) addMap(column Column, keys *leafColumn, values *leafColumn, value interface{}) {
+	if value == nil {
+		// A null map (the map column is optional).
+		for _, leaf := range []*leafColumn{keys, values} {
+			leaf.defs = append(leaf.defs, 0)
+			leaf.reps = append(leaf.reps, 0)
+			leaf.numValues++
+		}
+		return
+	}
+
+	entries := value.(map[string]string)
+	mapDef := keys.maxDef - 1
+	if len(entries) == 0 {
+		for _, leaf := range []*leafColumn{keys, values} {
+			leaf.defs = append(leaf.defs, mapDef)
+			leaf.reps = append(leaf.reps, 0)
+			leaf.numValues++
+		}
+		return
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		rep := 1
+		if i == 0 {
+			rep = 0
+		}
+		keys.reps = append(keys.reps, rep)
+		keys.defs = append(keys.defs, keys.maxDef)
+		keys.numValues++
+		values.reps = append(values.reps, rep)
+		values.defs = append(values.defs, values.maxDef)
+		values.numValues++
+
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(name)))
+		keys.values.Write(size[:])
+		keys.values.WriteString(name)
+		binary.LittleEndian.PutUint32(size[:], uint32(len(entries[name])))
+		values.values.Write(size[:])
+		values.values.WriteString(entries[name])
+	}
+}
+
+// flushRowGroup writes the buffered rows as a row group.
+func (writer *Writer) flushRowGroup() error {
+	if writer.rows == 0 {
+		return nil
+	}
+
+	group := rowGroup{numRows: writer.rows, fileStart: writer.offset}
+	for _, leaves := range writer.leaves {
+		for _, leaf := range leaves {
+			chunk, err := writer.writeChunk(leaf)
+			if err != nil {
+				return err
+			}
+			group.chunks = append(group.chunks, chunk)
+			group.byteSize += chunk.uncompressedSize
+		}
+	}
+
+	writer.rowGroups = append(writer.rowGroups, group)
+	writer.totalRows += writer.rows
+	writer.rows = 0
+	writer.buffered = 0
+	return nil
+}
+
+// writeChunk writes the buffered values of a leaf column as a column chunk with a single data page, and resets the leaf.
+func (writer *Writer) writeChunk(leaf *leafColumn) (columnChunk, error) {
+	var page bytes.Buffer
+	if leaf.maxRep > 0 {
+		writeLevels(&page, leaf.reps, leaf.maxRep)
+	}
+	if leaf.maxDef > 0 {
+		writeLevels(&page, leaf.defs, leaf.maxDef)
+	}
+	if leaf.physical == typeBoolean {
+		packed := make([]byte, (len(leaf.booleans)+7)/8)
+		for i, b := range leaf.booleans {
+			if b {
+				packed[i/8] |= 1 << uint(i%8)
+			}
+		}
+		page.Write(packed)
+	} else {
+		page.Write(leaf.values.Bytes())
+	}
+
+	compressed, err := writer.compress(page.Bytes())
+	if err != nil {
+		return columnChunk{}, err
+	}
+
+	var header thriftWriter
+	header.begin()
+	header.i32Field(1, pageTypeData)
+	header.i32Field(2, int32(page.Len()))
+	header.i32Field(3, int32(len(compressed)))
+	header.structField(5)
+	header.i32Field(1, int32(leaf.numValues))
+	header.i32Field(2, encodingPlain)
+	header.i32Field(3, encodingRLE)
+	header.i32Field(4, encodingRLE)
+	header.end()
+	header.end()
+
+	chunk := columnChunk{
+		leaf:             leaf,
+		offset:           writer.offset,
+		numValues:        int64(leaf.numValues),
+		uncompressedSize: int64(header.buf.Len() + page.Len()),
+		compressedSize:   int64(header.buf.Len() + len(compressed)),
+	}
+	if err := writer.write(header.buf.Bytes()); err != nil {
+		return chunk, err
+	}
+	if err := writer.write(compressed); err != nil {
+		return chunk, err
+	}
+
+	leaf.defs = leaf.defs[:0]
+	leaf.reps = leaf.reps[:0]
+	leaf.values.Reset()
+	leaf.booleans = leaf.booleans[:0]
+	leaf.numValues = 0
+	return chunk, nil
+}
+
+// compress compresses the content of a page with the codec of the file.
+func (writer *Writer) compress(data []byte) ([]byte, error) {
+	switch writer.codec {
+	case codecs[Snappy]:
+		return snappy.Encode(nil, data), nil
+	case codecs[Gzip]:
+		var buf bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buf)
+		if _, err := gzipWriter.Write(data); err != nil {
+			return nil, err
+		}
+		if err := gzipWriter.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+// writeLevels appends the repetition or definition levels in the RLE encoding, preceded by their size.
+func writeLevels(buf *bytes.Buffer, levels []int, maxLevel int) {
+	width := (bits.Len(uint(maxLevel)) + 7) / 8
+
+	var encoded bytes.Buffer
+	var varint [binary.MaxVarintLen64]byte
+	for start := 0; start < len(levels); {
+		end := start + 1
+		for end < len(levels) && levels[end] == levels[start] {
+			end++
+		}
+		encoded.Write(varint[:binary.PutUvarint(varint[:], uint64(end-start)<<1)])
+		for i := 0; i < width; i++ {
+			encoded.WriteByte(byte(levels[start] >> uint(8*i)))
+		}
+		start = end
+	}
+
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(encoded.Len()))
+	buf.Write(size[:])
+	buf.Write(encoded.Bytes())
+}
+
+// Close writes the buffered rows and the file metadata. It does not close the underlying writer.
+func (writer *Writer) Close() error {
+	if err := writer.flushRowGroup(); err != nil {
+		return err
+	}
+
+	var metadata thriftWriter
+	metadata.begin()
+	metadata.i32Field(1, 1)
+	metadata.listField(2, thriftStruct, writer.schemaSize())
+	writer.writeSchema(&metadata)
+	metadata.i64Field(3, writer.totalRows)
+	metadata.listField(4, thriftStruct, len(writer.rowGroups))
+	for _, group := range writer.rowGroups {
+		writer.writeRowGroup(&metadata, group)
+	}
+	metadata.binaryField(6, []byte("aquarium-persistor-gcp"))
+	metadata.end()
+
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(metadata.buf.Len()))
+	if err := writer.write(metadata.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := writer.write(size[:]); err != nil {
+		return err
+	}
+	return writer.write(magic)
+}
+
+// schemaSize returns the number of the schema elements (the root, the columns, and the groups and leaves of the maps).
+func (writer *Writer) schemaSize() int {
+	size := 1
+	for _, column := range writer.columns {
+		size++
+		if column.Type == StringMap {
+			size += 3
+		}
+	}
+	return size
+}
+
+// writeSchema writes the schema elements in the depth-first order.
+func (writer *Writer) writeSchema(metadata *thriftWriter) {
+	element := func(name string, physical int32, repetition int32, children int, converted int32) {
+		metadata.begin()
+		if physical >= 0 {
+			metadata.i32Field(1, physical)
+		}
+		if repetition >= 0 {
+			metadata.i32Field(3, repetition)
+		}
+		metadata.binaryField(4, []byte(name))
+		if children > 0 {
+			metadata.i32Field(5, int32(children))
+		}
+		if converted >= 0 {
+			metadata.i32Field(6, converted)
+		}
+		metadata.end()
+	}
+
+	element("schema", -1, -1, len(writer.columns), -1)
+	for _, column := range writer.columns {
+		repetition := int32(repetitionOptional)
+		if column.Required {
+			repetition = repetitionRequired
+		}
+
+		if column.Type == StringMap {
+			element(column.Name, -1, repetition, 1, convertedMap)
+			element("key_value", -1, repetitionRepeated, 2, convertedMapKeyValue)
+			element("key", typeByteArray, repetitionRequired, 0, convertedUTF8)
+			element("value", typeByteArray, repetitionOptional, 0, convertedUTF8)
+			continue
+		}
+
+		types := physicalTypes[column.Type]
+		element(column.Name, types[0], repetition, 0, types[1])
+	}
+}
+
+// writeRowGroup writes the metadata of a row group.
+func (writer *Writer) writeRowGroup(metadata *thriftWriter, group rowGroup) {
+	var compressedSize int64
+	metadata.begin()
+	metadata.listField(1, thriftStruct, len(group.chunks))
+	for _, chunk := range group.chunks {
+		compressedSize += chunk.compressedSize
+
+		metadata.begin()
+		metadata.i64Field(2, chunk.offset)
+		metadata.structField(3)
+		metadata.i32Field(1, chunk.leaf.physical)
+		metadata.listField(2, thriftI32, 2)
+		metadata.i32(encodingPlain)
+		metadata.i32(encodingRLE)
+		metadata.listField(3, thriftBinary, len(chunk.leaf.path))
+		for _, name := range chunk.leaf.path {
+			metadata.binary([]byte(name))
+		}
+		metadata.i32Field(4, writer.codec)
+		metadata.i64Field(5, chunk.numValues)
+		metadata.i64Field(6, chunk.uncompressedSize)
+		metadata.i64Field(7, chunk.compressedSize)
+		metadata.i64Field(9, chunk.offset)
+		metadata.end()
+		metadata.end()
+	}
+	metadata.i64Field(2, group.byteSize)
+	metadata.i64Field(3, group.numRows)
+	metadata.i64Field(5, group.fileStart)
+	metadata.i64Field(6, compressedSize)
+	metadata.end()
+}
+
+func (writer *Writer) write(data []byte) error {
+	n, err := writer.writer.Write(data)
+	writer.offset += int64(n)
+	return err
+}
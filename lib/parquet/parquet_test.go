@@ -0,0 +1,524 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// thriftStructValue is a Thrift structure decoded by readThriftStruct, with the values mapped by the field IDs.
+type thriftStructValue map[int16]interface{}
+
+// readThriftStruct decodes a structure in the Thrift compact protocol. The integers are decoded as int64,
+// the binaries as []byte, the lists as []interface{} and the structures as thriftStructValue.
+func readThriftStruct(t *testing.T, r *bytes.Reader) thriftStructValue {
+	t.Helper()
+
+	fields := make(thriftStructValue)
+	var id int16
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header == 0 {
+			return fields
+		}
+		if delta := int16(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			n, err := binary.ReadVarint(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id = int16(n)
+		}
+		fields[id] = readThriftValue(t, r, header&0x0f)
+	}
+}
+
+// readThriftValue decodes a value of the given compact protocol type.
+func readThriftValue(t *testing.T, r *bytes.Reader, valueType byte) interface{} {
+	t.Helper()
+
+	switch valueType {
+	case thriftI32, thriftI64:
+		n, err := binary.ReadVarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	case thriftBinary:
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		if _, err := r.Read(data); err != nil && size > 0 {
+			t.Fatal(err)
+		}
+		return data
+	case thriftList:
+		header, err := r.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := uint64(header >> 4)
+		if size == 15 {
+			if size, err = binary.ReadUvarint(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			items[i] = readThriftValue(t, r, header&0x0f)
+		}
+		return items
+	case thriftStruct:
+		return readThriftStruct(t, r)
+	}
+	t.Fatalf("Unexpected Thrift type %d", valueType)
+	return nil
+}
+
+// readFileMetadata checks the magic numbers of a Parquet file and decodes its file metadata.
+func readFileMetadata(t *testing.T, data []byte) thriftStructValue {
+	t.Helper()
+
+	if len(data) < 12 || !bytes.HasPrefix(data, magic) || !bytes.HasSuffix(data, magic) {
+		t.Fatal("Not a Parquet file")
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	return readThriftStruct(t, bytes.NewReader(data[len(data)-8-size:len(data)-8]))
+}
+
+// readPage returns the uncompressed content of the data page of a column chunk, which is the only page of the chunk.
+func readPage(t *testing.T, data []byte, chunk thriftStructValue, compression string) []byte {
+	t.Helper()
+
+	offset := chunk[3].(thriftStructValue)[9].(int64)
+	r := bytes.NewReader(data[offset:])
+	header := readThriftStruct(t, r)
+	page := make([]byte, header[3].(int64))
+	if _, err := r.Read(page); err != nil {
+		t.Fatal(err)
+	}
+
+	switch compression {
+	case Snappy:
+		decoded, err := snappy.Decode(nil, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page = decoded
+	case Gzip:
+		reader, err := gzip.NewReader(bytes.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page, err = ioutil.ReadAll(reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if int64(len(page)) != header[2].(int64) {
+		t.Errorf("page size = %d, want the uncompressed size %d", len(page), header[2])
+	}
+	return page
+}
+
+// leafPage is the decoded data page of a leaf column.
+type leafPage struct {
+	reps   []int
+	defs   []int
+	values *bytes.Reader // plain encoded values
+}
+
+// readLeafPage decodes the levels of the data page of a column chunk, which are followed by the values.
+func readLeafPage(t *testing.T, data []byte, chunk thriftStructValue, compression string, maxDef int, maxRep int) leafPage {
+	t.Helper()
+
+	numValues := int(chunk[3].(thriftStructValue)[5].(int64))
+	r := bytes.NewReader(readPage(t, data, chunk, compression))
+	leaf := leafPage{reps: make([]int, numValues), defs: make([]int, numValues), values: r}
+	if maxRep > 0 {
+		leaf.reps = readLevels(t, r, numValues, maxRep)
+	}
+	if maxDef > 0 {
+		leaf.defs = readLevels(t, r, numValues, maxDef)
+	}
+	return leaf
+}
+
+// readLevels decodes the repetition or definition levels of a page, which are written as RLE runs preceded by their size.
+func readLevels(t *testing.T, r *bytes.Reader, count int, maxLevel int) []int {
+	t.Helper()
+
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+	encoded := make([]byte, size)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	width := (bits.Len(uint(maxLevel)) + 7) / 8
+	runs := bytes.NewReader(encoded)
+	var levels []int
+	for runs.Len() > 0 {
+		header, err := binary.ReadUvarint(runs)
+		if err != nil || header&1 != 0 {
+			t.Fatalf("Invalid RLE run header %d", header)
+		}
+		level := 0
+		for i := 0; i < width; i++ {
+			b, err := runs.ReadByte()
+			if err != nil {
+				t.Fatal(err)
+			}
+			level |= int(b) << uint(8*i)
+		}
+		for n := header >> 1; n > 0; n-- {
+			levels = append(levels, level)
+		}
+	}
+	if len(levels) != count {
+		t.Fatalf("read %d levels, want %d", len(levels), count)
+	}
+	return levels
+}
+
+// readPlain decodes a plain encoded value of the given column type. The strings and JSON documents are decoded as string,
+// the bytes as []byte and the timestamps as time.Time in UTC.
+func readPlain(t *testing.T, r *bytes.Reader, columnType string) interface{} {
+	t.Helper()
+
+	var n uint64
+	size := 8
+	switch columnType {
+	case String, JSON, Bytes, Int32, Float:
+		size = 4
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		t.Fatal(err)
+	}
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(data[i])
+	}
+
+	switch columnType {
+	case String, JSON, Bytes:
+		value := make([]byte, n)
+		if _, err := io.ReadFull(r, value); err != nil {
+			t.Fatal(err)
+		}
+		if columnType == Bytes {
+			return value
+		}
+		return string(value)
+	case Int32:
+		return int32(n)
+	case Int64:
+		return int64(n)
+	case Float:
+		return math.Float32frombits(uint32(n))
+	case Double:
+		return math.Float64frombits(n)
+	case Timestamp:
+		return time.Unix(0, int64(n)*1000).UTC()
+	}
+	t.Fatalf("Unexpected column type %s", columnType)
+	return nil
+}
+
+// readRows decodes the rows of a Parquet file with the given columns, in the types in which they are written,
+// except that the strings and JSON documents are decoded as string and the bytes as []byte (see readPlain).
+func readRows(t *testing.T, data []byte, columns []Column, compression string) [][]interface{} {
+	t.Helper()
+
+	var rows [][]interface{}
+	for _, group := range readFileMetadata(t, data)[4].([]interface{}) {
+		numRows := int(group.(thriftStructValue)[3].(int64))
+		chunks := group.(thriftStructValue)[1].([]interface{})
+		groupRows := make([][]interface{}, numRows)
+		for i := range groupRows {
+			groupRows[i] = make([]interface{}, len(columns))
+		}
+
+		for i, column := range columns {
+			def := 0
+			if !column.Required {
+				def = 1
+			}
+
+			if column.Type == StringMap {
+				keys := readLeafPage(t, data, chunks[0].(thriftStructValue), compression, def+1, 1)
+				values := readLeafPage(t, data, chunks[1].(thriftStructValue), compression, def+2, 1)
+				chunks = chunks[2:]
+
+				row := -1
+				for j, rep := range keys.reps {
+					if rep == 0 {
+						row++
+						if keys.defs[j] < def {
+							continue
+						}
+						groupRows[row][i] = map[string]string{}
+					}
+					if keys.defs[j] == def+1 {
+						key := readPlain(t, keys.values, String).(string)
+						groupRows[row][i].(map[string]string)[key] = readPlain(t, values.values, String).(string)
+					}
+				}
+				if row != numRows-1 {
+					t.Fatalf("map column %s has %d rows, want %d", column.Name, row+1, numRows)
+				}
+				continue
+			}
+
+			leaf := readLeafPage(t, data, chunks[0].(thriftStructValue), compression, def, 0)
+			chunks = chunks[1:]
+			if len(leaf.defs) != numRows {
+				t.Fatalf("column %s has %d values, want %d", column.Name, len(leaf.defs), numRows)
+			}
+
+			var booleans []byte
+			boolean := 0
+			if column.Type == Boolean {
+				booleans = make([]byte, leaf.values.Len())
+				leaf.values.Read(booleans)
+			}
+			for row, level := range leaf.defs {
+				if level < def {
+					continue
+				}
+				if column.Type == Boolean {
+					groupRows[row][i] = booleans[boolean/8]&(1<<uint(boolean%8)) != 0
+					boolean++
+					continue
+				}
+				groupRows[row][i] = readPlain(t, leaf.values, column.Type)
+			}
+		}
+		rows = append(rows, groupRows...)
+	}
+	return rows
+}
+
+// envelopeColumns are the columns of message envelopes, with a map column.
+var envelopeColumns = []Column{
+	{Name: "message_id", Type: String, Required: true},
+	{Name: "publish_time", Type: Timestamp, Required: true},
+	{Name: "ordering_key", Type: String},
+	{Name: "attributes", Type: StringMap},
+	{Name: "payload", Type: Bytes, Required: true},
+}
+
+func TestWriterFile(t *testing.T) {
+	publishTime := time.Date(2020, 11, 5, 10, 30, 0, 0, time.UTC)
+	for _, compression := range []string{Uncompressed, Snappy, Gzip} {
+		t.Run(compression, func(t *testing.T) {
+			var buf bytes.Buffer
+			writer, err := NewWriter(&buf, envelopeColumns, compression, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, id := range []string{"1", "2", "3"} {
+				row := []interface{}{id, publishTime, nil, map[string]string{"b": "2", "a": "1"}, []byte("payload " + id)}
+				if err := writer.Write(row); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			metadata := readFileMetadata(t, buf.Bytes())
+			if metadata[1] != int64(1) || metadata[3] != int64(3) {
+				t.Errorf("version = %v, rows = %v, want 1 and 3", metadata[1], metadata[3])
+			}
+
+			var names []string
+			for _, element := range metadata[2].([]interface{}) {
+				names = append(names, string(element.(thriftStructValue)[4].([]byte)))
+			}
+			want := "schema,message_id,publish_time,ordering_key,attributes,key_value,key,value,payload"
+			if strings.Join(names, ",") != want {
+				t.Errorf("schema = %s, want %s", strings.Join(names, ","), want)
+			}
+
+			groups := metadata[4].([]interface{})
+			if len(groups) != 1 {
+				t.Fatalf("row groups = %d, want 1", len(groups))
+			}
+			chunks := groups[0].(thriftStructValue)[1].([]interface{})
+			if len(chunks) != 6 {
+				t.Fatalf("column chunks = %d, want 6 (a chunk for the key and the value of the map)", len(chunks))
+			}
+
+			// The message IDs are a required column, so the page holds only the plain encoded values.
+			page := readPage(t, buf.Bytes(), chunks[0].(thriftStructValue), compression)
+			wantPage := []byte("\x01\x00\x00\x001\x01\x00\x00\x002\x01\x00\x00\x003")
+			if !bytes.Equal(page, wantPage) {
+				t.Errorf("message_id page = %q, want %q", page, wantPage)
+			}
+
+			// The publish times are microseconds since the epoch.
+			page = readPage(t, buf.Bytes(), chunks[1].(thriftStructValue), compression)
+			if micros := int64(binary.LittleEndian.Uint64(page)); micros != publishTime.UnixNano()/1000 {
+				t.Errorf("publish_time = %d, want %d", micros, publishTime.UnixNano()/1000)
+			}
+		})
+	}
+}
+
+func TestWriterRowGroups(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, []Column{{Name: "n", Type: Int64, Required: true}}, Uncompressed, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A row group is written after each two values of 8 bytes.
+	for i := int64(0); i < 5; i++ {
+		if err := writer.Write([]interface{}{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := readFileMetadata(t, buf.Bytes())
+	var rows []int64
+	for _, group := range metadata[4].([]interface{}) {
+		rows = append(rows, group.(thriftStructValue)[3].(int64))
+	}
+	if !reflect.DeepEqual(rows, []int64{2, 2, 1}) || metadata[3] != int64(5) {
+		t.Errorf("rows of the row groups = %v (total %v), want [2 2 1]", rows, metadata[3])
+	}
+}
+
+func TestWriterGoldenFiles(t *testing.T) {
+	columns := []Column{
+		{Name: "id", Type: Int64, Required: true},
+		{Name: "name", Type: String},
+		{Name: "raw", Type: Bytes},
+		{Name: "doc", Type: JSON},
+		{Name: "count", Type: Int32},
+		{Name: "ratio", Type: Float},
+		{Name: "amount", Type: Double},
+		{Name: "paid", Type: Boolean},
+		{Name: "created", Type: Timestamp},
+		{Name: "labels", Type: StringMap},
+	}
+	created := time.Date(2020, 11, 5, 10, 30, 0, 123456000, time.UTC)
+	rows := [][]interface{}{
+		{int64(1), "Ana", []byte{0, 1, 2}, `{"a": 1}`, int32(7), float32(0.5), 12.25, true, created, map[string]string{"b": "2", "a": "1"}},
+		{int64(2), nil, nil, nil, nil, nil, nil, nil, nil, nil},
+		{int64(-3), "Ivo", []byte("x"), `[]`, int32(-1), float32(-2), 0.0, false, created.Add(time.Hour), map[string]string{}},
+		{int64(4), "Eva", nil, `null`, int32(0), float32(1.25), -1e10, true, created.Add(-time.Hour), map[string]string{"k": "v"}},
+	}
+
+	// The files in testdata were read with the Parquet reader of Apache Arrow (github.com/apache/arrow/go/v15),
+	// which returned these rows in three row groups, with the logical types of the columns (String, JSON, Timestamp, Map).
+	for _, compression := range []string{Uncompressed, Snappy} {
+		t.Run(compression, func(t *testing.T) {
+			var buf bytes.Buffer
+			// 40 bytes of values split the rows into three row groups.
+			writer, err := NewWriter(&buf, columns, compression, 40)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, row := range rows {
+				if err := writer.Write(row); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			golden, err := ioutil.ReadFile(filepath.Join("testdata", "rows-"+compression+".parquet"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), golden) {
+				t.Errorf("written file differs from testdata/rows-%s.parquet", compression)
+			}
+
+			if got := readRows(t, golden, columns, compression); !reflect.DeepEqual(got, rows) {
+				t.Errorf("rows read back = %v, want %v", got, rows)
+			}
+		})
+	}
+}
+
+func TestWriterRejectsInvalidRows(t *testing.T) {
+	columns := []Column{{Name: "id", Type: String, Required: true}, {Name: "n", Type: Int32}}
+
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, columns, Uncompressed, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range [][]interface{}{
+		{nil, int32(1)},
+		{"a", int64(1)},
+		{"a"},
+	} {
+		err := writer.Write(row)
+		if _, ok := err.(*TypeError); !ok {
+			t.Errorf("Write(%v) error = %v, want a *TypeError", row, err)
+		}
+	}
+	if err := writer.Write([]interface{}{"a", nil}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rejected rows are not added, not even partially.
+	if rows := readFileMetadata(t, buf.Bytes())[3]; rows != int64(1) {
+		t.Errorf("rows = %v, want 1", rows)
+	}
+
+	for _, invalid := range [][]Column{
+		nil,
+		{{Name: "a", Type: String}, {Name: "a", Type: Int32}},
+		{{Name: "a", Type: "decimal"}},
+	} {
+		if _, err := NewWriter(&buf, invalid, Uncompressed, 1<<20); err == nil {
+			t.Errorf("NewWriter(%v) error = nil, want an error", invalid)
+		}
+	}
+	if _, err := NewWriter(&buf, columns, "lz4", 1<<20); err == nil {
+		t.Error("NewWriter() error = nil, want an error for an unknown compression")
+	}
+}
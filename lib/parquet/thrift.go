@@ -0,0 +1,105 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// The types of the Thrift compact protocol.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes structures in the Thrift compact protocol, in which the Parquet file metadata is encoded.
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastIDs []int16 // IDs of the last written fields of the open structures
+}
+
+// begin starts a structure.
+func (writer *thriftWriter) begin() {
+	writer.lastIDs = append(writer.lastIDs, 0)
+}
+
+// end ends a structure.
+func (writer *thriftWriter) end() {
+	writer.buf.WriteByte(0)
+	writer.lastIDs = writer.lastIDs[:len(writer.lastIDs)-1]
+}
+
+func (writer *thriftWriter) field(id int16, fieldType byte) {
+	last := &writer.lastIDs[len(writer.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		writer.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		writer.buf.WriteByte(fieldType)
+		writer.i32(int32(id))
+	}
+	*last = id
+}
+
+func (writer *thriftWriter) i32(value int32) {
+	writer.i64(int64(value))
+}
+
+func (writer *thriftWriter) i64(value int64) {
+	var data [binary.MaxVarintLen64]byte
+	writer.buf.Write(data[:binary.PutVarint(data[:], value)])
+}
+
+func (writer *thriftWriter) binary(value []byte) {
+	var data [binary.MaxVarintLen64]byte
+	writer.buf.Write(data[:binary.PutUvarint(data[:], uint64(len(value)))])
+	writer.buf.Write(value)
+}
+
+func (writer *thriftWriter) i32Field(id int16, value int32) {
+	writer.field(id, thriftI32)
+	writer.i32(value)
+}
+
+func (writer *thriftWriter) i64Field(id int16, value int64) {
+	writer.field(id, thriftI64)
+	writer.i64(value)
+}
+
+func (writer *thriftWriter) binaryField(id int16, value []byte) {
+	writer.field(id, thriftBinary)
+	writer.binary(value)
+}
+
+// structField starts a structure field, which is ended by end.
+func (writer *thriftWriter) structField(id int16) {
+	writer.field(id, thriftStruct)
+	writer.begin()
+}
+
+// listField writes the header of a list field, which is followed by its elements (the structures are started by begin).
+func (writer *thriftWriter) listField(id int16, elementType byte, size int) {
+	writer.field(id, thriftList)
+	if size < 15 {
+		writer.buf.WriteByte(byte(size)<<4 | elementType)
+		return
+	}
+	writer.buf.WriteByte(0xf0 | elementType)
+	var data [binary.MaxVarintLen64]byte
+	writer.buf.Write(data[:binary.PutUvarint(data[:], uint64(size))])
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/parquet"
+)
+
+const defaultParquetRowGroupSize = 16
+
+// ParquetInfo represents Parquet format configuration.
+// It holds information needed for storing messages in Parquet files (the parquet message format).
+type ParquetInfo struct {
+	Compression  string // compression of the pages (uncompressed, snappy or gzip)
+	RowGroupSize int64  // size of the values of a row group in bytes (before compression), after which the row group is written
+	Schema       string // local path or gs:// URI of a schema which maps the JSON payload fields to columns (empty value stores the message envelopes)
+}
+
+// SetParquetInfo sets the parameters of a Parquet format configuration by extracting values from the corresponding environment variables.
+// An error is returned if any errors occur during the function execution.
+func SetParquetInfo(parquetInfo *ParquetInfo) error {
+	parquetInfo.Compression = getOptionalEnvVariable("PARQUET_COMPRESSION", parquet.Snappy)
+	if parquetInfo.Compression != parquet.Uncompressed && parquetInfo.Compression != parquet.Snappy && parquetInfo.Compression != parquet.Gzip {
+		return fmt.Errorf("Invalid Parquet compression '%s', expected '%s', '%s' or '%s'", parquetInfo.Compression, parquet.Uncompressed, parquet.Snappy, parquet.Gzip)
+	}
+
+	rowGroupSize, err := strconv.Atoi(getOptionalEnvVariable("PARQUET_ROW_GROUP_SIZE", strconv.Itoa(defaultParquetRowGroupSize)))
+	if err != nil {
+		return err
+	}
+	if rowGroupSize < 1 {
+		return fmt.Errorf("Parquet row group size must be at least 1 MB")
+	}
+	parquetInfo.RowGroupSize = int64(rowGroupSize) << 20
+
+	parquetInfo.Schema = getOptionalEnvVariable("PARQUET_SCHEMA", "")
+
+	return nil
+}
@@ -0,0 +1,411 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/parquet"
+)
+
+// The paths of the message fields which can be mapped to Parquet columns, in addition to the payload fields.
+const (
+	ParquetPathMessageID   = "$messageId"
+	ParquetPathPublishTime = "$publishTime"
+	ParquetPathOrderingKey = "$orderingKey"
+	ParquetPathAttributes  = "$attributes" // all of the attributes, or a single attribute as $attributes.<name>
+)
+
+// ParquetEnvelopeColumns are the columns of the Parquet files if no schema is configured.
+// Each row holds a message with its payload as bytes, so payloads of any format can be stored.
+var ParquetEnvelopeColumns = []parquet.Column{
+	{Name: "message_id", Type: parquet.String, Required: true},
+	{Name: "publish_time", Type: parquet.Timestamp, Required: true},
+	{Name: "ordering_key", Type: parquet.String},
+	{Name: "attributes", Type: parquet.StringMap},
+	{Name: "payload", Type: parquet.Bytes, Required: true},
+}
+
+// ParquetSchemaConfig is the content of a Parquet schema file.
+type ParquetSchemaConfig struct {
+	Columns []ParquetMapping `json:"columns"` // columns, in the order in which they are stored
+}
+
+// ParquetMapping maps a field of the JSON payload, or a field of the message, to a column.
+type ParquetMapping struct {
+	Name     string `json:"name"`     // name of the column
+	Path     string `json:"path"`     // dot separated path of a payload field, or a message field (e.g. $messageId), by default the name of the column
+	Type     string `json:"type"`     // type of the column (e.g. string, int64, timestamp)
+	Required bool   `json:"required"` // whether the field must be present and not null
+}
+
+// ParseParquetSchema parses a Parquet schema file.
+// An error is returned if the schema is not valid.
+func ParseParquetSchema(data []byte) (*ParquetSchemaConfig, error) {
+	var config ParquetSchemaConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("Invalid Parquet schema. %s", err)
+	}
+
+	for i, mapping := range config.Columns {
+		if mapping.Path == "" {
+			config.Columns[i].Path = mapping.Name
+			mapping.Path = mapping.Name
+		}
+		if err := checkParquetMapping(mapping); err != nil {
+			return nil, fmt.Errorf("Invalid Parquet schema. %s", err)
+		}
+	}
+
+	// The columns themselves are checked by the writer.
+	if _, err := parquet.NewWriter(&bytes.Buffer{}, config.columns(), parquet.Uncompressed, 1); err != nil {
+		return nil, fmt.Errorf("Invalid Parquet schema. %s", err)
+	}
+	return &config, nil
+}
+
+// checkParquetMapping checks whether a message field can be stored in the type of its column.
+func checkParquetMapping(mapping ParquetMapping) error {
+	if !strings.HasPrefix(mapping.Path, "$") {
+		return nil
+	}
+
+	var types []string
+	switch {
+	case mapping.Path == ParquetPathMessageID, mapping.Path == ParquetPathOrderingKey, strings.HasPrefix(mapping.Path, ParquetPathAttributes+"."):
+		types = []string{parquet.String, parquet.Bytes}
+	case mapping.Path == ParquetPathPublishTime:
+		types = []string{parquet.Timestamp}
+	case mapping.Path == ParquetPathAttributes:
+		types = []string{parquet.StringMap}
+	default:
+		return fmt.Errorf("Column '%s' has an unknown message field '%s'", mapping.Name, mapping.Path)
+	}
+
+	for _, columnType := range types {
+		if mapping.Type == columnType {
+			return nil
+		}
+	}
+	return fmt.Errorf("Column '%s' has type '%s', expected %s for the message field '%s'", mapping.Name, mapping.Type, strings.Join(types, " or "), mapping.Path)
+}
+
+// columns returns the columns of the schema.
+func (config *ParquetSchemaConfig) columns() []parquet.Column {
+	columns := make([]parquet.Column, len(config.Columns))
+	for i, mapping := range config.Columns {
+		columns[i] = parquet.Column{Name: mapping.Name, Type: mapping.Type, Required: mapping.Required}
+	}
+	return columns
+}
+
+// parquetSchemas caches the configured schemas, so a schema is read once per instance instead of once per batch.
+var (
+	parquetSchemas    = make(map[string]*ParquetSchemaConfig)
+	parquetSchemasMtx sync.Mutex
+)
+
+// LoadParquetSchema reads and parses the Parquet schema at the given source (see ReadConfigSource).
+// The schema is cached, so it is read only once.
+// An error is returned if the schema could not be read or is not valid.
+func LoadParquetSchema(ctx context.Context, source string) (*ParquetSchemaConfig, error) {
+	parquetSchemasMtx.Lock()
+	defer parquetSchemasMtx.Unlock()
+
+	if schema, ok := parquetSchemas[source]; ok {
+		return schema, nil
+	}
+
+	data, err := ReadConfigSource(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("Error during reading Parquet schema '%s'. %s", source, err)
+	}
+
+	schema, err := ParseParquetSchema(data)
+	if err != nil {
+		return nil, err
+	}
+
+	parquetSchemas[source] = schema
+	return schema, nil
+}
+
+// parquetEncoder encodes a batch of messages into a Parquet file.
+type parquetEncoder struct {
+	buf    bytes.Buffer
+	writer *parquet.Writer
+	schema *ParquetSchemaConfig // schema of the JSON payloads (nil if the rows are the message envelopes)
+}
+
+// newParquetEncoder creates an encoder of the Parquet format configuration. If a schema is configured, the columns are
+// mapped from the JSON payloads of the messages, otherwise the rows are the message envelopes (see ParquetEnvelopeColumns).
+func newParquetEncoder(ctx context.Context, conf PersistConf) (BatchEncoder, error) {
+	encoder := &parquetEncoder{}
+
+	columns := ParquetEnvelopeColumns
+	if conf.Parquet.Schema != "" {
+		var err error
+		encoder.schema, err = LoadParquetSchema(ctx, conf.Parquet.Schema)
+		if err != nil {
+			return nil, err
+		}
+		columns = encoder.schema.columns()
+	}
+
+	writer, err := parquet.NewWriter(&encoder.buf, columns, conf.Parquet.Compression, conf.Parquet.RowGroupSize)
+	if err != nil {
+		return nil, err
+	}
+	encoder.writer = writer
+	return encoder, nil
+}
+
+// Add encodes a message as a row of the batch.
+func (encoder *parquetEncoder) Add(msg Message) error {
+	var row []interface{}
+	if encoder.schema == nil {
+		publishTime := msg.PublishTime
+		if publishTime.IsZero() {
+			publishTime = time.Unix(0, 0)
+		}
+		attributes := msg.Attributes
+		if attributes == nil {
+			attributes = map[string]string{}
+		}
+		row = []interface{}{msg.ID, publishTime, parquetOptionalString(msg.OrderingKey), attributes, msg.Data}
+	} else {
+		var err error
+		row, err = encoder.schema.row(msg)
+		if err != nil {
+			return &SchemaMismatchError{Format: FormatParquet, Err: err}
+		}
+	}
+
+	err := encoder.writer.Write(row)
+	if _, ok := err.(*parquet.TypeError); ok {
+		return &SchemaMismatchError{Format: FormatParquet, Err: err}
+	}
+	return err
+}
+
+// Size returns the size of the encoded rows.
+func (encoder *parquetEncoder) Size() int64 {
+	return encoder.writer.Size()
+}
+
+// Close writes the remaining rows and the file metadata, and returns the content of the file.
+func (encoder *parquetEncoder) Close() ([]byte, error) {
+	if err := encoder.writer.Close(); err != nil {
+		return nil, err
+	}
+	return encoder.buf.Bytes(), nil
+}
+
+// row maps a message to the values of the columns. A missing or null field is a null value.
+// An error is returned if the payload is not a JSON object or if a field can not be converted to the type of its column.
+func (config *ParquetSchemaConfig) row(msg Message) ([]interface{}, error) {
+	var payload map[string]interface{}
+	row := make([]interface{}, len(config.Columns))
+	for i, mapping := range config.Columns {
+		if strings.HasPrefix(mapping.Path, "$") {
+			row[i] = parquetMessageField(msg, mapping)
+			continue
+		}
+
+		if payload == nil {
+			decoder := json.NewDecoder(bytes.NewReader(msg.Data))
+			decoder.UseNumber()
+			if err := decoder.Decode(&payload); err != nil || payload == nil {
+				return nil, fmt.Errorf("Payload is not a JSON object")
+			}
+		}
+
+		var value interface{} = payload
+		for _, name := range strings.Split(mapping.Path, ".") {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = object[name]
+		}
+
+		converted, err := parquetValue(mapping, value)
+		if err != nil {
+			return nil, err
+		}
+		row[i] = converted
+	}
+	return row, nil
+}
+
+// parquetMessageField returns the value of a message field (see ParquetPathMessageID and the other message paths).
+func parquetMessageField(msg Message, mapping ParquetMapping) interface{} {
+	var value interface{}
+	switch {
+	case mapping.Path == ParquetPathMessageID:
+		value = msg.ID
+	case mapping.Path == ParquetPathOrderingKey:
+		value = parquetOptionalString(msg.OrderingKey)
+	case mapping.Path == ParquetPathPublishTime:
+		if !msg.PublishTime.IsZero() {
+			value = msg.PublishTime
+		}
+	case mapping.Path == ParquetPathAttributes:
+		attributes := msg.Attributes
+		if attributes == nil {
+			attributes = map[string]string{}
+		}
+		value = attributes
+	default:
+		if attribute, ok := msg.Attributes[strings.TrimPrefix(mapping.Path, ParquetPathAttributes+".")]; ok {
+			value = attribute
+		}
+	}
+
+	if s, ok := value.(string); ok && mapping.Type == parquet.Bytes {
+		return []byte(s)
+	}
+	return value
+}
+
+// parquetOptionalString returns nil for an empty string, which is stored as a null.
+func parquetOptionalString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// parquetValue converts a JSON value to the type of its column.
+func parquetValue(mapping ParquetMapping, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	mismatch := func() error {
+		return &parquet.TypeError{Column: mapping.Name, Message: fmt.Sprintf("expected %s, got %s", mapping.Type, valueKind(value))}
+	}
+
+	switch mapping.Type {
+	case parquet.String:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+
+	case parquet.Bytes:
+		if s, ok := value.(string); ok {
+			return []byte(s), nil
+		}
+
+	case parquet.JSON:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, &parquet.TypeError{Column: mapping.Name, Message: err.Error()}
+		}
+		return data, nil
+
+	case parquet.Int32, parquet.Int64:
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, mismatch()
+		}
+		n, err := number.Int64()
+		if err != nil {
+			return nil, &parquet.TypeError{Column: mapping.Name, Message: fmt.Sprintf("%s is not an integer", number)}
+		}
+		if mapping.Type == parquet.Int64 {
+			return n, nil
+		}
+		if n < -1<<31 || n > 1<<31-1 {
+			return nil, &parquet.TypeError{Column: mapping.Name, Message: fmt.Sprintf("%d is out of the int32 range", n)}
+		}
+		return int32(n), nil
+
+	case parquet.Float, parquet.Double:
+		number, ok := value.(json.Number)
+		if !ok {
+			return nil, mismatch()
+		}
+		f, err := number.Float64()
+		if err != nil {
+			return nil, mismatch()
+		}
+		if mapping.Type == parquet.Float {
+			return float32(f), nil
+		}
+		return f, nil
+
+	case parquet.Boolean:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+
+	case parquet.Timestamp:
+		s, ok := value.(string)
+		if !ok {
+			return nil, mismatch()
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, &parquet.TypeError{Column: mapping.Name, Message: fmt.Sprintf("'%s' is not an RFC 3339 timestamp", s)}
+		}
+		return t, nil
+
+	case parquet.StringMap:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, mismatch()
+		}
+		entries := make(map[string]string, len(object))
+		for key, entry := range object {
+			s, ok := entry.(string)
+			if !ok {
+				return nil, &parquet.TypeError{Column: mapping.Name, Message: fmt.Sprintf("value of key '%s' is not a string", key)}
+			}
+			entries[key] = s
+		}
+		return entries, nil
+	}
+
+	return nil, mismatch()
+}
+
+// valueKind describes the kind of a JSON value in the type errors.
+func valueKind(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
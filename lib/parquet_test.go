@@ -0,0 +1,130 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/parquet"
+)
+
+func TestParquetSchemaRow(t *testing.T) {
+	schema, err := ParseParquetSchema([]byte(`{"columns": [
+		{"name": "id", "path": "$messageId", "type": "string", "required": true},
+		{"name": "source", "path": "$attributes.source", "type": "string"},
+		{"name": "customer", "path": "customer.name", "type": "string"},
+		{"name": "amount", "type": "double"},
+		{"name": "quantity", "type": "int32"},
+		{"name": "created", "type": "timestamp"},
+		{"name": "items", "type": "json"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := Message{
+		ID:         "42",
+		Attributes: map[string]string{"source": "shop"},
+		Data:       []byte(`{"customer": {"name": "Ana"}, "amount": 10.5, "quantity": 2, "created": "2020-11-05T10:30:00Z", "items": [1, 2]}`),
+	}
+	row, err := schema.row(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{"42", "shop", "Ana", 10.5, int32(2), time.Date(2020, 11, 5, 10, 30, 0, 0, time.UTC), []byte("[1,2]")}
+	if !reflect.DeepEqual(row, want) {
+		t.Errorf("row = %v, want %v", row, want)
+	}
+
+	// The missing fields are nulls.
+	row, err = schema.row(Message{ID: "42", Data: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(row, []interface{}{"42", nil, nil, nil, nil, nil, nil}) {
+		t.Errorf("row = %v, want nulls except the message ID", row)
+	}
+
+	for _, data := range []string{`[1]`, `null`, `{"quantity": 1.5}`, `{"quantity": 3000000000}`, `{"amount": "10"}`, `{"created": "yesterday"}`} {
+		if _, err := schema.row(Message{ID: "42", Data: []byte(data)}); err == nil {
+			t.Errorf("row(%s) error = nil, want an error", data)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"columns": [{"name": "t", "path": "$publishTime", "type": "string"}]}`,
+		`{"columns": [{"name": "x", "path": "$unknown", "type": "string"}]}`,
+		`{"columns": [{"name": "x", "type": "decimal"}]}`,
+		`{"columns": [{"name": "x", "type": "string", "unknown": true}]}`,
+		`{"columns": []}`,
+	} {
+		if _, err := ParseParquetSchema([]byte(invalid)); err == nil {
+			t.Errorf("ParseParquetSchema(%s) error = nil, want an error", invalid)
+		}
+	}
+}
+
+func TestProcessMessageParquetBatch(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+
+	schemaPath := filepath.Join(t.TempDir(), "orders.json")
+	schema := `{"columns": [{"name": "id", "type": "int64", "required": true}, {"name": "message_id", "path": "$messageId", "type": "string"}]}`
+	if err := ioutil.WriteFile(schemaPath, []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := PersistConf{
+		Storage:     StorageInfo{BucketID: "bucket", Prefix: "orders", Extension: "parquet", Format: FormatParquet},
+		Quarantine:  QuarantineInfo{BucketID: "quarantine"},
+		BatchOutput: BatchOutputInfo{MaxMessages: 2, MaxBytes: 1 << 20},
+		Parquet:     ParquetInfo{Compression: parquet.Snappy, RowGroupSize: 1 << 20, Schema: schemaPath},
+	}
+	report := NewRunReport()
+	results := make(chan error, 3)
+	for i, data := range []string{`{"id": 1}`, `{"name": "no id"}`, `{"id": 3}`} {
+		msg := Message{ID: string(rune('1' + i)), Data: []byte(data)}
+		ProcessMessageAsync(context.Background(), msg, conf, report, func(err error) { results <- err })
+	}
+
+	// The message without the required column is quarantined, while the other two fill a batch which is written.
+	for i := 0; i < 3; i++ {
+		if err := <-results; err != nil {
+			t.Errorf("result error = %v, want nil", err)
+		}
+	}
+	quarantined := gcs.Names("quarantine")
+	if len(quarantined) != 1 || !strings.Contains(quarantined[0], ReasonSchemaMismatch) {
+		t.Errorf("quarantined objects = %v, want 1 with the %s reason", quarantined, ReasonSchemaMismatch)
+	}
+	names := gcs.Names("bucket")
+	if len(names) != 1 || !strings.HasSuffix(names[0], ".parquet") {
+		t.Fatalf("stored objects = %v, want 1 batch file", names)
+	}
+	object, _ := gcs.Object("bucket", names[0])
+	if !bytes.HasPrefix(object.Data, []byte("PAR1")) || object.Metadata["messageCount"] != "2" {
+		t.Errorf("batch file holds %s messages, want a Parquet file of 2", object.Metadata["messageCount"])
+	}
+	if report.Persisted != 2 {
+		t.Errorf("persisted = %d, want 2", report.Persisted)
+	}
+}
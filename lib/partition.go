@@ -0,0 +1,321 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// SuccessMarker is the name of the empty object written to a partition once it is closed.
+	SuccessMarker = "_SUCCESS"
+	// ManifestName is the name of the manifest written to a partition once it is closed.
+	ManifestName = "_MANIFEST.json"
+)
+
+// ManifestObject describes a single object of a closed partition.
+type ManifestObject struct {
+	Name       string `json:"name"`       // name of the object
+	Generation int64  `json:"generation"` // generation of the object
+	Records    int    `json:"records"`    // number of messages stored in the object
+	ByteSize   int64  `json:"byteSize"`   // size of the object in bytes
+	CRC32C     string `json:"crc32c"`     // base64 encoded CRC32C checksum of the object (as reported by GCS)
+	MD5        string `json:"md5"`        // base64 encoded MD5 hash of the object (empty for composite objects)
+}
+
+// Manifest is the content of the manifest written to a closed partition.
+type Manifest struct {
+	Bucket        string           `json:"-"`                     // ID of the bucket of the partition (not written to the manifest)
+	Partition     string           `json:"partition"`             // folder of the partition (YYYY/MM/DD/HH)
+	PartitionTime time.Time        `json:"partitionTime"`         // start of the partition hour
+	Watermark     time.Time        `json:"watermark"`             // watermark at which the partition was closed
+	ClosedAt      time.Time        `json:"closedAt"`              // time at which the partition was closed
+	ObjectCount   int              `json:"objectCount"`           // number of objects in the partition
+	RecordCount   int              `json:"recordCount"`           // number of messages in the partition
+	ByteSize      int64            `json:"byteSize"`              // total size of the objects in bytes
+	Objects       []ManifestObject `json:"objects"`               // objects of the partition
+	CompactedAt   *time.Time       `json:"compactedAt,omitempty"` // time at which the manifest was rewritten after a compaction
+}
+
+// ClosablePartitions returns the start times of the hourly partitions which can be closed at the given watermark.
+// A partition can be closed once the watermark passes the end of its hour plus the lateness allowance.
+// Only the partitions within the lookback number of hours are returned, starting with the oldest one.
+func ClosablePartitions(watermark time.Time, lateness time.Duration, lookback int) []time.Time {
+	latest := PartitionHour(watermark.Add(-lateness)).Add(-time.Hour)
+
+	var partitions []time.Time
+	for i := lookback - 1; i >= 0; i-- {
+		partitions = append(partitions, latest.Add(-time.Duration(i)*time.Hour))
+	}
+	return partitions
+}
+
+// ClosePartitions closes all of the partitions which can be closed at the given watermark and are not closed yet,
+// in the GCS buckets of the configuration (see PartitionInfo.GCSBucketIDs). A bucket whose partitions cannot be closed
+// does not stop the closing of the other buckets. The partitions without objects are not closed.
+// The function returns the manifests of the newly closed partitions.
+// An error is returned if any errors occur during the function execution.
+func ClosePartitions(ctx context.Context, info PartitionInfo, watermark time.Time) ([]*Manifest, error) {
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var manifests []*Manifest
+	var firstErr error
+	for _, bucketID := range info.GCSBucketIDs() {
+		bucket := client.Bucket(bucketID)
+		for _, partitionTime := range ClosablePartitions(watermark, time.Duration(info.Lateness)*time.Second, info.Lookback) {
+			manifest, err := closePartition(ctx, bucket, partitionTime, watermark)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("Error during closing partitions of bucket '%s'. %s", bucketID, err)
+				}
+				break
+			}
+			if manifest != nil {
+				manifest.Bucket = bucketID
+				manifests = append(manifests, manifest)
+			}
+		}
+	}
+
+	return manifests, firstErr
+}
+
+// ClosePartition closes the partition of the given time in a GCS bucket, regardless of the watermark.
+// The function returns the manifest of the partition, or nil if the partition was already closed or it has no objects.
+// An error is returned if any errors occur during the function execution.
+func ClosePartition(ctx context.Context, bucketID string, partitionTime time.Time) (*Manifest, error) {
+	scheme, bucketID := splitDestination(bucketID)
+	if scheme != SchemeGCS {
+		return nil, fmt.Errorf("Partitions can be closed only in GCS buckets, not in '%s://%s'", scheme, bucketID)
+	}
+
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	manifest, err := closePartition(ctx, client.Bucket(bucketID), partitionTime, time.Now())
+	if manifest != nil {
+		manifest.Bucket = bucketID
+	}
+	return manifest, err
+}
+
+// closePartition writes the manifest and the success marker of a partition which does not have the marker yet.
+// A partition without objects is left open, since its hour may have had no messages at all, and nil is returned.
+// The manifest is written first, so a partition with the marker always has a manifest. Both are written on the condition
+// that they do not exist, so a partition is closed only once when several closers run at the same time, and the manifest
+// written by the first closer is not overwritten by the others.
+func closePartition(ctx context.Context, bucket *storage.BucketHandle, partitionTime time.Time, watermark time.Time) (*Manifest, error) {
+	folder := PartitionFolder(partitionTime)
+
+	_, err := bucket.Object(path.Join(folder, SuccessMarker)).Attrs(ctx)
+	if err == nil {
+		return nil, nil
+	}
+	if err != storage.ErrObjectNotExist {
+		return nil, err
+	}
+
+	manifest, err := BuildManifest(ctx, bucket, partitionTime)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.ObjectCount == 0 {
+		return nil, nil
+	}
+	manifest.Watermark = watermark
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeToHandle(ctx, bucket.Object(path.Join(folder, ManifestName)).If(storage.Conditions{DoesNotExist: true}), data, "application/json")
+	if isPreconditionFailed(err) {
+		// Another closer wrote the manifest first (or it stopped before writing the marker), so its manifest is kept.
+		manifest, err = readManifest(ctx, bucket, folder)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeToHandle(ctx, bucket.Object(path.Join(folder, SuccessMarker)).If(storage.Conditions{DoesNotExist: true}), nil, "text/plain")
+	if isPreconditionFailed(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// CloseCompletePartitions closes the partitions which are complete at the current time, if the partition closing is enabled.
+// Closing is best effort, since the messages are already stored, so the closed partitions and the errors are only logged,
+// and a partition which could not be closed is closed by one of the next calls.
+func CloseCompletePartitions(ctx context.Context, info PartitionInfo) {
+	if !info.Enabled {
+		return
+	}
+
+	manifests, err := ClosePartitions(ctx, info, time.Now())
+	if err != nil {
+		log.Printf("Error during closing partitions. %s.\n", err)
+	}
+	for _, manifest := range manifests {
+		log.Printf("Closed partition %s of bucket %s with %d messages.\n", manifest.Partition, manifest.Bucket, manifest.RecordCount)
+	}
+}
+
+// CloseCompletePartitionsPeriodically calls CloseCompletePartitions with the given interval until the context is cancelled.
+// It is used by the long-running persistor, which does not have the end of a run at which the partitions are closed.
+func CloseCompletePartitionsPeriodically(ctx context.Context, info PartitionInfo, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			CloseCompletePartitions(ctx, info)
+		}
+	}
+}
+
+// readManifest reads the manifest of the partition in the given folder.
+func readManifest(ctx context.Context, bucket *storage.BucketHandle, folder string) (*Manifest, error) {
+	data, err := readObject(ctx, bucket.Object(path.Join(folder, ManifestName)))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest of partition '%s'. %s", folder, err)
+	}
+	return &manifest, nil
+}
+
+// BuildManifest lists the objects of the partition of the given time and creates its manifest.
+// The number of records of an object is read from its messageCount metadata, and it is 1 if the metadata is not set.
+// If the partition is compacted, the batch files whose original objects are not deleted yet are left out,
+// so each message is counted once.
+// An error is returned if any errors occur during the function execution.
+func BuildManifest(ctx context.Context, bucket *storage.BucketHandle, partitionTime time.Time) (*Manifest, error) {
+	manifest, err := buildManifest(ctx, bucket, PartitionFolder(partitionTime))
+	if err != nil {
+		return nil, err
+	}
+	manifest.PartitionTime = PartitionHour(partitionTime)
+	return manifest, nil
+}
+
+// buildManifest creates the manifest of the partition in the given folder, as described for BuildManifest.
+func buildManifest(ctx context.Context, bucket *storage.BucketHandle, folder string) (*Manifest, error) {
+	manifest := &Manifest{
+		Partition: folder,
+		ClosedAt:  time.Now(),
+		Objects:   []ManifestObject{},
+	}
+
+	compaction, err := readCompactionManifest(ctx, bucket, folder)
+	if err != nil {
+		return nil, err
+	}
+	duplicates := make(map[string]bool)
+	if compaction != nil {
+		for _, batch := range compaction.Batches {
+			if batch.Status != BatchDeleted {
+				duplicates[batch.Name] = true
+			}
+		}
+	}
+
+	it := bucket.Objects(ctx, &storage.Query{Prefix: folder + "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if isInternalObject(folder, attrs.Name) || duplicates[attrs.Name] {
+			continue
+		}
+
+		object := ManifestObject{
+			Name:       attrs.Name,
+			Generation: attrs.Generation,
+			Records:    recordCount(attrs),
+			ByteSize:   attrs.Size,
+			CRC32C:     encodeCRC32C(attrs.CRC32C),
+			MD5:        base64.StdEncoding.EncodeToString(attrs.MD5),
+		}
+
+		manifest.Objects = append(manifest.Objects, object)
+		manifest.ObjectCount++
+		manifest.RecordCount += object.Records
+		manifest.ByteSize += object.ByteSize
+	}
+
+	return manifest, nil
+}
+
+// recordCount returns the number of messages stored in an object, given by its messageCount metadata.
+func recordCount(attrs *storage.ObjectAttrs) int {
+	if count, err := strconv.Atoi(attrs.Metadata["messageCount"]); err == nil {
+		return count
+	}
+	return 1
+}
+
+// encodeCRC32C encodes a CRC32C checksum in the same form as GCS does (base64 of the big-endian bytes).
+func encodeCRC32C(crc uint32) string {
+	var data [4]byte
+	binary.BigEndian.PutUint32(data[:], crc)
+	return base64.StdEncoding.EncodeToString(data[:])
+}
+
+// writeToHandle writes the data to the object of the given handle.
+func writeToHandle(ctx context.Context, object *storage.ObjectHandle, data []byte, contentType string) error {
+	writer := object.NewWriter(ctx)
+	writer.ContentType = contentType
+
+	if _, err := writer.Write(data); err != nil {
+		_ = writer.Close()
+		return err
+	}
+	return writer.Close()
+}
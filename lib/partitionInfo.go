@@ -0,0 +1,132 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+const (
+	defaultPartitionLateness = 600
+	defaultPartitionLookback = 24
+)
+
+// PartitionInfo represents partition closing configuration.
+// It holds information needed for writing completion markers and manifests of closed hourly partitions.
+type PartitionInfo struct {
+	Enabled         bool     // whether the partitions are closed at the end of each pull run
+	BucketID        string   // ID of a bucket in which the partitions are located
+	RoutedBucketIDs []string // IDs of the other GCS buckets in which the routes store messages
+	FanOutBucketIDs []string // IDs of the GCS buckets in which the fan-out stores copies of the messages
+	Lateness        int      // number of seconds after the end of an hour before its partition is closed
+	Lookback        int      // number of past hours which are checked for partitions that are not closed yet
+}
+
+// SetPartitionInfo sets the parameters of a partition closing configuration by extracting values from the corresponding environment variables.
+// The partitions are closed only if CLOSE_PARTITIONS is set to true, and they are located in the bucket given by BUCKET_ID.
+// If ROUTING_CONFIG is set, the partitions of the GCS buckets of the routes are closed as well, and if FANOUT_BUCKET_IDS is set,
+// the partitions of its GCS buckets. The other object stores do not hold the markers, so their buckets are skipped, and an error
+// is returned if none of the buckets is a GCS bucket.
+// An error is returned if any errors occur during the function execution.
+func SetPartitionInfo(partitionInfo *PartitionInfo) error {
+	var err error
+
+	partitionInfo.Enabled, err = strconv.ParseBool(getOptionalEnvVariable("CLOSE_PARTITIONS", "false"))
+	if err != nil {
+		return err
+	}
+	if !partitionInfo.Enabled {
+		return nil
+	}
+
+	partitionInfo.BucketID, err = getEnvVariable("BUCKET_ID")
+	if err != nil {
+		return err
+	}
+
+	var routingInfo RoutingInfo
+	err = SetRoutingInfo(&routingInfo)
+	if err != nil {
+		return err
+	}
+	if routingInfo.Enabled() {
+		var storageInfo StorageInfo
+		err = SetStorageInfo(&storageInfo)
+		if err != nil {
+			return err
+		}
+		router, err := LoadRouter(context.Background(), routingInfo, storageInfo)
+		if err != nil {
+			return err
+		}
+		for _, bucketID := range router.BucketIDs() {
+			if bucketID != partitionInfo.BucketID {
+				partitionInfo.RoutedBucketIDs = append(partitionInfo.RoutedBucketIDs, bucketID)
+			}
+		}
+	}
+
+	var fanOutInfo FanOutInfo
+	err = SetFanOutInfo(&fanOutInfo)
+	if err != nil {
+		return err
+	}
+	for _, bucketID := range fanOutInfo.BucketIDs {
+		if IsGCSDestination(bucketID) {
+			partitionInfo.FanOutBucketIDs = append(partitionInfo.FanOutBucketIDs, bucketID)
+		}
+	}
+
+	if len(partitionInfo.GCSBucketIDs()) == 0 {
+		return fmt.Errorf("Partition closing requires a GCS bucket, but BUCKET_ID, the routes and the fan-out store messages only in other object stores")
+	}
+
+	partitionInfo.Lateness, err = strconv.Atoi(getOptionalEnvVariable("PARTITION_LATENESS", strconv.Itoa(defaultPartitionLateness)))
+	if err != nil {
+		return err
+	}
+	if partitionInfo.Lateness < 0 {
+		return fmt.Errorf("Partition lateness must not be negative")
+	}
+
+	partitionInfo.Lookback, err = strconv.Atoi(getOptionalEnvVariable("PARTITION_LOOKBACK", strconv.Itoa(defaultPartitionLookback)))
+	if err != nil {
+		return err
+	}
+	if partitionInfo.Lookback < 0 {
+		return fmt.Errorf("Partition lookback must not be negative")
+	}
+
+	return nil
+}
+
+// GCSBucketIDs returns the names of the GCS buckets whose partitions are closed: the bucket given by BucketID, the buckets
+// of the routes and the buckets of the fan-out, without duplicates and without the gs:// scheme. The buckets of the other
+// object stores are left out.
+func (partitionInfo PartitionInfo) GCSBucketIDs() []string {
+	var bucketIDs []string
+	seen := make(map[string]bool)
+	for _, destination := range append(append([]string{partitionInfo.BucketID}, partitionInfo.RoutedBucketIDs...), partitionInfo.FanOutBucketIDs...) {
+		scheme, bucketID := splitDestination(destination)
+		if scheme != SchemeGCS || bucketID == "" || seen[bucketID] {
+			continue
+		}
+		seen[bucketID] = true
+		bucketIDs = append(bucketIDs, bucketID)
+	}
+	return bucketIDs
+}
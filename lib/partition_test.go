@@ -0,0 +1,222 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClosablePartitions(t *testing.T) {
+	kolkata := time.FixedZone("IST", 5*3600+1800)
+	watermark := time.Date(2020, 10, 1, 12, 5, 0, 0, kolkata)
+
+	partitions := ClosablePartitions(watermark, 10*time.Minute, 3)
+
+	want := []time.Time{
+		time.Date(2020, 10, 1, 8, 0, 0, 0, kolkata),
+		time.Date(2020, 10, 1, 9, 0, 0, 0, kolkata),
+		time.Date(2020, 10, 1, 10, 0, 0, 0, kolkata),
+	}
+	if len(partitions) != len(want) {
+		t.Fatalf("ClosablePartitions() = %v, want %v", partitions, want)
+	}
+	for i := range want {
+		if !partitions[i].Equal(want[i]) {
+			t.Errorf("partition %d = %v, want %v", i, partitions[i], want[i])
+		}
+	}
+}
+
+func TestClosePartition(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	partitionTime := time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local)
+	folder := PartitionFolder(partitionTime)
+	gcs.Put("bucket", path.Join(folder, "msg-1.txt"), []byte("a"), nil)
+	gcs.Put("bucket", path.Join(folder, "batch-2.txt"), []byte("bc\nde"), map[string]string{"messageCount": "2"})
+	gcs.Put("bucket", PartitionFolder(partitionTime.Add(time.Hour))+"/msg-3.txt", []byte("f"), nil)
+
+	manifest, err := ClosePartition(context.Background(), "bucket", partitionTime)
+	if err != nil {
+		t.Fatalf("ClosePartition() error = %v", err)
+	}
+	if manifest == nil || manifest.ObjectCount != 2 || manifest.RecordCount != 3 || manifest.ByteSize != 6 {
+		t.Fatalf("manifest = %+v, want 2 objects with 3 records and 6 bytes", manifest)
+	}
+	if _, ok := gcs.Object("bucket", path.Join(folder, SuccessMarker)); !ok {
+		t.Error("success marker was not written")
+	}
+
+	stored, ok := gcs.Object("bucket", path.Join(folder, ManifestName))
+	if !ok {
+		t.Fatal("manifest was not written")
+	}
+	var written Manifest
+	if err := json.Unmarshal(stored.Data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.RecordCount != 3 || len(written.Objects) != 2 {
+		t.Errorf("written manifest = %+v", written)
+	}
+
+	// A closed partition is not closed again.
+	manifest, err = ClosePartition(context.Background(), "bucket", partitionTime)
+	if err != nil || manifest != nil {
+		t.Errorf("ClosePartition() of a closed partition = %v, %v, want nil, nil", manifest, err)
+	}
+}
+
+func TestClosePartitionKeepsExistingManifest(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	// Another closer wrote the manifest, but not the marker yet.
+	partitionTime := time.Date(2020, 10, 1, 13, 0, 0, 0, time.Local)
+	folder := PartitionFolder(partitionTime)
+	gcs.Put("bucket", path.Join(folder, "msg-1.txt"), []byte("a"), nil)
+	existing, _ := json.Marshal(Manifest{Partition: folder, ObjectCount: 1, RecordCount: 1, ByteSize: 1, Objects: []ManifestObject{{Name: path.Join(folder, "msg-1.txt"), Records: 1, ByteSize: 1}}})
+	gcs.Put("bucket", path.Join(folder, ManifestName), existing, nil)
+	before, _ := gcs.Object("bucket", path.Join(folder, ManifestName))
+
+	// A late object, which the manifest of the first closer does not list.
+	gcs.Put("bucket", path.Join(folder, "msg-2.txt"), []byte("b"), nil)
+
+	manifest, err := ClosePartition(context.Background(), "bucket", partitionTime)
+	if err != nil {
+		t.Fatalf("ClosePartition() error = %v", err)
+	}
+	if manifest == nil || manifest.RecordCount != 1 {
+		t.Errorf("manifest = %+v, want the existing manifest", manifest)
+	}
+
+	after, _ := gcs.Object("bucket", path.Join(folder, ManifestName))
+	if after.Generation != before.Generation {
+		t.Error("existing manifest was overwritten")
+	}
+	if _, ok := gcs.Object("bucket", path.Join(folder, SuccessMarker)); !ok {
+		t.Error("success marker was not written")
+	}
+}
+
+func TestClosePartitionsSkipsEmptyPartitions(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	watermark := time.Date(2020, 10, 1, 12, 30, 0, 0, time.Local)
+	full := time.Date(2020, 10, 1, 10, 0, 0, 0, time.Local)
+	gcs.Put("bucket", path.Join(PartitionFolder(full), "msg-1.txt"), []byte("a"), nil)
+
+	manifests, err := ClosePartitions(context.Background(), PartitionInfo{Enabled: true, BucketID: "bucket", Lookback: 3}, watermark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 || manifests[0].Partition != PartitionFolder(full) {
+		t.Fatalf("closed partitions = %v, want only %s", manifests, PartitionFolder(full))
+	}
+	for _, name := range gcs.Names("bucket") {
+		if path.Base(name) == SuccessMarker && path.Dir(name) != PartitionFolder(full) {
+			t.Errorf("partition %s without objects was closed", path.Dir(name))
+		}
+	}
+}
+
+func TestClosePartitionsOfAllBuckets(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	watermark := time.Date(2020, 10, 1, 12, 30, 0, 0, time.Local)
+	partitionTime := time.Date(2020, 10, 1, 11, 0, 0, 0, time.Local)
+	for _, bucketID := range []string{"bucket", "routed", "copy"} {
+		gcs.Put(bucketID, path.Join(PartitionFolder(partitionTime), "msg-1.txt"), []byte("a"), nil)
+	}
+
+	info := PartitionInfo{
+		Enabled:         true,
+		BucketID:        "s3://primary",
+		RoutedBucketIDs: []string{"gs://bucket", "routed"},
+		FanOutBucketIDs: []string{"copy", "bucket", "azblob://container"},
+		Lookback:        1,
+	}
+	if got := info.GCSBucketIDs(); len(got) != 3 || got[0] != "bucket" || got[1] != "routed" || got[2] != "copy" {
+		t.Fatalf("GCSBucketIDs() = %v, want [bucket routed copy]", got)
+	}
+
+	manifests, err := ClosePartitions(context.Background(), info, watermark)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 3 {
+		t.Fatalf("closed %d partitions, want one in each GCS bucket", len(manifests))
+	}
+	for _, bucketID := range []string{"bucket", "routed", "copy"} {
+		if _, ok := gcs.Object(bucketID, path.Join(PartitionFolder(partitionTime), SuccessMarker)); !ok {
+			t.Errorf("partition of bucket %s was not closed", bucketID)
+		}
+	}
+
+	if _, err := ClosePartition(context.Background(), "s3://primary", partitionTime); err == nil {
+		t.Error("ClosePartition() of an S3 bucket error = nil, want an error")
+	}
+}
+
+func TestSetPartitionInfo(t *testing.T) {
+	for _, test := range []struct {
+		variables map[string]string
+		want      []string
+	}{
+		{map[string]string{"CLOSE_PARTITIONS": "true", "BUCKET_ID": "bucket", "FANOUT_BUCKET_IDS": "s3://copy,gs://other"}, []string{"bucket", "other"}},
+		{map[string]string{"CLOSE_PARTITIONS": "true", "BUCKET_ID": "s3://bucket", "FANOUT_BUCKET_IDS": "copy"}, []string{"copy"}},
+	} {
+		var restores []func()
+		for name, value := range test.variables {
+			restores = append(restores, setEnv(name, value))
+		}
+		var info PartitionInfo
+		err := SetPartitionInfo(&info)
+		for _, restore := range restores {
+			restore()
+		}
+		if err != nil {
+			t.Fatalf("SetPartitionInfo() with %v error = %v", test.variables, err)
+		}
+		if got := info.GCSBucketIDs(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GCSBucketIDs() with %v = %v, want %v", test.variables, got, test.want)
+		}
+	}
+
+	restoreClose := setEnv("CLOSE_PARTITIONS", "true")
+	restoreBucket := setEnv("BUCKET_ID", "s3://bucket")
+	defer restoreClose()
+	defer restoreBucket()
+	if err := SetPartitionInfo(&PartitionInfo{}); err == nil {
+		t.Error("SetPartitionInfo() without a GCS bucket error = nil, want an error")
+	}
+
+	defer setEnv("BUCKET_ID", "bucket")()
+	for _, name := range []string{"PARTITION_LATENESS", "PARTITION_LOOKBACK"} {
+		restore := setEnv(name, "-1")
+		err := SetPartitionInfo(&PartitionInfo{})
+		restore()
+		if err == nil {
+			t.Errorf("SetPartitionInfo() with %s=-1 error = nil, want an error", name)
+		}
+	}
+}
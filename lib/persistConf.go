@@ -0,0 +1,161 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// PersistConf represents the configuration of the persist path.
+// It is shared by all of the delivery mechanisms (push, pull and streaming pull), so each message
+// is processed in the same way regardless of how it was received.
+type PersistConf struct {
+	Storage             StorageInfo      // storage configuration
+	Quarantine          QuarantineInfo   // quarantine configuration
+	Notification        NotificationInfo // notification configuration
+	Index               IndexInfo        // message index configuration
+	Validation          ValidationInfo   // payload validation configuration
+	Routing             RoutingInfo      // routing configuration
+	FanOut              FanOutInfo       // fan-out configuration
+	BigQuery            BigQueryInfo     // BigQuery sink configuration
+	BatchOutput         BatchOutputInfo  // batched output configuration
+	Avro                AvroInfo         // Avro format configuration
+	Parquet             ParquetInfo      // Parquet format configuration
+	Filter              FilterInfo       // message filter configuration
+	Transform           TransformInfo    // transform pipeline configuration
+	Redaction           RedactionInfo    // redaction configuration
+	MaxDeliveryAttempts int              // number of delivery attempts after which a failing message is quarantined (0 disables the limit)
+}
+
+// SetPersistConf sets the parameters of a persist configuration by extracting values from the corresponding environment variables.
+// The quarantine and redaction configurations are set first, so they are available even if the rest of the configuration is invalid,
+// and a message quarantined because of an invalid configuration is redacted as well.
+// An error is returned if any errors occur during the function execution.
+func SetPersistConf(persistConf *PersistConf) error {
+	var err error
+
+	err = SetQuarantineInfo(&persistConf.Quarantine)
+	if err != nil {
+		return err
+	}
+
+	err = SetRedactionInfo(&persistConf.Redaction)
+	if err != nil {
+		return err
+	}
+
+	err = SetStorageInfo(&persistConf.Storage)
+	if err != nil {
+		return err
+	}
+
+	err = SetNotificationInfo(&persistConf.Notification)
+	if err != nil {
+		return err
+	}
+
+	err = SetIndexInfo(&persistConf.Index)
+	if err != nil {
+		return err
+	}
+
+	err = SetValidationInfo(&persistConf.Validation)
+	if err != nil {
+		return err
+	}
+	if persistConf.Validation.Enabled() && !persistConf.Quarantine.Enabled() {
+		return fmt.Errorf("Payload validation requires the quarantine (QUARANTINE_BUCKET_ID) for the invalid messages")
+	}
+
+	err = SetFilterInfo(&persistConf.Filter)
+	if err != nil {
+		return err
+	}
+
+	err = SetTransformInfo(&persistConf.Transform)
+	if err != nil {
+		return err
+	}
+	// As the routes, the transform pipeline is loaded together with the configuration, so an invalid configuration
+	// is reported when the persistor starts.
+	if persistConf.Transform.Enabled() {
+		persistConf.Transform.pipeline, err = LoadPipeline(context.Background(), persistConf.Transform.Config)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = SetRoutingInfo(&persistConf.Routing)
+	if err != nil {
+		return err
+	}
+	// The routes are loaded (once per instance) together with the configuration, so invalid routes are reported
+	// when the persistor starts.
+	if persistConf.Routing.Enabled() {
+		persistConf.Routing.router, err = LoadRouter(context.Background(), persistConf.Routing, persistConf.Storage)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = SetFanOutInfo(&persistConf.FanOut)
+	if err != nil {
+		return err
+	}
+
+	err = SetBigQueryInfo(&persistConf.BigQuery)
+	if err != nil {
+		return err
+	}
+	if persistConf.BigQuery.Enabled() && !persistConf.Quarantine.Enabled() {
+		return fmt.Errorf("BigQuery sink requires the quarantine (QUARANTINE_BUCKET_ID) as the dead-letter path of the rejected rows")
+	}
+
+	err = SetBatchOutputInfo(&persistConf.BatchOutput)
+	if err != nil {
+		return err
+	}
+
+	err = SetAvroInfo(&persistConf.Avro)
+	if err != nil {
+		return err
+	}
+
+	err = SetParquetInfo(&persistConf.Parquet)
+	if err != nil {
+		return err
+	}
+
+	// The sinks of the destinations are created in advance, so an invalid destination or sink configuration
+	// is reported when the persistor starts. The destinations of the routes are known only after the routes are loaded.
+	for _, destination := range append([]string{persistConf.Storage.BucketID}, persistConf.FanOut.BucketIDs...) {
+		_, err = GetSink(destination)
+		if err != nil {
+			return err
+		}
+	}
+
+	persistConf.MaxDeliveryAttempts, err = strconv.Atoi(getOptionalEnvVariable("MAX_DELIVERY_ATTEMPTS", "0"))
+	if err != nil {
+		return err
+	}
+	if persistConf.MaxDeliveryAttempts < 0 {
+		return fmt.Errorf("Maximum number of delivery attempts must not be negative")
+	}
+
+	return nil
+}
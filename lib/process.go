@@ -0,0 +1,335 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// ReasonMaxDeliveryAttempts is the quarantine reason of messages which failed on too many delivery attempts.
+const ReasonMaxDeliveryAttempts = "max-delivery-attempts"
+
+// ProcessMessage stores a message using the persist configuration. It is used by all of the delivery mechanisms.
+// If the filter is configured, a message which does not match it is acknowledged without being stored, and a message
+// for which the filter cannot be evaluated is handled by HandleFailure (a message whose payload is used by the filter,
+// but is not valid JSON, is quarantined with the ReasonInvalidPayload reason).
+// If the transforms are configured, the message is first passed through the transform pipeline, and each of the
+// resulting messages is processed separately. A message dropped by the pipeline is acknowledged without being stored,
+// while a message whose transform fails is handled by HandleFailure.
+// If the redaction is configured, the sensitive values of each payload are redacted before it is validated and stored,
+// and a payload which is not valid JSON is quarantined.
+// If the validation is configured, a message whose payload does not match the schema is quarantined instead of being stored.
+// If the routing is configured, each message is stored in the bucket, and with the file name and format, of the first
+// route whose condition it matches, or of the default route.
+// If the fan-out is configured, each message is also stored in the additional buckets, and it is acknowledged
+// only if the fan-out policy is satisfied.
+// If storing fails, the failure is handled by HandleFailure. If the notifications are configured, a notification
+// is published after the message is stored and the message is redelivered if the notification could not be published.
+// If the message index is enabled, the location of the message stored in GCS is added to the index entries written by FlushIndex.
+// If the BigQuery sink is configured, a row of the stored message is added to the rows inserted by FlushBigQuery, and the
+// message is acknowledged once its row is inserted or dead-lettered.
+// If the message is stored in a batched format (see IsBatchFormat), the pending batches to which it was added are written,
+// while the batches of other messages are left pending, and if its row is pending, the pending rows are inserted
+// (see DrainBigQuery), so the function returns once the message is fully stored.
+// Returned result is nil if the message should be acknowledged (it was stored, filtered out, dropped or quarantined), or an error
+// if the message should be redelivered.
+func ProcessMessage(ctx context.Context, msg Message, conf PersistConf, report *RunReport) error {
+	result := make(chan error, 1)
+	group := newAckGroup(func(err error) { result <- err })
+	group.finish(processMessage(ctx, msg, conf, report, group))
+
+	select {
+	case err := <-result:
+		return err
+	default:
+	}
+
+	if err := flushGroupBatches(ctx, group); err != nil {
+		log.Printf("Error during writing batches. %s.\n", err)
+	}
+	if conf.BigQuery.Enabled() {
+		if err := DrainBigQuery(ctx); err != nil {
+			log.Printf("Error during inserting rows into BigQuery. %s.\n", err)
+		}
+	}
+	return <-result
+}
+
+// ProcessMessageAsync processes a message in the same way as ProcessMessage, but it does not wait for the batch of the message
+// to be written. The done function is called with the result of the message, which is nil if the message should be acknowledged.
+// It is called before the function returns, unless the message was added to a batch, in which case it is called when the batch
+// is written (see FlushBatches), or its BigQuery row is pending, in which case it is called when the row is inserted.
+func ProcessMessageAsync(ctx context.Context, msg Message, conf PersistConf, report *RunReport, done func(error)) {
+	group := newAckGroup(done)
+	group.finish(processMessage(ctx, msg, conf, report, group))
+}
+
+// processMessage filters and transforms a message and processes the resulting messages, as described for ProcessMessage.
+// The messages added to batches are added to the ack group.
+func processMessage(ctx context.Context, msg Message, conf PersistConf, report *RunReport, group *ackGroup) error {
+	report.CountReceived()
+
+	if conf.Filter.Enabled() {
+		match, err := conf.Filter.Match(msg)
+		if err != nil {
+			log.Printf("Error during filtering message '%s'. %s.\n", msg.ID, err)
+			return HandleFailure(ctx, msg, err, conf, report)
+		}
+		if !match {
+			report.CountFiltered()
+			return nil
+		}
+	}
+
+	if !conf.Transform.Enabled() {
+		return processTransformed(ctx, msg, conf, report, group)
+	}
+
+	pipeline, err := conf.Transform.Pipeline(ctx)
+	if err != nil {
+		// The configuration could not be loaded, so the message is redelivered instead of being quarantined.
+		log.Printf("Error during loading transform configuration. %s.\n", err)
+		report.CountFailed()
+		return err
+	}
+
+	msgs, err := pipeline.Apply(ctx, msg)
+	if err != nil {
+		log.Printf("Error during transforming message '%s'. %s.\n", msg.ID, err)
+		return HandleFailure(ctx, msg, err, conf, report)
+	}
+	if len(msgs) == 0 {
+		report.CountDropped()
+		return nil
+	}
+
+	splitIDs(msg.ID, msgs)
+	for _, transformed := range msgs {
+		err = processTransformed(ctx, transformed, conf, report, group)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitIDs makes the IDs of the messages into which a message was split unique, by appending their position
+// to the original ID, so they are not stored under the same name. Messages given a new ID by a transform keep it.
+func splitIDs(id string, msgs []Message) {
+	if len(msgs) < 2 {
+		return
+	}
+	for i := range msgs {
+		if msgs[i].ID == id {
+			msgs[i].ID = fmt.Sprintf("%s_%d", id, i)
+		}
+	}
+}
+
+// processTransformed redacts, validates, routes, stores and indexes a single message, and publishes its notification.
+// A message stored in a batched format is added to a batch instead, and the steps which follow storing are taken when the batch is written.
+// Returned result is nil if the message was stored, added to a batch or quarantined, or an error if it should be redelivered.
+func processTransformed(ctx context.Context, msg Message, conf PersistConf, report *RunReport, group *ackGroup) error {
+	if conf.Redaction.Enabled() {
+		redactor, err := conf.Redaction.Redactor(ctx)
+		if err != nil {
+			// The rules could not be loaded, so the message is redelivered instead of being stored without redaction.
+			log.Printf("Error during loading redaction rules. %s.\n", err)
+			report.CountFailed()
+			return err
+		}
+
+		data, counts, err := redactor.Redact(msg.Data)
+		if err != nil {
+			log.Printf("Error during redacting message '%s'. %s.\n", msg.ID, err)
+			return HandleFailure(ctx, msg, Permanent(err), conf, report)
+		}
+		msg.Data = data
+		report.CountRedacted(counts)
+	}
+
+	if conf.Validation.Enabled() {
+		err := ValidatePayload(ctx, msg.Data, conf.Validation)
+		if _, ok := err.(*SchemaValidationError); ok {
+			report.CountValidation(false)
+			return quarantine(ctx, msg, ReasonInvalidSchema, err, conf, report)
+		}
+		if err != nil {
+			// The schema could not be loaded, so the message is redelivered instead of being treated as invalid.
+			log.Printf("Error during payload validation of message '%s'. %s.\n", msg.ID, err)
+			report.CountFailed()
+			return err
+		}
+		report.CountValidation(true)
+	}
+
+	storageInfo := conf.Storage
+	indexBucketID := conf.Index.BucketID
+	route := ""
+	if conf.Routing.Enabled() {
+		router, err := conf.Routing.Router(ctx, conf.Storage)
+		if err != nil {
+			// The routes could not be loaded, so the message is redelivered instead of being stored in the default location.
+			log.Printf("Error during loading routes. %s.\n", err)
+			report.CountFailed()
+			return err
+		}
+
+		route, storageInfo, err = router.Route(msg)
+		if err != nil {
+			log.Printf("Error during routing message '%s'. %s.\n", msg.ID, err)
+			return handleFailure(ctx, msg, err, conf, report)
+		}
+	}
+
+	if IsBatchFormat(storageInfo.Format) {
+		return addToBatch(ctx, msg, storageInfo, route, conf, report, group)
+	}
+
+	partitionTime := time.Now()
+	var attrs *storage.ObjectAttrs
+	var err error
+	if conf.FanOut.Enabled() {
+		attrs, err = persistFanOut(ctx, msg, storageInfo, conf.FanOut, partitionTime, report)
+	} else {
+		attrs, err = persistMessage(ctx, msg, storageInfo, partitionTime)
+	}
+	if err != nil {
+		log.Printf("Error during storing message '%s'. %s.\n", msg.ID, err)
+		return handleFailure(ctx, msg, err, conf, report)
+	}
+	if conf.Routing.Enabled() || conf.FanOut.Enabled() {
+		// The index entries are written to the bucket of the stored object, next to the objects they point to.
+		indexBucketID = attrs.Bucket
+	}
+
+	if conf.Notification.Enabled() {
+		err = Notify(ctx, newPersistedEvent(attrs, partitionTime, msg), conf.Notification)
+		if err != nil {
+			// The message is already stored, so it is redelivered instead of being quarantined.
+			log.Printf("Error during publishing notification for message '%s'. %s.\n", msg.ID, err)
+			report.CountFailed()
+			return err
+		}
+	}
+
+	if conf.Index.Enabled && IsGCSDestination(indexBucketID) {
+		addIndexEntry(indexBucketID, newIndexEntry(msg.ID, attrs))
+	}
+
+	if conf.BigQuery.Enabled() {
+		addBigQueryRow(ctx, msg, objectURI(attrs), conf.BigQuery, conf.Quarantine, group.add())
+	}
+
+	if route != "" {
+		report.CountRouted(route)
+	}
+	report.CountPersisted()
+	return nil
+}
+
+// HandleFailure decides what happens with a message which could not be stored.
+// The message is quarantined if the error is permanent, or if the number of delivery attempts reached
+// the configured limit (the delivery attempt is known only if the subscription has a dead letter policy).
+// The message is expected to be the received one, so if the redaction is configured, its payload is redacted
+// before it is quarantined, and a payload which cannot be redacted is left out of the quarantine record.
+// Returned result is nil if the message was quarantined and should be acknowledged. Otherwise the original
+// error is returned and the message should be redelivered, which is also the case if the quarantine
+// is not configured or fails.
+func HandleFailure(ctx context.Context, msg Message, err error, conf PersistConf, report *RunReport) error {
+	reason := failureReason(msg, err, conf)
+	if reason == "" {
+		report.CountFailed()
+		return err
+	}
+
+	redacted, cause := redactForQuarantine(ctx, msg, err, conf.Redaction)
+	if quarantine(ctx, redacted, reason, cause, conf, report) != nil {
+		return err
+	}
+	return nil
+}
+
+// handleFailure handles the failure of a message which is already redacted, as described for HandleFailure.
+func handleFailure(ctx context.Context, msg Message, err error, conf PersistConf, report *RunReport) error {
+	reason := failureReason(msg, err, conf)
+	if reason == "" {
+		report.CountFailed()
+		return err
+	}
+
+	return quarantine(ctx, msg, reason, err, conf, report)
+}
+
+// failureReason returns the quarantine reason of a failed message, or an empty string if the message should be redelivered.
+func failureReason(msg Message, err error, conf PersistConf) string {
+	switch {
+	case errors.Is(err, ErrInvalidPayload):
+		return ReasonInvalidPayload
+	case !IsRetryable(err):
+		return ReasonPermanentError
+	case conf.MaxDeliveryAttempts > 0 && msg.DeliveryAttempt != nil && *msg.DeliveryAttempt >= conf.MaxDeliveryAttempts:
+		return ReasonMaxDeliveryAttempts
+	default:
+		return ""
+	}
+}
+
+// redactForQuarantine redacts the payload of a message which failed before it was redacted (e.g. in the filter or a transform),
+// so its sensitive values are not written to the quarantine. If the payload cannot be redacted (e.g. it is not valid JSON,
+// or the rules cannot be loaded), the cause is wrapped in a PayloadWithheldError, so the payload is left out of the record.
+func redactForQuarantine(ctx context.Context, msg Message, cause error, info RedactionInfo) (Message, error) {
+	if !info.Enabled() {
+		return msg, cause
+	}
+
+	redactor, err := info.Redactor(ctx)
+	if err == nil {
+		var data []byte
+		data, _, err = redactor.Redact(msg.Data)
+		if err == nil {
+			msg.Data = data
+			return msg, cause
+		}
+	}
+	return msg, &PayloadWithheldError{Err: cause, Reason: err}
+}
+
+// quarantine stores a message in the quarantine for the given reason.
+// Returned result is nil if the message was quarantined, otherwise the cause is returned so the message is redelivered.
+func quarantine(ctx context.Context, msg Message, reason string, cause error, conf PersistConf, report *RunReport) error {
+	if !conf.Quarantine.Enabled() {
+		log.Printf("Message '%s' should be quarantined (%s), but the quarantine is not configured.\n", msg.ID, reason)
+		report.CountFailed()
+		return cause
+	}
+
+	qErr := QuarantineMessage(ctx, msg, reason, cause, conf.Quarantine)
+	if qErr != nil {
+		log.Printf("Error during message quarantine. %s.\n", qErr)
+		report.CountFailed()
+		return cause
+	}
+
+	log.Printf("Message '%s' was quarantined (%s).\n", msg.ID, reason)
+	report.CountQuarantined(reason)
+	return nil
+}
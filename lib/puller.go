@@ -17,7 +17,7 @@ package lib
 import (
 	"context"
 	"log"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/pubsub"
@@ -26,18 +26,28 @@ import (
 )
 
 // Pull function pulls messages from provided Pub/Sub subscription and calls storing function on each pulled message.
+// Messages which could not be stored are quarantined or redelivered, as decided by ProcessMessage.
 // As a part of a process, Pull creates a client that will receive blocks of messages.
 // Received blocks will be of a limited size if synchronous option is enabled.
 // Synchronous pull stores fixed number of messages and cancels the context which prevents further receiving.
 // If the streaming pull option is chosen, the client receives blocks of a variable sizes until context duration expires.
-// An error is returned if any errors occur during the function execution.
-func Pull(ctx context.Context, info *PullInfo, storageInfo StorageInfo, subConf *SubConf) error {
+// If the duration is not set (NumberOfSeconds is 0), the client receives messages until the passed in context is cancelled,
+// after which the already received messages are stored before the function returns.
+// If the message index is enabled, it is written periodically and at the end of the run.
+// The messages stored in batched formats are acknowledged when their batches are written, which happens when the batches
+// are full, periodically and when the receiving stops. A batch holds at most as many messages as a synchronous pull receives
+// and as the subscriber lets be outstanding (see batchMessageLimit). In the same way, if the BigQuery sink is configured,
+// the messages are acknowledged when their rows are inserted.
+// If the report interval is set, the report is logged and reset periodically, and the returned report holds only the counts
+// since it was last logged.
+// The function returns the report of the run, and an error if any errors occur during the function execution.
+func Pull(ctx context.Context, info *PullInfo, persistConf PersistConf, subConf *SubConf) (*RunReport, error) {
 
 	var err error
 
 	client, err := pubsub.NewClient(ctx, info.ProjectID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer client.Close()
 
@@ -50,44 +60,96 @@ func Pull(ctx context.Context, info *PullInfo, storageInfo StorageInfo, subConf
 	sub.ReceiveSettings.MaxOutstandingBytes = subConf.MaxOutstandingBytes
 	sub.ReceiveSettings.NumGoroutines = subConf.NumOfGoroutines
 
+	// The messages of a batch are acknowledged only when the batch is written, so a batch must not wait for more messages
+	// than the run receives, or than the subscriber lets be outstanding.
+	persistConf.BatchOutput.MaxMessages = batchMessageLimit(persistConf.BatchOutput.MaxMessages, info, subConf)
+
 	// Receive messages for NumberOfSeconds period.
-	ctxx, cancel := context.WithTimeout(ctx, time.Duration(info.NumberOfSeconds)*time.Second)
+	// If the period is not set, messages are received until the passed in context is cancelled.
+	var ctxx context.Context
+	var cancel context.CancelFunc
+	if info.NumberOfSeconds > 0 {
+		ctxx, cancel = context.WithTimeout(ctx, time.Duration(info.NumberOfSeconds)*time.Second)
+	} else {
+		ctxx, cancel = context.WithCancel(ctx)
+	}
 	defer cancel()
 
 	// Create a channel to handle messages to as they come in.
 	cm := make(chan *pubsub.Message)
+	report := NewRunReport()
+	done := make(chan struct{})
+
+	var messageCounter int64
+	ack := func(msg *pubsub.Message) func(error) {
+		return func(err error) {
+			// A message which could not be stored or quarantined is not acknowledged, so it is redelivered.
+			if err != nil {
+				msg.Nack()
+				return
+			}
 
-	go func() {
-		var mtx = &sync.Mutex{}
-		var messageCounter int = 0
-
-		for {
-			select {
-			case msg := <-cm:
-				mtx.Lock()
-
-				storageInfo.MessageID = msg.ID
+			msg.Ack()
 
-				if err := PersistData(ctx, msg.Data, storageInfo); err != nil {
-					panic(err)
+			if subConf.Synchronous {
+				// If max message count is exceeded then cancel the context.
+				if atomic.AddInt64(&messageCounter, 1) >= int64(info.NumberOfMessages) {
+					cancel()
 				}
+			}
+		}
+	}
 
-				messageCounter++
-				msg.Ack()
-
-				if subConf.Synchronous {
-					// If max message count is exceeded then cancel the context.
-					if messageCounter >= info.NumberOfMessages {
-						cancel()
-					}
-				}
-				mtx.Unlock()
-			case <-ctxx.Done():
-				return
+	go func() {
+		defer close(done)
+
+		// The channel is read until it is closed, so the messages which were received before
+		// the context expired are still stored. Storing uses a context which is not cancelled
+		// together with the receiving one, so in-flight messages are drained on shutdown.
+		// The messages stored in batches are acknowledged when their batch is written.
+		for msg := range cm {
+			ProcessMessageAsync(context.Background(), MessageFromPubsub(msg), persistConf, report, ack(msg))
+
+			// Receive returns only after all of the received messages are acknowledged, so the batches
+			// are written as soon as the receiving stops, including the batches of in-flight messages.
+			if ctxx.Err() != nil {
+				flushBatches()
 			}
 		}
 	}()
 
+	go func() {
+		<-ctxx.Done()
+		flushBatches()
+	}()
+
+	// The batches, the message index and the BigQuery rows are written periodically, so the messages which wait for them
+	// are acknowledged before their ack deadlines are extended for too long, also during a long pull window.
+	batchInterval := time.Duration(persistConf.BatchOutput.FlushInterval) * time.Second
+	if batchInterval <= 0 {
+		batchInterval = defaultBatchFlushInterval * time.Second
+	}
+	go flushPeriodically(ctxx, batchInterval, FlushBatches, "writing batches")
+	if persistConf.Index.Enabled {
+		interval := time.Duration(persistConf.Index.FlushInterval) * time.Second
+		if interval <= 0 {
+			interval = defaultIndexFlushInterval * time.Second
+		}
+		go flushPeriodically(ctxx, interval, FlushIndex, "writing message index")
+	}
+	if persistConf.BigQuery.Enabled() {
+		interval := time.Duration(persistConf.BigQuery.FlushInterval) * time.Second
+		if interval <= 0 {
+			interval = defaultBigQueryFlushInterval * time.Second
+		}
+		go flushPeriodically(ctxx, interval, FlushBigQuery, "inserting rows into BigQuery")
+	}
+
+	// The report is logged periodically and counting starts anew, so the report does not grow for the life of the process.
+	if info.ReportInterval > 0 {
+		go logReportPeriodically(ctxx, time.Duration(info.ReportInterval)*time.Second, report)
+	}
+
 	// Receive blocks until the passed in context exceeds.
 	recvErr := sub.Receive(ctxx, func(ctxx context.Context, msg *pubsub.Message) {
 		cm <- msg
@@ -98,5 +160,76 @@ func Pull(ctx context.Context, info *PullInfo, storageInfo StorageInfo, subConf
 	}
 
 	close(cm)
-	return err
+	<-done
+	flushBatches()
+
+	if persistConf.Index.Enabled {
+		if err := FlushIndex(context.Background()); err != nil {
+			log.Printf("Error during writing message index. %s.\n", err)
+		}
+	}
+	return report, err
+}
+
+// batchMessageLimit returns the effective maximum number of messages in a batch of a pull run: the smallest of the configured
+// maximum, the number of messages of a synchronous pull and the maximum number of outstanding messages of the subscriber.
+func batchMessageLimit(maxMessages int, info *PullInfo, subConf *SubConf) int {
+	limit := maxMessages
+	if subConf.Synchronous && info.NumberOfMessages > 0 && info.NumberOfMessages < limit {
+		limit = info.NumberOfMessages
+	}
+
+	// A negative value disables the limit of the subscriber, while zero selects its default.
+	outstanding := subConf.MaxOutstandingMessages
+	if outstanding == 0 {
+		outstanding = pubsub.DefaultReceiveSettings.MaxOutstandingMessages
+	}
+	if outstanding > 0 && outstanding < limit {
+		limit = outstanding
+	}
+	return limit
+}
+
+// flushBatches writes the pending batches and inserts the pending BigQuery rows, so the messages which wait for them
+// are acknowledged or redelivered, logging the errors.
+func flushBatches() {
+	if err := FlushBatches(context.Background()); err != nil {
+		log.Printf("Error during writing batches. %s.\n", err)
+	}
+	if err := DrainBigQuery(context.Background()); err != nil {
+		log.Printf("Error during inserting rows into BigQuery. %s.\n", err)
+	}
+}
+
+// flushPeriodically calls the flush function at the given interval until the context is done.
+// The action describes the flush in the logged errors.
+func flushPeriodically(ctx context.Context, interval time.Duration, flush func(context.Context) error, action string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := flush(ctx); err != nil {
+				log.Printf("Error during %s. %s.\n", action, err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// logReportPeriodically logs the counts of the report and resets it with the given interval, until the context is cancelled.
+func logReportPeriodically(ctx context.Context, interval time.Duration, report *RunReport) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			log.Printf("Run report: %s.\n", report.Rotate())
+		case <-ctx.Done():
+			return
+		}
+	}
 }
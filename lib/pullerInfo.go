@@ -16,10 +16,13 @@ package lib
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 )
 
+const defaultReportInterval = 3600
+
 // PullInfo represents pull configuration.
 // It holds information needed for Pull function.
 type PullInfo struct {
@@ -27,6 +30,7 @@ type PullInfo struct {
 	SubID            string // the ID of a subscription the messages will be pulled from
 	NumberOfMessages int    // the number of messages pull function will persist in one call (this applies only to the synchronous version)
 	NumberOfSeconds  int    // the time duration in which the messages will be received
+	ReportInterval   int    // the number of seconds between two run reports of a continuous pull (0 disables them)
 }
 
 // SubConf represents subscriber configuration.
@@ -60,6 +64,14 @@ func SetPullInfo(pullInfo *PullInfo) error {
 		return err
 	}
 
+	pullInfo.ReportInterval, err = strconv.Atoi(getOptionalEnvVariable("REPORT_INTERVAL", strconv.Itoa(defaultReportInterval)))
+	if err != nil {
+		return err
+	}
+	if pullInfo.ReportInterval < 0 {
+		return fmt.Errorf("Report interval must not be negative")
+	}
+
 	return err
 }
 
@@ -0,0 +1,102 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/syntio/aquarium-persistor-gcp/lib/avro"
+)
+
+func TestBatchMessageLimit(t *testing.T) {
+	for _, test := range []struct {
+		messages    int
+		synchronous bool
+		outstanding int
+		want        int
+	}{
+		{messages: 10, synchronous: true, outstanding: 100, want: 10},
+		{messages: 10, synchronous: false, outstanding: 100, want: 100},
+		{messages: 0, synchronous: true, outstanding: 50, want: 50},
+		{messages: 10, synchronous: true, outstanding: 5, want: 5},
+		{messages: 0, synchronous: false, outstanding: -1, want: 500},
+		{messages: 0, synchronous: false, outstanding: 0, want: 500},
+	} {
+		info := &PullInfo{NumberOfMessages: test.messages}
+		subConf := &SubConf{Synchronous: test.synchronous, MaxOutstandingMessages: test.outstanding}
+		if got := batchMessageLimit(500, info, subConf); got != test.want {
+			t.Errorf("batchMessageLimit(500, %+v, %+v) = %d, want %d", info, subConf, got, test.want)
+		}
+	}
+}
+
+func TestPullWritesBatchOfBoundedRun(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopPubsub := startPubsub(t, "project", "messages")
+	defer stopPubsub()
+
+	client, err := pubsub.NewClient(context.Background(), "project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic := client.Topic("messages")
+	defer topic.Stop()
+	if _, err := client.CreateSubscription(context.Background(), "messages-sub", pubsub.SubscriptionConfig{Topic: topic}); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range []string{"one", "two", "three"} {
+		if _, err := topic.Publish(context.Background(), &pubsub.Message{Data: []byte(data)}).Get(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The batch is limited to the 3 messages of the run, so it is written and the run stops long before its window ends.
+	conf := PersistConf{
+		Storage:     StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "avro", Format: FormatAvro},
+		BatchOutput: BatchOutputInfo{MaxMessages: 1000, MaxBytes: 1 << 20, FlushInterval: 600},
+		Avro:        AvroInfo{Codec: avro.CodecNull},
+	}
+	info := &PullInfo{ProjectID: "project", SubID: "messages-sub", NumberOfMessages: 3, NumberOfSeconds: 60}
+	subConf := &SubConf{Synchronous: true, MaxExtension: 60, MaxOutstandingMessages: 100, MaxOutstandingBytes: 1 << 20, NumOfGoroutines: 1}
+	start := time.Now()
+	report, err := Pull(context.Background(), info, conf, subConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Pull() returned after %v, want it to stop once the 3 messages are acknowledged", elapsed)
+	}
+
+	if report.Persisted != 3 {
+		t.Errorf("persisted = %d, want 3", report.Persisted)
+	}
+	names := gcs.Names("bucket")
+	if len(names) != 1 {
+		t.Fatalf("stored objects = %v, want 1 batch file", names)
+	}
+	if object, _ := gcs.Object("bucket", names[0]); object.Metadata["messageCount"] != "3" {
+		t.Errorf("metadata = %v, want 3 messages", object.Metadata)
+	}
+	for _, msg := range server.Messages() {
+		if msg.Acks != 1 {
+			t.Errorf("message %s was acknowledged %d times, want once", msg.Data, msg.Acks)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// ReasonPermanentError is the quarantine reason of messages which failed with a permanent error.
+	ReasonPermanentError = "permanent-error"
+
+	// maxMetadataError is the maximum size of the error stored in the metadata of a quarantine object.
+	maxMetadataError = 1024
+)
+
+// PayloadWithheldError wraps the error of a message whose payload is left out of its quarantine record,
+// since the redaction is configured and the payload could not be redacted.
+type PayloadWithheldError struct {
+	Err    error // error for which the message is quarantined
+	Reason error // error which prevented the redaction
+}
+
+// Error returns the message of the wrapped error, together with the reason for withholding the payload.
+func (e *PayloadWithheldError) Error() string {
+	return fmt.Sprintf("%s (the payload is withheld, since it could not be redacted: %s)", e.Err, e.Reason)
+}
+
+// Unwrap returns the wrapped error.
+func (e *PayloadWithheldError) Unwrap() error {
+	return e.Err
+}
+
+// QuarantineRecord is the JSON document stored in the quarantine for each message which could not be persisted.
+// It holds the message envelope together with the details of the failure.
+type QuarantineRecord struct {
+	Envelope
+	Reason           string    `json:"reason"`                     // reason for which the message was quarantined
+	Error            string    `json:"error"`                      // error which occurred while persisting the message
+	ValidationErrors []string  `json:"validationErrors,omitempty"` // schema validation errors (only for invalid messages)
+	DeliveryAttempt  int       `json:"deliveryAttempt,omitempty"`  // delivery attempt on which the message was quarantined
+	PayloadWithheld  bool      `json:"payloadWithheld,omitempty"`  // whether the payload is left out, since it could not be redacted
+	QuarantinedAt    time.Time `json:"quarantinedAt"`              // time at which the message was quarantined
+}
+
+// QuarantineMessage stores a message which could not be persisted, together with the error details, in the quarantine.
+// The record is stored in the quarantine folder, using the same date and hour structure as the persisted messages
+// and the reason as the file name prefix.
+// Returned result is an error which defines the validity of the function action.
+func QuarantineMessage(ctx context.Context, msg Message, reason string, cause error, info QuarantineInfo) error {
+	record := QuarantineRecord{
+		Envelope:      NewEnvelope(msg),
+		Reason:        reason,
+		QuarantinedAt: time.Now(),
+	}
+	if cause != nil {
+		record.Error = cause.Error()
+	}
+	if validationErr, ok := cause.(*SchemaValidationError); ok {
+		record.ValidationErrors = validationErr.Errors
+	}
+	if msg.DeliveryAttempt != nil {
+		record.DeliveryAttempt = *msg.DeliveryAttempt
+	}
+	var withheldErr *PayloadWithheldError
+	if errors.As(cause, &withheldErr) {
+		record.Data = nil
+		record.PayloadWithheld = true
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	objectName := path.Join(info.Prefix, FileName(StorageInfo{MessageID: msg.ID, Prefix: reason, Extension: "json"}))
+	metadata := map[string]string{
+		"reason": reason,
+		"error":  truncate(record.Error, maxMetadataError),
+	}
+
+	_, err = writeObject(ctx, info.BucketID, objectName, data, metadata)
+	if err != nil {
+		return fmt.Errorf("Quarantining message '%s' failed: %w", msg.ID, err)
+	}
+	return nil
+}
+
+// truncate shortens a string to the given number of bytes, which is used for keeping the object metadata within its size limit.
+// The string is cut on a rune boundary, so a multi-byte character is never split.
+func truncate(value string, size int) string {
+	if len(value) <= size {
+		return value
+	}
+	end := size - 3
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end] + "..."
+}
+
+// QuarantinedItem describes a quarantined message, as returned by ListQuarantined.
+type QuarantinedItem struct {
+	Name    string    // name of the quarantine object
+	Reason  string    // reason for which the message was quarantined
+	Error   string    // error which occurred while persisting the message
+	Size    int64     // size of the quarantine record in bytes
+	Created time.Time // time at which the message was quarantined
+}
+
+// ListQuarantined lists the quarantined messages whose object names start with the quarantine folder followed by the
+// given prefix (e.g. "2020/11/05" lists the messages quarantined on that day, while an empty prefix lists all of them).
+// The reason and error are read from the object metadata, so the records themselves are not downloaded.
+// An error is returned if any errors occur during the function execution.
+func ListQuarantined(ctx context.Context, info QuarantineInfo, prefix string) ([]QuarantinedItem, error) {
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	query := &storage.Query{Prefix: strings.TrimSuffix(info.Prefix, "/") + "/" + prefix}
+
+	var items []QuarantinedItem
+	it := client.Bucket(info.BucketID).Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, QuarantinedItem{
+			Name:    attrs.Name,
+			Reason:  attrs.Metadata["reason"],
+			Error:   attrs.Metadata["error"],
+			Size:    attrs.Size,
+			Created: attrs.Created,
+		})
+	}
+
+	return items, nil
+}
+
+// ReadQuarantined reads the quarantine record stored in the object with the given name.
+// An error is returned if any errors occur during the function execution.
+func ReadQuarantined(ctx context.Context, info QuarantineInfo, name string) (*QuarantineRecord, error) {
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	reader, err := client.Bucket(info.BucketID).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var record QuarantineRecord
+	err = json.NewDecoder(reader).Decode(&record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
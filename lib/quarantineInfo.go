@@ -0,0 +1,40 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+const defaultQuarantinePrefix = "quarantine"
+
+// QuarantineInfo represents quarantine configuration.
+// It holds information needed for storing messages which could not be persisted.
+// The quarantine is optional and it is disabled if the bucket ID is not set.
+type QuarantineInfo struct {
+	BucketID string // ID of a bucket in which quarantined messages will be stored (empty value disables the quarantine)
+	Prefix   string // folder in which quarantined messages will be stored
+}
+
+// SetQuarantineInfo sets the parameters of a quarantine configuration by extracting values from the corresponding environment variables.
+// Both of the variables are optional, if QUARANTINE_BUCKET_ID is not set the quarantine is disabled.
+// An error is returned if any errors occur during the function execution.
+func SetQuarantineInfo(quarantineInfo *QuarantineInfo) error {
+	quarantineInfo.BucketID = getOptionalEnvVariable("QUARANTINE_BUCKET_ID", "")
+	quarantineInfo.Prefix = getOptionalEnvVariable("QUARANTINE_PREFIX", defaultQuarantinePrefix)
+
+	return nil
+}
+
+// Enabled reports whether the quarantine is configured.
+func (quarantineInfo QuarantineInfo) Enabled() bool {
+	return quarantineInfo.BucketID != ""
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int
+		want  string
+	}{
+		{"short", 10, "short"},
+		{"exactly10!", 10, "exactly10!"},
+		{"a longer error message", 10, "a longe..."},
+		{"Hjelp på deg", 10, "Hjelp p..."},
+		{"Hjelp på deg", 11, "Hjelp p..."},
+		{"æææææææ", 9, "æææ..."},
+		{"æææææææ", 8, "ææ..."},
+	}
+
+	for _, test := range tests {
+		got := truncate(test.value, test.size)
+		if got != test.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.value, test.size, got, test.want)
+		}
+		if len(got) > test.size || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q is not a valid string within the size", test.value, test.size, got)
+		}
+	}
+}
+
+func TestQuarantineMessage(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+
+	attempt := 5
+	msg := Message{ID: "42", Data: []byte(`{"a":1}`), Attributes: map[string]string{"origin": "test"}, DeliveryAttempt: &attempt}
+	cause := &SchemaValidationError{Errors: []string{"/a: expected string"}}
+	info := QuarantineInfo{BucketID: "quarantine", Prefix: "quarantine"}
+	if err := QuarantineMessage(context.Background(), msg, ReasonSchemaMismatch, cause, info); err != nil {
+		t.Fatal(err)
+	}
+
+	names := gcs.Names("quarantine")
+	if len(names) != 1 || !strings.HasPrefix(names[0], "quarantine/") || !strings.HasSuffix(names[0], "/"+ReasonSchemaMismatch+"-42.json") {
+		t.Fatalf("quarantined objects = %v, want quarantine/<partition>/%s-42.json", names, ReasonSchemaMismatch)
+	}
+	object, _ := gcs.Object("quarantine", names[0])
+	if object.Metadata["reason"] != ReasonSchemaMismatch || object.Metadata["error"] != cause.Error() {
+		t.Errorf("metadata = %v, want the reason and the error", object.Metadata)
+	}
+	var record QuarantineRecord
+	if err := json.Unmarshal(object.Data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.MessageID != "42" || string(record.Data) != `{"a":1}` || record.Attributes["origin"] != "test" {
+		t.Errorf("envelope = %+v, want the quarantined message", record.Envelope)
+	}
+	if record.Reason != ReasonSchemaMismatch || record.DeliveryAttempt != 5 || len(record.ValidationErrors) != 1 || record.PayloadWithheld {
+		t.Errorf("Unexpected record %+v", record)
+	}
+
+	// The payload of a message which could not be redacted is left out of the record.
+	withheld := &PayloadWithheldError{Err: errors.New("invalid payload"), Reason: errors.New("not JSON")}
+	if err := QuarantineMessage(context.Background(), Message{ID: "43", Data: []byte("secret")}, ReasonPermanentError, withheld, info); err != nil {
+		t.Fatal(err)
+	}
+	items, err := ListQuarantined(context.Background(), info, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("listed %d messages, want 2", len(items))
+	}
+	for _, item := range items {
+		if !strings.HasSuffix(item.Name, "-43.json") {
+			continue
+		}
+		record, err := ReadQuarantined(context.Background(), info, item.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Data != nil || !record.PayloadWithheld || item.Reason != ReasonPermanentError {
+			t.Errorf("record = %+v, want the payload withheld", record)
+		}
+	}
+}
+
+func TestHandleFailure(t *testing.T) {
+	attempt := 5
+	tests := []struct {
+		name        string
+		err         error
+		attempt     *int
+		quarantine  bool
+		failWrites  bool
+		wantErr     bool
+		quarantined string
+	}{
+		{name: "retryable error", err: errors.New("connection reset"), quarantine: true, wantErr: true},
+		{name: "permanent error", err: Permanent(errors.New("invalid configuration")), quarantine: true, quarantined: ReasonPermanentError},
+		{name: "last delivery attempt", err: errors.New("connection reset"), attempt: &attempt, quarantine: true, quarantined: ReasonMaxDeliveryAttempts},
+		{name: "quarantine disabled", err: Permanent(errors.New("invalid configuration")), wantErr: true},
+		{name: "quarantine fails", err: Permanent(errors.New("invalid configuration")), quarantine: true, failWrites: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gcs, stopGCS := startGCS(t)
+			defer stopGCS()
+			if test.failWrites {
+				gcs.Fail = func(r *http.Request) int { return http.StatusForbidden }
+			}
+
+			conf := PersistConf{MaxDeliveryAttempts: 5}
+			if test.quarantine {
+				conf.Quarantine = QuarantineInfo{BucketID: "quarantine", Prefix: "quarantine"}
+			}
+			report := NewRunReport()
+			err := HandleFailure(context.Background(), Message{ID: "42", Data: []byte("abc"), DeliveryAttempt: test.attempt}, test.err, conf, report)
+
+			// The original error is returned, so the message is redelivered.
+			if test.wantErr && err != test.err {
+				t.Errorf("HandleFailure() error = %v, want %v", err, test.err)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("HandleFailure() error = %v, want nil", err)
+			}
+			names := gcs.Names("quarantine")
+			if test.quarantined == "" {
+				if len(names) != 0 {
+					t.Errorf("quarantined objects = %v, want none", names)
+				}
+				return
+			}
+			if len(names) != 1 || !strings.Contains(names[0], test.quarantined) || report.Quarantined[test.quarantined] != 1 {
+				t.Errorf("quarantined objects = %v, report = %s, want 1 with the %s reason", names, report, test.quarantined)
+			}
+		})
+	}
+}
+
+func TestSetPersistConfMaxDeliveryAttempts(t *testing.T) {
+	defer setStorageEnv("")()
+
+	restore := setEnv("MAX_DELIVERY_ATTEMPTS", "-1")
+	err := SetPersistConf(&PersistConf{})
+	restore()
+	if err == nil {
+		t.Error("SetPersistConf() with MAX_DELIVERY_ATTEMPTS=-1 error = nil, want an error")
+	}
+
+	defer setEnv("MAX_DELIVERY_ATTEMPTS", "5")()
+	var conf PersistConf
+	if err := SetPersistConf(&conf); err != nil {
+		t.Fatal(err)
+	}
+	if conf.MaxDeliveryAttempts != 5 {
+		t.Errorf("MaxDeliveryAttempts = %d, want 5", conf.MaxDeliveryAttempts)
+	}
+}
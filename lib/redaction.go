@@ -0,0 +1,283 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Actions of the redaction rules.
+const (
+	RedactMask = "mask" // replace the characters of the value with asterisks
+	RedactHash = "hash" // replace the value with its keyed HMAC-SHA256, so equal values stay equal
+	RedactDrop = "drop" // remove the field (or the array element)
+)
+
+// RedactionConfig is the content of the redaction rules file.
+type RedactionConfig struct {
+	Rules []RedactionRule `json:"rules"`
+}
+
+// RedactionRule selects values of a JSON payload and the action applied to them.
+// A rule selects the values either by a path or by a pattern, but not by both.
+type RedactionRule struct {
+	Path    string `json:"path"`    // dot separated path of a field (e.g. user.email), where * matches any key or array element
+	Pattern string `json:"pattern"` // regular expression matched against all string values (e.g. card numbers in free text)
+	Action  string `json:"action"`  // action applied to the selected values (mask, hash or drop)
+	Keep    int    `json:"keep"`    // number of trailing characters which the mask action leaves unchanged
+}
+
+// redactionRule is a compiled redaction rule.
+type redactionRule struct {
+	RedactionRule
+	path    []string
+	pattern *regexp.Regexp
+}
+
+// Redactor applies redaction rules to JSON payloads.
+type Redactor struct {
+	paths    []redactionRule // rules selecting values by their path, the first matching rule is applied
+	patterns []redactionRule // rules selecting string values by a pattern, applied in order
+	key      []byte
+}
+
+// NewRedactor creates a redactor from the content of a redaction rules file and the HMAC key.
+// An error is returned if a rule is not valid (e.g. it keeps a negative number of characters), or if the hash action is used without a key.
+func NewRedactor(config []byte, key []byte) (*Redactor, error) {
+	var redactionConfig RedactionConfig
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&redactionConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid redaction configuration. %s", err)
+	}
+
+	redactor := &Redactor{key: key}
+	for i, rule := range redactionConfig.Rules {
+		compiled := redactionRule{RedactionRule: rule}
+
+		if rule.Keep < 0 {
+			return nil, fmt.Errorf("Rule %d keeps a negative number of characters (%d)", i, rule.Keep)
+		}
+
+		switch rule.Action {
+		case RedactMask, RedactDrop:
+		case RedactHash:
+			if len(key) == 0 {
+				return nil, fmt.Errorf("Rule %d uses the hash action, but the HMAC key (REDACTION_HMAC_KEY) is not set", i)
+			}
+		default:
+			return nil, fmt.Errorf("Unknown action '%s' in rule %d", rule.Action, i)
+		}
+
+		switch {
+		case rule.Path != "" && rule.Pattern == "":
+			compiled.path = strings.Split(rule.Path, ".")
+			redactor.paths = append(redactor.paths, compiled)
+		case rule.Pattern != "" && rule.Path == "":
+			compiled.pattern, err = regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern in rule %d. %s", i, err)
+			}
+			redactor.patterns = append(redactor.patterns, compiled)
+		default:
+			return nil, fmt.Errorf("Rule %d must have either a path or a pattern", i)
+		}
+	}
+
+	return redactor, nil
+}
+
+// Redact applies the rules to a JSON payload and returns the redacted payload, together with the number of
+// redacted values per field. The fields are given as dot separated paths, with * in place of array indexes.
+// If nothing is redacted, the payload is returned unchanged, otherwise it is encoded again (without the
+// original formatting and with the object keys sorted).
+// An error is returned if the payload is not valid JSON.
+func (redactor *Redactor) Redact(data []byte) ([]byte, map[string]int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err == nil && decoder.More() {
+		err = fmt.Errorf("Unexpected data after the JSON value")
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Payload is not valid JSON. %s", err)
+	}
+
+	counts := make(map[string]int)
+	value, _ = redactor.redactValue(value, nil, counts)
+	if len(counts) == 0 {
+		return data, counts, nil
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), counts, nil
+}
+
+// redactValue redacts a value at the given path and its children. The second result reports whether the value is dropped.
+func (redactor *Redactor) redactValue(value interface{}, path []string, counts map[string]int) (interface{}, bool) {
+	if len(path) > 0 {
+		for _, rule := range redactor.paths {
+			if matchPath(rule.path, path) {
+				counts[strings.Join(path, ".")]++
+				return redactor.apply(rule, value)
+			}
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			redacted, drop := redactor.redactValue(child, childPath(path, key), counts)
+			if drop {
+				delete(v, key)
+			} else {
+				v[key] = redacted
+			}
+		}
+		return v, false
+
+	case []interface{}:
+		elements := v[:0]
+		for _, child := range v {
+			redacted, drop := redactor.redactValue(child, childPath(path, "*"), counts)
+			if !drop {
+				elements = append(elements, redacted)
+			}
+		}
+		return elements, false
+
+	case string:
+		for _, rule := range redactor.patterns {
+			if !rule.pattern.MatchString(v) {
+				continue
+			}
+			counts[strings.Join(path, ".")]++
+			if rule.Action == RedactDrop {
+				return nil, true
+			}
+			v = rule.pattern.ReplaceAllStringFunc(v, func(match string) string {
+				redacted, _ := redactor.apply(rule, match)
+				return redacted.(string)
+			})
+		}
+		return v, false
+	}
+
+	return value, false
+}
+
+// apply applies the action of a rule to a value. Values which are not strings are masked or hashed in their JSON form.
+func (redactor *Redactor) apply(rule redactionRule, value interface{}) (interface{}, bool) {
+	if rule.Action == RedactDrop {
+		return nil, true
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		data, _ := json.Marshal(value)
+		text = string(data)
+	}
+
+	if rule.Action == RedactHash {
+		mac := hmac.New(sha256.New, redactor.key)
+		io.WriteString(mac, text)
+		return hex.EncodeToString(mac.Sum(nil)), false
+	}
+
+	runes := []rune(text)
+	masked := len(runes)
+	if rule.Keep < masked {
+		masked -= rule.Keep
+	}
+	return strings.Repeat("*", masked) + string(runes[masked:]), false
+}
+
+// matchPath reports whether the path of a value matches the path of a rule.
+func matchPath(rulePath []string, path []string) bool {
+	if len(rulePath) != len(path) {
+		return false
+	}
+	for i := range path {
+		if rulePath[i] != "*" && rulePath[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// childPath returns the path of a child value, without sharing the memory of the parent path.
+func childPath(path []string, key string) []string {
+	child := make([]string, len(path)+1)
+	copy(child, path)
+	child[len(path)] = key
+	return child
+}
+
+// redactorKey identifies the redaction configuration of a cached redactor.
+type redactorKey struct {
+	config string
+	key    string
+}
+
+// redactors caches the redactors created from the redaction rules, so the rules are loaded once per instance
+// instead of once per message.
+var (
+	redactors    = make(map[redactorKey]*Redactor)
+	redactorsMtx sync.Mutex
+)
+
+// LoadRedactor returns the redactor of the redaction configuration, loading and compiling its rules if they are not cached yet.
+// A ConfigSourceError is returned if the rules cannot be read, and a permanent error if they are not valid.
+func LoadRedactor(ctx context.Context, info RedactionInfo) (*Redactor, error) {
+	redactorsMtx.Lock()
+	defer redactorsMtx.Unlock()
+
+	key := redactorKey{config: info.Config, key: info.Key}
+	if redactor, ok := redactors[key]; ok {
+		return redactor, nil
+	}
+
+	data, err := ReadConfigSource(ctx, info.Config)
+	if err != nil {
+		return nil, &ConfigSourceError{Source: info.Config, Err: err}
+	}
+
+	redactor, err := NewRedactor(data, []byte(info.Key))
+	if err != nil {
+		return nil, Permanent(err)
+	}
+
+	redactors[key] = redactor
+	return redactor, nil
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import "context"
+
+// RedactionInfo represents redaction configuration.
+// It holds information needed for masking, hashing or dropping sensitive fields of JSON payloads before they are stored.
+// The redaction is optional and it is disabled if the rules are not set.
+type RedactionInfo struct {
+	Config string // redaction rules source, a local path or gs://bucket/object (empty value disables the redaction)
+	Key    string // secret key of the HMAC used by the hash action
+
+	redactor *Redactor // loaded redactor
+}
+
+// SetRedactionInfo sets the parameters of a redaction configuration by extracting values from the corresponding environment variables.
+// If REDACTION_CONFIG is not set, the redaction is disabled. The rules are loaded (once per instance) together with
+// the configuration, so invalid rules, or a hash rule without REDACTION_HMAC_KEY, are reported when the persistor starts.
+// An error is returned if any errors occur during the function execution.
+func SetRedactionInfo(redactionInfo *RedactionInfo) error {
+	var err error
+
+	redactionInfo.Config = getOptionalEnvVariable("REDACTION_CONFIG", "")
+	redactionInfo.Key = getOptionalEnvVariable("REDACTION_HMAC_KEY", "")
+	if redactionInfo.Enabled() {
+		redactionInfo.redactor, err = LoadRedactor(context.Background(), *redactionInfo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Enabled reports whether the redaction is configured.
+func (redactionInfo RedactionInfo) Enabled() bool {
+	return redactionInfo.Config != ""
+}
+
+// Redactor returns the redactor of the configuration, loading the rules first if the configuration was not set by SetRedactionInfo.
+// An error is returned if the rules cannot be loaded.
+func (redactionInfo RedactionInfo) Redactor(ctx context.Context) (*Redactor, error) {
+	if redactionInfo.redactor != nil {
+		return redactionInfo.redactor, nil
+	}
+	return LoadRedactor(ctx, redactionInfo)
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewRedactorErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		key    string
+	}{
+		{"negative keep", `{"rules": [{"path": "email", "action": "mask", "keep": -1}]}`, ""},
+		{"unknown action", `{"rules": [{"path": "email", "action": "erase"}]}`, ""},
+		{"hash without a key", `{"rules": [{"path": "email", "action": "hash"}]}`, ""},
+		{"path and pattern", `{"rules": [{"path": "email", "pattern": "@", "action": "mask"}]}`, ""},
+		{"no path or pattern", `{"rules": [{"action": "mask"}]}`, ""},
+		{"invalid pattern", `{"rules": [{"pattern": "(", "action": "mask"}]}`, ""},
+		{"unknown field", `{"rules": [{"path": "email", "action": "mask", "kept": 2}]}`, ""},
+		{"invalid JSON", `{"rules": [`, "key"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewRedactor([]byte(test.config), []byte(test.key)); err == nil {
+				t.Errorf("NewRedactor() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestSetRedactionInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hashRules := writeTempFile(t, dir, "hash.json", `{"rules": [{"path": "email", "action": "hash"}]}`)
+	restoreConfig := setEnv("REDACTION_CONFIG", hashRules)
+	restoreKey := setEnv("REDACTION_HMAC_KEY", "secret")
+	var info RedactionInfo
+	err = SetRedactionInfo(&info)
+	restoreKey()
+	if err != nil {
+		t.Fatalf("SetRedactionInfo() error = %v", err)
+	}
+	if info.redactor == nil {
+		t.Error("SetRedactionInfo() did not load the rules")
+	}
+
+	// The same rules without the key of the hash action are not valid, so the cached redactor is not used.
+	err = SetRedactionInfo(&RedactionInfo{})
+	restoreConfig()
+	if err == nil || IsRetryable(err) {
+		t.Errorf("SetRedactionInfo() with a hash rule without a key error = %v, want a permanent error", err)
+	}
+
+	restoreConfig = setEnv("REDACTION_CONFIG", writeTempFile(t, dir, "invalid.json", `{"rules": [{"path": "email", "action": "erase"}]}`))
+	err = SetRedactionInfo(&RedactionInfo{})
+	restoreConfig()
+	if err == nil || IsRetryable(err) {
+		t.Errorf("SetRedactionInfo() with invalid rules error = %v, want a permanent error", err)
+	}
+
+	restoreConfig = setEnv("REDACTION_CONFIG", filepath.Join(dir, "missing.json"))
+	err = SetRedactionInfo(&RedactionInfo{})
+	restoreConfig()
+	var sourceErr *ConfigSourceError
+	if !errors.As(err, &sourceErr) {
+		t.Errorf("SetRedactionInfo() with missing rules error = %v, want a ConfigSourceError", err)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  string
+		data   string
+		want   string
+		counts map[string]int
+	}{
+		{
+			name:   "mask",
+			rules:  `{"path": "email", "action": "mask"}`,
+			data:   `{"email": "a@b.no", "id": 1}`,
+			want:   `{"email":"******","id":1}`,
+			counts: map[string]int{"email": 1},
+		},
+		{
+			name:   "mask keeping characters",
+			rules:  `{"path": "card", "action": "mask", "keep": 4}`,
+			data:   `{"card": "4111111111111111"}`,
+			want:   `{"card":"************1111"}`,
+			counts: map[string]int{"card": 1},
+		},
+		{
+			name:   "mask keeping more characters than the value has",
+			rules:  `{"path": "name", "action": "mask", "keep": 10}`,
+			data:   `{"name": "Åse"}`,
+			want:   `{"name":"***"}`,
+			counts: map[string]int{"name": 1},
+		},
+		{
+			name:   "mask a number",
+			rules:  `{"path": "pin", "action": "mask", "keep": 1}`,
+			data:   `{"pin": 1234}`,
+			want:   `{"pin":"***4"}`,
+			counts: map[string]int{"pin": 1},
+		},
+		{
+			name:   "hash",
+			rules:  `{"path": "user.email", "action": "hash"}`,
+			data:   `{"user": {"email": "a@b.no"}}`,
+			counts: map[string]int{"user.email": 1},
+		},
+		{
+			name:   "drop array elements",
+			rules:  `{"path": "users.*.email", "action": "drop"}`,
+			data:   `{"users": [{"email": "a", "id": 1}, {"id": 2}]}`,
+			want:   `{"users":[{"id":1},{"id":2}]}`,
+			counts: map[string]int{"users.*.email": 1},
+		},
+		{
+			name:   "pattern",
+			rules:  `{"pattern": "[0-9]{4}-[0-9]{4}", "action": "mask"}`,
+			data:   `{"note": "card 1234-5678 used"}`,
+			want:   `{"note":"card ********* used"}`,
+			counts: map[string]int{"note": 1},
+		},
+		{
+			name:   "nothing redacted",
+			rules:  `{"path": "email", "action": "mask"}`,
+			data:   `{ "id" : 1 }`,
+			want:   `{ "id" : 1 }`,
+			counts: map[string]int{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			redactor, err := NewRedactor([]byte(`{"rules": [`+test.rules+`]}`), []byte("key"))
+			if err != nil {
+				t.Fatalf("NewRedactor() error = %v", err)
+			}
+			data, counts, err := redactor.Redact([]byte(test.data))
+			if err != nil {
+				t.Fatalf("Redact() error = %v", err)
+			}
+			if test.name == "hash" {
+				// The hash is checked by its form, since the expected value would only repeat the implementation.
+				var value struct{ User struct{ Email string } }
+				if err := json.Unmarshal(data, &value); err != nil || len(value.User.Email) != 64 || value.User.Email == "a@b.no" {
+					t.Errorf("Redact() = %s, want a hex encoded HMAC-SHA256", data)
+				}
+			} else if string(data) != test.want {
+				t.Errorf("Redact() = %s, want %s", data, test.want)
+			}
+			if len(counts) != len(test.counts) {
+				t.Errorf("counts = %v, want %v", counts, test.counts)
+			}
+			for field, count := range test.counts {
+				if counts[field] != count {
+					t.Errorf("counts = %v, want %v", counts, test.counts)
+				}
+			}
+		})
+	}
+
+	redactor, _ := NewRedactor([]byte(`{"rules": [{"path": "email", "action": "mask"}]}`), nil)
+	for _, data := range []string{`not json`, `{"email": "a"} {}`} {
+		if _, _, err := redactor.Redact([]byte(data)); err == nil {
+			t.Errorf("Redact(%q) error = nil, want an error", data)
+		}
+	}
+}
+
+// writeTempFile writes the data to a file in the directory and returns its path.
+func writeTempFile(t *testing.T, dir string, name string, data string) string {
+	t.Helper()
+
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestProcessMessageRedactsQuarantined(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	redaction := RedactionInfo{Config: writeTempFile(t, dir, "rules.json", `{"rules": [{"path": "email", "action": "mask"}]}`)}
+	transform := TransformInfo{Config: writeTempFile(t, dir, "transforms.json", `[{"type": "project", "settings": {"fields": ["id", "email"]}}]`)}
+
+	tests := []struct {
+		name     string
+		conf     PersistConf
+		data     string
+		want     string
+		withheld bool
+	}{
+		{
+			name: "filter failure",
+			conf: PersistConf{Filter: FilterInfo{Expression: `payload.id > 1`}},
+			data: `{"id": "x", "email": "a@b.no"}`,
+			want: `{"email":"******","id":"x"}`,
+		},
+		{
+			name:     "transform failure",
+			conf:     PersistConf{Transform: transform},
+			data:     `email a@b.no`,
+			withheld: true,
+		},
+		{
+			name:     "redaction failure",
+			conf:     PersistConf{},
+			data:     `email a@b.no`,
+			withheld: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gcs, stop := startGCS(t)
+			defer stop()
+
+			conf := test.conf
+			conf.Storage = StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "txt", Format: FormatRaw}
+			conf.Quarantine = QuarantineInfo{BucketID: "quarantine"}
+			conf.Redaction = redaction
+
+			err := ProcessMessage(context.Background(), Message{ID: "42", Data: []byte(test.data)}, conf, NewRunReport())
+			if err != nil {
+				t.Fatalf("ProcessMessage() error = %v", err)
+			}
+
+			names := gcs.Names("quarantine")
+			if len(names) != 1 || len(gcs.Names("bucket")) != 0 {
+				t.Fatalf("quarantined objects = %v, stored objects = %v, want 1 quarantined object", names, gcs.Names("bucket"))
+			}
+			object, _ := gcs.Object("quarantine", names[0])
+			var record QuarantineRecord
+			if err := json.Unmarshal(object.Data, &record); err != nil {
+				t.Fatal(err)
+			}
+			if record.PayloadWithheld != test.withheld {
+				t.Errorf("payloadWithheld = %v, want %v", record.PayloadWithheld, test.withheld)
+			}
+			if string(record.Data) != test.want {
+				t.Errorf("quarantined payload = %q, want %q", record.Data, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleFailureWithholdsPayloadOnInvalidRules(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	conf := PersistConf{
+		Quarantine: QuarantineInfo{BucketID: "quarantine"},
+		Redaction:  RedactionInfo{Config: filepath.Join(os.TempDir(), "missing-redaction-rules.json")},
+	}
+	msg := Message{ID: "42", Data: []byte(`{"email": "a@b.no"}`)}
+	if err := HandleFailure(context.Background(), msg, Permanent(os.ErrInvalid), conf, NewRunReport()); err != nil {
+		t.Fatalf("HandleFailure() error = %v", err)
+	}
+
+	names := gcs.Names("quarantine")
+	if len(names) != 1 {
+		t.Fatalf("quarantined objects = %v, want 1", names)
+	}
+	object, _ := gcs.Object("quarantine", names[0])
+	var record QuarantineRecord
+	if err := json.Unmarshal(object.Data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if !record.PayloadWithheld || len(record.Data) != 0 {
+		t.Errorf("quarantine record = %+v, want the payload withheld", record)
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// replayFlushSize is the number of published messages after which the replay waits for their results.
+	replayFlushSize = 1000
+	// replayCheckpointInterval is the minimum time between two checkpoint writes.
+	replayCheckpointInterval = 10 * time.Second
+)
+
+// ReplayOptions represents the configuration of a replay run.
+type ReplayOptions struct {
+	BucketID   string    // ID of a bucket in which the messages are stored
+	Format     string    // format of the stored messages (FormatRaw or FormatEnvelope)
+	From       time.Time // start of the replayed time range (the partition of this hour is included)
+	To         time.Time // end of the replayed time range (the partition of this hour is excluded)
+	Prefix     string    // file prefix of the replayed objects (empty value replays all objects)
+	ProjectID  string    // ID of a project in which the target topic is located
+	TopicID    string    // ID of a topic to which the messages are republished
+	Rate       float64   // maximum number of published messages per second (0 disables the limit)
+	DryRun     bool      // whether the messages are only read and counted, without publishing
+	Checkpoint string    // name of the checkpoint object in the bucket (empty value disables checkpointing)
+}
+
+// ReplayCheckpoint is the content of the checkpoint object of a replay.
+// Since the objects are replayed in the order of their names, the checkpoint only holds the last replayed object.
+type ReplayCheckpoint struct {
+	From      time.Time `json:"from"`      // start of the replayed time range
+	To        time.Time `json:"to"`        // end of the replayed time range
+	Prefix    string    `json:"prefix"`    // file prefix of the replayed objects
+	TopicID   string    `json:"topicId"`   // target topic
+	Object    string    `json:"object"`    // name of the last (partially) replayed object
+	Records   int       `json:"records"`   // number of replayed messages of the last object
+	Done      bool      `json:"done"`      // whether all of the messages of the last object are replayed
+	Published int       `json:"published"` // total number of published messages
+	UpdatedAt time.Time `json:"updatedAt"` // time at which the checkpoint was written
+}
+
+// ReplayReport holds the results of a replay run.
+type ReplayReport struct {
+	Objects  int   `json:"objects"`  // number of read objects
+	Messages int   `json:"messages"` // number of published (or counted, in a dry run) messages
+	Bytes    int64 `json:"bytes"`    // total size of the message payloads in bytes
+}
+
+// replayPosition returns how many messages of an object were already replayed according to the checkpoint,
+// or -1 if the whole object was replayed.
+func (checkpoint *ReplayCheckpoint) replayPosition(objectName string) int {
+	if checkpoint == nil || checkpoint.Object == "" || objectName > checkpoint.Object {
+		return 0
+	}
+	if objectName == checkpoint.Object && !checkpoint.Done {
+		return checkpoint.Records
+	}
+	return -1
+}
+
+// Replay reads the messages stored in the hourly partitions of the time range and republishes them to the target topic.
+// The attributes and ordering keys of the messages are restored (see StoredReader.ReadObject), while Pub/Sub assigns
+// new message IDs. The objects are replayed in the order of their names, so a replay can be resumed from its checkpoint,
+// which is written periodically after the published messages are confirmed. Messages published after the last
+// checkpoint are published again when an interrupted replay is resumed. In a dry run the messages are only counted.
+// An error is returned if any errors occur during the function execution.
+func Replay(ctx context.Context, options ReplayOptions) (*ReplayReport, error) {
+	if !options.To.After(options.From) {
+		return nil, fmt.Errorf("End of the time range must be after its start")
+	}
+
+	reader, err := NewStoredReader(ctx, options.BucketID, options.Format)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	checkpoint, err := readReplayCheckpoint(ctx, reader.bucket, options)
+	if err != nil {
+		return nil, err
+	}
+
+	var topic *pubsub.Topic
+	if !options.DryRun {
+		client, err := pubsub.NewClient(ctx, options.ProjectID)
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+
+		topic = client.Topic(options.TopicID)
+		topic.EnableMessageOrdering = true
+		defer topic.Stop()
+	}
+
+	replay := &replayRun{
+		options:    options,
+		bucket:     reader.bucket,
+		topic:      topic,
+		limiter:    newRateLimiter(options.Rate),
+		checkpoint: checkpoint,
+		report:     &ReplayReport{},
+	}
+
+	for partitionTime := PartitionHour(options.From); partitionTime.Before(options.To); partitionTime = partitionTime.Add(time.Hour) {
+		objects, err := reader.ListObjects(ctx, partitionTime, options.Prefix)
+		if err != nil {
+			return replay.report, err
+		}
+
+		for _, attrs := range objects {
+			skip := checkpoint.replayPosition(attrs.Name)
+			if skip < 0 {
+				continue
+			}
+
+			err = reader.ReadObject(ctx, attrs, skip, func(index int, msg Message) error {
+				return replay.publish(ctx, attrs.Name, index, msg)
+			})
+			if err == nil {
+				err = replay.objectDone(ctx, attrs.Name)
+			}
+			if err != nil {
+				return replay.report, err
+			}
+			replay.report.Objects++
+		}
+	}
+
+	err = replay.flush(ctx)
+	if err != nil {
+		return replay.report, err
+	}
+	return replay.report, replay.saveCheckpoint(ctx, true)
+}
+
+// replayRun holds the state of a replay run.
+type replayRun struct {
+	options    ReplayOptions
+	bucket     *storage.BucketHandle
+	topic      *pubsub.Topic
+	limiter    *rateLimiter
+	checkpoint *ReplayCheckpoint // position up to which the published messages are confirmed
+	position   ReplayCheckpoint  // position after the last published message
+	results    []replayResult    // results of the messages published after the checkpoint
+	savedAt    time.Time
+	report     *ReplayReport
+}
+
+// replayResult is the result of a published message, together with its ordering key.
+type replayResult struct {
+	result      *pubsub.PublishResult
+	orderingKey string
+}
+
+// publish publishes a single message, waiting for the previously published messages if there are too many of them.
+func (replay *replayRun) publish(ctx context.Context, objectName string, index int, msg Message) error {
+	err := replay.limiter.wait(ctx)
+	if err != nil {
+		return err
+	}
+
+	replay.report.Messages++
+	replay.report.Bytes += int64(len(msg.Data))
+	replay.position.Object = objectName
+	replay.position.Records = index + 1
+	replay.position.Done = false
+	if replay.topic == nil {
+		return nil
+	}
+
+	result := replay.topic.Publish(ctx, &pubsub.Message{
+		Data:        msg.Data,
+		Attributes:  msg.Attributes,
+		OrderingKey: msg.OrderingKey,
+	})
+	replay.results = append(replay.results, replayResult{result: result, orderingKey: msg.OrderingKey})
+
+	if len(replay.results) < replayFlushSize {
+		return nil
+	}
+	return replay.flush(ctx)
+}
+
+// objectDone marks the object as replayed, once all of its messages are published.
+func (replay *replayRun) objectDone(ctx context.Context, objectName string) error {
+	replay.position.Object = objectName
+	replay.position.Done = true
+
+	if len(replay.results) > 0 {
+		return nil
+	}
+	return replay.flush(ctx)
+}
+
+// flush waits for the results of the published messages and moves the checkpoint after them.
+// A failed message pauses the publishing of its ordering key, so the keys of the pending messages are resumed
+// before the error is returned, and the topic can publish them again.
+func (replay *replayRun) flush(ctx context.Context) error {
+	for _, published := range replay.results {
+		if _, err := published.result.Get(ctx); err != nil {
+			for _, pending := range replay.results {
+				if pending.orderingKey != "" {
+					replay.topic.ResumePublish(pending.orderingKey)
+				}
+			}
+			// The messages published after the checkpoint are published again when the replay is resumed.
+			if cErr := replay.saveCheckpoint(ctx, true); cErr != nil {
+				log.Printf("Error during saving replay checkpoint. %s.\n", cErr)
+			}
+			return err
+		}
+		replay.checkpoint.Published++
+	}
+	replay.results = nil
+
+	replay.checkpoint.Object = replay.position.Object
+	replay.checkpoint.Records = replay.position.Records
+	replay.checkpoint.Done = replay.position.Done
+
+	return replay.saveCheckpoint(ctx, false)
+}
+
+// saveCheckpoint writes the checkpoint if checkpointing is enabled, and if forced or enough time passed since the last write.
+func (replay *replayRun) saveCheckpoint(ctx context.Context, force bool) error {
+	if replay.options.Checkpoint == "" || replay.options.DryRun {
+		return nil
+	}
+	if !force && time.Since(replay.savedAt) < replayCheckpointInterval {
+		return nil
+	}
+
+	replay.checkpoint.UpdatedAt = time.Now()
+	data, err := json.MarshalIndent(replay.checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = writeToHandle(ctx, replay.bucket.Object(replay.options.Checkpoint), data, "application/json")
+	if err != nil {
+		return err
+	}
+	replay.savedAt = time.Now()
+	return nil
+}
+
+// readReplayCheckpoint reads the checkpoint of a replay, or creates an empty one if it does not exist.
+// An error is returned if the checkpoint belongs to a replay with different options.
+func readReplayCheckpoint(ctx context.Context, bucket *storage.BucketHandle, options ReplayOptions) (*ReplayCheckpoint, error) {
+	checkpoint := &ReplayCheckpoint{
+		From:    options.From,
+		To:      options.To,
+		Prefix:  options.Prefix,
+		TopicID: options.TopicID,
+	}
+	if options.Checkpoint == "" {
+		return checkpoint, nil
+	}
+
+	data, err := readObject(ctx, bucket.Object(options.Checkpoint))
+	if err == storage.ErrObjectNotExist {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	saved := &ReplayCheckpoint{}
+	err = json.Unmarshal(data, saved)
+	if err != nil {
+		return nil, err
+	}
+	if !saved.From.Equal(options.From) || !saved.To.Equal(options.To) || saved.Prefix != options.Prefix || saved.TopicID != options.TopicID {
+		return nil, fmt.Errorf("Checkpoint '%s' belongs to a different replay", options.Checkpoint)
+	}
+
+	return saved, nil
+}
+
+// rateLimiter spaces out the calls of wait, so they happen at most at the given rate.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter creates a limiter of the given number of calls per second (0 disables the limit).
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until the next call is allowed or the context is done.
+func (limiter *rateLimiter) wait(ctx context.Context) error {
+	if limiter.interval == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if limiter.next.Before(now) {
+		limiter.next = now
+	}
+	delay := limiter.next.Sub(now)
+	limiter.next = limiter.next.Add(limiter.interval)
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,251 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// putEnvelope stores the envelope of a message in the partition of the given time, as PersistMessage does with the envelope format.
+func putEnvelope(t *testing.T, gcs *sinktest.GCSServer, partitionTime time.Time, msg Message) string {
+	t.Helper()
+
+	data, err := json.Marshal(NewEnvelope(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := path.Join(PartitionFolder(partitionTime), "msg-"+msg.ID+".json")
+	gcs.Put("bucket", name, data, nil)
+	return name
+}
+
+// publishedData returns the sorted payloads of the messages published to the fake Pub/Sub server.
+func publishedData(server *pstest.Server) []string {
+	var data []string
+	for _, msg := range server.Messages() {
+		data = append(data, string(msg.Data))
+	}
+	sort.Strings(data)
+	return data
+}
+
+// replayCheckpoint reads the checkpoint written by a replay with the given options.
+func replayCheckpoint(t *testing.T, gcs *sinktest.GCSServer, options ReplayOptions) ReplayCheckpoint {
+	t.Helper()
+
+	object, ok := gcs.Object("bucket", options.Checkpoint)
+	if !ok {
+		t.Fatal("checkpoint was not written")
+	}
+	var checkpoint ReplayCheckpoint
+	if err := json.Unmarshal(object.Data, &checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	return checkpoint
+}
+
+// replayOptions returns the options of a replay of the partitions from 12:00 to 14:00 to the replayed topic.
+func replayOptions(format string) ReplayOptions {
+	return ReplayOptions{
+		BucketID:   "bucket",
+		Format:     format,
+		From:       time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local),
+		To:         time.Date(2020, 10, 1, 14, 0, 0, 0, time.Local),
+		ProjectID:  "project",
+		TopicID:    "replayed",
+		Checkpoint: "_replay/replayed.json",
+	}
+}
+
+func TestReplay(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopPubsub := startPubsub(t, "project", "replayed")
+	defer stopPubsub()
+
+	options := replayOptions(FormatEnvelope)
+	putEnvelope(t, gcs, options.From, Message{ID: "1", Data: []byte("one"), Attributes: map[string]string{"origin": "test"}, OrderingKey: "key"})
+	putEnvelope(t, gcs, options.From.Add(time.Hour), Message{ID: "2", Data: []byte("two"), OrderingKey: "key"})
+	// The partition of the end of the range is not replayed.
+	putEnvelope(t, gcs, options.To, Message{ID: "3", Data: []byte("three")})
+
+	report, err := Replay(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 2 || report.Messages != 2 || report.Bytes != 6 {
+		t.Errorf("report = %+v, want 2 objects and messages with 6 bytes", report)
+	}
+	if got := publishedData(server); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Fatalf("published %v, want [one two]", got)
+	}
+	for _, msg := range server.Messages() {
+		if msg.OrderingKey != "key" {
+			t.Errorf("ordering key of %s = %q, want key", msg.Data, msg.OrderingKey)
+		}
+		if string(msg.Data) == "one" && msg.Attributes["origin"] != "test" {
+			t.Errorf("attributes = %v, want the stored attributes", msg.Attributes)
+		}
+	}
+
+	checkpoint := replayCheckpoint(t, gcs, options)
+	if !checkpoint.Done || checkpoint.Published != 2 || checkpoint.Object != path.Join(PartitionFolder(options.From.Add(time.Hour)), "msg-2.json") {
+		t.Errorf("checkpoint = %+v, want the last object done", checkpoint)
+	}
+
+	// A dry run only counts the messages.
+	options.DryRun = true
+	options.Checkpoint = ""
+	report, err = Replay(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Messages != 2 || len(server.Messages()) != 2 {
+		t.Errorf("dry run counted %d and published %d messages, want 2 and none", report.Messages, len(server.Messages())-2)
+	}
+}
+
+func TestReplayResumesFromCheckpoint(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopPubsub := startPubsub(t, "project", "replayed")
+	defer stopPubsub()
+
+	options := replayOptions(FormatRaw)
+	folder := putPartition(gcs, options.From, "one", "two", "three")
+	compaction, err := Compact(context.Background(), CompactionOptions{BucketID: "bucket", Partition: folder, Format: BatchFormatNDJSON, DeleteOriginals: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putPartition(gcs, options.From.Add(time.Hour), "four")
+
+	// The previous run stopped after the first message of the batch file.
+	checkpoint := ReplayCheckpoint{From: options.From, To: options.To, TopicID: options.TopicID, Object: compaction.Batches[0].Name, Records: 1, Published: 1}
+	data, _ := json.Marshal(checkpoint)
+	gcs.Put("bucket", options.Checkpoint, data, nil)
+
+	report, err := Replay(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := publishedData(server); !reflect.DeepEqual(got, []string{"four", "three", "two"}) {
+		t.Errorf("published %v, want the messages after the checkpoint", got)
+	}
+	if report.Messages != 3 {
+		t.Errorf("report = %+v, want 3 messages", report)
+	}
+	if saved := replayCheckpoint(t, gcs, options); !saved.Done || saved.Published != 4 {
+		t.Errorf("checkpoint = %+v, want all 4 messages published", saved)
+	}
+
+	// The replay is complete, so running it again publishes nothing.
+	if _, err := Replay(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Messages()) != 3 {
+		t.Errorf("published %d messages, want 3", len(server.Messages()))
+	}
+
+	// The checkpoint of a replay with different options is not used.
+	options.Prefix = "other"
+	if _, err := Replay(context.Background(), options); err == nil {
+		t.Error("Replay() with the checkpoint of another replay error = nil, want an error")
+	}
+}
+
+func TestReplayDeduplicatesCompactedMessages(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	server, stopPubsub := startPubsub(t, "project", "replayed")
+	defer stopPubsub()
+
+	options := replayOptions(FormatRaw)
+	folder := putPartition(gcs, options.From, "one", "two")
+	// The originals are kept, so the partition holds both the originals and the batch file.
+	if _, err := Compact(context.Background(), CompactionOptions{BucketID: "bucket", Partition: folder, Format: BatchFormatLengthPrefixed}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Replay(context.Background(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := publishedData(server); !reflect.DeepEqual(got, []string{"one", "two"}) || report.Objects != 2 {
+		t.Errorf("published %v from %d objects, want each message once from the 2 originals", got, report.Objects)
+	}
+}
+
+func TestReplayRate(t *testing.T) {
+	gcs, stopGCS := startGCS(t)
+	defer stopGCS()
+	_, stopPubsub := startPubsub(t, "project", "replayed")
+	defer stopPubsub()
+
+	options := replayOptions(FormatRaw)
+	putPartition(gcs, options.From, "one", "two", "three", "four")
+	options.Rate = 20
+
+	// The first message is published at once, and the others 50 ms apart.
+	start := time.Now()
+	if _, err := Replay(context.Background(), options); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("replay took %v, want at least 150ms", elapsed)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	unlimited := newRateLimiter(0)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := unlimited.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("unlimited calls took %v", elapsed)
+	}
+
+	limiter := newRateLimiter(100)
+	start = time.Now()
+	for i := 0; i < 6; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 45*time.Millisecond {
+		t.Errorf("6 calls at 100 per second took %v, want at least 50ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := newRateLimiter(0.1)
+	if err := slow.wait(ctx); err != nil {
+		t.Fatalf("first call error = %v, want nil", err)
+	}
+	if err := slow.wait(ctx); err != context.Canceled {
+		t.Errorf("wait() error = %v, want %v", err, context.Canceled)
+	}
+}
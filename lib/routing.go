@@ -0,0 +1,206 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// DefaultRouteName is the name of the default route, unless the configuration names it differently.
+const DefaultRouteName = "default"
+
+// RoutingConfig is the content of the routes file.
+type RoutingConfig struct {
+	Routes  []Route `json:"routes"`  // routes, in the order in which their conditions are evaluated
+	Default *Route  `json:"default"` // route of the messages which match none of the conditions (the storage configuration if not set)
+}
+
+// Route selects the storage of the messages matching its condition.
+// The empty fields are taken from the storage configuration (BUCKET_ID, MSG_PREFIX, MSG_EXTENSION and MSG_FORMAT).
+type Route struct {
+	Name      string `json:"name"`      // name of the route, used in the run report
+	Condition string `json:"condition"` // filter expression selecting the messages of the route (see Filter), not used by the default route
+	BucketID  string `json:"bucketId"`  // ID of a bucket in which the messages are stored
+	Prefix    string `json:"prefix"`    // prefix of a file name
+	Extension string `json:"extension"` // file extension
+	Format    string `json:"format"`    // format of a file content (raw, envelope or a batched format)
+}
+
+// compiledRoute is a route with its compiled condition and resulting storage configuration.
+type compiledRoute struct {
+	name    string
+	filter  *Filter
+	storage StorageInfo
+}
+
+// Router selects the storage configuration of each message by the routing rules.
+type Router struct {
+	routes       []compiledRoute
+	defaultRoute compiledRoute
+}
+
+// NewRouter creates a router from the content of a routes file and the storage configuration, which provides
+// the values missing in the routes.
+// An error is returned if a route is not valid (e.g. a missing name or condition, or an invalid format).
+func NewRouter(config []byte, base StorageInfo) (*Router, error) {
+	var routingConfig RoutingConfig
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&routingConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid routing configuration. %s", err)
+	}
+
+	names := make(map[string]bool)
+	router := &Router{}
+	for i, route := range routingConfig.Routes {
+		if route.Name == "" || names[route.Name] {
+			return nil, fmt.Errorf("Route %d must have a unique name", i)
+		}
+		names[route.Name] = true
+
+		if route.Condition == "" {
+			return nil, fmt.Errorf("Route '%s' has no condition", route.Name)
+		}
+		filter, err := CompileFilter(route.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid condition of route '%s'. %s", route.Name, err)
+		}
+
+		storage, err := routeStorage(route, base)
+		if err != nil {
+			return nil, err
+		}
+		router.routes = append(router.routes, compiledRoute{name: route.Name, filter: filter, storage: storage})
+	}
+
+	defaultRoute := Route{Name: DefaultRouteName}
+	if routingConfig.Default != nil {
+		defaultRoute = *routingConfig.Default
+		if defaultRoute.Name == "" {
+			defaultRoute.Name = DefaultRouteName
+		}
+		if defaultRoute.Condition != "" {
+			return nil, fmt.Errorf("Default route must not have a condition")
+		}
+	}
+	if names[defaultRoute.Name] {
+		return nil, fmt.Errorf("Route '%s' has the name of the default route", defaultRoute.Name)
+	}
+
+	router.defaultRoute.name = defaultRoute.Name
+	router.defaultRoute.storage, err = routeStorage(defaultRoute, base)
+	if err != nil {
+		return nil, err
+	}
+
+	return router, nil
+}
+
+// routeStorage returns the storage configuration of a route, filling the missing values from the base configuration.
+// The bucket may be given in any of the forms supported by the sinks (see Sink).
+func routeStorage(route Route, base StorageInfo) (StorageInfo, error) {
+	storage := base
+	if route.BucketID != "" {
+		storage.BucketID = route.BucketID
+	}
+	if route.Prefix != "" {
+		storage.Prefix = route.Prefix
+	}
+	if route.Extension != "" {
+		storage.Extension = route.Extension
+	}
+	if route.Format != "" {
+		storage.Format = route.Format
+	}
+
+	if !validFormat(storage.Format) {
+		return storage, fmt.Errorf("Invalid message format '%s' of route '%s', expected one of %s", storage.Format, route.Name, strings.Join(formats(), ", "))
+	}
+	if storage.BucketID == "" {
+		return storage, fmt.Errorf("Route '%s' has no bucket", route.Name)
+	}
+	if _, err := GetSink(storage.BucketID); err != nil {
+		return storage, fmt.Errorf("Invalid bucket of route '%s'. %s", route.Name, err)
+	}
+	return storage, nil
+}
+
+// Route returns the name and storage configuration of the first route whose condition matches the message,
+// or of the default route if none of them matches.
+// A permanent error is returned if a condition cannot be evaluated for the message.
+func (router *Router) Route(msg Message) (string, StorageInfo, error) {
+	for _, route := range router.routes {
+		match, err := route.filter.Match(msg)
+		if err != nil {
+			return "", StorageInfo{}, Permanent(fmt.Errorf("Error during evaluating route '%s'. %w", route.name, err))
+		}
+		if match {
+			return route.name, route.storage, nil
+		}
+	}
+	return router.defaultRoute.name, router.defaultRoute.storage, nil
+}
+
+// BucketIDs returns the IDs of the GCS buckets in which the routes (including the default route) store the messages,
+// without duplicates and in the order of the routes. The buckets of the other sinks are left out.
+func (router *Router) BucketIDs() []string {
+	var bucketIDs []string
+	seen := make(map[string]bool)
+	for _, route := range append(router.routes, router.defaultRoute) {
+		bucketID := route.storage.BucketID
+		if IsGCSDestination(bucketID) && !seen[bucketID] {
+			seen[bucketID] = true
+			bucketIDs = append(bucketIDs, bucketID)
+		}
+	}
+	return bucketIDs
+}
+
+// routers caches the routers created from the routes files, so the routes are loaded once per instance
+// instead of once per message.
+var (
+	routers    = make(map[string]*Router)
+	routersMtx sync.Mutex
+)
+
+// LoadRouter returns the router of the routing configuration, loading and compiling its routes if they are not cached yet.
+// A ConfigSourceError is returned if the routes cannot be read, and a permanent error if they are not valid.
+func LoadRouter(ctx context.Context, info RoutingInfo, base StorageInfo) (*Router, error) {
+	routersMtx.Lock()
+	defer routersMtx.Unlock()
+
+	if router, ok := routers[info.Config]; ok {
+		return router, nil
+	}
+
+	data, err := ReadConfigSource(ctx, info.Config)
+	if err != nil {
+		return nil, &ConfigSourceError{Source: info.Config, Err: err}
+	}
+
+	router, err := NewRouter(data, base)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+
+	routers[info.Config] = router
+	return router, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+)
+
+// RoutingInfo represents routing configuration.
+// It holds information needed for storing messages in different buckets, or with different names and formats,
+// depending on their content. The routing is optional and it is disabled if the routes are not set.
+type RoutingInfo struct {
+	Config string  // routes source, a local path or gs://bucket/object (empty value disables the routing)
+	router *Router // loaded routes
+}
+
+// SetRoutingInfo sets the parameters of a routing configuration by extracting values from the corresponding environment variables.
+// If ROUTING_CONFIG is not set, the routing is disabled.
+// An error is returned if any errors occur during the function execution.
+func SetRoutingInfo(routingInfo *RoutingInfo) error {
+	routingInfo.Config = getOptionalEnvVariable("ROUTING_CONFIG", "")
+
+	return nil
+}
+
+// Enabled reports whether the routing is configured.
+func (routingInfo RoutingInfo) Enabled() bool {
+	return routingInfo.Config != ""
+}
+
+// Router returns the router of the configuration, loading the routes first if the configuration was not set by SetPersistConf.
+// An error is returned if the routes cannot be loaded.
+func (routingInfo RoutingInfo) Router(ctx context.Context, base StorageInfo) (*Router, error) {
+	if routingInfo.router != nil {
+		return routingInfo.router, nil
+	}
+	return LoadRouter(ctx, routingInfo, base)
+}
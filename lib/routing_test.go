@@ -0,0 +1,190 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRouterBucketIDs(t *testing.T) {
+	defer setEnv("S3_ACCESS_KEY_ID", "key")()
+	defer setEnv("S3_SECRET_ACCESS_KEY", "secret")()
+
+	base := StorageInfo{BucketID: "main", Prefix: "msg", Extension: "txt", Format: FormatRaw}
+	router, err := NewRouter([]byte(`{
+		"routes": [
+			{"name": "orders", "condition": "payload.type == \"order\"", "bucketId": "orders"},
+			{"name": "refunds", "condition": "payload.type == \"refund\"", "bucketId": "orders", "prefix": "refund"},
+			{"name": "clicks", "condition": "payload.type == \"click\"", "bucketId": "s3://clicks"},
+			{"name": "other", "condition": "payload.type == \"other\""}
+		]
+	}`), base)
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+
+	if got, want := router.BucketIDs(), []string{"orders", "main"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BucketIDs() = %v, want %v", got, want)
+	}
+}
+
+func TestRouterRoute(t *testing.T) {
+	base := StorageInfo{BucketID: "main", Prefix: "msg", Extension: "txt", Format: FormatRaw}
+	router, err := NewRouter([]byte(`{
+		"routes": [
+			{"name": "pings", "condition": "has(attributes.type) && attributes.type == \"ping\"", "bucketId": "pings"},
+			{"name": "orders", "condition": "payload.type == \"order\"", "bucketId": "orders"}
+		],
+		"default": {"bucketId": "other"}
+	}`), base)
+	if err != nil {
+		t.Fatalf("NewRouter() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		msg     Message
+		route   string
+		wantErr error
+	}{
+		{name: "attribute route", msg: Message{Data: []byte("ping"), Attributes: map[string]string{"type": "ping"}}, route: "pings"},
+		{name: "payload route", msg: Message{Data: []byte(`{"type": "order"}`)}, route: "orders"},
+		{name: "default route", msg: Message{Data: []byte(`{"type": "refund"}`)}, route: "default"},
+		{name: "invalid payload", msg: Message{Data: []byte("order")}, wantErr: ErrInvalidPayload},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route, _, err := router.Route(test.msg)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) || IsRetryable(err) {
+					t.Errorf("Route() error = %v, want a permanent %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || route != test.route {
+				t.Errorf("Route() = %s, %v, want %s", route, err, test.route)
+			}
+		})
+	}
+}
+
+// setStorageEnv sets the required storage environment variables and the routes, and returns a function which restores them.
+func setStorageEnv(routes string) func() {
+	restores := []func(){
+		setEnv("BUCKET_ID", "main"),
+		setEnv("MSG_PREFIX", "msg"),
+		setEnv("MSG_EXTENSION", "txt"),
+		setEnv("ROUTING_CONFIG", routes),
+	}
+	return func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+func TestSetPersistConfLoadsRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := writeTempFile(t, dir, "valid.json", `{"routes": [{"name": "orders", "condition": "payload.type == \"order\"", "bucketId": "orders"}]}`)
+	invalid := writeTempFile(t, dir, "invalid.json", `{"routes": [{"name": "orders", "condition": "payload.type =="}]}`)
+
+	restore := setStorageEnv(valid)
+	var conf PersistConf
+	err = SetPersistConf(&conf)
+	restore()
+	if err != nil {
+		t.Fatalf("SetPersistConf() error = %v", err)
+	}
+	if conf.Routing.router == nil {
+		t.Errorf("SetPersistConf() did not load the routes")
+	}
+
+	restore = setStorageEnv(invalid)
+	err = SetPersistConf(&PersistConf{})
+	restore()
+	if err == nil || IsRetryable(err) {
+		t.Errorf("SetPersistConf() with invalid routes error = %v, want a permanent error", err)
+	}
+
+	restore = setStorageEnv(path.Join(dir, "missing.json"))
+	err = SetPersistConf(&PersistConf{})
+	restore()
+	var sourceErr *ConfigSourceError
+	if !errors.As(err, &sourceErr) {
+		t.Errorf("SetPersistConf() with missing routes error = %v, want a ConfigSourceError", err)
+	}
+}
+
+func TestClosePartitionsOfRoutedBuckets(t *testing.T) {
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "routing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	routes := writeTempFile(t, dir, "routes.json", `{
+		"routes": [{"name": "orders", "condition": "payload.type == \"order\"", "bucketId": "orders"}],
+		"default": {"bucketId": "other"}
+	}`)
+
+	restores := []func(){setStorageEnv(routes), setEnv("CLOSE_PARTITIONS", "true"), setEnv("PARTITION_LOOKBACK", "1")}
+	var info PartitionInfo
+	err = SetPartitionInfo(&info)
+	for _, restore := range restores {
+		restore()
+	}
+	if err != nil {
+		t.Fatalf("SetPartitionInfo() error = %v", err)
+	}
+	if want := []string{"orders", "other"}; !reflect.DeepEqual(info.RoutedBucketIDs, want) {
+		t.Fatalf("RoutedBucketIDs = %v, want %v", info.RoutedBucketIDs, want)
+	}
+
+	watermark := time.Now()
+	folder := PartitionFolder(ClosablePartitions(watermark, time.Duration(info.Lateness)*time.Second, 1)[0])
+	for _, bucket := range []string{"main", "orders", "other"} {
+		gcs.Put(bucket, path.Join(folder, "msg-1.txt"), []byte("a"), nil)
+	}
+
+	manifests, err := ClosePartitions(context.Background(), info, watermark)
+	if err != nil {
+		t.Fatalf("ClosePartitions() error = %v", err)
+	}
+	if len(manifests) != 3 {
+		t.Fatalf("closed %d partitions, want 3", len(manifests))
+	}
+	for i, bucket := range []string{"main", "orders", "other"} {
+		if manifests[i].Bucket != bucket || manifests[i].RecordCount != 1 {
+			t.Errorf("manifest %d = %+v, want 1 record in bucket %s", i, manifests[i], bucket)
+		}
+		if _, ok := gcs.Object(bucket, path.Join(folder, SuccessMarker)); !ok {
+			t.Errorf("bucket %s has no success marker", bucket)
+		}
+	}
+}
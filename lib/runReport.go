@@ -0,0 +1,161 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// RunReport holds the statistics of a single run (a pull call or a push request).
+// The counters are safe for concurrent use. All of the methods can be called on a nil report,
+// in which case nothing is counted.
+type RunReport struct {
+	mtx sync.Mutex
+
+	Received    int            `json:"received"`    // number of received messages
+	Persisted   int            `json:"persisted"`   // number of stored messages
+	Quarantined map[string]int `json:"quarantined"` // number of quarantined messages per reason
+	Failed      int            `json:"failed"`      // number of messages which were not acknowledged and will be redelivered
+	Valid       int            `json:"valid"`       // number of messages which passed the schema validation
+	Invalid     int            `json:"invalid"`     // number of messages which failed the schema validation
+	Filtered    int            `json:"filtered"`    // number of messages which did not match the filter and were not stored
+	Dropped     int            `json:"dropped"`     // number of messages dropped by the transforms
+	Redacted    map[string]int `json:"redacted"`    // number of redacted values per field
+	Routes      map[string]int `json:"routes"`      // number of stored messages per route
+	WriteErrors map[string]int `json:"writeErrors"` // number of failed writes per fan-out destination (after retries)
+}
+
+// NewRunReport creates an empty run report.
+func NewRunReport() *RunReport {
+	return &RunReport{
+		Quarantined: make(map[string]int),
+		Redacted:    make(map[string]int),
+		Routes:      make(map[string]int),
+		WriteErrors: make(map[string]int),
+	}
+}
+
+// update applies the given function to the report while holding its lock.
+func (report *RunReport) update(f func()) {
+	if report == nil {
+		return
+	}
+
+	report.mtx.Lock()
+	defer report.mtx.Unlock()
+	f()
+}
+
+// CountReceived counts a received message.
+func (report *RunReport) CountReceived() {
+	report.update(func() { report.Received++ })
+}
+
+// CountPersisted counts a stored message.
+func (report *RunReport) CountPersisted() {
+	report.update(func() { report.Persisted++ })
+}
+
+// CountQuarantined counts a message quarantined for the given reason.
+func (report *RunReport) CountQuarantined(reason string) {
+	report.update(func() { report.Quarantined[reason]++ })
+}
+
+// CountFailed counts a message which will be redelivered.
+func (report *RunReport) CountFailed() {
+	report.update(func() { report.Failed++ })
+}
+
+// CountValidation counts a message which passed or failed the schema validation.
+func (report *RunReport) CountValidation(valid bool) {
+	report.update(func() {
+		if valid {
+			report.Valid++
+		} else {
+			report.Invalid++
+		}
+	})
+}
+
+// CountFiltered counts a message which did not match the filter.
+func (report *RunReport) CountFiltered() {
+	report.update(func() { report.Filtered++ })
+}
+
+// CountDropped counts a message dropped by the transforms.
+func (report *RunReport) CountDropped() {
+	report.update(func() { report.Dropped++ })
+}
+
+// CountRedacted adds the numbers of redacted values per field.
+func (report *RunReport) CountRedacted(counts map[string]int) {
+	report.update(func() {
+		for field, count := range counts {
+			report.Redacted[field] += count
+		}
+	})
+}
+
+// CountRouted counts a message stored by the given route.
+func (report *RunReport) CountRouted(route string) {
+	report.update(func() { report.Routes[route]++ })
+}
+
+// CountWriteError counts a failed write to the given fan-out destination.
+func (report *RunReport) CountWriteError(bucketID string) {
+	report.update(func() { report.WriteErrors[bucketID]++ })
+}
+
+// Rotate returns the counts collected so far as a new report and resets the report, so the counters (and the
+// per-reason, per-field, per-route and per-destination maps) of a long-running process do not grow without limit.
+func (report *RunReport) Rotate() *RunReport {
+	rotated := NewRunReport()
+	if report == nil {
+		return rotated
+	}
+
+	report.mtx.Lock()
+	defer report.mtx.Unlock()
+
+	rotated.Received, report.Received = report.Received, 0
+	rotated.Persisted, report.Persisted = report.Persisted, 0
+	rotated.Quarantined, report.Quarantined = report.Quarantined, rotated.Quarantined
+	rotated.Failed, report.Failed = report.Failed, 0
+	rotated.Valid, report.Valid = report.Valid, 0
+	rotated.Invalid, report.Invalid = report.Invalid, 0
+	rotated.Filtered, report.Filtered = report.Filtered, 0
+	rotated.Dropped, report.Dropped = report.Dropped, 0
+	rotated.Redacted, report.Redacted = report.Redacted, rotated.Redacted
+	rotated.Routes, report.Routes = report.Routes, rotated.Routes
+	rotated.WriteErrors, report.WriteErrors = report.WriteErrors, rotated.WriteErrors
+	return rotated
+}
+
+// String returns the JSON representation of the report.
+func (report *RunReport) String() string {
+	if report == nil {
+		return "{}"
+	}
+
+	report.mtx.Lock()
+	defer report.mtx.Unlock()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
@@ -0,0 +1,42 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"testing"
+)
+
+func TestRunReportRotate(t *testing.T) {
+	report := NewRunReport()
+	report.CountReceived()
+	report.CountPersisted()
+	report.CountQuarantined(ReasonPermanentError)
+	report.CountRouted("orders")
+
+	rotated := report.Rotate()
+	if rotated.Received != 1 || rotated.Persisted != 1 || rotated.Quarantined[ReasonPermanentError] != 1 || rotated.Routes["orders"] != 1 {
+		t.Errorf("rotated report = %s, want the counts collected before the rotation", rotated)
+	}
+	want := `{"received":0,"persisted":0,"quarantined":{},"failed":0,"valid":0,"invalid":0,"filtered":0,"dropped":0,"redacted":{},"routes":{},"writeErrors":{}}`
+	if report.String() != want {
+		t.Errorf("report after the rotation = %s, want %s", report, want)
+	}
+
+	// The counting continues in the reset report, without changing the rotated one.
+	report.CountRouted("orders")
+	if report.Routes["orders"] != 1 || rotated.Routes["orders"] != 1 {
+		t.Errorf("routes = %v and %v, want 1 in each", report.Routes, rotated.Routes)
+	}
+}
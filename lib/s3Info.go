@@ -0,0 +1,74 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	// minS3PartSize is the minimum size of a part of a multipart upload, except for the last one.
+	minS3PartSize = 5
+)
+
+// S3Info represents S3-compatible object store configuration.
+// It holds information needed for storing objects in the buckets given as s3://bucket destinations.
+// The endpoint allows using other S3-compatible stores (e.g. MinIO), and the AWS endpoint of the region is used if it is not set.
+type S3Info struct {
+	Endpoint        string // URL of the object store (e.g. http://localhost:9000), the AWS endpoint of the region if empty
+	Region          string // region used for signing the requests
+	AccessKeyID     string // access key ID of the credentials
+	SecretAccessKey string // secret access key of the credentials
+	SessionToken    string // session token of temporary credentials (optional)
+	PathStyle       bool   // whether the bucket is given in the path instead of the host name (needed by most S3-compatible stores)
+	PartSize        int    // size of the parts of a multipart upload in MB, objects larger than a part are uploaded in parts
+}
+
+// SetS3Info sets the parameters of an S3 configuration by extracting values from the corresponding environment variables.
+// The credentials are taken from S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY, or from the standard AWS variables if those are not set.
+// An error is returned if any errors occur during the function execution.
+func SetS3Info(s3Info *S3Info) error {
+	var err error
+
+	s3Info.Endpoint = getOptionalEnvVariable("S3_ENDPOINT", "")
+	s3Info.Region = getOptionalEnvVariable("S3_REGION", getOptionalEnvVariable("AWS_REGION", defaultS3Region))
+	if s3Info.Endpoint == "" {
+		s3Info.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s3Info.Region)
+	}
+
+	s3Info.AccessKeyID = getOptionalEnvVariable("S3_ACCESS_KEY_ID", getOptionalEnvVariable("AWS_ACCESS_KEY_ID", ""))
+	s3Info.SecretAccessKey = getOptionalEnvVariable("S3_SECRET_ACCESS_KEY", getOptionalEnvVariable("AWS_SECRET_ACCESS_KEY", ""))
+	s3Info.SessionToken = getOptionalEnvVariable("S3_SESSION_TOKEN", getOptionalEnvVariable("AWS_SESSION_TOKEN", ""))
+	if s3Info.AccessKeyID == "" || s3Info.SecretAccessKey == "" {
+		return fmt.Errorf("S3 credentials are not set (S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY)")
+	}
+
+	s3Info.PathStyle, err = strconv.ParseBool(getOptionalEnvVariable("S3_PATH_STYLE", "false"))
+	if err != nil {
+		return err
+	}
+
+	s3Info.PartSize, err = strconv.Atoi(getOptionalEnvVariable("S3_PART_SIZE", "16"))
+	if err != nil {
+		return err
+	}
+	if s3Info.PartSize < minS3PartSize {
+		return fmt.Errorf("S3 part size must be at least %d MB", minS3PartSize)
+	}
+
+	return nil
+}
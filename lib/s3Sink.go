@@ -0,0 +1,319 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// s3RequestTimeout is the timeout of a single request to the object store.
+const s3RequestTimeout = 30 * time.Second
+
+// S3Sink writes objects to a bucket of an S3-compatible object store. The requests are signed with AWS Signature Version 4,
+// and objects larger than the part size are written with a multipart upload.
+type S3Sink struct {
+	info     S3Info
+	bucket   string
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Sink creates a sink of the given bucket.
+// An error is returned if the endpoint of the configuration is not a valid URL.
+func NewS3Sink(info S3Info, bucket string) (*S3Sink, error) {
+	endpoint, err := url.Parse(info.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint '%s'", info.Endpoint)
+	}
+
+	return &S3Sink{
+		info:     info,
+		bucket:   bucket,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: s3RequestTimeout},
+	}, nil
+}
+
+// WriteObject writes an object to the bucket. The metadata is stored as user-defined metadata (x-amz-meta-* headers),
+// and the values which are not printable ASCII are encoded as described in RFC 2047.
+func (sink *S3Sink) WriteObject(ctx context.Context, objectName string, data []byte, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	header, err := s3MetadataHeader(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	var etag string
+	if len(data) <= sink.info.PartSize<<20 {
+		etag, err = sink.putObject(ctx, objectName, data, header)
+	} else {
+		etag, err = sink.multipartUpload(ctx, objectName, data, header)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.ObjectAttrs{
+		Bucket:   SchemeS3 + "://" + sink.bucket,
+		Name:     objectName,
+		Size:     int64(len(data)),
+		Etag:     etag,
+		Metadata: metadata,
+	}, nil
+}
+
+// putObject writes an object with a single request and returns its ETag.
+func (sink *S3Sink) putObject(ctx context.Context, objectName string, data []byte, header http.Header) (string, error) {
+	response, _, err := sink.do(ctx, http.MethodPut, objectName, nil, header, data)
+	if err != nil {
+		return "", err
+	}
+	return response.Get("ETag"), nil
+}
+
+// multipartUpload writes an object in parts and returns its ETag. The upload is aborted if any of the parts fails,
+// so the store does not keep the uploaded parts.
+func (sink *S3Sink) multipartUpload(ctx context.Context, objectName string, data []byte, header http.Header) (string, error) {
+	_, body, err := sink.do(ctx, http.MethodPost, objectName, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return "", err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &initiated); err != nil || initiated.UploadID == "" {
+		return "", fmt.Errorf("Invalid response to the multipart upload initiation. %v", err)
+	}
+	uploadID := url.Values{"uploadId": {initiated.UploadID}}
+
+	etag, err := sink.uploadParts(ctx, objectName, initiated.UploadID, data)
+	if err != nil {
+		if _, _, abortErr := sink.do(ctx, http.MethodDelete, objectName, uploadID, nil, nil); abortErr != nil {
+			err = fmt.Errorf("%s (abort failed: %s)", err, abortErr)
+		}
+		return "", err
+	}
+	return etag, nil
+}
+
+// s3CompletedPart is a part of a completed multipart upload.
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// uploadParts uploads the parts of an object and completes the multipart upload.
+func (sink *S3Sink) uploadParts(ctx context.Context, objectName string, uploadID string, data []byte) (string, error) {
+	partSize := sink.info.PartSize << 20
+
+	var completed struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}
+	for offset, number := 0, 1; offset < len(data); offset, number = offset+partSize, number+1 {
+		end := offset + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		response, _, err := sink.do(ctx, http.MethodPut, objectName, query, nil, data[offset:end])
+		if err != nil {
+			return "", err
+		}
+		completed.Parts = append(completed.Parts, s3CompletedPart{PartNumber: number, ETag: response.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(completed)
+	if err != nil {
+		return "", err
+	}
+	_, body, err = sink.do(ctx, http.MethodPost, objectName, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("Invalid response to the multipart upload completion. %s", err)
+	}
+	// The completion can fail after the response status was already sent, in which case the body holds the error.
+	if result.XMLName.Local == "Error" {
+		return "", &ObjectStoreError{StatusCode: http.StatusInternalServerError, Code: result.Code, Message: result.Message}
+	}
+	return result.ETag, nil
+}
+
+// do sends a signed request for an object and returns the response header and body.
+// An *ObjectStoreError is returned if the store responds with an error status.
+func (sink *S3Sink) do(ctx context.Context, method string, objectName string, query url.Values, header http.Header, body []byte) (http.Header, []byte, error) {
+	request, err := http.NewRequest(method, sink.objectURL(objectName, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	request = request.WithContext(ctx)
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	sink.info.sign(request, body, time.Now())
+
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.StatusCode >= 300 {
+		storeErr := &ObjectStoreError{StatusCode: response.StatusCode, Message: http.StatusText(response.StatusCode)}
+		var xmlErr struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if xml.Unmarshal(data, &xmlErr) == nil && xmlErr.Code != "" {
+			storeErr.Code = xmlErr.Code
+			storeErr.Message = xmlErr.Message
+		}
+		return nil, nil, storeErr
+	}
+	return response.Header, data, nil
+}
+
+// objectURL returns the URL of an object, with the bucket in the path or in the host name.
+func (sink *S3Sink) objectURL(objectName string, query url.Values) string {
+	objectURL := *sink.endpoint
+	if sink.info.PathStyle {
+		objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + sink.bucket + "/" + objectName
+	} else {
+		objectURL.Host = sink.bucket + "." + objectURL.Host
+		objectURL.Path = strings.TrimSuffix(objectURL.Path, "/") + "/" + objectName
+	}
+	objectURL.RawPath = uriEscape(objectURL.Path, false)
+	objectURL.RawQuery = s3CanonicalQuery(query)
+	return objectURL.String()
+}
+
+// s3MetadataHeader converts object metadata to the x-amz-meta-* headers.
+// An error is returned if a metadata key is not a valid header name.
+func s3MetadataHeader(metadata map[string]string) (http.Header, error) {
+	header := make(http.Header)
+	for key, value := range metadata {
+		for _, c := range key {
+			if c <= ' ' || c >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+				return nil, Permanent(fmt.Errorf("Metadata key '%s' cannot be stored as an S3 header", key))
+			}
+		}
+		for _, c := range value {
+			if c < ' ' || c >= 0x7f {
+				value = mime.QEncoding.Encode("utf-8", value)
+				break
+			}
+		}
+		header.Set("X-Amz-Meta-"+key, value)
+	}
+	return header, nil
+}
+
+// sign signs a request with AWS Signature Version 4. All of the headers which are set on the request are signed,
+// together with the host, the payload hash and the date.
+func (info S3Info) sign(request *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", amzDate[:8], info.Region)
+	payloadHash := sha256.Sum256(body)
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if info.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", info.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for key, values := range request.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		uriEscape(request.URL.Path, false),
+		s3CanonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + info.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], info.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		info.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery encodes the query parameters sorted by their names, as required by the signature.
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, uriEscape(key, true)+"="+uriEscape(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
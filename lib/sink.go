@@ -0,0 +1,159 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// Sink stores objects in an object store. Each destination of the stored messages (the bucket of the storage
+// configuration, of a route or of the fan-out) is written through a sink, chosen by the form of the destination:
+//
+//	bucket or gs://bucket  a GCS bucket
+//	s3://bucket            a bucket of an S3-compatible object store, configured by S3Info
+//	azblob://container     a container of Azure Blob Storage, configured by AzureInfo
+type Sink interface {
+	// WriteObject writes the data to an object with the given name and returns the attributes of the written object.
+	// The metadata is attached to the object if it is not empty. Except for GCS, the bucket of the returned
+	// attributes includes the scheme (e.g. s3://bucket), so it identifies the sink as well.
+	WriteObject(ctx context.Context, objectName string, data []byte, metadata map[string]string) (*storage.ObjectAttrs, error)
+}
+
+// Destination schemes of the sinks.
+const (
+	SchemeGCS   = "gs"
+	SchemeS3    = "s3"
+	SchemeAzure = "azblob"
+)
+
+// ObjectStoreError is an error response of an object store other than GCS.
+// It is classified by IsRetryable in the same way as the errors of the GCP APIs.
+type ObjectStoreError struct {
+	StatusCode int    // HTTP status code of the response
+	Code       string // error code returned by the store (e.g. NoSuchBucket)
+	Message    string // error message returned by the store
+}
+
+func (err *ObjectStoreError) Error() string {
+	return fmt.Sprintf("Object store responded with %d %s: %s", err.StatusCode, err.Code, err.Message)
+}
+
+// splitDestination splits a destination into its scheme and bucket. A destination without a scheme is a GCS bucket.
+func splitDestination(destination string) (string, string) {
+	if i := strings.Index(destination, "://"); i >= 0 {
+		return destination[:i], destination[i+3:]
+	}
+	return SchemeGCS, destination
+}
+
+// destinationKey returns the canonical form of a destination, so a GCS bucket given with and without the gs:// scheme
+// is recognized as the same destination.
+func destinationKey(destination string) string {
+	scheme, bucketID := splitDestination(destination)
+	return scheme + "://" + bucketID
+}
+
+// uriEscape percent-encodes all of the characters except the unreserved ones (RFC 3986), and except the slashes
+// unless encodeSlash is set. It is used by the sinks which sign their requests, so the signed path matches the sent one.
+func uriEscape(value string, encodeSlash bool) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// IsGCSDestination reports whether the destination is a GCS bucket, so it can be used by the features which work
+// only with GCS (e.g. the message index, compaction and partition markers).
+func IsGCSDestination(destination string) bool {
+	scheme, _ := splitDestination(destination)
+	return scheme == SchemeGCS
+}
+
+// sinks caches the sinks of the destinations, so a sink is configured once per instance instead of once per message.
+var (
+	sinks    = make(map[string]Sink)
+	sinksMtx sync.Mutex
+)
+
+// GetSink returns the sink of a destination, creating it if it is not cached yet.
+// An error is returned if the scheme of the destination is unknown or if its sink configuration is not valid.
+func GetSink(destination string) (Sink, error) {
+	sinksMtx.Lock()
+	defer sinksMtx.Unlock()
+
+	if sink, ok := sinks[destination]; ok {
+		return sink, nil
+	}
+
+	sink, err := newSink(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	sinks[destination] = sink
+	return sink, nil
+}
+
+// newSink creates the sink of a destination.
+func newSink(destination string) (Sink, error) {
+	scheme, bucket := splitDestination(destination)
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, fmt.Errorf("Invalid destination '%s'", destination)
+	}
+
+	switch scheme {
+	case SchemeGCS:
+		return gcsSink{bucketID: bucket}, nil
+
+	case SchemeS3:
+		var s3Info S3Info
+		err := SetS3Info(&s3Info)
+		if err != nil {
+			return nil, err
+		}
+		return NewS3Sink(s3Info, bucket)
+
+	case SchemeAzure:
+		var azureInfo AzureInfo
+		err := SetAzureInfo(&azureInfo)
+		if err != nil {
+			return nil, err
+		}
+		return NewAzureSink(azureInfo, bucket)
+	}
+
+	return nil, fmt.Errorf("Unknown scheme '%s' of destination '%s'", scheme, destination)
+}
+
+// gcsSink writes objects to a GCS bucket.
+type gcsSink struct {
+	bucketID string
+}
+
+// WriteObject writes an object to the bucket.
+func (sink gcsSink) WriteObject(ctx context.Context, objectName string, data []byte, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	return writeObject(ctx, sink.bucketID, objectName, data, metadata)
+}
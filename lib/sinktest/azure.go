@@ -0,0 +1,268 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sinktest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AzureBlob is a block blob stored in the fake Azure server.
+type AzureBlob struct {
+	Data     []byte
+	Metadata map[string]string // blob metadata, with the names in lower case
+	ETag     string
+	Blocks   int // number of committed blocks (0 if the blob was written with a single request)
+}
+
+// AzureServer is a fake of the Azure Blob Storage service in the style of the Azurite emulator, where the account
+// is given in the path (http://host/account/container/blob). It serves the Put Blob, Put Block, Put Block List and
+// Get Blob requests, and it verifies the Shared Key signatures. The containers are created on the first write.
+type AzureServer struct {
+	*httptest.Server
+	AccountName string
+	AccountKey  string // base64 encoded account key
+
+	// Fail, if set, is called for each request and a non-zero result is returned as the response status,
+	// which allows simulating failures of the service.
+	Fail func(r *http.Request) int
+
+	mtx    sync.Mutex
+	blobs  map[string]*AzureBlob        // committed blobs mapped by container/blob
+	staged map[string]map[string][]byte // uncommitted blocks mapped by container/blob and block ID
+}
+
+// NewAzureServer starts a fake Azure server of an account with the given name and base64 encoded key.
+// The Blob service endpoint of the account is the server URL followed by the account name.
+// The server has to be closed by the caller.
+func NewAzureServer(accountName string, accountKey string) *AzureServer {
+	server := &AzureServer{
+		AccountName: accountName,
+		AccountKey:  accountKey,
+		blobs:       make(map[string]*AzureBlob),
+		staged:      make(map[string]map[string][]byte),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// Endpoint returns the Blob service endpoint of the account.
+func (server *AzureServer) Endpoint() string {
+	return server.URL + "/" + server.AccountName
+}
+
+// Blob returns a committed blob.
+func (server *AzureServer) Blob(container string, name string) (*AzureBlob, bool) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	blob, ok := server.blobs[container+"/"+name]
+	return blob, ok
+}
+
+// Names returns the names of the committed blobs of a container, sorted alphabetically.
+func (server *AzureServer) Names(container string) []string {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	var names []string
+	for name := range server.blobs {
+		if strings.HasPrefix(name, container+"/") {
+			names = append(names, strings.TrimPrefix(name, container+"/"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handle serves a single request.
+func (server *AzureServer) handle(w http.ResponseWriter, r *http.Request) {
+	if server.Fail != nil {
+		if status := server.Fail(r); status != 0 {
+			azureError(w, status, "InjectedFailure", "Failure injected by the test")
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		azureError(w, http.StatusBadRequest, "InvalidInput", err.Error())
+		return
+	}
+	if !server.authorized(r) {
+		azureError(w, http.StatusForbidden, "AuthorizationFailure", "Signature does not match")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	if len(parts) != 3 || parts[0] != server.AccountName || parts[1] == "" || parts[2] == "" {
+		azureError(w, http.StatusBadRequest, "InvalidUri", "Only blob requests are supported")
+		return
+	}
+	name := parts[1] + "/" + parts[2]
+	query := r.URL.Query()
+
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		if server.staged[name] == nil {
+			server.staged[name] = make(map[string][]byte)
+		}
+		server.staged[name][query.Get("blockid")] = body
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		var blockList struct {
+			Latest []string `xml:"Latest"`
+		}
+		if err := xml.Unmarshal(body, &blockList); err != nil || len(blockList.Latest) == 0 {
+			azureError(w, http.StatusBadRequest, "InvalidXmlDocument", "Invalid block list")
+			return
+		}
+		var data bytes.Buffer
+		for _, blockID := range blockList.Latest {
+			block, ok := server.staged[name][blockID]
+			if !ok {
+				azureError(w, http.StatusBadRequest, "InvalidBlockList", fmt.Sprintf("Block %s is not staged", blockID))
+				return
+			}
+			data.Write(block)
+		}
+		delete(server.staged, name)
+		server.put(w, name, data.Bytes(), r.Header, len(blockList.Latest))
+
+	case r.Method == http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			azureError(w, http.StatusBadRequest, "MissingRequiredHeader", "x-ms-blob-type must be BlockBlob")
+			return
+		}
+		server.put(w, name, body, r.Header, 0)
+
+	case r.Method == http.MethodGet:
+		blob, ok := server.blobs[name]
+		if !ok {
+			azureError(w, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist")
+			return
+		}
+		for key, value := range blob.Metadata {
+			w.Header().Set("x-ms-meta-"+key, value)
+		}
+		w.Header().Set("ETag", blob.ETag)
+		w.Write(blob.Data)
+
+	default:
+		azureError(w, http.StatusNotImplemented, "UnsupportedHttpVerb", "Request is not supported by the fake")
+	}
+}
+
+// put commits a blob with the metadata of the request.
+func (server *AzureServer) put(w http.ResponseWriter, name string, data []byte, header http.Header, blocks int) {
+	metadata := make(map[string]string)
+	for key, values := range header {
+		if strings.HasPrefix(strings.ToLower(key), "x-ms-meta-") {
+			metadata[strings.TrimPrefix(strings.ToLower(key), "x-ms-meta-")] = values[0]
+		}
+	}
+
+	hash := md5.Sum(data)
+	blob := &AzureBlob{Data: data, Metadata: metadata, ETag: "\"0x" + strings.ToUpper(hex.EncodeToString(hash[:8])) + "\"", Blocks: blocks}
+	server.blobs[name] = blob
+	w.Header().Set("ETag", blob.ETag)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// authorized verifies the Shared Key signature of a request.
+func (server *AzureServer) authorized(r *http.Request) bool {
+	prefix := "SharedKey " + server.AccountName + ":"
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, prefix) || r.Header.Get("x-ms-date") == "" || r.Header.Get("x-ms-version") == "" {
+		return false
+	}
+
+	var lines []string
+	lines = append(lines, r.Method)
+	for _, name := range []string{"Content-Encoding", "Content-Language"} {
+		lines = append(lines, r.Header.Get(name))
+	}
+	if r.ContentLength > 0 {
+		lines = append(lines, fmt.Sprint(r.ContentLength))
+	} else {
+		lines = append(lines, "")
+	}
+	for _, name := range []string{"Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		lines = append(lines, r.Header.Get(name))
+	}
+
+	var headerNames []string
+	for key := range r.Header {
+		if strings.HasPrefix(strings.ToLower(key), "x-ms-") {
+			headerNames = append(headerNames, strings.ToLower(key))
+		}
+	}
+	sort.Strings(headerNames)
+	for _, name := range headerNames {
+		lines = append(lines, name+":"+strings.TrimSpace(r.Header.Get(name)))
+	}
+
+	resource := "/" + server.AccountName + r.URL.EscapedPath()
+	query := r.URL.Query()
+	var queryNames []string
+	for key := range query {
+		queryNames = append(queryNames, key)
+	}
+	sort.Strings(queryNames)
+	for _, key := range queryNames {
+		values := query[key]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(key) + ":" + strings.Join(values, ",")
+	}
+	lines = append(lines, resource)
+
+	key, err := base64.StdEncoding.DecodeString(server.AccountKey)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	expected := prefix + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(authorization), []byte(expected))
+}
+
+// azureError writes an error response in the Blob service format.
+func azureError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+	w.Write(append([]byte(xml.Header), data...))
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sinktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+
+	bigquery "google.golang.org/api/bigquery/v2"
+)
+
+// bigQueryInsertAllPath matches the path of the streaming insert (tabledata.insertAll) requests.
+var bigQueryInsertAllPath = regexp.MustCompile(`^/bigquery/v2/projects/([^/]+)/datasets/([^/]+)/tables/([^/]+)/insertAll$`)
+
+// BigQueryServer is a fake of the BigQuery streaming insert API. It serves the tabledata.insertAll requests
+// in the style of the BigQuery emulators, where the server address is given in BIGQUERY_EMULATOR_HOST.
+// The tables are created on the first insert. If a schema is set, the rows are checked against it and the invalid
+// rows are rejected the way BigQuery rejects them, i.e. with an insert error for each invalid row.
+type BigQueryServer struct {
+	*httptest.Server
+
+	// Schema, if set, is the schema of all of the tables. The rows with unknown columns, missing required columns
+	// or values which are not valid JSON in JSON columns are rejected.
+	Schema *bigquery.TableSchema
+
+	// Reject, if set, is called for each row and a non-empty result rejects the row with the result as the error message.
+	Reject func(row map[string]interface{}) string
+
+	// Fail, if set, is called for each request and a non-zero result is returned as the response status,
+	// which allows simulating failures of the service.
+	Fail func(r *http.Request) int
+
+	mtx       sync.Mutex
+	rows      map[string][]map[string]interface{} // inserted rows mapped by project.dataset.table
+	insertIDs map[string]bool                     // insert IDs of the inserted rows mapped by project.dataset.table/insertId
+	requests  int
+}
+
+// NewBigQueryServer starts a fake BigQuery server. The server has to be closed by the caller.
+func NewBigQueryServer() *BigQueryServer {
+	server := &BigQueryServer{
+		rows:      make(map[string][]map[string]interface{}),
+		insertIDs: make(map[string]bool),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// Host returns the address of the server in the host:port form, as expected in BIGQUERY_EMULATOR_HOST.
+func (server *BigQueryServer) Host() string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Rows returns the rows inserted into a table given as project.dataset.table.
+func (server *BigQueryServer) Rows(table string) []map[string]interface{} {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	return append([]map[string]interface{}(nil), server.rows[table]...)
+}
+
+// Requests returns the number of received insert requests.
+func (server *BigQueryServer) Requests() int {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	return server.requests
+}
+
+func (server *BigQueryServer) handle(w http.ResponseWriter, r *http.Request) {
+	match := bigQueryInsertAllPath.FindStringSubmatch(r.URL.Path)
+	if r.Method != http.MethodPost || match == nil {
+		writeBigQueryError(w, http.StatusNotFound, "notFound", fmt.Sprintf("Not found: %s %s", r.Method, r.URL.Path))
+		return
+	}
+
+	server.mtx.Lock()
+	server.requests++
+	server.mtx.Unlock()
+
+	if server.Fail != nil {
+		if code := server.Fail(r); code != 0 {
+			writeBigQueryError(w, code, "backendError", "Simulated failure")
+			return
+		}
+	}
+
+	var request bigquery.TableDataInsertAllRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeBigQueryError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	table := strings.Join(match[1:], ".")
+	response := bigquery.TableDataInsertAllResponse{Kind: "bigquery#tableDataInsertAllResponse"}
+	var valid []*bigquery.TableDataInsertAllRequestRows
+	for i, row := range request.Rows {
+		values := make(map[string]interface{}, len(row.Json))
+		for column, value := range row.Json {
+			values[column] = value
+		}
+
+		message := server.check(values)
+		if message == "" {
+			valid = append(valid, row)
+			continue
+		}
+		response.InsertErrors = append(response.InsertErrors, &bigquery.TableDataInsertAllResponseInsertErrors{
+			Index:  int64(i),
+			Errors: []*bigquery.ErrorProto{{Reason: "invalid", Message: message}},
+		})
+	}
+
+	// Without skipping the invalid rows, a request with an invalid row inserts none of the rows,
+	// and the valid rows are reported as stopped.
+	if len(response.InsertErrors) > 0 && !request.SkipInvalidRows {
+		rejected := make(map[int64]bool)
+		for _, insertErr := range response.InsertErrors {
+			rejected[insertErr.Index] = true
+		}
+		for i := range request.Rows {
+			if !rejected[int64(i)] {
+				response.InsertErrors = append(response.InsertErrors, &bigquery.TableDataInsertAllResponseInsertErrors{
+					Index:  int64(i),
+					Errors: []*bigquery.ErrorProto{{Reason: "stopped"}},
+				})
+			}
+		}
+		valid = nil
+	}
+
+	server.mtx.Lock()
+	for _, row := range valid {
+		// Like BigQuery, the rows with an already inserted insert ID are dropped as duplicates.
+		if row.InsertId != "" {
+			if server.insertIDs[table+"/"+row.InsertId] {
+				continue
+			}
+			server.insertIDs[table+"/"+row.InsertId] = true
+		}
+		values := make(map[string]interface{}, len(row.Json))
+		for column, value := range row.Json {
+			values[column] = value
+		}
+		server.rows[table] = append(server.rows[table], values)
+	}
+	server.mtx.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// check returns the reason for rejecting a row, or an empty string if the row is valid.
+func (server *BigQueryServer) check(row map[string]interface{}) string {
+	if server.Schema != nil {
+		fields := make(map[string]*bigquery.TableFieldSchema)
+		for _, field := range server.Schema.Fields {
+			fields[field.Name] = field
+			if _, ok := row[field.Name]; !ok && field.Mode == "REQUIRED" {
+				return fmt.Sprintf("Missing required field: %s.", field.Name)
+			}
+		}
+		for column, value := range row {
+			field, ok := fields[column]
+			if !ok {
+				return fmt.Sprintf("no such field: %s.", column)
+			}
+			if field.Type == "JSON" {
+				text, ok := value.(string)
+				if !ok || !json.Valid([]byte(text)) {
+					return fmt.Sprintf("Field %s: Invalid JSON value.", column)
+				}
+			}
+		}
+	}
+
+	if server.Reject != nil {
+		return server.Reject(row)
+	}
+	return ""
+}
+
+// writeBigQueryError writes an error response in the format of the Google APIs.
+func writeBigQueryError(w http.ResponseWriter, code int, reason string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors":  []map[string]string{{"reason": reason, "message": message}},
+		},
+	})
+}
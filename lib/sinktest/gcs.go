@@ -0,0 +1,329 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sinktest
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GCSObject is an object stored in the fake GCS server.
+type GCSObject struct {
+	Data        []byte
+	Metadata    map[string]string
+	ContentType string
+	Generation  int64
+}
+
+// GCSServer is a fake of the GCS JSON API, serving the requests made by the storage library when STORAGE_EMULATOR_HOST
+// is set: multipart uploads, object reads (including range reads), metadata reads, listing (with a prefix and
+// a delimiter), deletes and composes. The ifGenerationMatch precondition is checked for uploads, composes and deletes.
+// The buckets are created on the first write.
+type GCSServer struct {
+	*httptest.Server
+
+	// Fail, if set, is called for each request and a non-zero result is returned as the response status,
+	// which allows simulating failures of the service.
+	Fail func(r *http.Request) int
+
+	mtx        sync.Mutex
+	objects    map[string]*GCSObject // objects mapped by bucket/name
+	generation int64
+}
+
+// NewGCSServer starts a fake GCS server. The server has to be closed by the caller.
+func NewGCSServer() *GCSServer {
+	server := &GCSServer{objects: make(map[string]*GCSObject)}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// Host returns the address of the server in the host:port form, as expected in STORAGE_EMULATOR_HOST.
+func (server *GCSServer) Host() string {
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// Object returns the object with the given name.
+func (server *GCSServer) Object(bucket string, name string) (*GCSObject, bool) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	object, ok := server.objects[bucket+"/"+name]
+	return object, ok
+}
+
+// Names returns the sorted names of the objects of a bucket.
+func (server *GCSServer) Names(bucket string) []string {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	return server.names(bucket, "")
+}
+
+// Put stores an object, e.g. a configuration read by the persistor.
+func (server *GCSServer) Put(bucket string, name string, data []byte, metadata map[string]string) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	server.put(bucket, name, data, metadata, "")
+}
+
+func (server *GCSServer) handle(w http.ResponseWriter, r *http.Request) {
+	if server.Fail != nil {
+		if code := server.Fail(r); code != 0 {
+			gcsError(w, code, "Simulated failure")
+			return
+		}
+	}
+
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	query := r.URL.Query()
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		server.upload(w, r, strings.SplitN(strings.TrimPrefix(path, "/upload/storage/v1/b/"), "/", 2)[0])
+
+	case strings.HasPrefix(path, "/storage/v1/b/") || strings.HasPrefix(path, "/b/"):
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "/storage/v1"), "/b/")
+		parts := strings.SplitN(path, "/", 3)
+		bucket := parts[0]
+		if len(parts) < 3 {
+			server.list(w, bucket, query)
+			return
+		}
+
+		name := parts[2]
+		if r.Method == http.MethodPost && strings.HasSuffix(name, "/compose") {
+			server.compose(w, r, bucket, strings.TrimSuffix(name, "/compose"))
+			return
+		}
+
+		key := bucket + "/" + name
+		object, ok := server.objects[key]
+		if !ok {
+			gcsError(w, http.StatusNotFound, "No such object: "+key)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if server.checkPrecondition(w, query, key) {
+				delete(server.objects, key)
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+		json.NewEncoder(w).Encode(gcsResource(bucket, name, object))
+
+	default:
+		// The storage library reads the object content from http://host/bucket/name.
+		server.read(w, r, strings.TrimPrefix(path, "/"))
+	}
+}
+
+func (server *GCSServer) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || r.URL.Query().Get("uploadType") != "multipart" {
+		gcsError(w, http.StatusBadRequest, "Only multipart uploads are supported")
+		return
+	}
+
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	var resource struct {
+		Name        string            `json:"name"`
+		Metadata    map[string]string `json:"metadata"`
+		ContentType string            `json:"contentType"`
+	}
+	part, err := reader.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&resource)
+	}
+	var data []byte
+	if err == nil {
+		part, err = reader.NextPart()
+	}
+	if err == nil {
+		data, err = ioutil.ReadAll(part)
+	}
+	if err != nil {
+		gcsError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !server.checkPrecondition(w, r.URL.Query(), bucket+"/"+resource.Name) {
+		return
+	}
+	object := server.put(bucket, resource.Name, data, resource.Metadata, resource.ContentType)
+	json.NewEncoder(w).Encode(gcsResource(bucket, resource.Name, object))
+}
+
+func (server *GCSServer) compose(w http.ResponseWriter, r *http.Request, bucket string, name string) {
+	var request struct {
+		Destination struct {
+			Metadata    map[string]string `json:"metadata"`
+			ContentType string            `json:"contentType"`
+		} `json:"destination"`
+		SourceObjects []struct {
+			Name       string `json:"name"`
+			Generation string `json:"generation"`
+		} `json:"sourceObjects"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		gcsError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(request.SourceObjects) > 32 {
+		gcsError(w, http.StatusBadRequest, "The number of source components provided exceeds the maximum of 32")
+		return
+	}
+
+	var data []byte
+	for _, source := range request.SourceObjects {
+		object, ok := server.objects[bucket+"/"+source.Name]
+		if !ok || (source.Generation != "" && source.Generation != "0" && source.Generation != strconv.FormatInt(object.Generation, 10)) {
+			gcsError(w, http.StatusNotFound, "No such object: "+bucket+"/"+source.Name)
+			return
+		}
+		data = append(data, object.Data...)
+	}
+
+	if !server.checkPrecondition(w, r.URL.Query(), bucket+"/"+name) {
+		return
+	}
+	object := server.put(bucket, name, data, request.Destination.Metadata, request.Destination.ContentType)
+	json.NewEncoder(w).Encode(gcsResource(bucket, name, object))
+}
+
+func (server *GCSServer) list(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	items := []interface{}{}
+	var prefixes []string
+	seen := make(map[string]bool)
+	for _, name := range server.names(bucket, prefix) {
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				folder := name[:len(prefix)+i+len(delimiter)]
+				if !seen[folder] {
+					seen[folder] = true
+					prefixes = append(prefixes, folder)
+				}
+				continue
+			}
+		}
+		items = append(items, gcsResource(bucket, name, server.objects[bucket+"/"+name]))
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"kind": "storage#objects", "items": items, "prefixes": prefixes})
+}
+
+func (server *GCSServer) read(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := server.objects[key]
+	generation := r.URL.Query().Get("generation")
+	if !ok || (generation != "" && generation != strconv.FormatInt(object.Generation, 10)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.Generation, 10))
+	data := object.Data
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		var start, end int
+		n, _ := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
+		if n < 2 || end >= len(data) {
+			end = len(data) - 1
+		}
+		if start > end {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// checkPrecondition checks the ifGenerationMatch precondition of a request, where 0 requires that the object does not exist.
+// If the precondition fails, the error response is written and false is returned.
+func (server *GCSServer) checkPrecondition(w http.ResponseWriter, query url.Values, key string) bool {
+	value := query.Get("ifGenerationMatch")
+	if value == "" {
+		return true
+	}
+
+	generation, _ := strconv.ParseInt(value, 10, 64)
+	object, ok := server.objects[key]
+	if (generation == 0 && ok) || (generation != 0 && (!ok || object.Generation != generation)) {
+		gcsError(w, http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold.")
+		return false
+	}
+	return true
+}
+
+func (server *GCSServer) put(bucket string, name string, data []byte, metadata map[string]string, contentType string) *GCSObject {
+	server.generation++
+	object := &GCSObject{Data: data, Metadata: metadata, ContentType: contentType, Generation: server.generation}
+	server.objects[bucket+"/"+name] = object
+	return object
+}
+
+func (server *GCSServer) names(bucket string, prefix string) []string {
+	var names []string
+	for key := range server.objects {
+		if strings.HasPrefix(key, bucket+"/"+prefix) {
+			names = append(names, strings.TrimPrefix(key, bucket+"/"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gcsResource returns the JSON resource of an object.
+func gcsResource(bucket string, name string, object *GCSObject) map[string]interface{} {
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Checksum(object.Data, crc32.MakeTable(crc32.Castagnoli)))
+	return map[string]interface{}{
+		"kind":        "storage#object",
+		"bucket":      bucket,
+		"name":        name,
+		"generation":  strconv.FormatInt(object.Generation, 10),
+		"size":        strconv.Itoa(len(object.Data)),
+		"crc32c":      base64.StdEncoding.EncodeToString(crc[:]),
+		"metadata":    object.Metadata,
+		"contentType": object.ContentType,
+	}
+}
+
+// gcsError writes an error response in the format of the GCS JSON API.
+func gcsError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, message)
+}
@@ -0,0 +1,294 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sinktest provides in-process fakes of the object stores written by the sinks, for testing the persistor
+// without access to the real services.
+package sinktest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MinS3PartSize is the minimum size of a part of a multipart upload, except for the last one, as enforced by S3.
+const MinS3PartSize = 5 << 20
+
+// S3Object is an object stored in the fake S3 server.
+type S3Object struct {
+	Data      []byte
+	Metadata  map[string]string // user-defined metadata, with the keys in lower case
+	ETag      string
+	Multipart bool // whether the object was written with a multipart upload
+}
+
+// s3Upload is a multipart upload in progress.
+type s3Upload struct {
+	bucket   string
+	key      string
+	metadata map[string]string
+	parts    map[int][]byte
+}
+
+// S3Server is a fake of an S3-compatible object store, serving the object and multipart upload requests
+// in the path style (http://host/bucket/key). It checks that the requests are signed with the configured
+// access key and that the payload hashes match, but it does not verify the signatures themselves.
+// The buckets are created on the first write.
+type S3Server struct {
+	*httptest.Server
+	AccessKeyID string
+
+	// Fail, if set, is called for each request and a non-zero result is returned as the response status,
+	// which allows simulating failures of the store.
+	Fail func(r *http.Request) int
+
+	mtx     sync.Mutex
+	objects map[string]*S3Object // objects mapped by bucket/key
+	uploads map[string]*s3Upload // multipart uploads in progress mapped by their IDs
+	counter int
+}
+
+// NewS3Server starts a fake S3 server which accepts the requests signed with the given access key ID.
+// The server has to be closed by the caller.
+func NewS3Server(accessKeyID string) *S3Server {
+	server := &S3Server{
+		AccessKeyID: accessKeyID,
+		objects:     make(map[string]*S3Object),
+		uploads:     make(map[string]*s3Upload),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	return server
+}
+
+// Object returns a stored object.
+func (server *S3Server) Object(bucket string, key string) (*S3Object, bool) {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	object, ok := server.objects[bucket+"/"+key]
+	return object, ok
+}
+
+// Keys returns the keys of the objects stored in a bucket, sorted alphabetically.
+func (server *S3Server) Keys(bucket string) []string {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	var keys []string
+	for name := range server.objects {
+		if strings.HasPrefix(name, bucket+"/") {
+			keys = append(keys, strings.TrimPrefix(name, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// PendingUploads returns the number of multipart uploads which were neither completed nor aborted.
+func (server *S3Server) PendingUploads() int {
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	return len(server.uploads)
+}
+
+// handle serves a single request.
+func (server *S3Server) handle(w http.ResponseWriter, r *http.Request) {
+	if server.Fail != nil {
+		if status := server.Fail(r); status != 0 {
+			s3Error(w, status, "InjectedFailure", "Failure injected by the test")
+			return
+		}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if !strings.Contains(r.Header.Get("Authorization"), "Credential="+server.AccessKeyID+"/") {
+		s3Error(w, http.StatusForbidden, "InvalidAccessKeyId", "Request is not signed with the expected access key")
+		return
+	}
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		s3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "Payload hash does not match the body")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		s3Error(w, http.StatusBadRequest, "InvalidRequest", "Only object requests are supported")
+		return
+	}
+	bucket, key := parts[0], parts[1]
+	query := r.URL.Query()
+
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		upload, ok := server.uploads[query.Get("uploadId")]
+		number, err := strconv.Atoi(query.Get("partNumber"))
+		if !ok || err != nil || number < 1 {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload", "Upload or part number is not valid")
+			return
+		}
+		upload.parts[number] = body
+		w.Header().Set("ETag", etag(body))
+
+	case r.Method == http.MethodPut:
+		object := &S3Object{Data: body, Metadata: s3Metadata(r.Header), ETag: etag(body)}
+		server.objects[bucket+"/"+key] = object
+		w.Header().Set("ETag", object.ETag)
+
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		server.counter++
+		uploadID := fmt.Sprintf("upload-%d", server.counter)
+		server.uploads[uploadID] = &s3Upload{bucket: bucket, key: key, metadata: s3Metadata(r.Header), parts: make(map[int][]byte)}
+		s3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: uploadID})
+
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		server.completeUpload(w, query.Get("uploadId"), body)
+
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(server.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodGet:
+		object, ok := server.objects[bucket+"/"+key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		for name, value := range object.Metadata {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		w.Header().Set("ETag", object.ETag)
+		w.Write(object.Data)
+
+	case r.Method == http.MethodDelete:
+		delete(server.objects, bucket+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", "Request is not supported by the fake")
+	}
+}
+
+// completeUpload completes a multipart upload by joining its parts in the order given by the request.
+func (server *S3Server) completeUpload(w http.ResponseWriter, uploadID string, body []byte) {
+	upload, ok := server.uploads[uploadID]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 {
+		s3Error(w, http.StatusBadRequest, "MalformedXML", "Invalid list of parts")
+		return
+	}
+
+	var data bytes.Buffer
+	var hashes []byte
+	for i, part := range request.Parts {
+		partData, ok := upload.parts[part.PartNumber]
+		if !ok || etag(partData) != part.ETag || i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			s3Error(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Part %d is not valid", part.PartNumber))
+			return
+		}
+		if i < len(request.Parts)-1 && len(partData) < MinS3PartSize {
+			s3Error(w, http.StatusBadRequest, "EntityTooSmall", fmt.Sprintf("Part %d is smaller than the minimum part size", part.PartNumber))
+			return
+		}
+		data.Write(partData)
+		hash := md5.Sum(partData)
+		hashes = append(hashes, hash[:]...)
+	}
+
+	hash := md5.Sum(hashes)
+	object := &S3Object{
+		Data:      data.Bytes(),
+		Metadata:  upload.metadata,
+		ETag:      fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(hash[:]), len(request.Parts)),
+		Multipart: true,
+	}
+	server.objects[upload.bucket+"/"+upload.key] = object
+	delete(server.uploads, uploadID)
+
+	s3XML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: upload.bucket, Key: upload.key, ETag: object.ETag})
+}
+
+// s3Metadata extracts the user-defined metadata from the request headers.
+func s3Metadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for name, values := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			metadata[strings.ToLower(strings.TrimPrefix(strings.ToLower(name), "x-amz-meta-"))] = values[0]
+		}
+	}
+	return metadata
+}
+
+// etag returns the ETag of an object or part written with a single request.
+func etag(data []byte) string {
+	hash := md5.Sum(data)
+	return "\"" + hex.EncodeToString(hash[:]) + "\""
+}
+
+// s3XML writes an XML response.
+func s3XML(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	data, _ := xml.Marshal(value)
+	w.Write(append([]byte(xml.Header), data...))
+}
+
+// s3Error writes an error response in the S3 format.
+func s3Error(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	data, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+	w.Write(append([]byte(xml.Header), data...))
+}
@@ -16,47 +16,118 @@ package lib
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
 )
 
-// PersistData stores a message in GCS bucket. Before storing, the unique file is created
-// using information from storage configuration. Each message is written in a separate file.
+// PersistData stores a message in the bucket of the storage configuration, through the sink of the bucket
+// (see Sink). Before storing, the unique file is created using information from storage configuration.
+// Each message is written in a separate file.
 // Returned result is an error which defines the validity of the function action.
 func PersistData(ctx context.Context, data []byte, info StorageInfo) error {
-	var err error
-
-	client, err := storage.NewClient(ctx)
+	sink, err := GetSink(info.BucketID)
 	if err != nil {
 		return err
 	}
 
-	objectName := FileName(info)
+	_, err = sink.WriteObject(ctx, FileName(info), data, nil)
+	return err
+}
+
+// PersistMessage stores a message in the bucket (see Sink) and in the format given by the storage configuration.
+// In the raw format the file content is the message payload, and the message attributes are stored as the object
+// metadata if AttributesAsMetadata is set. In the envelope format the file content is the JSON envelope of the message.
+// Returned result is an error which defines the validity of the function action.
+func PersistMessage(ctx context.Context, msg Message, info StorageInfo) error {
+	_, err := persistMessage(ctx, msg, info, time.Now())
+	return err
+}
+
+// persistMessage stores a message in the folder of the given partition time, as described for PersistMessage.
+// The function returns the attributes of the written object.
+func persistMessage(ctx context.Context, msg Message, info StorageInfo, partitionTime time.Time) (*storage.ObjectAttrs, error) {
+	sink, err := GetSink(info.BucketID)
+	if err != nil {
+		return nil, err
+	}
+
+	info.MessageID = msg.ID
+	objectName := fileName(info, partitionTime)
+
+	if info.Format == FormatEnvelope {
+		data, err := json.Marshal(NewEnvelope(msg))
+		if err != nil {
+			return nil, err
+		}
+		return sink.WriteObject(ctx, objectName, data, nil)
+	}
+
+	var metadata map[string]string
+	if info.AttributesAsMetadata {
+		metadata = msg.Attributes
+	}
+	return sink.WriteObject(ctx, objectName, msg.Data, metadata)
+}
+
+// writeObject writes the data to an object with the given name and returns the attributes of the written object.
+// The metadata is attached to the object if it is not empty.
+func writeObject(ctx context.Context, bucketID string, objectName string, data []byte, metadata map[string]string) (*storage.ObjectAttrs, error) {
+	var err error
+
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	ctxx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	objectWriter := client.Bucket(info.BucketID).Object(objectName).NewWriter(ctxx)
+	objectWriter := client.Bucket(bucketID).Object(objectName).NewWriter(ctxx)
+	if len(metadata) > 0 {
+		objectWriter.Metadata = metadata
+	}
 	if _, err := objectWriter.Write(data); err != nil {
 		_ = ResourceCloser(client, objectWriter)
-		return err
+		return nil, err
 	}
 
 	err = ResourceCloser(client, objectWriter)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return objectWriter.Attrs(), nil
 }
 
 // FileName constructs a name of file in which the message will be written.
 // Returned value is a string which consists of current date and hour, followed by chosen prefix, message ID and file extension.
 func FileName(info StorageInfo) string {
-	currentTime := time.Now()
-	formattedTime := fmt.Sprintf("%02d/%02d/%02d/%02d", currentTime.Year(), currentTime.Month(), currentTime.Day(), currentTime.Hour())
-	objectName := fmt.Sprintf("%s/%s-%s.%s", formattedTime, info.Prefix, info.MessageID, info.Extension)
+	return fileName(info, time.Now())
+}
+
+// fileName constructs a name of file in the folder of the given partition time, as described for FileName.
+func fileName(info StorageInfo, partitionTime time.Time) string {
+	objectName := fmt.Sprintf("%s/%s-%s.%s", PartitionFolder(partitionTime), info.Prefix, info.MessageID, info.Extension)
 	return objectName
 }
 
+// PartitionFolder returns the folder of the hourly partition to which the given time belongs, in the YYYY/MM/DD/HH format.
+func PartitionFolder(partitionTime time.Time) string {
+	return fmt.Sprintf("%02d/%02d/%02d/%02d", partitionTime.Year(), partitionTime.Month(), partitionTime.Day(), partitionTime.Hour())
+}
+
+// PartitionHour returns the start of the hourly partition to which the given time belongs. The hour is taken in the location
+// of the time, as in PartitionFolder, so the two match also in the time zones whose offset is not a whole number of hours
+// (time.Truncate truncates relative to UTC).
+func PartitionHour(partitionTime time.Time) time.Time {
+	return time.Date(partitionTime.Year(), partitionTime.Month(), partitionTime.Day(), partitionTime.Hour(), 0, 0, 0, partitionTime.Location())
+}
+
 // ResourceCloser closes the client and writer components of the GCP storage service.
 // Returned result is an error which defines the validity of the function action.
 func ResourceCloser(client *storage.Client, writer *storage.Writer) error {
@@ -70,3 +141,18 @@ func ResourceCloser(client *storage.Client, writer *storage.Writer) error {
 
 	return err
 }
+
+// newStorageClient creates a client of the GCP storage service.
+// If STORAGE_EMULATOR_HOST is set, all requests are sent to the emulator (the storage library
+// itself redirects only the object reads).
+func newStorageClient(ctx context.Context) (*storage.Client, error) {
+	host := os.Getenv("STORAGE_EMULATOR_HOST")
+	if host == "" {
+		return storage.NewClient(ctx)
+	}
+
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return storage.NewClient(ctx, option.WithEndpoint(strings.TrimSuffix(host, "/")+"/storage/v1/"), option.WithoutAuthentication())
+}
@@ -14,6 +14,23 @@
 
 package lib
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// FormatRaw stores the message payload as the file content (default).
+	FormatRaw = "raw"
+	// FormatEnvelope stores the message payload together with its metadata as a JSON envelope.
+	FormatEnvelope = "envelope"
+	// FormatAvro stores batches of messages as Avro object container files.
+	FormatAvro = "avro"
+	// FormatParquet stores batches of messages as Parquet files.
+	FormatParquet = "parquet"
+)
+
 // StorageInfo represents storage configuration.
 // It holds information needed for storing messages to GCS.
 type StorageInfo struct {
@@ -21,6 +38,9 @@ type StorageInfo struct {
 	BucketID  string // ID of a bucket in which messages will be stored
 	Prefix    string // prefix of a file name
 	Extension string // file extension (txt, json, yaml, etc.)
+	Format    string // format of a file content (raw, envelope or a batched format)
+
+	AttributesAsMetadata bool // whether the message attributes are stored as the object metadata in the raw format
 }
 
 // SetStorageInfo sets the parameters of a storage config.
@@ -43,5 +63,25 @@ func SetStorageInfo(storageInfo *StorageInfo) error {
 		return err
 	}
 
+	storageInfo.Format = getOptionalEnvVariable("MSG_FORMAT", FormatRaw)
+	if !validFormat(storageInfo.Format) {
+		return fmt.Errorf("Invalid message format '%s', expected one of %s", storageInfo.Format, strings.Join(formats(), ", "))
+	}
+
+	storageInfo.AttributesAsMetadata, err = strconv.ParseBool(getOptionalEnvVariable("MSG_ATTRIBUTES_AS_METADATA", "false"))
+	if err != nil {
+		return err
+	}
+
 	return err
 }
+
+// formats returns the names of the formats in which the messages can be stored.
+func formats() []string {
+	return append([]string{FormatRaw, FormatEnvelope}, batchFormats()...)
+}
+
+// validFormat reports whether the messages can be stored in the given format.
+func validFormat(format string) bool {
+	return format == FormatRaw || format == FormatEnvelope || IsBatchFormat(format)
+}
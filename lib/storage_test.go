@@ -0,0 +1,71 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPartitionHour(t *testing.T) {
+	kolkata := time.FixedZone("IST", 5*3600+1800)
+	kathmandu := time.FixedZone("NPT", 5*3600+2700)
+
+	tests := []struct {
+		name   string
+		time   time.Time
+		want   time.Time
+		folder string
+	}{
+		{
+			name:   "UTC",
+			time:   time.Date(2020, 10, 1, 12, 34, 56, 789, time.UTC),
+			want:   time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC),
+			folder: "2020/10/01/12",
+		},
+		{
+			name:   "half hour offset",
+			time:   time.Date(2020, 10, 1, 12, 10, 0, 0, kolkata),
+			want:   time.Date(2020, 10, 1, 12, 0, 0, 0, kolkata),
+			folder: "2020/10/01/12",
+		},
+		{
+			name:   "quarter hour offset",
+			time:   time.Date(2020, 10, 1, 0, 50, 0, 0, kathmandu),
+			want:   time.Date(2020, 10, 1, 0, 0, 0, 0, kathmandu),
+			folder: "2020/10/01/00",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := PartitionHour(test.time)
+			if !got.Equal(test.want) {
+				t.Errorf("PartitionHour() = %v, want %v", got, test.want)
+			}
+			if folder := PartitionFolder(got); folder != test.folder || folder != PartitionFolder(test.time) {
+				t.Errorf("PartitionFolder(PartitionHour()) = %s, want %s", folder, test.folder)
+			}
+		})
+	}
+}
+
+func TestFileName(t *testing.T) {
+	info := StorageInfo{MessageID: "123", Prefix: "msg", Extension: "json"}
+	got := fileName(info, time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("IST", 5*3600+1800)))
+	if want := "2020/01/02/03/msg-123.json"; got != want {
+		t.Errorf("fileName() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/syntio/aquarium-persistor-gcp/lib/avro"
+	"google.golang.org/api/iterator"
+)
+
+// ErrUnsupportedBatch is the cause of the errors returned by StoredReader for the batch files it cannot read back as messages:
+// Parquet files, and Avro files written with a configured schema, whose records are the payloads without the message IDs.
+var ErrUnsupportedBatch = errors.New("batch file cannot be read as messages")
+
+// StoredReader reads the messages stored by the persistor back from a bucket.
+// It supports objects holding a single message (in the raw or envelope format), batch files written by Compact and
+// Avro files of message envelopes (see AvroEnvelopeSchema). The other batched formats are refused with ErrUnsupportedBatch.
+// The objects can be read concurrently.
+type StoredReader struct {
+	client    *storage.Client
+	bucket    *storage.BucketHandle
+	format    string                         // format of the stored messages (FormatRaw or FormatEnvelope)
+	manifests map[string]*CompactionManifest // compaction manifests mapped by their partition
+	mtx       sync.Mutex                     // guards the manifests, so the objects can be read concurrently
+}
+
+// NewStoredReader creates a reader of the messages stored in the given bucket in the given format.
+// An error is returned if any errors occur during the function execution.
+func NewStoredReader(ctx context.Context, bucketID string, format string) (*StoredReader, error) {
+	if format != FormatRaw && format != FormatEnvelope {
+		return nil, fmt.Errorf("Unknown message format '%s'", format)
+	}
+
+	client, err := newStorageClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StoredReader{
+		client:    client,
+		bucket:    client.Bucket(bucketID),
+		format:    format,
+		manifests: make(map[string]*CompactionManifest),
+	}, nil
+}
+
+// Close closes the storage client of the reader.
+func (reader *StoredReader) Close() error {
+	return reader.client.Close()
+}
+
+// ListObjects lists the objects of the hourly partition of the given time, in the order of their names.
+// Only the objects whose name starts with the prefix (the file prefix of the storage configuration) and
+// the batch files are listed, while the markers and manifests are skipped.
+// An error is returned if any errors occur during the function execution.
+func (reader *StoredReader) ListObjects(ctx context.Context, partitionTime time.Time, prefix string) ([]*storage.ObjectAttrs, error) {
+	return reader.ListPrefix(ctx, PartitionFolder(partitionTime)+"/"+prefix)
+}
+
+// ListPrefix lists the objects whose name starts with the given prefix, in the order of their names.
+// The batch files in the folders under the prefix are listed as well, regardless of the file prefix,
+// while the markers and manifests are skipped. As in the partition manifests, the batch files of a compaction whose
+// original objects are not deleted yet are skipped as well, so each message is read once.
+// An error is returned if any errors occur during the function execution.
+func (reader *StoredReader) ListPrefix(ctx context.Context, objectPrefix string) ([]*storage.ObjectAttrs, error) {
+	folder, prefix := path.Split(objectPrefix)
+
+	var objects []*storage.ObjectAttrs
+	it := reader.bucket.Objects(ctx, &storage.Query{Prefix: folder})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if isInternalObject(folder, attrs.Name) {
+			continue
+		}
+		if attrs.Metadata["batchFormat"] == "" && !strings.HasPrefix(strings.TrimPrefix(attrs.Name, folder), prefix) {
+			continue
+		}
+		duplicate, err := reader.isDuplicateBatch(ctx, attrs)
+		if err != nil {
+			return nil, err
+		}
+		if duplicate {
+			continue
+		}
+		objects = append(objects, attrs)
+	}
+
+	return objects, nil
+}
+
+// ReadObject reads the messages stored in an object and calls fn for each of them, with the index of the message
+// within the object. The first skip messages are not passed to fn, which is used for resuming a partially read batch.
+// The attributes of messages stored in the raw format are restored from the object metadata, or for batch files
+// from the compaction manifest. The message IDs are restored from the object names, and the publish time and
+// ordering key are restored only from the envelopes. The messages of Avro files are restored from their envelope records.
+// An error is returned if any errors occur during the function execution or if fn returns an error.
+func (reader *StoredReader) ReadObject(ctx context.Context, attrs *storage.ObjectAttrs, skip int, fn func(index int, msg Message) error) error {
+	batchFormat := attrs.Metadata["batchFormat"]
+	if batchFormat == FormatParquet {
+		return fmt.Errorf("Object '%s' is a %s file. %w", attrs.Name, batchFormat, ErrUnsupportedBatch)
+	}
+
+	objectReader, err := reader.bucket.Object(attrs.Name).Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer objectReader.Close()
+
+	switch batchFormat {
+	case FormatAvro:
+		return readAvroMessages(objectReader, attrs.Name, skip, fn)
+	case "":
+		if skip > 0 {
+			return nil
+		}
+		data, err := ioutil.ReadAll(objectReader)
+		if err != nil {
+			return err
+		}
+		msg, err := reader.message(data, attrs.Name, attrs.Metadata)
+		if err != nil {
+			return err
+		}
+		return fn(0, msg)
+	}
+
+	sources, err := reader.batchSources(ctx, attrs)
+	if err != nil {
+		return err
+	}
+
+	records, err := NewBatchReader(objectReader, batchFormat)
+	if err != nil {
+		return err
+	}
+
+	for index := 0; ; index++ {
+		record, err := records.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if index < skip {
+			continue
+		}
+
+		// Without the compaction manifest, the message ID is replaced by the position of the record in the batch.
+		source := CompactionSource{Name: fmt.Sprintf("%s-%d", strings.TrimSuffix(attrs.Name, path.Ext(attrs.Name)), index)}
+		if index < len(sources) {
+			source = sources[index]
+		}
+
+		msg, err := reader.message(record, source.Name, source.Metadata)
+		if err != nil {
+			return err
+		}
+		err = fn(index, msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// message decodes a stored message from the content and metadata of the object in which it was stored.
+func (reader *StoredReader) message(data []byte, objectName string, metadata map[string]string) (Message, error) {
+	if reader.format == FormatEnvelope {
+		envelope := Envelope{}
+		err := json.Unmarshal(data, &envelope)
+		if err != nil {
+			return Message{}, fmt.Errorf("Object '%s' does not contain a message envelope. %s", objectName, err)
+		}
+		return envelope.Message(), nil
+	}
+
+	return Message{
+		ID:         messageIDFromName(objectName),
+		Data:       data,
+		Attributes: metadata,
+	}, nil
+}
+
+// readAvroMessages reads the messages of an Avro file of message envelopes, as described for ReadObject.
+// An error wrapping ErrUnsupportedBatch is returned if the records of the file are not envelopes.
+func readAvroMessages(r io.Reader, objectName string, skip int, fn func(index int, msg Message) error) error {
+	records, err := avro.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Error during reading Avro file '%s'. %s", objectName, err)
+	}
+	if records.Schema().Name != avroEnvelopeSchema.Name {
+		return fmt.Errorf("Avro file '%s' has records of schema '%s' instead of message envelopes. %w", objectName, records.Schema().Name, ErrUnsupportedBatch)
+	}
+
+	for index := 0; ; index++ {
+		record, err := records.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error during reading Avro file '%s'. %s", objectName, err)
+		}
+		if index < skip {
+			continue
+		}
+
+		err = fn(index, avroEnvelopeMessage(record.(map[string]interface{})))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// avroEnvelopeMessage converts a record of AvroEnvelopeSchema to the message it holds.
+func avroEnvelopeMessage(record map[string]interface{}) Message {
+	var msg Message
+	msg.ID, _ = record["id"].(string)
+	msg.Data, _ = record["payload"].([]byte)
+	if publishTime, _ := record["publishTime"].(int64); publishTime != 0 {
+		msg.PublishTime = time.Unix(0, publishTime*1000).UTC()
+	}
+	if attributes, _ := record["attributes"].(map[string]interface{}); len(attributes) > 0 {
+		msg.Attributes = make(map[string]string, len(attributes))
+		for key, value := range attributes {
+			msg.Attributes[key], _ = value.(string)
+		}
+	}
+	return msg
+}
+
+// batchSources returns the original objects of a batch file, as listed in the compaction manifest of its partition.
+// If the manifest does not exist, the result is empty.
+func (reader *StoredReader) batchSources(ctx context.Context, attrs *storage.ObjectAttrs) ([]CompactionSource, error) {
+	batch, err := reader.compactionBatch(ctx, attrs)
+	if err != nil || batch == nil {
+		return nil, err
+	}
+	return batch.Sources, nil
+}
+
+// isDuplicateBatch reports whether the object is a batch file of a compaction whose original objects are not deleted yet,
+// so its messages are also stored in the original objects.
+func (reader *StoredReader) isDuplicateBatch(ctx context.Context, attrs *storage.ObjectAttrs) (bool, error) {
+	if attrs.Metadata["compactedPartition"] == "" {
+		return false, nil
+	}
+	batch, err := reader.compactionBatch(ctx, attrs)
+	if err != nil || batch == nil {
+		return false, err
+	}
+	return batch.Status != BatchDeleted, nil
+}
+
+// compactionBatch returns the batch of a compacted object, as listed in the compaction manifest of its partition.
+// The manifests are read once per reader. If the manifest does not exist or it does not list the object, the result is nil.
+func (reader *StoredReader) compactionBatch(ctx context.Context, attrs *storage.ObjectAttrs) (*CompactionBatch, error) {
+	partition := attrs.Metadata["compactedPartition"]
+
+	reader.mtx.Lock()
+	defer reader.mtx.Unlock()
+
+	manifest, ok := reader.manifests[partition]
+	if !ok {
+		var err error
+		manifest, err = readCompactionManifest(ctx, reader.bucket, partition)
+		if err != nil {
+			return nil, err
+		}
+		reader.manifests[partition] = manifest
+	}
+	if manifest == nil {
+		return nil, nil
+	}
+
+	for i := range manifest.Batches {
+		if manifest.Batches[i].Name == attrs.Name {
+			return &manifest.Batches[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// messageIDFromName extracts the message ID from the name of an object written by PersistMessage.
+// The name consists of the partition folder, file prefix, message ID and extension.
+func messageIDFromName(objectName string) string {
+	name := path.Base(objectName)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Transform processes a message after it is received and before it is stored.
+// The function returns the messages which are stored instead of the received one: the message itself (possibly
+// modified), no messages if it is dropped, or several messages if it is split. A transform must not modify the
+// passed in message (e.g. its attributes map), since the original message is quarantined if the transform fails.
+// Errors marked with Permanent cause the message to be quarantined, while other errors cause it to be redelivered.
+type Transform interface {
+	Apply(ctx context.Context, msg Message) ([]Message, error)
+}
+
+// TransformFunc is an adapter which allows using an ordinary function as a Transform.
+type TransformFunc func(ctx context.Context, msg Message) ([]Message, error)
+
+// Apply calls the function.
+func (f TransformFunc) Apply(ctx context.Context, msg Message) ([]Message, error) {
+	return f(ctx, msg)
+}
+
+// Pipeline is a chain of transforms, applied in order. Each message returned by a transform is passed to the next one.
+type Pipeline []Transform
+
+// Apply applies the transforms of the pipeline to the message and returns the messages which should be stored.
+func (pipeline Pipeline) Apply(ctx context.Context, msg Message) ([]Message, error) {
+	msgs := []Message{msg}
+	for _, transform := range pipeline {
+		var next []Message
+		for _, current := range msgs {
+			out, err := transform.Apply(ctx, current)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		msgs = next
+	}
+	return msgs, nil
+}
+
+// TransformFactory creates a transform from its settings, as given in the transform configuration.
+// An error is returned if the settings are not valid.
+type TransformFactory func(settings json.RawMessage) (Transform, error)
+
+// transformFactories holds the registered transform types, mapped by their names.
+var (
+	transformFactories    = make(map[string]TransformFactory)
+	transformFactoriesMtx sync.RWMutex
+)
+
+// RegisterTransform registers a transform type under the given name, so it can be used in the transform configuration.
+// Registering a name twice replaces the previous factory. The built-in transforms are registered in the init function.
+func RegisterTransform(name string, factory TransformFactory) {
+	transformFactoriesMtx.Lock()
+	defer transformFactoriesMtx.Unlock()
+
+	transformFactories[name] = factory
+}
+
+// TransformTypes returns the names of the registered transform types, sorted alphabetically.
+func TransformTypes() []string {
+	transformFactoriesMtx.RLock()
+	defer transformFactoriesMtx.RUnlock()
+
+	var names []string
+	for name := range transformFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TransformStage is a single stage of the transform configuration.
+type TransformStage struct {
+	Type     string          `json:"type"`     // name of a registered transform type
+	Settings json.RawMessage `json:"settings"` // settings passed to the factory of the transform type
+}
+
+// ParsePipeline creates a pipeline from the transform configuration, which is a JSON array of stages, e.g.
+//
+//	[{"type": "decompress"}, {"type": "project", "settings": {"fields": ["id", "user.name"]}}]
+//
+// An error is returned if the configuration is not valid or it uses an unknown transform type.
+func ParsePipeline(data []byte) (Pipeline, error) {
+	var stages []TransformStage
+	err := json.Unmarshal(data, &stages)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid transform configuration. %s", err)
+	}
+
+	pipeline := make(Pipeline, 0, len(stages))
+	for i, stage := range stages {
+		transformFactoriesMtx.RLock()
+		factory, ok := transformFactories[stage.Type]
+		transformFactoriesMtx.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("Unknown transform type '%s' in stage %d", stage.Type, i)
+		}
+
+		transform, err := factory(stage.Settings)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid settings of the %s transform in stage %d. %s", stage.Type, i, err)
+		}
+		pipeline = append(pipeline, transform)
+	}
+
+	return pipeline, nil
+}
+
+// pipelines caches the pipelines created from the transform configurations, so a configuration is loaded
+// once per instance instead of once per message.
+var (
+	pipelines    = make(map[string]Pipeline)
+	pipelinesMtx sync.Mutex
+)
+
+// LoadPipeline returns the pipeline of the given transform configuration source (a local path or gs://bucket/object),
+// loading and parsing the configuration if it is not cached yet.
+// A ConfigSourceError is returned if the configuration cannot be read, and a permanent error if it is not valid.
+func LoadPipeline(ctx context.Context, source string) (Pipeline, error) {
+	pipelinesMtx.Lock()
+	defer pipelinesMtx.Unlock()
+
+	if pipeline, ok := pipelines[source]; ok {
+		return pipeline, nil
+	}
+
+	data, err := ReadConfigSource(ctx, source)
+	if err != nil {
+		return nil, &ConfigSourceError{Source: source, Err: err}
+	}
+
+	pipeline, err := ParsePipeline(data)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+
+	pipelines[source] = pipeline
+	return pipeline, nil
+}
+
+// decodeSettings decodes the settings of a transform into the given value. Missing settings leave the value unchanged,
+// while unknown fields are reported, so a typo in the configuration is not silently ignored.
+func decodeSettings(settings json.RawMessage, value interface{}) error {
+	if len(settings) == 0 || string(settings) == "null" {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(settings))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(value)
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import "context"
+
+// TransformInfo represents transform pipeline configuration.
+// It holds information needed for transforming messages after they are received and before they are stored.
+// The transforms are optional and they are disabled if the configuration is not set.
+type TransformInfo struct {
+	Config string // transform configuration source, a local path or gs://bucket/object (empty value disables the transforms)
+
+	pipeline Pipeline // loaded pipeline
+}
+
+// SetTransformInfo sets the parameters of a transform configuration by extracting values from the corresponding environment variables.
+// If TRANSFORM_CONFIG is not set, the transforms are disabled.
+// An error is returned if any errors occur during the function execution.
+func SetTransformInfo(transformInfo *TransformInfo) error {
+	transformInfo.Config = getOptionalEnvVariable("TRANSFORM_CONFIG", "")
+
+	return nil
+}
+
+// Enabled reports whether the transforms are configured.
+func (transformInfo TransformInfo) Enabled() bool {
+	return transformInfo.Config != ""
+}
+
+// Pipeline returns the pipeline of the configuration, loading it first if the configuration was not set by SetPersistConf.
+// An error is returned if the pipeline cannot be loaded.
+func (transformInfo TransformInfo) Pipeline(ctx context.Context) (Pipeline, error) {
+	if transformInfo.pipeline != nil {
+		return transformInfo.pipeline, nil
+	}
+	return LoadPipeline(ctx, transformInfo.Config)
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Names of the built-in transform types.
+const (
+	TransformEnrich     = "enrich"
+	TransformProject    = "project"
+	TransformDecompress = "decompress"
+)
+
+func init() {
+	RegisterTransform(TransformEnrich, newEnrichTransform)
+	RegisterTransform(TransformProject, newProjectTransform)
+	RegisterTransform(TransformDecompress, newDecompressTransform)
+}
+
+// EnrichSettings are the settings of the enrich transform, which adds attributes (headers) to a message.
+type EnrichSettings struct {
+	Attributes  map[string]string `json:"attributes"`  // static attributes added to each message
+	MessageID   string            `json:"messageId"`   // name of the attribute set to the message ID (not set if empty)
+	PublishTime string            `json:"publishTime"` // name of the attribute set to the publish time (not set if empty)
+	ReceiveTime string            `json:"receiveTime"` // name of the attribute set to the time at which the message was processed (not set if empty)
+	Overwrite   bool              `json:"overwrite"`   // whether the attributes which the message already has are overwritten
+}
+
+// newEnrichTransform creates the enrich transform.
+func newEnrichTransform(settings json.RawMessage) (Transform, error) {
+	var enrich EnrichSettings
+	err := decodeSettings(settings, &enrich)
+	if err != nil {
+		return nil, err
+	}
+
+	return TransformFunc(func(ctx context.Context, msg Message) ([]Message, error) {
+		attributes := make(map[string]string, len(msg.Attributes)+len(enrich.Attributes)+3)
+		for key, value := range msg.Attributes {
+			attributes[key] = value
+		}
+
+		set := func(key string, value string) {
+			if _, exists := attributes[key]; key != "" && (enrich.Overwrite || !exists) {
+				attributes[key] = value
+			}
+		}
+		for key, value := range enrich.Attributes {
+			set(key, value)
+		}
+		set(enrich.MessageID, msg.ID)
+		if !msg.PublishTime.IsZero() {
+			set(enrich.PublishTime, msg.PublishTime.UTC().Format(time.RFC3339Nano))
+		}
+		set(enrich.ReceiveTime, time.Now().UTC().Format(time.RFC3339Nano))
+
+		msg.Attributes = attributes
+		return []Message{msg}, nil
+	}), nil
+}
+
+// ProjectSettings are the settings of the project transform, which keeps only the given fields of a JSON object payload.
+type ProjectSettings struct {
+	Fields []string `json:"fields"` // kept fields, nested fields are given as dot separated paths (e.g. user.name)
+}
+
+// newProjectTransform creates the project transform. The kept fields keep their position in the object hierarchy,
+// and fields which the payload does not have are skipped. A payload which is not a JSON object is a permanent error.
+func newProjectTransform(settings json.RawMessage) (Transform, error) {
+	var project ProjectSettings
+	err := decodeSettings(settings, &project)
+	if err != nil {
+		return nil, err
+	}
+	if len(project.Fields) == 0 {
+		return nil, fmt.Errorf("No fields are given")
+	}
+
+	var paths [][]string
+	for _, field := range project.Fields {
+		paths = append(paths, strings.Split(field, "."))
+	}
+
+	return TransformFunc(func(ctx context.Context, msg Message) ([]Message, error) {
+		var source map[string]json.RawMessage
+		err := json.Unmarshal(msg.Data, &source)
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("Payload is not a JSON object. %s", err))
+		}
+
+		projected := make(map[string]interface{})
+		for _, path := range paths {
+			copyField(source, projected, path)
+		}
+
+		msg.Data, err = json.Marshal(projected)
+		if err != nil {
+			return nil, err
+		}
+		return []Message{msg}, nil
+	}), nil
+}
+
+// copyField copies the field at the given path from the source object to the projected object.
+// If a parent of the field is already copied as a whole, the field is already included and nothing is done.
+func copyField(source map[string]json.RawMessage, projected map[string]interface{}, path []string) {
+	value, ok := source[path[0]]
+	if !ok {
+		return
+	}
+
+	if len(path) == 1 {
+		projected[path[0]] = value
+		return
+	}
+
+	var nested map[string]json.RawMessage
+	if err := json.Unmarshal(value, &nested); err != nil {
+		return
+	}
+
+	child, ok := projected[path[0]].(map[string]interface{})
+	if !ok {
+		if _, copied := projected[path[0]]; copied {
+			return
+		}
+		child = make(map[string]interface{})
+		projected[path[0]] = child
+	}
+	copyField(nested, child, path[1:])
+}
+
+// Encodings supported by the decompress transform.
+const (
+	EncodingAuto = "auto" // detect the encoding from the payload, and leave payloads which are not compressed unchanged
+	EncodingGzip = "gzip"
+	EncodingZlib = "zlib"
+)
+
+// defaultMaxDecompressedSize is the default limit of a decompressed payload, which protects against decompression bombs.
+const defaultMaxDecompressedSize = 64 << 20
+
+// DecompressSettings are the settings of the decompress transform.
+type DecompressSettings struct {
+	Encoding  string `json:"encoding"`  // encoding of the payload (auto, gzip or zlib), auto by default
+	Attribute string `json:"attribute"` // attribute which holds the encoding (e.g. content-encoding), it overrides the encoding setting and it is removed after decompression
+	MaxSize   int64  `json:"maxSize"`   // maximum size of a decompressed payload in bytes
+}
+
+// newDecompressTransform creates the decompress transform. Payloads which cannot be decompressed in the gzip or zlib
+// encoding, or whose decompressed size exceeds the limit, are permanent errors. In the auto encoding, a payload which
+// looks compressed but cannot be decompressed (e.g. a text which happens to start like a zlib header) is left unchanged.
+func newDecompressTransform(settings json.RawMessage) (Transform, error) {
+	decompress := DecompressSettings{Encoding: EncodingAuto, MaxSize: defaultMaxDecompressedSize}
+	err := decodeSettings(settings, &decompress)
+	if err != nil {
+		return nil, err
+	}
+	if !isKnownEncoding(decompress.Encoding) {
+		return nil, fmt.Errorf("Unknown encoding '%s'", decompress.Encoding)
+	}
+
+	return TransformFunc(func(ctx context.Context, msg Message) ([]Message, error) {
+		encoding := decompress.Encoding
+		if value, ok := msg.Attributes[decompress.Attribute]; decompress.Attribute != "" && ok {
+			if !isKnownEncoding(value) && value != "identity" {
+				return nil, Permanent(fmt.Errorf("Unknown encoding '%s' in the %s attribute", value, decompress.Attribute))
+			}
+			encoding = value
+
+			attributes := make(map[string]string, len(msg.Attributes))
+			for key, value := range msg.Attributes {
+				if key != decompress.Attribute {
+					attributes[key] = value
+				}
+			}
+			msg.Attributes = attributes
+		}
+		detected := encoding == EncodingAuto
+		if detected {
+			encoding = detectEncoding(msg.Data)
+		}
+
+		var reader io.ReadCloser
+		switch encoding {
+		case EncodingGzip:
+			reader, err = gzip.NewReader(bytes.NewReader(msg.Data))
+		case EncodingZlib:
+			reader, err = zlib.NewReader(bytes.NewReader(msg.Data))
+		default:
+			return []Message{msg}, nil
+		}
+		if err != nil && detected {
+			return []Message{msg}, nil
+		}
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("Payload cannot be decompressed (%s). %s", encoding, err))
+		}
+		defer reader.Close()
+
+		data, err := ioutil.ReadAll(io.LimitReader(reader, decompress.MaxSize+1))
+		if err != nil && detected {
+			return []Message{msg}, nil
+		}
+		if err != nil {
+			return nil, Permanent(fmt.Errorf("Payload cannot be decompressed (%s). %s", encoding, err))
+		}
+		if int64(len(data)) > decompress.MaxSize {
+			return nil, Permanent(fmt.Errorf("Decompressed payload exceeds %d bytes", decompress.MaxSize))
+		}
+
+		msg.Data = data
+		return []Message{msg}, nil
+	}), nil
+}
+
+// isKnownEncoding reports whether the decompress transform supports the encoding.
+func isKnownEncoding(encoding string) bool {
+	return encoding == EncodingAuto || encoding == EncodingGzip || encoding == EncodingZlib
+}
+
+// detectEncoding detects the encoding of a payload by its header, and returns an empty string if it is not compressed.
+func detectEncoding(data []byte) string {
+	if len(data) < 2 {
+		return ""
+	}
+	if data[0] == 0x1f && data[1] == 0x8b {
+		return EncodingGzip
+	}
+	// A zlib header uses the deflate method (8) with a window of at most 32 KiB, no preset dictionary,
+	// and its two bytes are a multiple of 31.
+	if data[0]&0x0f == 8 && data[0]>>4 <= 7 && data[1]&0x20 == 0 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0 {
+		return EncodingZlib
+	}
+	return ""
+}
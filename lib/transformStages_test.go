@@ -0,0 +1,278 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib_test
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+	"github.com/syntio/aquarium-persistor-gcp/lib/transformtest"
+)
+
+func TestEnrichTransform(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		msg    lib.Message
+		want   lib.Message
+	}{
+		{
+			name:   "static attributes",
+			config: `[{"type": "enrich", "settings": {"attributes": {"source": "web", "team": "data"}}}]`,
+			msg:    transformtest.Message("{}", "type", "click"),
+			want:   transformtest.Message("{}", "type", "click", "source", "web", "team", "data"),
+		},
+		{
+			name:   "existing attributes are kept",
+			config: `[{"type": "enrich", "settings": {"attributes": {"source": "web"}}}]`,
+			msg:    transformtest.Message("{}", "source", "app"),
+			want:   transformtest.Message("{}", "source", "app"),
+		},
+		{
+			name:   "existing attributes are overwritten",
+			config: `[{"type": "enrich", "settings": {"attributes": {"source": "web"}, "overwrite": true}}]`,
+			msg:    transformtest.Message("{}", "source", "app"),
+			want:   transformtest.Message("{}", "source", "web"),
+		},
+		{
+			name:   "message fields",
+			config: `[{"type": "enrich", "settings": {"messageId": "id", "publishTime": "published"}}]`,
+			msg:    transformtest.Message("{}"),
+			want:   transformtest.Message("{}", "id", "test-message", "published", "2020-01-01T00:00:00Z"),
+		},
+		{
+			name:   "no settings",
+			config: `[{"type": "enrich"}]`,
+			msg:    transformtest.Message("{}", "type", "click"),
+			want:   transformtest.Message("{}", "type", "click"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipeline := transformtest.Pipeline(t, test.config)
+			transformtest.Equal(t, transformtest.Apply(t, pipeline, test.msg), []lib.Message{test.want})
+		})
+	}
+}
+
+func TestEnrichTransformReceiveTime(t *testing.T) {
+	pipeline := transformtest.Pipeline(t, `[{"type": "enrich", "settings": {"receiveTime": "received"}}]`)
+
+	before := time.Now().UTC()
+	msgs := transformtest.Apply(t, pipeline, transformtest.Message("{}"))
+	received, err := time.Parse(time.RFC3339Nano, msgs[0].Attributes["received"])
+	if err != nil {
+		t.Fatalf("Invalid receive time. %s", err)
+	}
+	if received.Before(before) || received.After(time.Now()) {
+		t.Errorf("Receive time %v is not the time of the transform", received)
+	}
+}
+
+func TestProjectTransform(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+		data   string
+		want   string
+	}{
+		{"top level fields", `["id", "name"]`, `{"id": 1, "name": "a", "secret": "b"}`, `{"id":1,"name":"a"}`},
+		{"nested fields", `["id", "user.name"]`, `{"id": 1, "user": {"name": "a", "email": "b"}}`, `{"id":1,"user":{"name":"a"}}`},
+		{"several nested fields", `["user.name", "user.age"]`, `{"user": {"name": "a", "email": "b", "age": 3}}`, `{"user":{"age":3,"name":"a"}}`},
+		{"parent and child", `["user", "user.name"]`, `{"user": {"name": "a", "email": "b"}}`, `{"user":{"name":"a","email":"b"}}`},
+		{"missing fields", `["id", "user.name", "other"]`, `{"id": 1}`, `{"id":1}`},
+		{"nested field of a scalar", `["id.value"]`, `{"id": 1}`, `{}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipeline := transformtest.Pipeline(t, `[{"type": "project", "settings": {"fields": `+test.fields+`}}]`)
+			got := transformtest.Apply(t, pipeline, transformtest.Message(test.data, "type", "click"))
+			transformtest.Equal(t, got, []lib.Message{transformtest.Message(test.want, "type", "click")})
+		})
+	}
+}
+
+func TestProjectTransformErrors(t *testing.T) {
+	for _, config := range []string{
+		`[{"type": "project"}]`,
+		`[{"type": "project", "settings": {"fields": []}}]`,
+		`[{"type": "project", "settings": {"field": ["id"]}}]`,
+	} {
+		if _, err := lib.ParsePipeline([]byte(config)); err == nil {
+			t.Errorf("ParsePipeline(%s) succeeded, but an error was expected", config)
+		}
+	}
+
+	pipeline := transformtest.Pipeline(t, `[{"type": "project", "settings": {"fields": ["id"]}}]`)
+	for _, data := range []string{`not json`, `[1, 2]`, `"text"`} {
+		err := transformtest.ApplyError(t, pipeline, transformtest.Message(data))
+		if lib.IsRetryable(err) {
+			t.Errorf("Projecting %q failed with a retryable error: %s", data, err)
+		}
+	}
+}
+
+func TestDecompressTransform(t *testing.T) {
+	payload := `{"id": 1, "text": "Hjelp meg"}`
+	gzipped := string(transformtest.Gzip(t, payload))
+	zlibbed := string(transformtest.Zlib(t, payload))
+
+	tests := []struct {
+		name     string
+		settings string
+		msg      lib.Message
+		want     lib.Message
+	}{
+		{"auto gzip", `{}`, transformtest.Message(gzipped), transformtest.Message(payload)},
+		{"auto zlib", `{}`, transformtest.Message(zlibbed), transformtest.Message(payload)},
+		{"auto plain text", `{}`, transformtest.Message("Hjelp meg"), transformtest.Message("Hjelp meg")},
+		{"auto text with a zlib header", `{}`, transformtest.Message("x^ is not compressed"), transformtest.Message("x^ is not compressed")},
+		{"auto truncated gzip", `{}`, transformtest.Message(gzipped[:12]), transformtest.Message(gzipped[:12])},
+		{"auto empty payload", `{}`, transformtest.Message(""), transformtest.Message("")},
+		{"gzip", `{"encoding": "gzip"}`, transformtest.Message(gzipped), transformtest.Message(payload)},
+		{"zlib", `{"encoding": "zlib"}`, transformtest.Message(zlibbed), transformtest.Message(payload)},
+		{
+			"attribute",
+			`{"encoding": "zlib", "attribute": "content-encoding"}`,
+			transformtest.Message(gzipped, "content-encoding", "gzip", "type", "click"),
+			transformtest.Message(payload, "type", "click"),
+		},
+		{
+			"identity attribute",
+			`{"attribute": "content-encoding"}`,
+			transformtest.Message(payload, "content-encoding", "identity"),
+			transformtest.Message(payload),
+		},
+		{
+			"missing attribute",
+			`{"attribute": "content-encoding"}`,
+			transformtest.Message(gzipped, "type", "click"),
+			transformtest.Message(payload, "type", "click"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipeline := transformtest.Pipeline(t, `[{"type": "decompress", "settings": `+test.settings+`}]`)
+			transformtest.Equal(t, transformtest.Apply(t, pipeline, test.msg), []lib.Message{test.want})
+		})
+	}
+}
+
+func TestDecompressTransformErrors(t *testing.T) {
+	gzipped := string(transformtest.Gzip(t, strings.Repeat("a", 100)))
+
+	tests := []struct {
+		name     string
+		settings string
+		msg      lib.Message
+	}{
+		{"gzip plain text", `{"encoding": "gzip"}`, transformtest.Message("Hjelp meg")},
+		{"zlib plain text", `{"encoding": "zlib"}`, transformtest.Message("Hjelp meg")},
+		{"zlib text with a zlib header", `{"encoding": "zlib"}`, transformtest.Message("x^ is not compressed")},
+		{"truncated gzip", `{"encoding": "gzip"}`, transformtest.Message(gzipped[:12])},
+		{"unknown attribute value", `{"attribute": "content-encoding"}`, transformtest.Message(gzipped, "content-encoding", "br")},
+		{"size limit", `{"maxSize": 99}`, transformtest.Message(gzipped)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipeline := transformtest.Pipeline(t, `[{"type": "decompress", "settings": `+test.settings+`}]`)
+			err := transformtest.ApplyError(t, pipeline, test.msg)
+			if lib.IsRetryable(err) {
+				t.Errorf("Decompression failed with a retryable error: %s", err)
+			}
+		})
+	}
+
+	if _, err := lib.ParsePipeline([]byte(`[{"type": "decompress", "settings": {"encoding": "br"}}]`)); err == nil {
+		t.Errorf("ParsePipeline() with an unknown encoding succeeded, but an error was expected")
+	}
+}
+
+// splitLines is a transform which splits a message into one message per line, dropping the empty lines.
+func splitLines(ctx context.Context, msg lib.Message) ([]lib.Message, error) {
+	var msgs []lib.Message
+	for _, line := range strings.Split(string(msg.Data), "\n") {
+		if line == "" {
+			continue
+		}
+		split := msg
+		split.Data = []byte(line)
+		msgs = append(msgs, split)
+	}
+	return msgs, nil
+}
+
+func TestPipelineSplitAndDrop(t *testing.T) {
+	recorder := &transformtest.Recorder{}
+	lib.RegisterTransform("test-split", func(settings json.RawMessage) (lib.Transform, error) {
+		return lib.TransformFunc(splitLines), nil
+	})
+	lib.RegisterTransform("test-record", func(settings json.RawMessage) (lib.Transform, error) {
+		return recorder, nil
+	})
+
+	pipeline := transformtest.Pipeline(t, `[
+		{"type": "test-split"},
+		{"type": "test-record"},
+		{"type": "enrich", "settings": {"attributes": {"split": "true"}}}
+	]`)
+
+	tests := []struct {
+		name string
+		data string
+		want []lib.Message
+	}{
+		{
+			name: "split",
+			data: "a\nb\n\nc",
+			want: []lib.Message{
+				transformtest.Message("a", "split", "true"),
+				transformtest.Message("b", "split", "true"),
+				transformtest.Message("c", "split", "true"),
+			},
+		},
+		{
+			name: "single line",
+			data: "a",
+			want: []lib.Message{transformtest.Message("a", "split", "true")},
+		},
+		{
+			name: "drop",
+			data: "\n\n",
+			want: []lib.Message{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder.Messages = nil
+			got := transformtest.Apply(t, pipeline, transformtest.Message(test.data))
+			transformtest.Equal(t, got, test.want)
+
+			// The later stages get the split messages, and nothing is passed on for a dropped message.
+			if len(recorder.Messages) != len(test.want) {
+				t.Errorf("Recorder got %d messages, want %d", len(recorder.Messages), len(test.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSetPersistConfLoadsPipeline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setStorageEnv("")()
+
+	valid := writeTempFile(t, dir, "valid.json", `[{"type": "enrich", "settings": {"attributes": {"source": "test"}}}]`)
+	restore := setEnv("TRANSFORM_CONFIG", valid)
+	var conf PersistConf
+	err = SetPersistConf(&conf)
+	restore()
+	if err != nil {
+		t.Fatalf("SetPersistConf() error = %v", err)
+	}
+	if len(conf.Transform.pipeline) != 1 {
+		t.Errorf("SetPersistConf() did not load the pipeline")
+	}
+
+	for _, config := range []string{`[{"type": "unknown"}]`, `{"type": "enrich"}`, `[{"type": "project", "settings": {"field": "id"}}]`} {
+		restore = setEnv("TRANSFORM_CONFIG", writeTempFile(t, dir, "invalid.json", config))
+		err = SetPersistConf(&PersistConf{})
+		restore()
+		if err == nil || IsRetryable(err) {
+			t.Errorf("SetPersistConf() with transform configuration %s error = %v, want a permanent error", config, err)
+		}
+	}
+
+	restore = setEnv("TRANSFORM_CONFIG", path.Join(dir, "missing.json"))
+	err = SetPersistConf(&PersistConf{})
+	restore()
+	var sourceErr *ConfigSourceError
+	if !errors.As(err, &sourceErr) {
+		t.Errorf("SetPersistConf() with a missing transform configuration error = %v, want a ConfigSourceError", err)
+	}
+}
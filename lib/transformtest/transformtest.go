@@ -0,0 +1,166 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package transformtest provides helpers for unit testing transforms and transform configurations.
+package transformtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// Message creates a message with the given payload and attributes, given as key-value pairs (e.g. "source", "web").
+// The message has a fixed ID and publish time, so the results of transforms using them are predictable.
+func Message(data string, attributes ...string) lib.Message {
+	msg := lib.Message{
+		ID:          "test-message",
+		Data:        []byte(data),
+		Attributes:  make(map[string]string),
+		PublishTime: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		msg.Attributes[attributes[i]] = attributes[i+1]
+	}
+	return msg
+}
+
+// Apply applies the transform to the message and returns the resulting messages, failing the test on an error.
+// The test also fails if the transform modifies the attributes of the passed in message.
+func Apply(t testing.TB, transform lib.Transform, msg lib.Message) []lib.Message {
+	t.Helper()
+
+	original := copyAttributes(msg.Attributes)
+	msgs, err := transform.Apply(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Transform failed. %s", err)
+	}
+	if !reflect.DeepEqual(original, msg.Attributes) {
+		t.Fatalf("Transform modified the attributes of the original message: %v, was %v", msg.Attributes, original)
+	}
+	return msgs
+}
+
+// ApplyError applies the transform to the message and returns its error, failing the test if the transform succeeds.
+func ApplyError(t testing.TB, transform lib.Transform, msg lib.Message) error {
+	t.Helper()
+
+	_, err := transform.Apply(context.Background(), msg)
+	if err == nil {
+		t.Fatalf("Transform succeeded, but an error was expected")
+	}
+	return err
+}
+
+// Pipeline parses a transform configuration, failing the test if it is not valid.
+func Pipeline(t testing.TB, config string) lib.Pipeline {
+	t.Helper()
+
+	pipeline, err := lib.ParsePipeline([]byte(config))
+	if err != nil {
+		t.Fatalf("Invalid transform configuration. %s", err)
+	}
+	return pipeline
+}
+
+// Equal fails the test if the messages differ in their IDs, payloads, attributes or ordering keys.
+// Payloads are compared as strings, so the failure message is readable.
+func Equal(t testing.TB, got []lib.Message, want []lib.Message) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("Got %d messages, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].ID != want[i].ID {
+			t.Errorf("Message %d: got ID '%s', want '%s'", i, got[i].ID, want[i].ID)
+		}
+		if string(got[i].Data) != string(want[i].Data) {
+			t.Errorf("Message %d: got payload %q, want %q", i, got[i].Data, want[i].Data)
+		}
+		if len(got[i].Attributes) != 0 || len(want[i].Attributes) != 0 {
+			if !reflect.DeepEqual(got[i].Attributes, want[i].Attributes) {
+				t.Errorf("Message %d: got attributes %v, want %v", i, got[i].Attributes, want[i].Attributes)
+			}
+		}
+		if got[i].OrderingKey != want[i].OrderingKey {
+			t.Errorf("Message %d: got ordering key '%s', want '%s'", i, got[i].OrderingKey, want[i].OrderingKey)
+		}
+	}
+}
+
+// Gzip compresses the data with gzip, failing the test on an error.
+func Gzip(t testing.TB, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Zlib compresses the data with zlib, failing the test on an error.
+func Zlib(t testing.TB, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Recorder is a transform which records the messages passed to it and passes them on unchanged.
+// It is used to check what a pipeline passes to its later stages.
+type Recorder struct {
+	mtx      sync.Mutex
+	Messages []lib.Message
+}
+
+// Apply records the message and returns it.
+func (recorder *Recorder) Apply(ctx context.Context, msg lib.Message) ([]lib.Message, error) {
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+
+	recorder.Messages = append(recorder.Messages, msg)
+	return []lib.Message{msg}, nil
+}
+
+// copyAttributes returns a copy of the attributes map.
+func copyAttributes(attributes map[string]string) map[string]string {
+	if attributes == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		copied[key] = value
+	}
+	return copied
+}
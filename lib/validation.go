@@ -0,0 +1,127 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ReasonInvalidSchema is the quarantine reason of messages whose payload does not match the JSON Schema.
+const ReasonInvalidSchema = "invalid-schema"
+
+// SchemaValidationError is returned by ValidatePayload if the payload does not match the schema.
+type SchemaValidationError struct {
+	Errors []string // validation errors, each with the location of the invalid value
+}
+
+func (err *SchemaValidationError) Error() string {
+	return "Payload does not match the schema: " + strings.Join(err.Errors, "; ")
+}
+
+// loadedSchema is a cached result of loading a schema.
+type loadedSchema struct {
+	schema *jsonschema.Schema
+	err    error
+}
+
+// schemas caches the compiled schemas, so a schema is loaded once per instance instead of once per message.
+// The schemas which do not compile are cached as well, while the schemas which could not be read are read again.
+var (
+	schemas    = make(map[string]loadedSchema)
+	schemasMtx sync.Mutex
+)
+
+// loadSchema returns the cached schema of the given source, loading and compiling it if needed.
+// A ConfigSourceError is returned if the schema cannot be read, and a permanent error if it does not compile.
+func loadSchema(ctx context.Context, source string) (*jsonschema.Schema, error) {
+	schemasMtx.Lock()
+	defer schemasMtx.Unlock()
+
+	if cached, ok := schemas[source]; ok {
+		return cached.schema, cached.err
+	}
+
+	data, err := ReadConfigSource(ctx, source)
+	if err != nil {
+		return nil, &ConfigSourceError{Source: source, Err: err}
+	}
+
+	var schema *jsonschema.Schema
+	compiler := jsonschema.NewCompiler()
+	if err = compiler.AddResource(source, bytes.NewReader(data)); err == nil {
+		schema, err = compiler.Compile(source)
+	}
+	if err != nil {
+		err = Permanent(fmt.Errorf("Invalid schema '%s'. %s", source, err))
+	}
+
+	schemas[source] = loadedSchema{schema: schema, err: err}
+	return schema, err
+}
+
+// ValidatePayload validates a message payload against the JSON Schema of the validation configuration.
+// Returned result is nil if the payload is valid, and a *SchemaValidationError if it is not valid JSON or
+// does not match the schema. Any other error means that the schema could not be loaded (see SetValidationInfo).
+func ValidatePayload(ctx context.Context, data []byte, info ValidationInfo) error {
+	schema, err := info.compiledSchema(ctx)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return &SchemaValidationError{Errors: []string{"Payload is not valid JSON: " + err.Error()}}
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return &SchemaValidationError{Errors: []string{"Payload is not valid JSON: unexpected data after the JSON value"}}
+	}
+
+	err = schema.Validate(value)
+	if validationErr, ok := err.(*jsonschema.ValidationError); ok {
+		result := &SchemaValidationError{}
+		for _, cause := range validationErr.BasicOutput().Errors {
+			// The basic output also contains the errors of the (sub)schemas whose keywords failed, which only
+			// repeat the schema location, so only the errors of the failed keywords are kept.
+			if strings.HasPrefix(cause.Error, "doesn't validate with") {
+				continue
+			}
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", instanceLocation(cause.InstanceLocation), cause.Error))
+		}
+		if len(result.Errors) == 0 {
+			result.Errors = []string{validationErr.Error()}
+		}
+		return result
+	}
+	return err
+}
+
+// instanceLocation returns a readable form of a JSON pointer to the validated value.
+func instanceLocation(pointer string) string {
+	if pointer == "" {
+		return "/"
+	}
+	return pointer
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ValidationInfo represents payload validation configuration.
+// It holds information needed for validating message payloads against a JSON Schema before they are stored.
+// The validation is optional and it is disabled if the schema is not set.
+type ValidationInfo struct {
+	Schema string // JSON Schema source, a local path or gs://bucket/object (empty value disables the validation)
+
+	schema *jsonschema.Schema // compiled schema
+}
+
+// SetValidationInfo sets the parameters of a validation configuration by extracting values from the corresponding environment variables.
+// If VALIDATION_SCHEMA is not set, the validation is disabled. The schema is compiled (once per instance) together with
+// the configuration, so a schema which does not compile is reported when the persistor starts.
+// An error is returned if any errors occur during the function execution.
+func SetValidationInfo(validationInfo *ValidationInfo) error {
+	var err error
+
+	validationInfo.Schema = getOptionalEnvVariable("VALIDATION_SCHEMA", "")
+	if validationInfo.Enabled() {
+		validationInfo.schema, err = loadSchema(context.Background(), validationInfo.Schema)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Enabled reports whether the validation is configured.
+func (validationInfo ValidationInfo) Enabled() bool {
+	return validationInfo.Schema != ""
+}
+
+// compiledSchema returns the compiled schema of the configuration, loading it first if the configuration was not set by SetValidationInfo.
+// An error is returned if the schema cannot be loaded.
+func (validationInfo ValidationInfo) compiledSchema(ctx context.Context) (*jsonschema.Schema, error) {
+	if validationInfo.schema != nil {
+		return validationInfo.schema, nil
+	}
+	return loadSchema(ctx, validationInfo.Schema)
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["id"],
+	"properties": {
+		"id": {"type": "integer"},
+		"name": {"type": "string"}
+	}
+}`
+
+func TestValidatePayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := ValidationInfo{Schema: writeTempFile(t, dir, "schema.json", testSchema)}
+
+	tests := []struct {
+		name   string
+		data   string
+		errors []string // prefixes of the expected validation errors
+	}{
+		{name: "valid", data: `{"id": 1, "name": "a"}`},
+		{name: "large integer", data: `{"id": 12345678901234567890}`},
+		{name: "wrong type", data: `{"id": 1, "name": 2}`, errors: []string{"/name: "}},
+		{name: "missing field", data: `{"name": "a"}`, errors: []string{"/: "}},
+		{name: "not JSON", data: `id=1`, errors: []string{"Payload is not valid JSON"}},
+		{name: "data after the value", data: `{"id": 1} {"id": 2}`, errors: []string{"Payload is not valid JSON: unexpected data"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidatePayload(context.Background(), []byte(test.data), info)
+			if test.errors == nil {
+				if err != nil {
+					t.Errorf("ValidatePayload() error = %v, want nil", err)
+				}
+				return
+			}
+
+			validationErr, ok := err.(*SchemaValidationError)
+			if !ok {
+				t.Fatalf("ValidatePayload() error = %v, want a *SchemaValidationError", err)
+			}
+			if len(validationErr.Errors) != len(test.errors) {
+				t.Fatalf("validation errors = %q, want %d errors", validationErr.Errors, len(test.errors))
+			}
+			for i, prefix := range test.errors {
+				if !strings.HasPrefix(validationErr.Errors[i], prefix) {
+					t.Errorf("validation error = %q, want prefix %q", validationErr.Errors[i], prefix)
+				}
+			}
+		})
+	}
+}
+
+func TestValidatePayloadInvalidSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A missing schema may still be created, so it is read again, while a schema which does not compile is a permanent error.
+	missing := filepath.Join(dir, "missing.json")
+	err = ValidatePayload(context.Background(), []byte(`{}`), ValidationInfo{Schema: missing})
+	var sourceErr *ConfigSourceError
+	if !errors.As(err, &sourceErr) {
+		t.Errorf("ValidatePayload() with a missing schema error = %v, want a ConfigSourceError", err)
+	}
+	invalid := writeTempFile(t, dir, "invalid.json", `{"type": 1}`)
+	err = ValidatePayload(context.Background(), []byte(`{}`), ValidationInfo{Schema: invalid})
+	if _, ok := err.(*SchemaValidationError); err == nil || ok || IsRetryable(err) {
+		t.Errorf("ValidatePayload() with an invalid schema error = %v, want a permanent schema error", err)
+	}
+
+	writeTempFile(t, dir, "missing.json", testSchema)
+	if err := ValidatePayload(context.Background(), []byte(`{"id": 1}`), ValidationInfo{Schema: missing}); err != nil {
+		t.Errorf("ValidatePayload() with a created schema error = %v, want nil", err)
+	}
+}
+
+func TestSetValidationInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	restore := setEnv("VALIDATION_SCHEMA", writeTempFile(t, dir, "schema.json", testSchema))
+	var info ValidationInfo
+	err = SetValidationInfo(&info)
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.schema == nil {
+		t.Error("SetValidationInfo() did not compile the schema")
+	}
+
+	restore = setEnv("VALIDATION_SCHEMA", writeTempFile(t, dir, "invalid.json", `{"type": 1}`))
+	err = SetValidationInfo(&ValidationInfo{})
+	restore()
+	if err == nil || IsRetryable(err) {
+		t.Errorf("SetValidationInfo() with an invalid schema error = %v, want a permanent error", err)
+	}
+}
+
+func TestProcessMessageValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	gcs, stop := startGCS(t)
+	defer stop()
+
+	conf := PersistConf{
+		Storage:    StorageInfo{BucketID: "bucket", Prefix: "msg", Extension: "txt", Format: FormatRaw},
+		Quarantine: QuarantineInfo{BucketID: "quarantine"},
+		Validation: ValidationInfo{Schema: writeTempFile(t, dir, "schema.json", testSchema)},
+	}
+	report := NewRunReport()
+
+	if err := ProcessMessage(context.Background(), Message{ID: "1", Data: []byte(`{"id": 1}`)}, conf, report); err != nil {
+		t.Fatalf("ProcessMessage() of a valid message error = %v", err)
+	}
+	if err := ProcessMessage(context.Background(), Message{ID: "2", Data: []byte(`{"id": "x"}`)}, conf, report); err != nil {
+		t.Fatalf("ProcessMessage() of an invalid message error = %v, want nil after the message is quarantined", err)
+	}
+
+	if names := gcs.Names("bucket"); len(names) != 1 || !strings.HasSuffix(names[0], "msg-1.txt") {
+		t.Errorf("stored objects = %v, want only the valid message", names)
+	}
+	names := gcs.Names("quarantine")
+	if len(names) != 1 || !strings.HasSuffix(names[0], ReasonInvalidSchema+"-2.json") {
+		t.Fatalf("quarantined objects = %v, want the invalid message", names)
+	}
+	object, _ := gcs.Object("quarantine", names[0])
+	var record QuarantineRecord
+	if err := json.Unmarshal(object.Data, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Reason != ReasonInvalidSchema || len(record.ValidationErrors) != 1 || !strings.HasPrefix(record.ValidationErrors[0], "/id: ") {
+		t.Errorf("quarantine record = %+v, want the validation error of /id", record)
+	}
+	if report.Valid != 1 || report.Invalid != 1 {
+		t.Errorf("report counts %d valid and %d invalid messages, want 1 and 1", report.Valid, report.Invalid)
+	}
+
+	// If the schema cannot be loaded, the message is redelivered instead of being quarantined.
+	conf.Validation.Schema = filepath.Join(dir, "missing.json")
+	if err := ProcessMessage(context.Background(), Message{ID: "3", Data: []byte(`{"id": 3}`)}, conf, report); err == nil {
+		t.Error("ProcessMessage() with a missing schema error = nil, want an error")
+	}
+	if len(gcs.Names("bucket")) != 1 || len(gcs.Names("quarantine")) != 1 {
+		t.Errorf("message stored or quarantined without a schema")
+	}
+}
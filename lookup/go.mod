@@ -0,0 +1,7 @@
+module github.com/syntio/aquarium-persistor-gcp/lookup
+
+go 1.15
+
+replace github.com/syntio/aquarium-persistor-gcp/lib => ../lib
+
+require github.com/syntio/aquarium-persistor-gcp/lib v1.2.3
@@ -0,0 +1,105 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lookup
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// LookupResponse is the body of a successful lookup response.
+type LookupResponse struct {
+	lib.Envelope
+	Object    string `json:"object"`    // name of the object in which the message is stored
+	Partition string `json:"partition"` // folder of the partition in which the object is located
+	Record    int    `json:"record"`    // position of the message in a batch file
+}
+
+// LookupHandler represents entry point for finding a stored message by its ID.
+// The message ID is given by the id query parameter, and the searched time window by the optional from and to
+// parameters (in the RFC 3339 format). By default the past LOOKUP_WINDOW hours are searched.
+// The response contains the message envelope together with the location of the message.
+func LookupHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var lookupInfo lib.LookupInfo
+	err = lib.SetLookupInfo(&lookupInfo)
+	if err != nil {
+		log.Printf("Error during retrieving environment variables. %s.\n", err)
+		panic(err)
+	}
+
+	query := r.URL.Query()
+	messageID := query.Get("id")
+	if messageID == "" {
+		http.Error(w, "Message ID is not set", http.StatusBadRequest)
+		return
+	}
+
+	// The current hour is included, so the end of the default window is the end of that hour.
+	to := lib.PartitionHour(time.Now()).Add(time.Hour)
+	if value := query.Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid end of the time window", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-time.Duration(lookupInfo.Window) * time.Hour)
+	if value := query.Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid start of the time window", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The partitions are named by the local time of the persistor.
+	result, err := lib.LookupMessage(r.Context(), lookupInfo.BucketID, lookupInfo.Format, messageID, from.Local(), to.Local())
+	if err == lib.ErrMessageNotFound {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, lib.ErrUnsupportedBatch) {
+		http.Error(w, "Message is stored in a batch file which cannot be read", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Printf("Error during message lookup. %s.\n", err)
+		http.Error(w, "Error during message lookup", http.StatusInternalServerError)
+		return
+	}
+
+	response := LookupResponse{
+		Envelope:  lib.NewEnvelope(result.Message),
+		Object:    result.Entry.Object,
+		Partition: result.Entry.Partition,
+		Record:    result.Entry.Record,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Printf("Error during writing lookup response. %s.\n", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lookup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// setEnv sets the environment variables for the duration of a test.
+func setEnv(t *testing.T, values map[string]string) {
+	for name, value := range values {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestLookupHandler(t *testing.T) {
+	gcs := sinktest.NewGCSServer()
+	defer gcs.Close()
+	setEnv(t, map[string]string{"STORAGE_EMULATOR_HOST": gcs.Host(), "BUCKET_ID": "bucket", "MSG_FORMAT": lib.FormatEnvelope})
+
+	partitionTime := time.Date(2020, 10, 1, 12, 0, 0, 0, time.Local)
+	msg := lib.Message{ID: "1", Data: []byte("payload"), Attributes: map[string]string{"origin": "test"}, PublishTime: partitionTime.UTC()}
+	data, err := json.Marshal(lib.NewEnvelope(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := path.Join(lib.PartitionFolder(partitionTime), "msg-1.json")
+	gcs.Put("bucket", object, data, nil)
+
+	window := "&from=" + partitionTime.Format(time.RFC3339) + "&to=" + partitionTime.Add(time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		status int
+	}{
+		{name: "hit", method: http.MethodGet, query: "id=1" + window, status: http.StatusOK},
+		{name: "miss", method: http.MethodGet, query: "id=2" + window, status: http.StatusNotFound},
+		{name: "outside of the window", method: http.MethodGet, query: "id=1&to=" + partitionTime.Format(time.RFC3339), status: http.StatusNotFound},
+		{name: "missing ID", method: http.MethodGet, query: window[1:], status: http.StatusBadRequest},
+		{name: "invalid window", method: http.MethodGet, query: "id=1&from=yesterday", status: http.StatusBadRequest},
+		{name: "wrong method", method: http.MethodPost, query: "id=1", status: http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			LookupHandler(recorder, httptest.NewRequest(test.method, "/?"+test.query, nil))
+			if recorder.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var response LookupResponse
+			if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			if response.MessageID != "1" || string(response.Data) != "payload" || response.Attributes["origin"] != "test" {
+				t.Errorf("response envelope = %+v, want the stored message", response.Envelope)
+			}
+			if response.Object != object || response.Partition != lib.PartitionFolder(partitionTime) {
+				t.Errorf("response location = %s in %s, want %s", response.Object, response.Partition, object)
+			}
+		})
+	}
+}
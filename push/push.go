@@ -16,7 +16,9 @@ package push
 
 import (
 	"context"
+	"errors"
 	"log"
+	"sync"
 
 	cfmetadata "cloud.google.com/go/functions/metadata"
 
@@ -25,12 +27,14 @@ import (
 
 // PubsubMessage is a helper structure used for fetching incoming messages data
 type PubsubMessage struct {
-	Data []byte `json:"data"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
 }
 
 // PushHandler represents entry point for processing Pub/Sub push trigger.
 // The function creates storage configuration and calls helper function which stores the message.
-// Returned result is an error which defines the validity of the function action.
+// Returned result is an error which defines the validity of the function action. An error is returned
+// only for retryable failures, so the function should be deployed with retries enabled.
 func PushHandler(ctx context.Context, message PubsubMessage) error {
 	var err error
 
@@ -41,21 +45,70 @@ func PushHandler(ctx context.Context, message PubsubMessage) error {
 	}
 
 	//EventID is a unique ID for the event (message).
-	storageInfo := lib.StorageInfo{
-		MessageID: metadata.EventID,
+	msg := lib.Message{
+		ID:          metadata.EventID,
+		Data:        message.Data,
+		Attributes:  message.Attributes,
+		PublishTime: metadata.Timestamp,
 	}
 
-	err = lib.SetStorageInfo(&storageInfo)
+	return persist(ctx, msg)
+}
+
+// persistConf caches the persist configuration, so the configuration is loaded once per instance instead of once per message.
+// An invalid configuration is cached together with its error, since it fails on every delivery.
+var (
+	persistConf       lib.PersistConf
+	persistConfErr    error
+	persistConfLoaded bool
+	persistConfMtx    sync.Mutex
+)
+
+// loadPersistConf returns the persist configuration of the instance, extracting it from the environment variables if it is not cached yet.
+// The error of an invalid configuration is marked as permanent, while a configuration file (e.g. the routes) which
+// could not be read is classified by its error and it is not cached, so the configuration is loaded again with the next message.
+func loadPersistConf() (lib.PersistConf, error) {
+	persistConfMtx.Lock()
+	defer persistConfMtx.Unlock()
+
+	if persistConfLoaded {
+		return persistConf, persistConfErr
+	}
+
+	var conf lib.PersistConf
+	err := lib.SetPersistConf(&conf)
 	if err != nil {
-		log.Printf("Error during retrieving environment variables. %s.\n", err)
-		return err
+		var sourceErr *lib.ConfigSourceError
+		if errors.As(err, &sourceErr) {
+			return conf, err
+		}
+		err = lib.Permanent(err)
 	}
 
-	err = lib.PersistData(ctx, message.Data, storageInfo)
+	persistConf, persistConfErr, persistConfLoaded = conf, err, true
+	return conf, err
+}
+
+// persist stores the message using the persist configuration of the instance.
+// Permanent failures (e.g. invalid configuration or missing permissions) are written to the quarantine
+// and reported as success, so the message is acknowledged and not redelivered.
+// Retryable failures, and permanent failures when the quarantine is disabled or fails, are returned
+// so Pub/Sub redelivers the message.
+func persist(ctx context.Context, msg lib.Message) error {
+	conf, err := loadPersistConf()
 	if err != nil {
-		log.Printf("Error during data storage. %s.\n", err)
-		return err
+		log.Printf("Error during retrieving environment variables. %s.\n", err)
+		return lib.HandleFailure(ctx, msg, err, conf, nil)
 	}
 
-	return nil
+	err = lib.ProcessMessage(ctx, msg, conf, nil)
+
+	// The index is best effort, so the message is not redelivered if its index entry could not be written.
+	// The entries are written once enough of them are collected by the instance, or the oldest of them is old enough.
+	if conf.Index.Enabled {
+		if iErr := lib.FlushIndexIfDue(ctx, conf.Index); iErr != nil {
+			log.Printf("Error during writing message index. %s.\n", iErr)
+		}
+	}
+	return err
 }
@@ -0,0 +1,399 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+const (
+	// keyCacheTTL is the time for which the fetched keys are used before they are fetched again.
+	keyCacheTTL = time.Hour
+	// keyRefreshInterval is the minimum time between two refreshes caused by an unknown key ID.
+	keyRefreshInterval = time.Minute
+	// clockSkew is the tolerated difference between the token issuer clock and the local clock.
+	clockSkew = time.Minute
+)
+
+var (
+	// ErrInvalidToken is returned if a token is missing, malformed, expired or its signature is not valid.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrForbidden is returned if a token is valid, but it was not issued to an allowed service account.
+	ErrForbidden = errors.New("token email is not allowed")
+	// ErrKeysUnavailable is returned if the keys needed to verify a token could not be fetched.
+	ErrKeysUnavailable = errors.New("token keys are unavailable")
+)
+
+// KeySource is an interface which wraps the method for fetching the public keys used for signing tokens.
+// The returned keys are mapped by their key IDs.
+type KeySource interface {
+	Keys(ctx context.Context) (map[string]*rsa.PublicKey, error)
+}
+
+// StaticKeySource is a KeySource with a fixed set of keys, mostly used for testing.
+type StaticKeySource map[string]*rsa.PublicKey
+
+// Keys returns the fixed set of keys.
+func (source StaticKeySource) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	return source, nil
+}
+
+// JWKSKeySource is a KeySource which fetches keys from a JSON Web Key Set URL on every call.
+type JWKSKeySource struct {
+	URL    string
+	Client *http.Client
+}
+
+// Keys fetches the key set and parses its RSA keys.
+func (source JWKSKeySource) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	client := source.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	request, err := http.NewRequest(http.MethodGet, source.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching key set from '%s' failed with status code %d", source.URL, response.StatusCode)
+	}
+
+	var keySet struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&keySet)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, key := range keySet.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+// CachedKeySource is a KeySource which caches the keys of another source.
+// The keys are fetched again once the cache expires or when a token is signed with an unknown key.
+type CachedKeySource struct {
+	Source KeySource
+
+	mtx     sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+// Keys returns the cached keys, fetching them if the cache is empty or expired.
+func (source *CachedKeySource) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	source.mtx.Lock()
+	defer source.mtx.Unlock()
+
+	if source.keys != nil && time.Since(source.fetched) < keyCacheTTL {
+		return source.keys, nil
+	}
+	return source.fetch(ctx)
+}
+
+// Refresh fetches the keys again, unless they were fetched less than keyRefreshInterval ago.
+// It is used when a token refers to a key which is not in the cache (e.g. after a key rotation).
+func (source *CachedKeySource) Refresh(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	source.mtx.Lock()
+	defer source.mtx.Unlock()
+
+	if source.keys != nil && time.Since(source.fetched) < keyRefreshInterval {
+		return source.keys, nil
+	}
+	return source.fetch(ctx)
+}
+
+// fetch fetches the keys from the underlying source and stores them in the cache.
+func (source *CachedKeySource) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	keys, err := source.Source.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	source.keys = keys
+	source.fetched = time.Now()
+	return keys, nil
+}
+
+// TokenClaims holds the claims of a Pub/Sub push token which are checked during verification.
+type TokenClaims struct {
+	Issuer        string      `json:"iss"`
+	Audience      interface{} `json:"aud"`
+	Email         string      `json:"email"`
+	EmailVerified bool        `json:"email_verified"`
+	ExpiresAt     int64       `json:"exp"`
+	IssuedAt      int64       `json:"iat"`
+	NotBefore     int64       `json:"nbf"` // optional, 0 if not set
+}
+
+// TokenVerifier verifies the OIDC tokens sent by Pub/Sub push subscriptions.
+type TokenVerifier struct {
+	Keys KeySource
+	Info lib.AuthInfo
+	Now  func() time.Time // clock used for checking the token expiration (time.Now if not set)
+}
+
+// NewTokenVerifier creates a TokenVerifier which uses a cached key set fetched from the configured JWKS URL.
+func NewTokenVerifier(authInfo lib.AuthInfo) *TokenVerifier {
+	return &TokenVerifier{
+		Keys: &CachedKeySource{Source: JWKSKeySource{URL: authInfo.JWKSURL}},
+		Info: authInfo,
+	}
+}
+
+// Verify checks the signature, issuer, audience, expiration and email of a token.
+// ErrForbidden is returned if the token is valid but its email is not allowed, an error wrapping ErrKeysUnavailable
+// if the keys could not be fetched, while an error wrapping ErrInvalidToken is returned for any other verification failure.
+func (verifier *TokenVerifier) Verify(ctx context.Context, token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: malformed header: %v", ErrInvalidToken, err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm '%s'", ErrInvalidToken, header.Alg)
+	}
+
+	key, err := verifier.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature: %v", ErrInvalidToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("%w: invalid signature", ErrInvalidToken)
+	}
+
+	var claims TokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed claims: %v", ErrInvalidToken, err)
+	}
+
+	if err := verifier.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return &claims, nil
+}
+
+// key returns the public key with the given ID, refreshing the cached keys if the key is unknown.
+func (verifier *TokenVerifier) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	keys, err := verifier.Keys.Keys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrKeysUnavailable, err)
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+
+	if refresher, ok := verifier.Keys.(interface {
+		Refresh(ctx context.Context) (map[string]*rsa.PublicKey, error)
+	}); ok {
+		keys, err = refresher.Refresh(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrKeysUnavailable, err)
+		}
+		if key, ok := keys[kid]; ok {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: unknown key ID '%s'", ErrInvalidToken, kid)
+}
+
+// checkClaims checks the issuer, audience, time validity (exp, iat and nbf) and email of a token.
+func (verifier *TokenVerifier) checkClaims(claims TokenClaims) error {
+	now := time.Now()
+	if verifier.Now != nil {
+		now = verifier.Now()
+	}
+
+	if !contains(verifier.Info.Issuers, claims.Issuer) {
+		return fmt.Errorf("%w: unexpected issuer '%s'", ErrInvalidToken, claims.Issuer)
+	}
+
+	if !audienceMatches(claims.Audience, verifier.Info.Audience) {
+		return fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+
+	if now.Add(-clockSkew).After(time.Unix(claims.ExpiresAt, 0)) {
+		return fmt.Errorf("%w: token expired", ErrInvalidToken)
+	}
+	if now.Add(clockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return fmt.Errorf("%w: token used before issued", ErrInvalidToken)
+	}
+	if claims.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return fmt.Errorf("%w: token used before its not-before time", ErrInvalidToken)
+	}
+
+	if !claims.EmailVerified || !contains(verifier.Info.AllowedEmails, claims.Email) {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+// VerifyPushToken wraps a handler with the verification of the bearer token sent by an authenticated push subscription.
+// Requests without a valid token are rejected with 401 Unauthorized, and requests with a valid token
+// issued to a service account which is not allowed are rejected with 403 Forbidden. If the keys could not be fetched,
+// the token cannot be verified, so the request is rejected with 503 Service Unavailable and Pub/Sub redelivers the message.
+func VerifyPushToken(verifier *TokenVerifier, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		_, err := verifier.Verify(r.Context(), token)
+		if errors.Is(err, ErrForbidden) {
+			log.Printf("Push request rejected. %s.\n", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, ErrKeysUnavailable) {
+			log.Printf("Error during fetching token keys. %s.\n", err)
+			http.Error(w, "Token keys are unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Printf("Push request rejected. %s.\n", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+var (
+	authenticatedHandler     http.Handler
+	authenticatedHandlerErr  error
+	authenticatedHandlerOnce sync.Once
+)
+
+// AuthenticatedPushHTTPHandler represents entry point for processing authenticated Pub/Sub HTTP push subscriptions.
+// It verifies the push token using the configuration given by the environment variables and calls PushHTTPHandler.
+// The verifier is created on the first request, so the fetched keys are reused while the instance is alive.
+func AuthenticatedPushHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	authenticatedHandlerOnce.Do(func() {
+		var authInfo lib.AuthInfo
+		authenticatedHandlerErr = lib.SetAuthInfo(&authInfo)
+		if authenticatedHandlerErr == nil {
+			authenticatedHandler = VerifyPushToken(NewTokenVerifier(authInfo), http.HandlerFunc(PushHTTPHandler))
+		}
+	})
+
+	if authenticatedHandlerErr != nil {
+		log.Printf("Error during retrieving environment variables. %s.\n", authenticatedHandlerErr)
+		http.Error(w, "Invalid configuration", http.StatusInternalServerError)
+		return
+	}
+
+	authenticatedHandler.ServeHTTP(w, r)
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceMatches checks whether the audience claim (a string or a list of strings) contains the expected audience.
+func audienceMatches(audience interface{}, expected string) bool {
+	switch aud := audience.(type) {
+	case string:
+		return aud == expected
+	case []interface{}:
+		for _, value := range aud {
+			if value == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contains checks whether the list contains the given value.
+func contains(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+	return false
+}
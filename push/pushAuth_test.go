@@ -0,0 +1,290 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+const (
+	testAudience = "https://persistor.example.com/push"
+	testEmail    = "push@project.iam.gserviceaccount.com"
+	testIssuer   = "https://accounts.google.com"
+)
+
+var testNow = time.Unix(1600000000, 0)
+
+// testKey is shared by the tests, since generating RSA keys is slow.
+var testKey = mustGenerateKey()
+
+func mustGenerateKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// signToken creates a RS256 token with the given header and claims.
+func signToken(t *testing.T, key *rsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) string {
+	t.Helper()
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validHeader() map[string]interface{} {
+	return map[string]interface{}{"alg": "RS256", "kid": "key-1", "typ": "JWT"}
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            testIssuer,
+		"aud":            testAudience,
+		"email":          testEmail,
+		"email_verified": true,
+		"iat":            testNow.Add(-time.Minute).Unix(),
+		"exp":            testNow.Add(time.Hour).Unix(),
+	}
+}
+
+func newTestVerifier(keys KeySource) *TokenVerifier {
+	return &TokenVerifier{
+		Keys: keys,
+		Info: lib.AuthInfo{
+			Audience:      testAudience,
+			AllowedEmails: []string{testEmail},
+			Issuers:       []string{"accounts.google.com", testIssuer},
+		},
+		Now: func() time.Time { return testNow },
+	}
+}
+
+func TestVerify(t *testing.T) {
+	otherKey := mustGenerateKey()
+
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		header  func(map[string]interface{})
+		claims  func(map[string]interface{})
+		token   string
+		wantErr error
+	}{
+		{name: "valid token"},
+		{name: "audience list", claims: func(c map[string]interface{}) { c["aud"] = []string{"other", testAudience} }},
+		{name: "expired within clock skew", claims: func(c map[string]interface{}) { c["exp"] = testNow.Add(-30 * time.Second).Unix() }},
+		{name: "malformed token", token: "not-a-token", wantErr: ErrInvalidToken},
+		{name: "bad signature", key: otherKey, wantErr: ErrInvalidToken},
+		{name: "algorithm mismatch", header: func(h map[string]interface{}) { h["alg"] = "HS256" }, wantErr: ErrInvalidToken},
+		{name: "no algorithm", header: func(h map[string]interface{}) { h["alg"] = "none" }, wantErr: ErrInvalidToken},
+		{name: "unknown key ID", header: func(h map[string]interface{}) { h["kid"] = "key-2" }, wantErr: ErrInvalidToken},
+		{name: "expired", claims: func(c map[string]interface{}) { c["exp"] = testNow.Add(-time.Hour).Unix() }, wantErr: ErrInvalidToken},
+		{name: "issued in the future", claims: func(c map[string]interface{}) { c["iat"] = testNow.Add(time.Hour).Unix() }, wantErr: ErrInvalidToken},
+		{name: "not yet valid", claims: func(c map[string]interface{}) { c["nbf"] = testNow.Add(time.Hour).Unix() }, wantErr: ErrInvalidToken},
+		{name: "wrong issuer", claims: func(c map[string]interface{}) { c["iss"] = "https://issuer.example.com" }, wantErr: ErrInvalidToken},
+		{name: "wrong audience", claims: func(c map[string]interface{}) { c["aud"] = "https://other.example.com" }, wantErr: ErrInvalidToken},
+		{name: "disallowed email", claims: func(c map[string]interface{}) { c["email"] = "other@project.iam.gserviceaccount.com" }, wantErr: ErrForbidden},
+		{name: "unverified email", claims: func(c map[string]interface{}) { c["email_verified"] = false }, wantErr: ErrForbidden},
+	}
+
+	verifier := newTestVerifier(StaticKeySource{"key-1": &testKey.PublicKey})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := test.token
+			if token == "" {
+				header, claims := validHeader(), validClaims()
+				if test.header != nil {
+					test.header(header)
+				}
+				if test.claims != nil {
+					test.claims(claims)
+				}
+				key := test.key
+				if key == nil {
+					key = testKey
+				}
+				token = signToken(t, key, header, claims)
+			}
+
+			claims, err := verifier.Verify(context.Background(), token)
+			if test.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Verify() error = %v, want nil", err)
+				}
+				if claims.Email != testEmail {
+					t.Errorf("Verify() email = %q, want %q", claims.Email, testEmail)
+				}
+				return
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// rotatingKeySource returns the keys of its current set and counts the fetches.
+type rotatingKeySource struct {
+	keys    map[string]*rsa.PublicKey
+	fetches int
+}
+
+func (source *rotatingKeySource) Keys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	source.fetches++
+	return source.keys, nil
+}
+
+func TestVerifyRefetchesUnknownKey(t *testing.T) {
+	rotatedKey := mustGenerateKey()
+	source := &rotatingKeySource{keys: map[string]*rsa.PublicKey{"key-1": &testKey.PublicKey}}
+	cached := &CachedKeySource{Source: source}
+	verifier := newTestVerifier(cached)
+
+	if _, err := verifier.Verify(context.Background(), signToken(t, testKey, validHeader(), validClaims())); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if source.fetches != 1 {
+		t.Fatalf("fetches = %d, want 1", source.fetches)
+	}
+
+	// The keys are rotated, so a token signed with the new key is verified after the keys are fetched again.
+	source.keys = map[string]*rsa.PublicKey{"key-2": &rotatedKey.PublicKey}
+	cached.fetched = time.Now().Add(-keyRefreshInterval)
+	header := validHeader()
+	header["kid"] = "key-2"
+	token := signToken(t, rotatedKey, header, validClaims())
+	if _, err := verifier.Verify(context.Background(), token); err != nil {
+		t.Fatalf("Verify() after rotation error = %v", err)
+	}
+	if source.fetches != 2 {
+		t.Fatalf("fetches = %d, want 2", source.fetches)
+	}
+
+	// An unknown key does not cause another fetch within the refresh interval.
+	header["kid"] = "key-3"
+	if _, err := verifier.Verify(context.Background(), signToken(t, rotatedKey, header, validClaims())); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Verify() error = %v, want %v", err, ErrInvalidToken)
+	}
+	if source.fetches != 2 {
+		t.Fatalf("fetches = %d, want 2", source.fetches)
+	}
+}
+
+func TestJWKSKeySource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{"kid": "key-1", "kty": "RSA", "n": base64.RawURLEncoding.EncodeToString(testKey.N.Bytes()), "e": "AQAB"},
+				{"kid": "ec-key", "kty": "EC"},
+			},
+		})
+	}))
+	defer server.Close()
+
+	verifier := newTestVerifier(&CachedKeySource{Source: JWKSKeySource{URL: server.URL}})
+	if _, err := verifier.Verify(context.Background(), signToken(t, testKey, validHeader(), validClaims())); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+}
+
+func TestVerifyPushToken(t *testing.T) {
+	verifier := newTestVerifier(StaticKeySource{"key-1": &testKey.PublicKey})
+	handler := VerifyPushToken(verifier, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	disallowed := validClaims()
+	disallowed["email"] = "other@project.iam.gserviceaccount.com"
+	expired := validClaims()
+	expired["exp"] = testNow.Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{name: "valid token", authorization: "Bearer " + signToken(t, testKey, validHeader(), validClaims()), want: http.StatusNoContent},
+		{name: "missing header", want: http.StatusUnauthorized},
+		{name: "not a bearer token", authorization: "Basic dXNlcjpwYXNz", want: http.StatusUnauthorized},
+		{name: "invalid token", authorization: "Bearer " + signToken(t, testKey, validHeader(), expired), want: http.StatusUnauthorized},
+		{name: "disallowed email", authorization: "Bearer " + signToken(t, testKey, validHeader(), disallowed), want: http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("status = %d, want %d", recorder.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyPushTokenKeysUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	verifier := newTestVerifier(&CachedKeySource{Source: JWKSKeySource{URL: server.URL}})
+	if _, err := verifier.Verify(context.Background(), signToken(t, testKey, validHeader(), validClaims())); !errors.Is(err, ErrKeysUnavailable) {
+		t.Fatalf("Verify() error = %v, want %v", err, ErrKeysUnavailable)
+	}
+
+	// The token may be valid, so the request is rejected as a temporary failure and the message is redelivered.
+	handler := VerifyPushToken(verifier, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called without a verified token")
+	}))
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+	request.Header.Set("Authorization", "Bearer "+signToken(t, testKey, validHeader(), validClaims()))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+const (
+	// messagePublishedType is the type of CloudEvents sent for Pub/Sub messages.
+	messagePublishedType = "google.cloud.pubsub.topic.v1.messagePublished"
+	// structuredContentType is the content type of a CloudEvent sent in the structured content mode.
+	structuredContentType = "application/cloudevents+json"
+)
+
+// CloudEvent is a helper structure which holds the CloudEvent attributes and the data of a Pub/Sub message event.
+type CloudEvent struct {
+	ID          string          `json:"id"`
+	Source      string          `json:"source"`
+	SpecVersion string          `json:"specversion"`
+	Type        string          `json:"type"`
+	Time        time.Time       `json:"time"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// PushCloudEventHandler represents entry point for processing Pub/Sub messages delivered as CloudEvents
+// (2nd gen Cloud Functions and Eventarc triggers). Both binary and structured content modes are supported.
+// The message ID, publish time, attributes and data are taken from the messagePublished event and the message
+// is stored in the same way as with the other push handlers.
+func PushCloudEventHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	event, err := ExtractCloudEvent(r)
+	if err != nil {
+		log.Printf("Error during CloudEvent unmarshaling. %s.\n", err)
+		http.Error(w, "Invalid CloudEvent", http.StatusBadRequest)
+		return
+	}
+
+	msg, err := event.Message()
+	if err != nil {
+		log.Printf("Error during CloudEvent message extraction. %s.\n", err)
+		http.Error(w, "Invalid CloudEvent", http.StatusBadRequest)
+		return
+	}
+
+	storeMessage(w, r, msg)
+}
+
+// ExtractCloudEvent extracts a CloudEvent from an HTTP request.
+// In the structured content mode the whole event is read from the body, while in the binary
+// content mode the event attributes are read from the ce- headers and the body holds the event data.
+// An error is returned if any of the required attributes (id, source, specversion and type) is missing.
+func ExtractCloudEvent(r *http.Request) (CloudEvent, error) {
+	var event CloudEvent
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == structuredContentType {
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil {
+			return event, err
+		}
+		return event, event.checkRequired("")
+	}
+
+	event.ID = r.Header.Get("ce-id")
+	event.Source = r.Header.Get("ce-source")
+	event.SpecVersion = r.Header.Get("ce-specversion")
+	event.Type = r.Header.Get("ce-type")
+
+	if eventTime := r.Header.Get("ce-time"); eventTime != "" {
+		var err error
+		event.Time, err = time.Parse(time.RFC3339Nano, eventTime)
+		if err != nil {
+			return event, err
+		}
+	}
+
+	if err := event.checkRequired("ce-"); err != nil {
+		return event, err
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&event.Data)
+	return event, err
+}
+
+// checkRequired returns an error naming the first required attribute which is missing in the event.
+// The prefix is prepended to the attribute name (ce- for the headers of the binary content mode).
+func (event CloudEvent) checkRequired(prefix string) error {
+	for _, attribute := range []struct {
+		name  string
+		value string
+	}{
+		{"specversion", event.SpecVersion},
+		{"id", event.ID},
+		{"source", event.Source},
+		{"type", event.Type},
+	} {
+		if attribute.value == "" {
+			return fmt.Errorf("Required CloudEvent attribute '%s%s' is missing", prefix, attribute.name)
+		}
+	}
+	return nil
+}
+
+// Message converts the messagePublished event to a Message.
+// The event ID and time are used if the message ID or publish time are missing in the event data.
+// An error is returned if the event is not a messagePublished event or if its data could not be parsed.
+func (event CloudEvent) Message() (lib.Message, error) {
+	if event.Type != messagePublishedType {
+		return lib.Message{}, fmt.Errorf("Unexpected event type '%s', expected '%s'", event.Type, messagePublishedType)
+	}
+
+	var request PushRequest
+	err := json.Unmarshal(event.Data, &request)
+	if err != nil {
+		return lib.Message{}, err
+	}
+
+	if request.Message.MessageID == "" {
+		request.Message.MessageID = event.ID
+	}
+	if request.Message.PublishTime.IsZero() {
+		request.Message.PublishTime = event.Time
+	}
+
+	return request.message()
+}
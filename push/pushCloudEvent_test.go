@@ -0,0 +1,163 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eventData is the data of a messagePublished event, without the message ID and publish time.
+const eventData = `{"message": {"data": "aGVsbG8=", "attributes": {"origin": "test"}}, "subscription": "projects/project/subscriptions/sub"}`
+
+// binaryHeaders returns the ce- headers of a messagePublished event in the binary content mode.
+func binaryHeaders() map[string]string {
+	return map[string]string{
+		"Content-Type":   "application/json",
+		"ce-id":          "42",
+		"ce-source":      "//pubsub.googleapis.com/projects/project/topics/topic",
+		"ce-specversion": "1.0",
+		"ce-type":        messagePublishedType,
+		"ce-time":        "2020-11-05T10:30:00Z",
+	}
+}
+
+// structuredEvent returns a messagePublished event in the structured content mode, leaving out the given attribute.
+func structuredEvent(without string) string {
+	attributes := []string{
+		`"id": "42"`,
+		`"source": "//pubsub.googleapis.com/projects/project/topics/topic"`,
+		`"specversion": "1.0"`,
+		`"type": "` + messagePublishedType + `"`,
+		`"time": "2020-11-05T10:30:00Z"`,
+	}
+	var kept []string
+	for _, attribute := range attributes {
+		if !strings.HasPrefix(attribute, `"`+without+`"`) {
+			kept = append(kept, attribute)
+		}
+	}
+	return `{` + strings.Join(kept, ", ") + `, "data": ` + eventData + `}`
+}
+
+func newEventRequest(headers map[string]string, body string) *http.Request {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	return request
+}
+
+func TestExtractCloudEvent(t *testing.T) {
+	publishTime := time.Date(2020, 11, 5, 10, 30, 0, 0, time.UTC)
+	requests := map[string]*http.Request{
+		"binary":     newEventRequest(binaryHeaders(), eventData),
+		"structured": newEventRequest(map[string]string{"Content-Type": "application/cloudevents+json; charset=utf-8"}, structuredEvent("")),
+	}
+
+	for mode, request := range requests {
+		t.Run(mode, func(t *testing.T) {
+			event, err := ExtractCloudEvent(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The message ID and publish time are taken from the event, since they are missing in its data.
+			msg, err := event.Message()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.ID != "42" || string(msg.Data) != "hello" || msg.Attributes["origin"] != "test" || !msg.PublishTime.Equal(publishTime) {
+				t.Errorf("Unexpected message %+v", msg)
+			}
+		})
+	}
+}
+
+func TestExtractCloudEventMissingAttributes(t *testing.T) {
+	for _, attribute := range []string{"id", "source", "specversion", "type"} {
+		headers := binaryHeaders()
+		delete(headers, "ce-"+attribute)
+		_, err := ExtractCloudEvent(newEventRequest(headers, eventData))
+		if err == nil || !strings.Contains(err.Error(), "'ce-"+attribute+"'") {
+			t.Errorf("ExtractCloudEvent() without ce-%s error = %v, want an error naming the header", attribute, err)
+		}
+
+		_, err = ExtractCloudEvent(newEventRequest(map[string]string{"Content-Type": structuredContentType}, structuredEvent(attribute)))
+		if err == nil || !strings.Contains(err.Error(), "'"+attribute+"'") {
+			t.Errorf("ExtractCloudEvent() of a structured event without %s error = %v, want an error naming the attribute", attribute, err)
+		}
+	}
+
+	headers := binaryHeaders()
+	headers["ce-time"] = "yesterday"
+	if _, err := ExtractCloudEvent(newEventRequest(headers, eventData)); err == nil {
+		t.Error("ExtractCloudEvent() with an invalid ce-time error = nil, want an error")
+	}
+}
+
+func TestPushCloudEventHandler(t *testing.T) {
+	otherType := binaryHeaders()
+	otherType["ce-type"] = "google.cloud.storage.object.v1.finalized"
+	missingID := binaryHeaders()
+	delete(missingID, "ce-id")
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		body    string
+		fail    int // the status of the failed writes to the bucket
+		want    int
+		stored  int
+	}{
+		{name: "binary content mode", headers: binaryHeaders(), body: eventData, want: http.StatusNoContent, stored: 1},
+		{name: "structured content mode", headers: map[string]string{"Content-Type": structuredContentType}, body: structuredEvent(""), want: http.StatusNoContent, stored: 1},
+		{name: "not a POST request", method: http.MethodGet, headers: binaryHeaders(), want: http.StatusMethodNotAllowed},
+		{name: "missing required attribute", headers: missingID, body: eventData, want: http.StatusBadRequest},
+		{name: "invalid event data", headers: binaryHeaders(), body: `{"message": `, want: http.StatusBadRequest},
+		{name: "unexpected event type", headers: otherType, body: eventData, want: http.StatusBadRequest},
+		{name: "retryable storage error", headers: binaryHeaders(), body: eventData, fail: http.StatusTooManyRequests, want: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gcs := startStorage(t)
+			gcs.Fail = func(r *http.Request) int { return test.fail }
+
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			// The storage retries the retryable errors until the request is cancelled.
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			request := newEventRequest(test.headers, test.body).WithContext(ctx)
+			request.Method = method
+			recorder := httptest.NewRecorder()
+			PushCloudEventHandler(recorder, request)
+
+			if recorder.Code != test.want {
+				t.Errorf("status = %d, want %d", recorder.Code, test.want)
+			}
+			if stored := gcs.Names("bucket"); len(stored) != test.stored {
+				t.Errorf("stored objects = %v, want %d", stored, test.stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib"
+)
+
+// PushRequest is a helper structure used for fetching the body of a Pub/Sub HTTP push request.
+type PushRequest struct {
+	Message struct {
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+		OrderingKey string            `json:"orderingKey"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt *int   `json:"deliveryAttempt"`
+}
+
+// PushHTTPHandler represents entry point for processing Pub/Sub HTTP push subscriptions (e.g. on Cloud Run).
+// The function parses the push request, creates storage configuration and stores the message.
+// A successful status is returned only after the message is stored (or quarantined because of a permanent failure),
+// otherwise Pub/Sub redelivers the message.
+func PushHTTPHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	msg, err := ExtractPushMessage(r)
+	if err != nil {
+		log.Printf("Error during push request unmarshaling. %s.\n", err)
+		http.Error(w, "Invalid push request", http.StatusBadRequest)
+		return
+	}
+
+	storeMessage(w, r, msg)
+}
+
+// storeMessage stores the message and writes the response status.
+// The success status is written only if the message was stored or quarantined.
+func storeMessage(w http.ResponseWriter, r *http.Request, msg lib.Message) {
+	err := persist(r.Context(), msg)
+	if err != nil {
+		http.Error(w, "Error during data storage", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExtractPushMessage extracts the message from the body of a Pub/Sub HTTP push request.
+// An error is returned if the body could not be parsed or if the message ID is missing.
+func ExtractPushMessage(r *http.Request) (lib.Message, error) {
+	var request PushRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		return lib.Message{}, err
+	}
+
+	return request.message()
+}
+
+// message converts the push request to a Message.
+// An error is returned if the message ID is missing.
+func (request PushRequest) message() (lib.Message, error) {
+	if request.Message.MessageID == "" {
+		return lib.Message{}, fmt.Errorf("Message ID is missing in the push request")
+	}
+
+	return lib.Message{
+		ID:              request.Message.MessageID,
+		Data:            request.Message.Data,
+		Attributes:      request.Message.Attributes,
+		PublishTime:     request.Message.PublishTime,
+		OrderingKey:     request.Message.OrderingKey,
+		DeliveryAttempt: request.DeliveryAttempt,
+	}, nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2020 Syntio Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package push
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syntio/aquarium-persistor-gcp/lib/sinktest"
+)
+
+// resetPersistConf discards the cached persist configuration, so the next message loads it again.
+func resetPersistConf() {
+	persistConfMtx.Lock()
+	defer persistConfMtx.Unlock()
+
+	persistConfLoaded = false
+}
+
+// startStorage starts a fake GCS server and configures the push functions to store the messages in its bucket
+// and to quarantine them in its quarantine bucket. The configuration is restored when the test ends.
+func startStorage(t *testing.T) *sinktest.GCSServer {
+	t.Helper()
+
+	gcs := sinktest.NewGCSServer()
+	t.Cleanup(gcs.Close)
+	setEnv(t, map[string]string{
+		"STORAGE_EMULATOR_HOST": gcs.Host(),
+		"BUCKET_ID":             "bucket",
+		"MSG_PREFIX":            "msg",
+		"MSG_EXTENSION":         "txt",
+		"QUARANTINE_BUCKET_ID":  "quarantine",
+	})
+	return gcs
+}
+
+// setEnv sets the environment variables for the duration of a test, discarding the cached configuration
+// when they are set and when they are restored.
+func setEnv(t *testing.T, variables map[string]string) {
+	t.Helper()
+
+	for name, value := range variables {
+		previous, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		name := name
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, previous)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+	resetPersistConf()
+	t.Cleanup(resetPersistConf)
+}
+
+func TestExtractPushMessage(t *testing.T) {
+	body := `{
+		"message": {
+			"data": "aGVsbG8=",
+			"attributes": {"origin": "test"},
+			"messageId": "42",
+			"publishTime": "2020-11-05T10:30:00Z",
+			"orderingKey": "key"
+		},
+		"subscription": "projects/project/subscriptions/sub",
+		"deliveryAttempt": 3
+	}`
+	msg, err := ExtractPushMessage(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != "42" || string(msg.Data) != "hello" || msg.Attributes["origin"] != "test" || msg.OrderingKey != "key" {
+		t.Errorf("Unexpected message %+v", msg)
+	}
+	if !msg.PublishTime.Equal(time.Date(2020, 11, 5, 10, 30, 0, 0, time.UTC)) {
+		t.Errorf("publish time = %v, want 2020-11-05T10:30:00Z", msg.PublishTime)
+	}
+	if msg.DeliveryAttempt == nil || *msg.DeliveryAttempt != 3 {
+		t.Errorf("delivery attempt = %v, want 3", msg.DeliveryAttempt)
+	}
+
+	for _, invalid := range []string{
+		`not json`,
+		`{"message": {"data": "aGVsbG8="}}`,
+		`{"message": {"data": "not base64!", "messageId": "42"}}`,
+		`{"message": {"messageId": "42", "publishTime": "yesterday"}}`,
+	} {
+		if _, err := ExtractPushMessage(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(invalid))); err == nil {
+			t.Errorf("ExtractPushMessage(%s) error = nil, want an error", invalid)
+		}
+	}
+}
+
+func TestPushHTTPHandler(t *testing.T) {
+	valid := `{"message": {"data": "aGVsbG8=", "messageId": "42"}, "subscription": "projects/project/subscriptions/sub"}`
+
+	tests := []struct {
+		name        string
+		method      string
+		body        string
+		fail        int // the status of the failed writes to the bucket
+		quarantine  bool
+		want        int
+		stored      int
+		quarantined int
+	}{
+		{name: "stored", body: valid, quarantine: true, want: http.StatusNoContent, stored: 1},
+		{name: "not a POST request", method: http.MethodGet, want: http.StatusMethodNotAllowed},
+		{name: "invalid JSON", body: `{"message": `, want: http.StatusBadRequest},
+		{name: "missing message ID", body: `{"message": {"data": "aGVsbG8="}}`, want: http.StatusBadRequest},
+		{name: "permanent error quarantined", body: valid, fail: http.StatusForbidden, quarantine: true, want: http.StatusNoContent, quarantined: 1},
+		{name: "permanent error without quarantine", body: valid, fail: http.StatusForbidden, want: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gcs := startStorage(t)
+			if !test.quarantine {
+				setEnv(t, map[string]string{"QUARANTINE_BUCKET_ID": ""})
+			}
+			gcs.Fail = func(r *http.Request) int {
+				if strings.Contains(r.URL.Path, "/b/bucket/") {
+					return test.fail
+				}
+				return 0
+			}
+
+			method := test.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			recorder := httptest.NewRecorder()
+			PushHTTPHandler(recorder, httptest.NewRequest(method, "/", strings.NewReader(test.body)))
+
+			if recorder.Code != test.want {
+				t.Errorf("status = %d, want %d", recorder.Code, test.want)
+			}
+			if stored := gcs.Names("bucket"); len(stored) != test.stored {
+				t.Errorf("stored objects = %v, want %d", stored, test.stored)
+			}
+			if quarantined := gcs.Names("quarantine"); len(quarantined) != test.quarantined {
+				t.Errorf("quarantined objects = %v, want %d", quarantined, test.quarantined)
+			}
+		})
+	}
+}
+
+func TestPersistCachesConfiguration(t *testing.T) {
+	gcs := startStorage(t)
+
+	recorder := httptest.NewRecorder()
+	PushHTTPHandler(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"message": {"data": "YQ==", "messageId": "1"}}`)))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusNoContent)
+	}
+
+	// The configuration is not read again, so a changed environment does not affect the instance.
+	os.Setenv("MSG_PREFIX", "changed")
+	recorder = httptest.NewRecorder()
+	PushHTTPHandler(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"message": {"data": "Yg==", "messageId": "2"}}`)))
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusNoContent)
+	}
+	for _, name := range gcs.Names("bucket") {
+		if !strings.Contains(name, "msg") {
+			t.Errorf("object %s was stored with the changed prefix", name)
+		}
+	}
+
+	// An invalid configuration is cached as a permanent error, so the messages are quarantined.
+	setEnv(t, map[string]string{"MSG_FORMAT": "unknown"})
+	for _, id := range []string{"3", "4"} {
+		recorder = httptest.NewRecorder()
+		PushHTTPHandler(recorder, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"message": {"data": "Yw==", "messageId": "`+id+`"}}`)))
+		if recorder.Code != http.StatusNoContent {
+			t.Errorf("status = %d, want %d", recorder.Code, http.StatusNoContent)
+		}
+	}
+	if quarantined := gcs.Names("quarantine"); len(quarantined) != 2 {
+		t.Errorf("quarantined objects = %v, want 2", quarantined)
+	}
+}
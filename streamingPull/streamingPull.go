@@ -27,15 +27,15 @@ import (
 const synchronous = false
 
 // StreamingPullHandler represents the main streaming pull function which is triggered by HTTP request.
-// It creates pull, subscriber and storage configurations that are passed to Puller for pulling and storing messages from Pub/Sub,
+// It creates pull, subscriber and persist configurations that are passed to Puller for pulling and storing messages from Pub/Sub,
 // using streaming (asynchronous) pull mechanism.
 func StreamingPullHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	ctx := context.Background()
 
-	var storageInfo lib.StorageInfo
-	err = lib.SetStorageInfo(&storageInfo)
+	var persistConf lib.PersistConf
+	err = lib.SetPersistConf(&persistConf)
 	if err != nil {
 		errorMessage(err)
 		panic(err)
@@ -66,12 +66,24 @@ func StreamingPullHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	err = lib.Pull(ctx, &pullInfo, storageInfo, &subscriberConf)
+	report, err := lib.Pull(ctx, &pullInfo, persistConf, &subscriberConf)
 	if err != nil {
 		log.Printf("Error during pubsub pulling. %s.\n", err)
 		panic(err)
 	}
-	fmt.Fprint(w, "Finished execution")
+	log.Printf("Run report: %s.\n", report)
+
+	var partitionInfo lib.PartitionInfo
+	err = lib.SetPartitionInfo(&partitionInfo)
+	if err != nil {
+		errorMessage(err)
+		panic(err)
+	}
+
+	// The messages are already stored, so a partition which could not be closed is only logged,
+	// and it is closed by one of the next runs.
+	lib.CloseCompletePartitions(ctx, partitionInfo)
+	fmt.Fprintf(w, "Finished execution. Run report: %s", report)
 
 }
 